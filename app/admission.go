@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// defaultAdmissionQueueDepth bounds how many commands may wait for a slot before clients are turned away.
+const defaultAdmissionQueueDepth = 1024
+
+// ErrBusy is returned to clients when both the execution slots and the wait queue are full.
+var ErrBusy = errors.New("BUSY server overloaded, try again")
+
+// admissionBypass lists commands that never wait for admission: connection,
+// admin and replication commands must keep working under overload, and
+// blocking commands would hold a slot for as long as they wait.
+var admissionBypass = map[string]bool{
+	"PING":     true,
+	"ECHO":     true,
+	"QUIT":     true,
+	"INFO":     true,
+	"CONFIG":   true,
+	"DEBUG":    true,
+	"SHUTDOWN": true,
+	"SLOWLOG":  true,
+	"MONITOR":  true,
+	"AUTH":     true,
+	"HOTKEYS":  true,
+	"REPLCONF": true,
+	"PSYNC":    true,
+	"WAIT":     true,
+	"XREAD":    true,
+	"BLMPOP":   true,
+	"MULTI":    true,
+	"DISCARD":  true,
+}
+
+// admissionReadWeights lists reads whose cost grows with the data they touch.
+// Other reads are O(1) and bypass admission; writes weigh 1.
+var admissionReadWeights = map[string]int64{
+	"KEYS":          4,
+	"DBSIZE":        1,
+	"DBSTATS":       4,
+	"RANDOMKEY":     1,
+	"SINTER":        2,
+	"SINTERCARD":    2,
+	"SUNION":        2,
+	"SDIFF":         2,
+	"SMEMBERS":      1,
+	"HGETALL":       1,
+	"HKEYS":         1,
+	"HVALS":         1,
+	"XRANGE":        1,
+	"LRANGE":        1,
+	"LPOS":          1,
+	"ZRANGE":        1,
+	"ZRANGEBYSCORE": 1,
+	"EVAL":          1,
+	"EVALSHA":       1,
+	"PUBSUB":        1,
+}
+
+// admissionWeight returns how many execution slots a command occupies, or 0 when it is not gated.
+func admissionWeight(registry *Registry, cmdName string) int64 {
+	if admissionBypass[cmdName] {
+		return 0
+	}
+	if cmdName == "EXEC" {
+		// EXEC runs its whole queue while holding one admission.
+		return 2
+	}
+	if weight, ok := admissionReadWeights[cmdName]; ok {
+		return weight
+	}
+	if registry.IsWriteCommand(cmdName) {
+		return 1
+	}
+	return 0
+}
+
+// AdmissionController is a weighted semaphore in front of command execution.
+// Commands beyond the in-flight limit wait in a bounded queue; once that is
+// full they fail fast with ErrBusy instead of piling up goroutines.
+type AdmissionController struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	maxWeight  int64
+	queueDepth int64
+	inFlight   int64
+	queued     int64
+	admitted   uint64
+	rejected   uint64
+}
+
+// NewAdmissionController creates a controller allowing maxWeight concurrent slots and queueDepth waiters.
+func NewAdmissionController(maxWeight, queueDepth int64) *AdmissionController {
+	a := &AdmissionController{maxWeight: maxWeight, queueDepth: queueDepth}
+	a.cond = sync.NewCond(&a.mu)
+	return a
+}
+
+// Acquire reserves weight slots, waiting in the queue if necessary. It
+// returns ErrBusy without waiting when the queue is already full. A zero
+// limit disables admission control.
+func (a *AdmissionController) Acquire(weight int64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.fitsLocked(weight) {
+		a.inFlight += weight
+		a.admitted++
+		return nil
+	}
+	if a.queued >= a.queueDepth {
+		a.rejected++
+		return ErrBusy
+	}
+
+	a.queued++
+	for !a.fitsLocked(weight) {
+		a.cond.Wait()
+	}
+	a.queued--
+	a.inFlight += weight
+	a.admitted++
+	return nil
+}
+
+// fitsLocked reports whether weight more slots are available. A command
+// heavier than the whole limit is admitted once nothing else is running.
+func (a *AdmissionController) fitsLocked(weight int64) bool {
+	if a.maxWeight <= 0 {
+		return true
+	}
+	return a.inFlight == 0 || a.inFlight+weight <= a.maxWeight
+}
+
+// Release returns weight slots and wakes waiters.
+func (a *AdmissionController) Release(weight int64) {
+	a.mu.Lock()
+	a.inFlight -= weight
+	a.mu.Unlock()
+	a.cond.Broadcast()
+}
+
+// Queued returns the weight currently executing and the number of waiting commands.
+func (a *AdmissionController) Queued() (int64, int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.inFlight, a.queued
+}
+
+// Limits returns the in-flight weight limit and the queue depth.
+func (a *AdmissionController) Limits() (int64, int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.maxWeight, a.queueDepth
+}
+
+// SetMaxInFlight changes the in-flight weight limit; 0 disables admission control.
+func (a *AdmissionController) SetMaxInFlight(maxWeight int64) {
+	a.mu.Lock()
+	a.maxWeight = maxWeight
+	a.mu.Unlock()
+	a.cond.Broadcast()
+}
+
+// SetQueueDepth changes how many commands may wait for a slot.
+func (a *AdmissionController) SetQueueDepth(depth int64) {
+	a.mu.Lock()
+	a.queueDepth = depth
+	a.mu.Unlock()
+}
+
+// ResetStats clears the admitted and rejected counters.
+func (a *AdmissionController) ResetStats() {
+	a.mu.Lock()
+	a.admitted = 0
+	a.rejected = 0
+	a.mu.Unlock()
+}
+
+// Info renders the admission counters for the INFO stats section.
+func (a *AdmissionController) Info() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("admission_max_inflight:%d\r\n", a.maxWeight))
+	builder.WriteString(fmt.Sprintf("admission_queue_depth:%d\r\n", a.queueDepth))
+	builder.WriteString(fmt.Sprintf("admission_inflight:%d\r\n", a.inFlight))
+	builder.WriteString(fmt.Sprintf("admission_queued:%d\r\n", a.queued))
+	builder.WriteString(fmt.Sprintf("admission_admitted:%d\r\n", a.admitted))
+	builder.WriteString(fmt.Sprintf("admission_rejected:%d\r\n", a.rejected))
+	return builder.String()
+}
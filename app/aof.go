@@ -0,0 +1,700 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// aofRewriteItemsPerCmd caps the elements one rewritten RPUSH, SADD,
+	// HSET or ZADD carries, so a big key does not become one huge command.
+	aofRewriteItemsPerCmd = 64
+	// aofRewriteDrainChunk is how large the buffered writes may be for the
+	// rewrite to copy them under the AOF lock; while there are more, it
+	// copies without the lock and looks again.
+	aofRewriteDrainChunk = 64 << 10
+	// defaultAOFRewriteBufferLimit bounds the writes buffered while a
+	// rewrite runs. Past it the buffer is dropped and the rewrite restarts.
+	defaultAOFRewriteBufferLimit    = 64 << 20
+	defaultAutoAOFRewritePercentage = 100
+	defaultAutoAOFRewriteMinSize    = 64 << 20
+)
+
+// errAOFRewriteInProgress is returned when a rewrite is requested while another is running.
+var errAOFRewriteInProgress = errors.New("ERR Background append only file rewriting already in progress")
+
+var (
+	errAOFRewriteCancelled = errors.New("rewrite cancelled")
+	errAOFRewriteOverflow  = errors.New("rewrite buffer limit exceeded")
+)
+
+// appendFsyncPolicies are the values appendfsync accepts.
+var appendFsyncPolicies = []string{"always", "everysec", "no"}
+
+// AOF is the append-only file: every write the server replicates is also
+// appended to it, so replaying it on startup rebuilds the dataset. A
+// background rewrite replaces it with the shortest command stream that
+// recreates a snapshot, followed by the writes made while the snapshot was
+// being written. While appendonly is on, a goroutine fsyncs the file every
+// second and starts the rewrites the size rules schedule.
+type AOF struct {
+	server   *Server
+	mu       sync.Mutex
+	enabled  bool
+	fsync    string
+	filename string
+	// file is what writes are appended to. It is nil while appendonly is
+	// off, and while it is on until the first rewrite has made the file.
+	file     *os.File
+	size     int64
+	baseSize int64 // size right after the last rewrite or load
+	unsynced bool
+	writeErr error
+	// db is the database the command stream last selected, or -1.
+	db   int
+	stop chan struct{}
+
+	autoPercentage int64
+	autoMinSize    int64
+	bufferLimit    int
+
+	rewrite          *aofRewrite
+	rewriteScheduled bool
+	lastRewriteErr   error
+	lastRewriteTime  time.Duration
+	rewrites         int64
+}
+
+// aofRewrite is one background rewrite. buf collects, under the AOF lock,
+// the writes made after its snapshot.
+type aofRewrite struct {
+	started  time.Time
+	buffered bool // appendonly was on when it started, so buf is complete
+	buf      []byte
+	overflow atomic.Bool
+	cancel   atomic.Bool
+	done     chan struct{}
+}
+
+// check reports why the rewrite must stop, if it must.
+func (rw *aofRewrite) check() error {
+	switch {
+	case rw.cancel.Load():
+		return errAOFRewriteCancelled
+	case rw.overflow.Load():
+		return errAOFRewriteOverflow
+	}
+	return nil
+}
+
+// newAOF returns an AOF that is off, with the Redis defaults.
+func newAOF(s *Server) *AOF {
+	return &AOF{
+		server:         s,
+		fsync:          "everysec",
+		filename:       "appendonly.aof",
+		db:             -1,
+		autoPercentage: defaultAutoAOFRewritePercentage,
+		autoMinSize:    defaultAutoAOFRewriteMinSize,
+		bufferLimit:    defaultAOFRewriteBufferLimit,
+	}
+}
+
+// path returns where the file lives in the configured directory.
+func (a *AOF) path() string {
+	return filepath.Join(a.server.Config().Dir, a.filename)
+}
+
+// Append logs one command of the write stream, given both parsed and
+// encoded. On a master that is the replication stream, SELECTs included;
+// on a replica, the stream its master sends.
+func (a *AOF) Append(cmd RESP, b []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(cmd.Array) == 2 && strings.EqualFold(cmd.Array[0].String, "SELECT") {
+		if db, err := strconv.Atoi(cmd.Array[1].String); err == nil {
+			a.db = db
+		}
+	}
+	if !a.enabled {
+		return
+	}
+	if rw := a.rewrite; rw != nil && rw.buffered && !rw.overflow.Load() {
+		if len(rw.buf)+len(b) > a.bufferLimit {
+			rw.overflow.Store(true)
+			rw.buf = nil
+		} else {
+			rw.buf = append(rw.buf, b...)
+		}
+	}
+	if a.file != nil {
+		a.writeLocked(b)
+	}
+}
+
+// writeLocked appends b to the file, fsyncing as appendfsync says, and
+// schedules a rewrite once the file has outgrown the auto-rewrite rule.
+func (a *AOF) writeLocked(b []byte) {
+	if _, err := a.file.Write(b); err != nil {
+		// Cut off whatever part of the command made it, so the next one
+		// does not follow half a command.
+		a.file.Truncate(a.size)
+		if a.writeErr == nil {
+			logWarning("Error writing to the AOF file", "err", err)
+		}
+		a.writeErr = err
+		return
+	}
+	a.writeErr = nil
+	a.size += int64(len(b))
+	switch a.fsync {
+	case "always":
+		a.file.Sync()
+	case "everysec":
+		a.unsynced = true
+	}
+	if a.rewrite == nil && a.autoPercentage > 0 && a.size >= a.autoMinSize &&
+		(a.size-a.baseSize)*100 >= a.baseSize*a.autoPercentage {
+		a.rewriteScheduled = true
+	}
+}
+
+// run fsyncs the file every second under appendfsync everysec and starts
+// scheduled rewrites until stop is closed.
+func (a *AOF) run(stop chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			a.mu.Lock()
+			if a.unsynced && a.file != nil {
+				a.file.Sync()
+				a.unsynced = false
+			}
+			// A file that could not be created is retried until it is.
+			due := a.rewrite == nil && (a.rewriteScheduled || a.file == nil)
+			a.mu.Unlock()
+			if due {
+				a.Rewrite()
+			}
+		}
+	}
+}
+
+// Rewrite starts a background rewrite from a snapshot of every database.
+// The writes made from then on are kept in memory as well as appended to
+// the current file, and follow the snapshot in the new one.
+func (a *AOF) Rewrite() error {
+	s := a.server
+	s.repl.snapshotMu.Lock()
+	defer s.repl.snapshotMu.Unlock()
+
+	a.mu.Lock()
+	if a.rewrite != nil {
+		a.mu.Unlock()
+		return errAOFRewriteInProgress
+	}
+	rw := &aofRewrite{started: time.Now(), buffered: a.enabled, done: make(chan struct{})}
+	if rw.buffered && a.db >= 0 {
+		// The stream only selects a database when it changes.
+		selectDB := selectDBCommand(a.db)
+		rw.buf = selectDB.MarshalBytes()
+	}
+	a.rewrite, a.rewriteScheduled = rw, false
+	path := a.path()
+	a.mu.Unlock()
+
+	go a.runRewrite(rw, path, s.dbs.Snapshot())
+	return nil
+}
+
+// runRewrite writes the new file and, unless the rewrite was cancelled or
+// fell too far behind, renames it over the old one. Only then does the
+// old file stop being appended to, so a rewrite that dies leaves it whole.
+func (a *AOF) runRewrite(rw *aofRewrite, path string, snapshot [][]SnapshotEntry) {
+	defer close(rw.done)
+	tmp, err := a.writeRewrite(rw, path, snapshot)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err == nil {
+		err = a.finishRewriteLocked(rw, tmp, path)
+	}
+	if tmp != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	a.rewrite = nil
+	switch {
+	case errors.Is(err, errAOFRewriteCancelled):
+		return
+	case errors.Is(err, errAOFRewriteOverflow):
+		logWarning("AOF rewrite buffer limit exceeded, restarting the rewrite", "limit", a.bufferLimit)
+		a.rewriteScheduled = true
+	case err != nil:
+		logWarning("Background AOF rewrite failed", "err", err)
+	default:
+		logNotice("Background AOF rewrite finished successfully")
+		a.rewrites++
+	}
+	a.lastRewriteErr, a.lastRewriteTime = err, time.Since(rw.started)
+}
+
+// writeRewrite writes the snapshot to a temporary file next to path, then
+// copies over the writes buffered meanwhile until few enough are left to
+// copy under the lock.
+func (a *AOF) writeRewrite(rw *aofRewrite, path string, snapshot [][]SnapshotEntry) (*os.File, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "temp-rewriteaof-*.aof")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp AOF file: %w", err)
+	}
+	writer := bufio.NewWriter(tmp)
+	for db, entries := range snapshot {
+		if len(entries) == 0 {
+			continue
+		}
+		selectDB := selectDBCommand(db)
+		writer.Write(selectDB.MarshalBytes())
+		for _, entry := range entries {
+			failpoint(fpAOFRewriteEntry)
+			if err := rw.check(); err != nil {
+				return tmp, err
+			}
+			for _, cmd := range rewriteCommands(entry) {
+				writer.Write(cmd.MarshalBytes())
+			}
+		}
+	}
+	for {
+		if err := rw.check(); err != nil {
+			return tmp, err
+		}
+		a.mu.Lock()
+		chunk := rw.buf
+		if len(chunk) > aofRewriteDrainChunk {
+			rw.buf = nil
+		}
+		a.mu.Unlock()
+		if len(chunk) <= aofRewriteDrainChunk {
+			break
+		}
+		writer.Write(chunk)
+	}
+	// A bufio.Writer keeps its first error, so checking once covers every write.
+	if err := writer.Flush(); err != nil {
+		return tmp, fmt.Errorf("failed to write temp AOF file: %w", err)
+	}
+	return tmp, nil
+}
+
+// finishRewriteLocked appends the last buffered writes to tmp, syncs it,
+// renames it over path and, when appendonly is on, appends to it from now
+// on. The caller holds a.mu, so no write lands in between.
+func (a *AOF) finishRewriteLocked(rw *aofRewrite, tmp *os.File, path string) error {
+	if err := rw.check(); err != nil {
+		return err
+	}
+	_, err := tmp.Write(rw.buf)
+	rw.buf = nil
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		// CreateTemp makes the file owner-only; like dumps it is normally world-readable.
+		err = tmp.Chmod(0o644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write temp AOF file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to rename AOF file: %w", err)
+	}
+	if !a.enabled || !rw.buffered {
+		return nil
+	}
+
+	a.closeFileLocked()
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open the rewritten AOF file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open the rewritten AOF file: %w", err)
+	}
+	a.file, a.size, a.baseSize = file, info.Size(), info.Size()
+	return nil
+}
+
+// closeFileLocked fsyncs and closes the file, if it is open.
+func (a *AOF) closeFileLocked() {
+	if a.file == nil {
+		return
+	}
+	a.file.Sync()
+	a.file.Close()
+	a.file, a.unsynced = nil, false
+}
+
+// start turns appendonly on. With resume the file at path was just loaded
+// and is appended to as it is; otherwise a rewrite creates it from the
+// dataset, and writes are only appended once it has.
+func (a *AOF) start(resume bool) error {
+	a.mu.Lock()
+	if a.enabled {
+		a.mu.Unlock()
+		return nil
+	}
+	if resume {
+		file, err := os.OpenFile(a.path(), os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			a.mu.Unlock()
+			return err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			a.mu.Unlock()
+			return err
+		}
+		a.file, a.size, a.baseSize = file, info.Size(), info.Size()
+	}
+	a.enabled = true
+	a.stop = make(chan struct{})
+	go a.run(a.stop)
+	a.mu.Unlock()
+
+	if !resume {
+		// If a rewrite is already running, run picks this up after it.
+		a.Rewrite()
+	}
+	return nil
+}
+
+// stopLocked turns appendonly off: a running rewrite is abandoned and the
+// file is synced and closed.
+func (a *AOF) stopLocked() {
+	if !a.enabled {
+		return
+	}
+	a.enabled, a.rewriteScheduled = false, false
+	close(a.stop)
+	a.stop = nil
+	if a.rewrite != nil {
+		a.rewrite.cancel.Store(true)
+	}
+	a.closeFileLocked()
+}
+
+// SetEnabled turns appendonly on or off, as CONFIG SET appendonly does.
+func (a *AOF) SetEnabled(on bool) {
+	if on {
+		a.start(false)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.stopLocked()
+}
+
+// Enabled reports whether appendonly is on.
+func (a *AOF) Enabled() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.enabled
+}
+
+// Restart rebuilds the file from the dataset after the dataset was
+// replaced wholesale, as by a full resync. The old file is no longer
+// appended to; it stays until the rewrite replaces it.
+func (a *AOF) Restart() {
+	a.mu.Lock()
+	if !a.enabled {
+		a.mu.Unlock()
+		return
+	}
+	if a.rewrite != nil {
+		a.rewrite.cancel.Store(true)
+	}
+	a.closeFileLocked()
+	a.mu.Unlock()
+	// A cancelled rewrite may still be finishing; run retries after it.
+	a.Rewrite()
+}
+
+// Close stops the AOF for shutdown. A rewrite in progress is abandoned and
+// waited for, which leaves the old file as it was.
+func (a *AOF) Close() {
+	a.mu.Lock()
+	a.stopLocked()
+	rw := a.rewrite
+	a.mu.Unlock()
+	if rw != nil {
+		rw.cancel.Store(true)
+		<-rw.done
+	}
+}
+
+// Fsync returns the appendfsync policy.
+func (a *AOF) Fsync() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.fsync
+}
+
+// SetFsync sets the appendfsync policy, which must be one of appendFsyncPolicies.
+func (a *AOF) SetFsync(policy string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.fsync = policy
+}
+
+// AutoRewrite returns the growth percentage and minimum size that schedule
+// a rewrite; a percentage of 0 disables them.
+func (a *AOF) AutoRewrite() (percentage, minSize int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.autoPercentage, a.autoMinSize
+}
+
+// SetAutoRewritePercentage sets how much the file must have grown since
+// the last rewrite for another to be scheduled.
+func (a *AOF) SetAutoRewritePercentage(percentage int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.autoPercentage = percentage
+}
+
+// SetAutoRewriteMinSize sets the size below which no rewrite is scheduled.
+func (a *AOF) SetAutoRewriteMinSize(minSize int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.autoMinSize = minSize
+}
+
+// Info renders the AOF fields of INFO persistence.
+func (a *AOF) Info() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	status := func(err error) string {
+		if err != nil {
+			return "err"
+		}
+		return "ok"
+	}
+	lastTime, currentTime := int64(-1), int64(-1)
+	if a.lastRewriteTime > 0 {
+		lastTime = int64(a.lastRewriteTime.Seconds())
+	}
+	if a.rewrite != nil {
+		currentTime = int64(time.Since(a.rewrite.started).Seconds())
+	}
+
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("aof_enabled:%d\r\n", boolInt(a.enabled)))
+	builder.WriteString(fmt.Sprintf("aof_rewrite_in_progress:%d\r\n", boolInt(a.rewrite != nil)))
+	builder.WriteString(fmt.Sprintf("aof_rewrite_scheduled:%d\r\n", boolInt(a.rewriteScheduled)))
+	builder.WriteString(fmt.Sprintf("aof_last_rewrite_time_sec:%d\r\n", lastTime))
+	builder.WriteString(fmt.Sprintf("aof_current_rewrite_time_sec:%d\r\n", currentTime))
+	builder.WriteString(fmt.Sprintf("aof_last_bgrewrite_status:%s\r\n", status(a.lastRewriteErr)))
+	builder.WriteString(fmt.Sprintf("aof_last_write_status:%s\r\n", status(a.writeErr)))
+	builder.WriteString(fmt.Sprintf("aof_rewrites:%d\r\n", a.rewrites))
+	if a.enabled {
+		builder.WriteString(fmt.Sprintf("aof_current_size:%d\r\n", a.size))
+		builder.WriteString(fmt.Sprintf("aof_base_size:%d\r\n", a.baseSize))
+	}
+	return builder.String()
+}
+
+// Load replays the file at path into the databases. A command cut off at
+// the end, as a crash mid-append leaves, is truncated away with a warning,
+// as is a transaction that never reached its EXEC. Anything else that
+// does not parse, or names a command that does not exist, fails the load.
+func (a *AOF) Load(path string) error {
+	s := a.server
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The commands run as a client of their own, which tracks SELECT.
+	conn, peer := net.Pipe()
+	peer.Close()
+	defer conn.Close()
+	defer s.removeClientState(conn)
+	apply := func(cmd RESP) error {
+		name := strings.ToUpper(cmd.Array[0].String)
+		handler, ok := s.registry.Get(name)
+		if !ok || s.registry.CheckArity(name, len(cmd.Array)-1) != "" {
+			return fmt.Errorf("unknown command '%s'", cmd.Array[0].String)
+		}
+		handler(s.newCommandContext(conn, cmd.Array[1:]))
+		return nil
+	}
+
+	counter := &countingReader{r: f}
+	reader := bufio.NewReader(counter)
+	var (
+		good      int64 // end of the last command applied
+		queued    []RESP
+		inMulti   bool
+		truncated bool
+	)
+	for {
+		if _, err := reader.Peek(1); err == io.EOF {
+			break
+		}
+		cmd, err := ParseLimit(reader, s.Config().ProtoMaxBulkLen)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			truncated = true
+			break
+		}
+		offset := counter.n - int64(reader.Buffered())
+		if err == nil && (cmd.Type != Array || len(cmd.Array) == 0) {
+			err = errors.New("not a command")
+		}
+		if err != nil {
+			return fmt.Errorf("bad AOF format before byte %d: %w", offset, err)
+		}
+
+		switch name := strings.ToUpper(cmd.Array[0].String); {
+		case name == "MULTI":
+			inMulti, queued = true, nil
+			continue
+		case name == "EXEC":
+			for _, q := range queued {
+				if err := apply(q); err != nil {
+					return err
+				}
+			}
+			inMulti, queued = false, nil
+		case inMulti:
+			queued = append(queued, cmd)
+			continue
+		default:
+			if err := apply(cmd); err != nil {
+				return err
+			}
+		}
+		good = offset
+	}
+
+	if truncated || inMulti {
+		logWarning("AOF ends with an incomplete command or transaction, truncating it", "path", path, "size", good)
+		if err := os.Truncate(path, good); err != nil {
+			return err
+		}
+	}
+	logNotice("DB loaded from append only file", "path", path)
+	return nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// selectDBCommand is the SELECT that switches the command stream to db.
+func selectDBCommand(db int) RESP {
+	return bulkStrings([]string{"SELECT", strconv.Itoa(db)})
+}
+
+// rewriteCommands returns the commands that recreate one key: a SET, or
+// batches of RPUSH, SADD, HSET or ZADD, or an XADD per stream entry,
+// followed by a PEXPIREAT when the key has a TTL.
+func rewriteCommands(entry SnapshotEntry) []RESP {
+	key := entry.Key
+	var cmds []RESP
+	switch v := entry.Value.(type) {
+	case string:
+		if !entry.Expiry.IsZero() {
+			return []RESP{setPXATCommand(key, v, entry.Expiry)}
+		}
+		return []RESP{bulkStrings([]string{"SET", key, v})}
+	case *List:
+		cmds = batchCommands("RPUSH", key, v.Elements(), 1)
+	case Set:
+		cmds = batchCommands("SADD", key, slices.Collect(maps.Keys(v)), 1)
+	case Hash:
+		items := make([]string, 0, 2*len(v))
+		for field, value := range v {
+			items = append(items, field, value)
+		}
+		cmds = batchCommands("HSET", key, items, 2)
+	case *ZSet:
+		items := make([]string, 0, 2*v.Len())
+		for _, m := range v.Members() {
+			items = append(items, formatDouble(m.Score), m.Member)
+		}
+		cmds = batchCommands("ZADD", key, items, 2)
+	case *Stream:
+		for _, e := range v.Entries {
+			args := []string{"XADD", key, e.ID}
+			for _, fv := range e.Fields {
+				args = append(args, fv.Field, fv.Value)
+			}
+			cmds = append(cmds, bulkStrings(args))
+		}
+		if len(v.Entries) == 0 {
+			// An emptied stream keeps its last ID: add an entry with it
+			// and trim it straight away.
+			lastID := v.LastID
+			if lastID == "" || lastID == "0-0" {
+				lastID = "0-1"
+			}
+			cmds = append(cmds, bulkStrings([]string{"XADD", key, "MAXLEN", "0", lastID, "x", "y"}))
+		}
+	}
+	if !entry.Expiry.IsZero() {
+		cmds = append(cmds, bulkStrings([]string{"PEXPIREAT", key, strconv.FormatInt(entry.Expiry.UnixMilli(), 10)}))
+	}
+	return cmds
+}
+
+// batchCommands splits items into name commands on key, each carrying at
+// most aofRewriteItemsPerCmd groups of width strings.
+func batchCommands(name, key string, items []string, width int) []RESP {
+	var cmds []RESP
+	for len(items) > 0 {
+		n := min(len(items), aofRewriteItemsPerCmd*width)
+		args := append([]string{name, key}, items[:n]...)
+		cmds = append(cmds, bulkStrings(args))
+		items = items[n:]
+	}
+	return cmds
+}
+
+// bgrewriteaofCommand starts a background AOF rewrite.
+func bgrewriteaofCommand(ctx *CommandContext) (RESP, []byte) {
+	if err := ctx.Server.aof.Rewrite(); err != nil {
+		return NewError(err.Error()), nil
+	}
+	return NewSimpleString("Background append only file rewriting started"), nil
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startAOFServer starts a server with appendonly on in dir, so a second
+// one started there replays what the first logged.
+func startAOFServer(t *testing.T, dir string) *Server {
+	t.Helper()
+	return startServer(t, func(o *ServerOptions) {
+		o.Dir = dir
+		o.AppendOnly = true
+	})
+}
+
+// stopServer shuts s down as SHUTDOWN NOSAVE would.
+func stopServer(t *testing.T, s *Server) {
+	t.Helper()
+	if err := s.shutdown.Run(saveNever, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// aofRewrites returns how many rewrites s has finished, once none is running.
+func aofRewrites(t *testing.T, s *Server, atLeast int64) int64 {
+	t.Helper()
+	var n int64
+	eventually(t, "the AOF rewrite to finish", func() bool {
+		s.aof.mu.Lock()
+		defer s.aof.mu.Unlock()
+		n = s.aof.rewrites
+		return s.aof.rewrite == nil && s.aof.file != nil && n >= atLeast
+	})
+	return n
+}
+
+// datasetDump renders every database of s with its TTLs in a canonical
+// form, so two servers holding the same data dump the same string.
+func datasetDump(s *Server) string {
+	var b strings.Builder
+	for db, entries := range s.dbs.Snapshot() {
+		slices.SortFunc(entries, func(x, y SnapshotEntry) int { return strings.Compare(x.Key, y.Key) })
+		for _, e := range entries {
+			var value any = e.Value
+			switch v := e.Value.(type) {
+			case Set:
+				value = slices.Sorted(maps.Keys(v))
+			case Hash:
+				fields := slices.Sorted(maps.Keys(v))
+				for i, field := range fields {
+					fields[i] += "=" + v[field]
+				}
+				value = fields
+			case *List:
+				value = v.Elements()
+			case *ZSet:
+				value = v.Members()
+			case *Stream:
+				value = fmt.Sprint(v.Entries, v.LastID)
+			}
+			ttl := int64(0)
+			if !e.Expiry.IsZero() {
+				ttl = e.Expiry.UnixMilli()
+			}
+			fmt.Fprintf(&b, "%d %q %d %T %v\n", db, e.Key, ttl, e.Value, value)
+		}
+	}
+	return b.String()
+}
+
+// TestAOFReplay logs one of everything, then checks a restart replays the
+// exact dataset, TTLs and streams included, both from the file as written
+// and after BGREWRITEAOF has compacted it.
+func TestAOFReplay(t *testing.T) {
+	dir := t.TempDir()
+	s := startAOFServer(t, dir)
+	c := dial(t, s)
+	for _, cmd := range [][]string{
+		{"SET", "plain", "v"},
+		{"SET", "ttl", "v", "EX", "1000"},
+		{"INCR", "counter"},
+		{"INCRBY", "counter", "41"},
+		{"RPUSH", "list", "a", "b", "c"},
+		{"LPOP", "list"},
+		{"SADD", "set", "x", "y", "z"},
+		{"HSET", "hash", "f1", "v1", "f2", "v2"},
+		{"ZADD", "zset", "1.5", "a", "-inf", "b", "inf", "c"},
+		{"PEXPIRE", "zset", "500000"},
+		{"XADD", "stream", "1-1", "f", "v"},
+		{"XADD", "stream", "*", "f", "v", "g", "w"},
+		{"XADD", "emptied", "5-5", "f", "v"},
+		{"XTRIM", "emptied", "MAXLEN", "0"},
+		{"SET", "gone", "v"},
+		{"DEL", "gone"},
+		{"MULTI"},
+		{"SET", "in-tx", "1"},
+		{"SELECT", "2"},
+		{"RPUSH", "other-db", "v"},
+		{"EXEC"},
+		{"SELECT", "3"},
+		{"SET", "db3", "v"},
+	} {
+		if reply := c.do(cmd...); reply.Type == Error {
+			t.Fatalf("%v: %s", cmd, reply.String)
+		}
+	}
+	// Enough members to need several batched commands in the rewrite.
+	for i := range 3 * aofRewriteItemsPerCmd {
+		c.do("SADD", "big", strconv.Itoa(i))
+	}
+	want := datasetDump(s)
+	aofRewrites(t, s, 1)
+	stopServer(t, s)
+
+	s = startAOFServer(t, dir)
+	if got := datasetDump(s); got != want {
+		t.Fatalf("replayed dataset:\n%s\nwant:\n%s", got, want)
+	}
+	rewrites := aofRewrites(t, s, 0)
+	expectReply(t, dial(t, s).do("BGREWRITEAOF"), NewSimpleString("Background append only file rewriting started"))
+	aofRewrites(t, s, rewrites+1)
+	stopServer(t, s)
+
+	file, err := os.ReadFile(filepath.Join(dir, "appendonly.aof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(file), "INCR") || !strings.Contains(string(file), "MAXLEN") {
+		t.Fatal("the rewritten AOF does not recreate the keys from their values")
+	}
+	s = startAOFServer(t, dir)
+	if got := datasetDump(s); got != want {
+		t.Fatalf("dataset replayed after a rewrite:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// TestAOFRewriteConcurrentWrites holds a rewrite midway while clients
+// write to several databases, then checks the new file has every write.
+func TestAOFRewriteConcurrentWrites(t *testing.T) {
+	dir := t.TempDir()
+	s := startAOFServer(t, dir)
+	seed := dial(t, s)
+	for i := range 100 {
+		seed.do("SET", "seed:"+strconv.Itoa(i), "v")
+	}
+	rewrites := aofRewrites(t, s, 1)
+
+	latch := LatchFailpoint(fpAOFRewriteEntry)
+	defer latch.Release()
+	expectReply(t, seed.do("BGREWRITEAOF"), NewSimpleString("Background append only file rewriting started"))
+	if !latch.WaitReached(5 * time.Second) {
+		t.Fatal("the rewrite never reached its first key")
+	}
+	expectReply(t, seed.do("BGREWRITEAOF"), NewError(errAOFRewriteInProgress.Error()))
+
+	const writers, writes = 8, 300
+	var wg sync.WaitGroup
+	for w := range writers {
+		c := dial(t, s)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.do("SELECT", strconv.Itoa(w%3))
+			for i := range writes {
+				c.do("INCR", "counter")
+				c.do("RPUSH", "list:"+strconv.Itoa(w), strconv.Itoa(i))
+				c.do("SET", "seed:"+strconv.Itoa(i%100), strconv.Itoa(w))
+				if i == writes/2 && w == 0 {
+					latch.Release()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	aofRewrites(t, s, rewrites+1)
+	want := datasetDump(s)
+	stopServer(t, s)
+
+	s = startAOFServer(t, dir)
+	if got := datasetDump(s); got != want {
+		t.Fatalf("replayed dataset:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// TestAOFRewriteBufferOverflow lets the writes made during a rewrite
+// outgrow the buffer, which must restart the rewrite rather than lose them.
+func TestAOFRewriteBufferOverflow(t *testing.T) {
+	dir := t.TempDir()
+	s := startAOFServer(t, dir)
+	c := dial(t, s)
+	c.do("SET", "k", "v")
+	rewrites := aofRewrites(t, s, 1)
+	s.aof.mu.Lock()
+	s.aof.bufferLimit = 1024
+	s.aof.mu.Unlock()
+
+	latch := LatchFailpoint(fpAOFRewriteEntry)
+	defer latch.Release()
+	c.do("BGREWRITEAOF")
+	if !latch.WaitReached(5 * time.Second) {
+		t.Fatal("the rewrite never reached its first key")
+	}
+	s.aof.mu.Lock()
+	rw := s.aof.rewrite
+	s.aof.mu.Unlock()
+	for i := range 100 {
+		c.do("RPUSH", "list", strings.Repeat("x", 100)+strconv.Itoa(i))
+	}
+	if !rw.overflow.Load() {
+		t.Fatal("10kB of writes fit a 1kB rewrite buffer")
+	}
+	latch.Release()
+	aofRewrites(t, s, rewrites+1)
+	if !strings.Contains(c.do("INFO", "persistence").String, "aof_last_bgrewrite_status:ok") {
+		t.Fatal("the restarted rewrite did not succeed")
+	}
+	want := datasetDump(s)
+	stopServer(t, s)
+
+	s = startAOFServer(t, dir)
+	if got := datasetDump(s); got != want {
+		t.Fatalf("replayed dataset:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// TestAOFShutdownMidRewrite shuts down while a rewrite is halfway through
+// its snapshot: the old file must be left exactly as it was and the
+// temporary file removed.
+func TestAOFShutdownMidRewrite(t *testing.T) {
+	dir := t.TempDir()
+	s := startAOFServer(t, dir)
+	c := dial(t, s)
+	for i := range 10 {
+		c.do("SET", "k"+strconv.Itoa(i), "v")
+	}
+	aofRewrites(t, s, 1)
+	c.do("INCR", "counter")
+	want := datasetDump(s)
+	path := filepath.Join(dir, "appendonly.aof")
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	latch := LatchFailpoint(fpAOFRewriteEntry)
+	defer latch.Release()
+	c.do("BGREWRITEAOF")
+	if !latch.WaitReached(5 * time.Second) {
+		t.Fatal("the rewrite never reached its first key")
+	}
+	s.aof.mu.Lock()
+	rw := s.aof.rewrite
+	s.aof.mu.Unlock()
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- s.Shutdown(ctx)
+	}()
+	eventually(t, "shutdown to cancel the rewrite", rw.cancel.Load)
+	latch.Release()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(before) {
+		t.Fatal("the AOF changed under a cancelled rewrite")
+	}
+	if temps, _ := filepath.Glob(filepath.Join(dir, "temp-rewriteaof-*")); len(temps) > 0 {
+		t.Fatalf("temporary files left behind: %v", temps)
+	}
+	s = startAOFServer(t, dir)
+	if got := datasetDump(s); got != want {
+		t.Fatalf("replayed dataset:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// TestAOFTruncatedTail loads files a crash left mid-append: the partial
+// command or unfinished transaction is dropped and cut off the file.
+// Garbage anywhere else refuses to load.
+func TestAOFTruncatedTail(t *testing.T) {
+	for name, tail := range map[string]string{
+		"command":     "*3\r\n$3\r\nSET\r\n$4\r\nlost\r\n$1\r",
+		"transaction": "*1\r\n$5\r\nMULTI\r\n*3\r\n$3\r\nSET\r\n$4\r\nlost\r\n$1\r\nv\r\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "appendonly.aof")
+			good := "*3\r\n$3\r\nSET\r\n$4\r\nkept\r\n$1\r\nv\r\n"
+			if err := os.WriteFile(path, []byte(good+tail), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			c := dial(t, startAOFServer(t, dir))
+			expectReply(t, c.do("GET", "kept"), NewBulkString("v"))
+			expectReply(t, c.do("EXISTS", "lost"), NewInteger(0))
+			expectReply(t, c.do("SET", "after", "v"), NewSimpleString("OK"))
+			eventually(t, "the write to be appended", func() bool {
+				file, _ := os.ReadFile(path)
+				return strings.HasPrefix(string(file), good+"*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n*3\r\n$3\r\nSET\r\n$5\r\nafter")
+			})
+		})
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "appendonly.aof"), []byte("*1\r\n$4\r\nPING\r\nnonsense\r\n*1\r\n$4\r\nPING\r\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultServerOptions()
+	opts.Dir, opts.AppendOnly, opts.LogLevel = dir, true, "warning"
+	if _, err := NewServer(opts); err == nil || !strings.Contains(err.Error(), "unknown command 'nonsense'") {
+		t.Fatalf("loading a corrupt AOF returned %v", err)
+	}
+}
+
+// TestAOFAutoRewrite checks the file is rewritten on its own once it has
+// doubled past auto-aof-rewrite-min-size.
+func TestAOFAutoRewrite(t *testing.T) {
+	s := startAOFServer(t, t.TempDir())
+	c := dial(t, s)
+	rewrites := aofRewrites(t, s, 1)
+	expectReply(t, c.do("CONFIG", "SET", "auto-aof-rewrite-min-size", "4kb"), NewSimpleString("OK"))
+	expectReply(t, c.do("CONFIG", "GET", "auto-aof-rewrite-percentage"),
+		NewArray([]RESP{NewBulkString("auto-aof-rewrite-percentage"), NewBulkString("100")}))
+	for range 200 {
+		c.do("SET", "k", strings.Repeat("x", 50))
+	}
+	aofRewrites(t, s, rewrites+1)
+	info := c.do("INFO", "persistence").String
+	if !strings.Contains(info, "aof_current_size:") || strings.Contains(info, "aof_current_size:0\r\n") {
+		t.Fatalf("INFO persistence after the rewrite:\n%s", info)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"strings"
+)
+
+const (
+	errNoAuth    = "NOAUTH Authentication required."
+	errWrongPass = "WRONGPASS invalid username-password pair"
+	errNoPassSet = "ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?"
+	errHelloAuth = "NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time"
+)
+
+// defaultUser is the only user; AUTH and HELLO accept it by name.
+const defaultUser = "default"
+
+// noAuthCommands run before a client has authenticated. HELLO checks for
+// its AUTH option itself; RESET only ever logs out, and QUIT only hangs up.
+var noAuthCommands = map[string]bool{
+	"AUTH":  true,
+	"HELLO": true,
+	"RESET": true,
+	"QUIT":  true,
+}
+
+// authenticated reports whether the client may run commands under config.
+// Connections made while no password was set stay authenticated if one is
+// set later, as with Redis's default user.
+func authenticated(state *ClientState, config *ServerConfig) bool {
+	if config.RequirePass == "" {
+		return true
+	}
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+	return state.Authenticated
+}
+
+// checkAuth returns NOAUTH for a command from a client that has not
+// authenticated yet, or "" when the command may run.
+func checkAuth(state *ClientState, config *ServerConfig, cmdName string) string {
+	if noAuthCommands[cmdName] || authenticated(state, config) {
+		return ""
+	}
+	return errNoAuth
+}
+
+// passwordMatches compares password against requirepass in constant time.
+// Both are hashed first so the comparison doesn't leak the length either.
+func passwordMatches(config *ServerConfig, password string) bool {
+	want := sha256.Sum256([]byte(config.RequirePass))
+	got := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(want[:], got[:]) == 1
+}
+
+// authenticate checks a username and password and marks the client
+// authenticated on success. It returns the error to reply with, or "".
+func authenticate(state *ClientState, config *ServerConfig, username, password string) string {
+	if username != defaultUser || !passwordMatches(config, password) {
+		return errWrongPass
+	}
+	state.mu.Lock()
+	state.Authenticated = true
+	state.mu.Unlock()
+	return ""
+}
+
+// authCommand implements AUTH [username] password.
+func authCommand(ctx *CommandContext) (RESP, []byte) {
+	username, password := defaultUser, ctx.Args[0].String
+	if len(ctx.Args) == 2 {
+		username, password = ctx.Args[0].String, ctx.Args[1].String
+	} else if ctx.Config.RequirePass == "" {
+		return NewError(errNoPassSet), nil
+	}
+	if msg := authenticate(ctx.Client, ctx.Config, username, password); msg != "" {
+		return NewError(msg), nil
+	}
+	return NewSimpleString("OK"), nil
+}
+
+// redactArgs returns argv with passwords replaced by "(redacted)", for logs
+// that keep command lines.
+func redactArgs(argv []RESP) []RESP {
+	if len(argv) == 0 {
+		return argv
+	}
+	redact := func(from, to int) []RESP {
+		out := append([]RESP(nil), argv...)
+		for i := from; i < to && i < len(out); i++ {
+			out[i] = NewBulkString("(redacted)")
+		}
+		return out
+	}
+	switch strings.ToUpper(argv[0].String) {
+	case "AUTH":
+		return redact(1, len(argv))
+	case "HELLO":
+		for i := 2; i+2 < len(argv); i++ {
+			if strings.EqualFold(argv[i].String, "AUTH") {
+				return redact(i+1, i+3)
+			}
+		}
+	case "CONFIG":
+		if len(argv) == 4 && strings.EqualFold(argv[1].String, "SET") {
+			switch strings.ToLower(argv[2].String) {
+			case "requirepass", "masterauth":
+				return redact(3, 4)
+			}
+		}
+	}
+	return argv
+}
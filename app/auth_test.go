@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAuth(t *testing.T) {
+	s := startServer(t, func(o *ServerOptions) { o.RequirePass = "secret" })
+	c := dial(t, s)
+
+	for _, cmd := range [][]string{{"PING"}, {"GET", "k"}, {"SET", "k", "v"}, {"PSYNC", "?", "-1"}} {
+		expectReply(t, c.do(cmd...), NewError(errNoAuth))
+	}
+	expectReply(t, c.do("AUTH", "wrong"), NewError(errWrongPass))
+	expectReply(t, c.do("AUTH", "nobody", "secret"), NewError(errWrongPass))
+	expectReply(t, c.do("PING"), NewError(errNoAuth))
+
+	expectReply(t, c.do("AUTH", "secret"), NewSimpleString("OK"))
+	expectReply(t, c.do("SET", "k", "v"), NewSimpleString("OK"))
+	expectReply(t, c.do("GET", "k"), NewBulkString("v"))
+
+	// Authenticating is per connection, and RESET undoes it.
+	expectReply(t, dial(t, s).do("GET", "k"), NewError(errNoAuth))
+	expectReply(t, c.do("RESET"), NewSimpleString("RESET"))
+	expectReply(t, c.do("GET", "k"), NewError(errNoAuth))
+	expectReply(t, c.do("AUTH", "default", "secret"), NewSimpleString("OK"))
+	expectReply(t, c.do("GET", "k"), NewBulkString("v"))
+}
+
+func TestReplicaMasterAuth(t *testing.T) {
+	master := startServer(t, func(o *ServerOptions) { o.RequirePass = "secret" })
+	mc := dial(t, master)
+	expectReply(t, mc.do("AUTH", "secret"), NewSimpleString("OK"))
+	expectReply(t, mc.do("SET", "k", "v"), NewSimpleString("OK"))
+
+	// Without the password the handshake is refused and the replica
+	// never attaches.
+	startServer(t, func(o *ServerOptions) {
+		o.ReplicaOf = fmt.Sprintf("127.0.0.1 %d", master.Config().Port)
+		o.MasterAuth = "wrong"
+	})
+	time.Sleep(100 * time.Millisecond)
+	if n := master.repl.GetReplicaCount(); n != 0 {
+		t.Fatalf("master has %d replicas after a handshake with the wrong masterauth", n)
+	}
+
+	replica := startServer(t, func(o *ServerOptions) {
+		o.ReplicaOf = fmt.Sprintf("127.0.0.1 %d", master.Config().Port)
+		o.MasterAuth = "secret"
+	})
+	eventually(t, "the replica to come online", func() bool { return master.repl.GetOnlineReplicaCount() == 1 })
+	rc := dial(t, replica)
+	eventually(t, "the replica to load the master's data", func() bool {
+		return sameReply(rc.do("GET", "k"), NewBulkString("v"))
+	})
+	expectReply(t, mc.do("SET", "k", "streamed"), NewSimpleString("OK"))
+	eventually(t, "the replica to apply the stream", func() bool {
+		return sameReply(rc.do("GET", "k"), NewBulkString("streamed"))
+	})
+}
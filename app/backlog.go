@@ -0,0 +1,79 @@
+package main
+
+// defaultReplBacklogSize is how many bytes of the replication stream the
+// master keeps for partial resynchronization.
+const defaultReplBacklogSize = 1 << 20
+
+// ReplBacklog is a circular buffer holding the most recent bytes of the
+// replication stream, so a replica that reconnects shortly after losing its
+// link can continue from its offset instead of taking a full resync.
+// Offsets follow Redis: a replica that has processed offset n asks for the
+// stream from n+1.
+type ReplBacklog struct {
+	buf []byte
+	// idx is where the next byte is written.
+	idx int
+	// histLen is how many bytes of history the buffer holds.
+	histLen int
+	// endOffset is the master offset of the last byte held.
+	endOffset int64
+}
+
+// NewReplBacklog returns an empty backlog of size bytes whose history starts
+// after offset.
+func NewReplBacklog(size int, offset int64) *ReplBacklog {
+	return &ReplBacklog{buf: make([]byte, size), endOffset: offset}
+}
+
+// Append records stream bytes, overwriting the oldest history once full.
+func (b *ReplBacklog) Append(p []byte) {
+	b.endOffset += int64(len(p))
+	if len(p) >= len(b.buf) {
+		p = p[len(p)-len(b.buf):]
+	}
+	for len(p) > 0 {
+		n := copy(b.buf[b.idx:], p)
+		b.idx = (b.idx + n) % len(b.buf)
+		b.histLen = min(b.histLen+n, len(b.buf))
+		p = p[n:]
+	}
+}
+
+// Since returns a copy of the stream from offset through the last byte
+// held. It reports false when offset is not covered by the history.
+func (b *ReplBacklog) Since(offset int64) ([]byte, bool) {
+	start := b.endOffset - int64(b.histLen) + 1
+	if offset < start || offset > b.endOffset+1 {
+		return nil, false
+	}
+	n := int(b.endOffset + 1 - offset)
+	out := make([]byte, n)
+	from := (b.idx - n + len(b.buf)) % len(b.buf)
+	copied := copy(out, b.buf[from:])
+	copy(out[copied:], b.buf[:n-copied])
+	return out, true
+}
+
+// Resize returns a backlog of size bytes keeping as much of the most recent
+// history as fits.
+func (b *ReplBacklog) Resize(size int) *ReplBacklog {
+	resized := NewReplBacklog(size, b.endOffset-int64(b.histLen))
+	history, _ := b.Since(b.endOffset - int64(b.histLen) + 1)
+	resized.Append(history)
+	return resized
+}
+
+// Size returns the backlog capacity in bytes.
+func (b *ReplBacklog) Size() int {
+	return len(b.buf)
+}
+
+// HistLen returns how many bytes of history the backlog holds.
+func (b *ReplBacklog) HistLen() int {
+	return b.histLen
+}
+
+// FirstOffset returns the offset of the oldest byte held.
+func (b *ReplBacklog) FirstOffset() int64 {
+	return b.endOffset - int64(b.histLen) + 1
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// BlockMode says how waiters on the same key share a wake-up.
+type BlockMode int
+
+const (
+	// BlockBroadcast waiters all see the event (XREAD): every ready waiter is served.
+	BlockBroadcast BlockMode = iota
+	// BlockConsume waiters take the event (BLPOP-style): they are served in strict
+	// FIFO order and a later consumer never jumps ahead of one that is not ready.
+	BlockConsume
+)
+
+// blockingWrites are write commands that may wait. processCommand does not
+// hold the write locks for them; they take those locks only around their
+// first check (see Block's release), so a blocked client never holds up a
+// full resync or a script.
+var blockingWrites = map[string]bool{
+	"BLMPOP": true,
+}
+
+// errUnblocked is the reply a client gets when CLIENT UNBLOCK ... ERROR releases it.
+const errUnblocked = "UNBLOCKED client unblocked via CLIENT UNBLOCK"
+
+// Waiter caps. A connection runs one command at a time, so it holds at most
+// one waiter; its cap is on how many keys that waiter may register, which
+// bounds the per-key queues one client can grow. The global cap bounds how
+// many clients may wait at once.
+const (
+	defaultMaxBlockedClients = 10000
+	defaultMaxBlockedKeys    = 1024
+)
+
+// Replies for commands refused by the waiter caps.
+const (
+	errTooManyBlockedClients = "ERR max number of blocked clients reached"
+	errTooManyBlockedKeys    = "ERR too many keys to block on"
+)
+
+// blockPredicate checks whether a waiter can be served now, returning its reply.
+// It may consume data (a pop) when it reports ready.
+type blockPredicate func() (RESP, bool)
+
+// blockWaiter is one client blocked on one or more keys of its selected database.
+type blockWaiter struct {
+	cmd       string
+	db        int
+	keys      []string
+	conn      net.Conn
+	clientID  int64
+	mode      BlockMode
+	predicate blockPredicate
+	since     time.Time
+	result    chan blockOutcome
+	done      bool
+}
+
+// blockOutcome is what ends a wait: a reply, or a timeout for the command to format.
+type blockOutcome struct {
+	reply    RESP
+	timedOut bool
+}
+
+// BlockedInfo describes a blocked client for introspection.
+type BlockedInfo struct {
+	Cmd      string
+	DB       int
+	Keys     []string
+	ClientID int64
+	Since    time.Time
+}
+
+// BlockManager is the single registry for commands that wait on keys. It
+// owns wake ordering (FIFO per database and key), the re-check that closes
+// the window between a failed attempt and registration, timeouts, CLIENT
+// UNBLOCK and disconnect cleanup, so individual commands only supply a
+// predicate.
+type BlockManager struct {
+	mu      sync.Mutex
+	waiters map[dbKey][]*blockWaiter
+	byConn  map[net.Conn]*blockWaiter
+
+	maxClients int // waiters at once
+	maxKeys    int // keys per waiter
+}
+
+// newBlockManager returns a manager with nobody blocked.
+func newBlockManager() *BlockManager {
+	return &BlockManager{
+		maxClients: defaultMaxBlockedClients,
+		maxKeys:    defaultMaxBlockedKeys,
+		waiters:    make(map[dbKey][]*blockWaiter),
+		byConn:     make(map[net.Conn]*blockWaiter),
+	}
+}
+
+// Block serves cmd from predicate, waiting up to timeout (0 waits forever)
+// for a Signal on one of keys, in the client's selected database, to make
+// it ready. The bool result is false on
+// timeout, in which case the caller replies with its command's timeout value.
+// Inside EXEC the command never waits: it behaves as if it timed out at once.
+// A command that would wait past the waiter caps gets an error reply instead.
+// release, when not nil, is called once the first check of predicate is
+// done, before Block waits or returns, so a caller can hold locks the
+// predicate needs for that check without holding them while it waits.
+func (bm *BlockManager) Block(state *ClientState, cmd string, keys []string, mode BlockMode, timeout time.Duration, predicate blockPredicate, release func()) (RESP, bool) {
+	state.mu.RLock()
+	conn, clientID, db, executing, reader := state.conn, state.ID, state.DB, state.Executing, state.reader
+	state.mu.RUnlock()
+	if release == nil {
+		release = func() {}
+	}
+
+	bm.mu.Lock()
+	// Checking under the manager lock means a Signal for data that arrives
+	// after this check cannot run until the waiter is registered.
+	if reply, ready := predicate(); ready {
+		bm.mu.Unlock()
+		release()
+		return reply, true
+	}
+	if executing {
+		bm.mu.Unlock()
+		release()
+		return RESP{}, false
+	}
+	if msg := bm.checkCapsLocked(keys); msg != "" {
+		bm.mu.Unlock()
+		release()
+		return NewError(msg), true
+	}
+
+	w := &blockWaiter{
+		cmd:       cmd,
+		db:        db,
+		keys:      keys,
+		conn:      conn,
+		clientID:  clientID,
+		mode:      mode,
+		predicate: predicate,
+		since:     time.Now(),
+		result:    make(chan blockOutcome, 1),
+	}
+	for _, key := range keys {
+		bk := dbKey{db, key}
+		bm.waiters[bk] = append(bm.waiters[bk], w)
+	}
+	bm.byConn[conn] = w
+	bm.mu.Unlock()
+	release()
+	failpoint(fpAfterRegisterBlockedClient)
+	logDebug("Client blocked", "id", clientID, "cmd", cmd, "db", db, "keys", keys)
+
+	if reader != nil {
+		defer bm.watchDisconnect(w, reader)()
+	}
+
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	failpoint(fpBlockingReadBeforeSelect)
+	select {
+	case outcome := <-w.result:
+		return outcome.reply, !outcome.timedOut
+	case <-timeoutCh:
+		bm.mu.Lock()
+		if w.done {
+			// Served concurrently with the timeout; the result is already queued.
+			bm.mu.Unlock()
+			outcome := <-w.result
+			return outcome.reply, !outcome.timedOut
+		}
+		bm.removeLocked(w)
+		bm.mu.Unlock()
+		return RESP{}, false
+	}
+}
+
+// checkCapsLocked returns the error for registering a waiter on keys past
+// the waiter caps, or "" when it fits.
+func (bm *BlockManager) checkCapsLocked(keys []string) string {
+	if len(bm.byConn) >= bm.maxClients {
+		return errTooManyBlockedClients
+	}
+	if len(keys) > bm.maxKeys {
+		return errTooManyBlockedKeys
+	}
+	return ""
+}
+
+// watchDisconnect releases w if its connection closes while it waits, and
+// returns a function that stops the watch. The connection's own read loop is
+// parked in the blocked command meanwhile, so peeking its reader is safe;
+// stopping interrupts the peek with a read deadline, which bufio recovers
+// from, before the read loop resumes. Each peek asks for one byte more than
+// is buffered, so commands a client pipelines behind the blocked one are
+// left for the read loop while the watch goes on; only a client that fills
+// the whole read buffer goes unwatched until it is served.
+func (bm *BlockManager) watchDisconnect(w *blockWaiter, reader *bufio.Reader) func() {
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		var err error
+		for err == nil {
+			n := reader.Buffered() + 1
+			if n > reader.Size() {
+				return
+			}
+			_, err = reader.Peek(n)
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return
+		}
+		bm.mu.Lock()
+		if !w.done {
+			bm.finishLocked(w, blockOutcome{timedOut: true})
+		}
+		bm.mu.Unlock()
+	}()
+
+	return func() {
+		w.conn.SetReadDeadline(time.Now())
+		<-exited
+		w.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// Signal re-evaluates the waiters on key in database db in FIFO order after
+// its data changed. A consumer that is not ready holds back the consumers
+// queued behind it on that key, but not waiters on the same key name in
+// other databases.
+func (bm *BlockManager) Signal(db int, key string) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	consumerStalled := false
+	for _, w := range slices.Clone(bm.waiters[dbKey{db, key}]) {
+		if w.done || (w.mode == BlockConsume && consumerStalled) {
+			continue
+		}
+		reply, ready := w.predicate()
+		if !ready {
+			if w.mode == BlockConsume {
+				consumerStalled = true
+			}
+			continue
+		}
+		failpoint(fpNotifyBeforeDeliver)
+		bm.finishLocked(w, blockOutcome{reply: reply})
+	}
+}
+
+// serveReadyKeys signals the keys marked ready by a client, each once and in
+// the order they were marked. Inside EXEC or a script it does nothing: the keys
+// are served when the transaction or script has finished.
+func (s *Server) serveReadyKeys(state *ClientState) {
+	state.mu.Lock()
+	if state.Executing || len(state.ReadyKeys) == 0 {
+		state.mu.Unlock()
+		return
+	}
+	keys := state.ReadyKeys
+	state.ReadyKeys = nil
+	state.mu.Unlock()
+
+	failpoint(fpBeforeServeReadyKeys)
+	seen := make(map[dbKey]bool, len(keys))
+	for _, bk := range keys {
+		if !seen[bk] {
+			seen[bk] = true
+			s.blocks.Signal(bk.db, bk.key)
+		}
+	}
+}
+
+// Unblock releases the client with clientID if it is blocked, either as a
+// timeout or with an UNBLOCKED error. It reports whether a client was released.
+func (bm *BlockManager) Unblock(clientID int64, withError bool) bool {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	for _, w := range bm.byConn {
+		if w.clientID != clientID || w.done {
+			continue
+		}
+		outcome := blockOutcome{timedOut: true}
+		if withError {
+			outcome = blockOutcome{reply: NewError(errUnblocked)}
+		}
+		bm.finishLocked(w, outcome)
+		return true
+	}
+	return false
+}
+
+// RemoveConn drops any wait registered by conn.
+func (bm *BlockManager) RemoveConn(conn net.Conn) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	if w, ok := bm.byConn[conn]; ok {
+		bm.removeLocked(w)
+	}
+}
+
+// Blocked returns the blocked clients, longest-waiting first.
+func (bm *BlockManager) Blocked() []BlockedInfo {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	infos := make([]BlockedInfo, 0, len(bm.byConn))
+	for _, w := range bm.byConn {
+		infos = append(infos, BlockedInfo{Cmd: w.cmd, DB: w.db, Keys: w.keys, ClientID: w.clientID, Since: w.since})
+	}
+	slices.SortFunc(infos, func(a, b BlockedInfo) int { return a.Since.Compare(b.Since) })
+	return infos
+}
+
+// finishLocked delivers an outcome to a waiter and unregisters it.
+func (bm *BlockManager) finishLocked(w *blockWaiter, outcome blockOutcome) {
+	w.result <- outcome
+	bm.removeLocked(w)
+}
+
+// removeLocked unregisters a waiter from every key it waits on.
+func (bm *BlockManager) removeLocked(w *blockWaiter) {
+	w.done = true
+	for _, key := range w.keys {
+		bk := dbKey{w.db, key}
+		remaining := slices.DeleteFunc(bm.waiters[bk], func(other *blockWaiter) bool { return other == w })
+		if len(remaining) == 0 {
+			delete(bm.waiters, bk)
+		} else {
+			bm.waiters[bk] = remaining
+		}
+	}
+	if bm.byConn[w.conn] == w {
+		delete(bm.byConn, w.conn)
+	}
+}
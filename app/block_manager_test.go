@@ -0,0 +1,198 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// waitBlocked waits until n clients are blocked on s.
+func waitBlocked(t *testing.T, s *Server, n int) {
+	t.Helper()
+	eventually(t, "clients to block", func() bool { return len(s.blocks.Blocked()) == n })
+}
+
+func TestBlockedClientsAreKeyedByDatabase(t *testing.T) {
+	s := startServer(t, nil)
+	inZero, inOne, writer := dial(t, s), dial(t, s), dial(t, s)
+	expectReply(t, inOne.do("SELECT", "1"), NewSimpleString("OK"))
+
+	inZero.send("BLMPOP", "0", "1", "k", "LEFT")
+	waitBlocked(t, s, 1)
+	inOne.send("BLMPOP", "0", "1", "k", "LEFT")
+	waitBlocked(t, s, 2)
+
+	// A push in db 1 must reach the client waiting there, even though the
+	// client queued first on the same key name in db 0 cannot be served.
+	expectReply(t, writer.do("SELECT", "1"), NewSimpleString("OK"))
+	expectReply(t, writer.do("RPUSH", "k", "one"), NewInteger(1))
+	expectReply(t, inOne.read(), NewArray([]RESP{NewBulkString("k"), NewArray([]RESP{NewBulkString("one")})}))
+	waitBlocked(t, s, 1)
+	if blocked := s.blocks.Blocked(); blocked[0].DB != 0 {
+		t.Fatalf("still blocked in db %d, want 0", blocked[0].DB)
+	}
+
+	expectReply(t, writer.do("SELECT", "0"), NewSimpleString("OK"))
+	expectReply(t, writer.do("RPUSH", "k", "zero"), NewInteger(1))
+	expectReply(t, inZero.read(), NewArray([]RESP{NewBulkString("k"), NewArray([]RESP{NewBulkString("zero")})}))
+	waitBlocked(t, s, 0)
+}
+
+// waitedKeys returns how many keys s has waiters on.
+func waitedKeys(s *Server) int {
+	s.blocks.mu.Lock()
+	defer s.blocks.mu.Unlock()
+	return len(s.blocks.waiters)
+}
+
+// popped is the BLMPOP reply for one element popped from key.
+func popped(key, value string) RESP {
+	return NewArray([]RESP{NewBulkString(key), NewArray([]RESP{NewBulkString(value)})})
+}
+
+func TestBlockConsumeIsFIFO(t *testing.T) {
+	s := startServer(t, nil)
+	first, second, writer := dial(t, s), dial(t, s), dial(t, s)
+	secondID := int64(second.do("CLIENT", "ID").Number)
+
+	first.send("BLMPOP", "0", "1", "k", "LEFT")
+	waitBlocked(t, s, 1)
+	second.send("BLMPOP", "0", "1", "k", "LEFT")
+	waitBlocked(t, s, 2)
+
+	expectReply(t, writer.do("RPUSH", "k", "a"), NewInteger(1))
+	expectReply(t, first.read(), popped("k", "a"))
+	waitBlocked(t, s, 1)
+	if blocked := s.blocks.Blocked(); blocked[0].ClientID != secondID {
+		t.Fatalf("client %d is still blocked, want the second one", blocked[0].ClientID)
+	}
+
+	expectReply(t, writer.do("RPUSH", "k", "b"), NewInteger(1))
+	expectReply(t, second.read(), popped("k", "b"))
+	waitBlocked(t, s, 0)
+}
+
+func TestBlockConsumeVersusBroadcast(t *testing.T) {
+	s := startServer(t, nil)
+	writer := dial(t, s)
+
+	// Both stream readers see the one entry.
+	readers := []*testClient{dial(t, s), dial(t, s)}
+	for i, r := range readers {
+		r.send("XREAD", "BLOCK", "0", "STREAMS", "s", "$")
+		waitBlocked(t, s, i+1)
+	}
+	id := writer.do("XADD", "s", "*", "f", "v").String
+	for _, r := range readers {
+		reply := r.read()
+		if reply.Type != Array || len(reply.Array) != 1 || reply.Array[0].Array[1].Array[0].Array[0].String != id {
+			t.Fatalf("XREAD replied %q, want entry %s", reply.Marshal(), id)
+		}
+	}
+	waitBlocked(t, s, 0)
+
+	// Each list popper takes one element of the push.
+	poppers := []*testClient{dial(t, s), dial(t, s), dial(t, s)}
+	for i, p := range poppers {
+		p.send("BLMPOP", "0", "1", "k", "LEFT")
+		waitBlocked(t, s, i+1)
+	}
+	expectReply(t, writer.do("RPUSH", "k", "a", "b"), NewInteger(2))
+	expectReply(t, poppers[0].read(), popped("k", "a"))
+	expectReply(t, poppers[1].read(), popped("k", "b"))
+	waitBlocked(t, s, 1)
+}
+
+func TestBlockTimeout(t *testing.T) {
+	s := startServer(t, nil)
+	c := dial(t, s)
+
+	expectReply(t, c.do("BLMPOP", "0.05", "1", "k", "LEFT"), NewNullArray())
+	expectReply(t, c.do("XREAD", "BLOCK", "50", "STREAMS", "s", "$"), NewNullArray())
+	waitBlocked(t, s, 0)
+	if waiters := waitedKeys(s); waiters != 0 {
+		t.Fatalf("%d keys still have waiters after the timeouts", waiters)
+	}
+}
+
+func TestBlockDisconnect(t *testing.T) {
+	s := startServer(t, nil)
+
+	c := dial(t, s)
+	c.send("BLMPOP", "0", "1", "k", "LEFT")
+	waitBlocked(t, s, 1)
+	c.conn.Close()
+	waitBlocked(t, s, 0)
+
+	// A client that pipelines more commands behind the blocked one is
+	// still noticed when it hangs up.
+	c = dial(t, s)
+	c.send("BLMPOP", "0", "1", "k", "LEFT")
+	waitBlocked(t, s, 1)
+	c.send("PING")
+	c.send("PING")
+	time.Sleep(50 * time.Millisecond)
+	c.conn.Close()
+	waitBlocked(t, s, 0)
+	if waiters := waitedKeys(s); waiters != 0 {
+		t.Fatalf("%d keys still have waiters after the disconnects", waiters)
+	}
+}
+
+func TestBlockPipelinedCommandsRunAfterServe(t *testing.T) {
+	s := startServer(t, nil)
+	c, writer := dial(t, s), dial(t, s)
+
+	c.send("BLMPOP", "0", "1", "k", "LEFT")
+	waitBlocked(t, s, 1)
+	c.send("PING")
+	time.Sleep(50 * time.Millisecond)
+
+	expectReply(t, writer.do("RPUSH", "k", "a"), NewInteger(1))
+	expectReply(t, c.read(), popped("k", "a"))
+	expectReply(t, c.read(), NewSimpleString("PONG"))
+}
+
+func TestClientUnblock(t *testing.T) {
+	s := startServer(t, nil)
+	c, admin := dial(t, s), dial(t, s)
+	id := strconv.Itoa(c.do("CLIENT", "ID").Number)
+
+	expectReply(t, admin.do("CLIENT", "UNBLOCK", id), NewInteger(0))
+
+	c.send("BLMPOP", "0", "1", "k", "LEFT")
+	waitBlocked(t, s, 1)
+	expectReply(t, admin.do("CLIENT", "UNBLOCK", id), NewInteger(1))
+	expectReply(t, c.read(), NewNullArray())
+	waitBlocked(t, s, 0)
+
+	c.send("XREAD", "BLOCK", "0", "STREAMS", "s", "$")
+	waitBlocked(t, s, 1)
+	expectReply(t, admin.do("CLIENT", "UNBLOCK", id, "ERROR"), NewInteger(1))
+	expectReply(t, c.read(), NewError(errUnblocked))
+	waitBlocked(t, s, 0)
+	if waiters := waitedKeys(s); waiters != 0 {
+		t.Fatalf("%d keys still have waiters after CLIENT UNBLOCK", waiters)
+	}
+}
+
+func TestBlockCaps(t *testing.T) {
+	s := startServer(t, nil)
+	s.blocks.mu.Lock()
+	s.blocks.maxClients, s.blocks.maxKeys = 1, 2
+	s.blocks.mu.Unlock()
+	first, second, writer := dial(t, s), dial(t, s), dial(t, s)
+
+	expectReply(t, first.do("BLMPOP", "0", "3", "a", "b", "c", "LEFT"), NewError(errTooManyBlockedKeys))
+
+	first.send("BLMPOP", "0", "2", "a", "b", "LEFT")
+	waitBlocked(t, s, 1)
+	expectReply(t, second.do("BLMPOP", "0", "1", "k", "LEFT"), NewError(errTooManyBlockedClients))
+
+	// The caps only refuse waits; data that is already there is served.
+	expectReply(t, writer.do("RPUSH", "k", "v"), NewInteger(1))
+	expectReply(t, second.do("BLMPOP", "0", "1", "k", "LEFT"), popped("k", "v"))
+
+	expectReply(t, writer.do("RPUSH", "b", "v"), NewInteger(1))
+	expectReply(t, first.read(), popped("b", "v"))
+}
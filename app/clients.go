@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ClientInfo is a point-in-time copy of one connection's state for CLIENT LIST.
+type ClientInfo struct {
+	ID        int64
+	Addr      string
+	LocalAddr string
+	Name      string
+	Age       time.Duration
+	Idle      time.Duration
+	Flags     string
+	DB        int
+	Channels  int
+	Patterns  int
+	Queued    int // -1 outside MULTI
+	Proto     int
+	LastCmd   string
+	conn      net.Conn
+}
+
+// snapshotClients copies the state of every live connection, ordered by ID.
+func (s *Server) snapshotClients() []ClientInfo {
+	s.clientStatesMu.RLock()
+	states := make([]*ClientState, 0, len(s.clientStates))
+	for _, state := range s.clientStates {
+		states = append(states, state)
+	}
+	s.clientStatesMu.RUnlock()
+
+	blocked := make(map[int64]bool)
+	for _, b := range s.blocks.Blocked() {
+		blocked[b.ClientID] = true
+	}
+
+	now := time.Now()
+	infos := make([]ClientInfo, 0, len(states))
+	for _, state := range states {
+		state.mu.RLock()
+		info := ClientInfo{
+			ID:      state.ID,
+			Name:    state.Name,
+			Age:     now.Sub(state.CreatedAt),
+			Idle:    now.Sub(state.LastActive),
+			Queued:  -1,
+			Proto:   state.Protocol,
+			DB:      state.DB,
+			LastCmd: state.LastCmd,
+			conn:    state.conn,
+		}
+		var flags strings.Builder
+		if state.IsReplicaLink {
+			flags.WriteByte('S')
+		}
+		if state.InTransaction {
+			flags.WriteByte('x')
+			info.Queued = len(state.QueuedCommands)
+		}
+		if state.Subscribed {
+			flags.WriteByte('P')
+		}
+		if state.Monitoring {
+			flags.WriteByte('O')
+		}
+		if state.ReadOnly {
+			flags.WriteByte('r')
+		}
+		state.mu.RUnlock()
+
+		if s.tracking.Redirect(state) >= 0 {
+			flags.WriteByte('t')
+		}
+
+		if blocked[info.ID] {
+			flags.WriteByte('b')
+		}
+		info.Flags = flags.String()
+		if info.Flags == "" {
+			info.Flags = "N"
+		}
+		if info.Proto == 0 {
+			info.Proto = RESP2
+		}
+		if info.LastCmd == "" {
+			info.LastCmd = "NULL"
+		}
+		if info.conn != nil {
+			info.Addr = clientAddr(info.conn)
+			info.LocalAddr = info.conn.LocalAddr().String()
+			if isUnixConn(info.conn) {
+				info.LocalAddr = info.Addr
+			}
+			info.Channels, info.Patterns = s.pubsub.Counts(info.conn)
+		}
+		infos = append(infos, info)
+	}
+
+	slices.SortFunc(infos, func(a, b ClientInfo) int { return int(a.ID - b.ID) })
+	return infos
+}
+
+// clientByID returns the live connection with the given ID, or nil.
+func (s *Server) clientByID(id int64) *ClientState {
+	s.clientStatesMu.RLock()
+	defer s.clientStatesMu.RUnlock()
+	for _, state := range s.clientStates {
+		if state.ID == id {
+			return state
+		}
+	}
+	return nil
+}
+
+// clientAddr returns the address a client is listed and logged under. A
+// Unix socket client has no address of its own, so like Redis it is shown
+// as the socket path with port 0.
+func clientAddr(conn net.Conn) string {
+	if isUnixConn(conn) {
+		return conn.LocalAddr().String() + ":0"
+	}
+	return conn.RemoteAddr().String()
+}
+
+// isUnixConn reports whether conn came in over a Unix domain socket.
+func isUnixConn(conn net.Conn) bool {
+	return conn.LocalAddr().Network() == "unix"
+}
+
+// String renders the CLIENT LIST line for the client.
+func (c ClientInfo) String() string {
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s db=%d sub=%d psub=%d multi=%d resp=%d cmd=%s",
+		c.ID, c.Addr, c.LocalAddr, c.Name, int64(c.Age.Seconds()), int64(c.Idle.Seconds()), c.Flags, c.DB,
+		c.Channels, c.Patterns, c.Queued, c.Proto, c.LastCmd)
+}
+
+// validClientName reports whether name can appear in CLIENT LIST output unambiguously.
+func validClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// killClient disconnects target. A client killing itself is disconnected
+// after its reply is written so it still learns the outcome.
+func (s *Server) killClient(self net.Conn, target ClientInfo) {
+	if target.conn == self {
+		state := s.clientState(self)
+		state.mu.Lock()
+		state.closeAfterReply = true
+		state.mu.Unlock()
+		return
+	}
+	target.conn.Close()
+}
@@ -0,0 +1,90 @@
+package main
+
+import "net"
+
+// CommandContext is everything a handler runs against: its arguments, the
+// connection and client state that sent them, the client's selected
+// database, the registry, the configuration in effect when it started and
+// the server it runs on. Handlers take it instead of reaching for shared
+// state, so they can run against a store of the caller's choosing.
+type CommandContext struct {
+	Args     []RESP // arguments after the command name
+	Conn     net.Conn
+	Client   *ClientState
+	DB       *KeyValueStore
+	Registry *Registry
+	Config   *ServerConfig
+	Server   *Server
+}
+
+// newCommandContext builds the context for running a command from conn
+// against its selected database.
+func (s *Server) newCommandContext(conn net.Conn, args []RESP) *CommandContext {
+	client := s.clientState(conn)
+	client.mu.RLock()
+	index := client.DB
+	client.mu.RUnlock()
+	return &CommandContext{
+		Args:     args,
+		Conn:     conn,
+		Client:   client,
+		DB:       s.dbs.DB(index),
+		Registry: s.registry,
+		Config:   s.Config(),
+		Server:   s,
+	}
+}
+
+// selectedDB resolves the client's selected database again. Blocked
+// commands use it on every check, so a SWAPDB or SELECT made while they
+// wait is honoured instead of the store they started with.
+func (ctx *CommandContext) selectedDB() *KeyValueStore {
+	return ctx.Server.dbs.DB(ctx.selectedIndex())
+}
+
+// selectedIndex returns the index of the client's selected database.
+func (ctx *CommandContext) selectedIndex() int {
+	ctx.Client.mu.RLock()
+	defer ctx.Client.mu.RUnlock()
+	return ctx.Client.DB
+}
+
+// rewritePropagation makes the running command replicate as cmds instead
+// of its own invocation. Handlers use it when the result depends on
+// master-only inputs such as the clock, so replicas apply the effect rather
+// than recomputing it.
+func (ctx *CommandContext) rewritePropagation(cmds ...RESP) {
+	if ctx.Config.IsReplica {
+		return
+	}
+	ctx.Client.mu.Lock()
+	ctx.Client.PropagateAs = cmds
+	ctx.Client.PropagateNone = false
+	ctx.Client.mu.Unlock()
+}
+
+// suppressPropagation makes the running command replicate nothing, not
+// even the SELECT of its database. Write commands use it when they turn out
+// to change no data, such as SET NX on an existing key.
+func (ctx *CommandContext) suppressPropagation() {
+	if ctx.Config.IsReplica {
+		return
+	}
+	ctx.Client.mu.Lock()
+	ctx.Client.PropagateAs = nil
+	ctx.Client.PropagateNone = true
+	ctx.Client.mu.Unlock()
+}
+
+// markReady records that the running command may have given keys in
+// database db data that clients blocked on them are waiting for. The keys
+// are signalled by serveReadyKeys once the command has been propagated, so
+// replicas see the write that made a key ready before whatever a blocked
+// client then takes from it.
+func (ctx *CommandContext) markReady(db int, keys ...string) {
+	ctx.Client.mu.Lock()
+	for _, key := range keys {
+		ctx.Client.ReadyKeys = append(ctx.Client.ReadyKeys, dbKey{db, key})
+	}
+	ctx.Client.mu.Unlock()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+// Names returns the registered command names in sorted order.
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.commands))
+	for name := range r.commands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// adminCommands are the commands Redis flags admin: server management and
+// replication plumbing. MONITOR does not show them.
+var adminCommands = map[string]bool{
+	"CONFIG":       true,
+	"DEBUG":        true,
+	"SHUTDOWN":     true,
+	"SLOWLOG":      true,
+	"SAVE":         true,
+	"BGSAVE":       true,
+	"BGREWRITEAOF": true,
+	"HOTKEYS":      true,
+	"MONITOR":      true,
+	"REPLCONF":     true,
+	"PSYNC":        true,
+	"REPLICAOF":    true,
+	"SLAVEOF":      true,
+}
+
+// commandFlags derives a command's COMMAND flags from its registration.
+func (r *Registry) commandFlags(name string) []RESP {
+	var flags []RESP
+	_, hasKeys := commandKeySpecs[name]
+	switch {
+	case r.IsWriteCommand(name):
+		flags = append(flags, NewSimpleString("write"))
+	case hasKeys || keylessReads[name] || name == "XREAD" || name == "SINTERCARD":
+		flags = append(flags, NewSimpleString("readonly"))
+	}
+	switch name {
+	case "XREAD", "LMPOP", "BLMPOP", "SINTERCARD":
+		flags = append(flags, NewSimpleString("movablekeys"))
+	}
+	if adminCommands[name] {
+		flags = append(flags, NewSimpleString("admin"))
+	}
+	return flags
+}
+
+// commandInfo renders one COMMAND entry: name, arity, flags, first key, last
+// key, key step, ACL categories, tips, key specs and subcommands. Key
+// positions are one-based and count the command name, as clients expect.
+func (r *Registry) commandInfo(name string) RESP {
+	first, last, step := 0, 0, 0
+	if spec, ok := commandKeySpecs[name]; ok {
+		first, last, step = spec.first+1, spec.last, spec.step
+		if last >= 0 {
+			last++
+		}
+	}
+
+	return NewArray([]RESP{
+		NewBulkString(strings.ToLower(name)),
+		NewInteger(r.Arity(name)),
+		NewArray(r.commandFlags(name)),
+		NewInteger(first),
+		NewInteger(last),
+		NewInteger(step),
+		NewArray(nil),
+		NewArray(nil),
+		NewArray(nil),
+		NewArray(nil),
+	})
+}
+
+// commandCommand implements COMMAND, COMMAND COUNT, COMMAND INFO and COMMAND DOCS.
+func commandCommand(ctx *CommandContext) (RESP, []byte) {
+	if len(ctx.Args) == 0 {
+		var entries []RESP
+		for _, name := range ctx.Registry.Names() {
+			entries = append(entries, ctx.Registry.commandInfo(name))
+		}
+		return NewArray(entries), nil
+	}
+
+	sub := strings.ToUpper(ctx.Args[0].String)
+	switch sub {
+	case "COUNT":
+		if len(ctx.Args) != 1 {
+			return NewError("ERR wrong number of arguments for 'command|count' command"), nil
+		}
+		return NewInteger(len(ctx.Registry.commands)), nil
+	case "INFO":
+		names := ctx.Registry.Names()
+		if len(ctx.Args) > 1 {
+			names = make([]string, 0, len(ctx.Args)-1)
+			for _, arg := range ctx.Args[1:] {
+				names = append(names, strings.ToUpper(arg.String))
+			}
+		}
+		entries := make([]RESP, 0, len(names))
+		for _, name := range names {
+			if _, ok := ctx.Registry.commands[name]; !ok {
+				entries = append(entries, NewNullArray())
+				continue
+			}
+			entries = append(entries, ctx.Registry.commandInfo(name))
+		}
+		return NewArray(entries), nil
+	case "DOCS":
+		// No command documentation is kept; an empty reply satisfies clients
+		// that fetch docs at connect time.
+		return NewMap(nil), nil
+	}
+	return NewError("ERR unknown subcommand '" + sub + "'. Try COMMAND COUNT, COMMAND INFO or COMMAND DOCS"), nil
+}
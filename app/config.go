@@ -1,63 +1,511 @@
 package main
 
 import (
+    "errors"
     "fmt"
+    "os"
+    "slices"
     "strconv"
     "strings"
-    "sync"
 )
 
-// ServerConfig holds process-wide configuration and local offset.
-type ServerConfig struct {
-    Dir         string
-    DBFilename  string
-    IsReplica   bool
-    MasterHost  string
-    MasterPort  int
-    offset      int64
-    offsetMutex sync.RWMutex
-}
+// ServerVersion is the Redis version this server reports itself as compatible with.
+const ServerVersion = "7.2.0"
 
-var serverConfig = &ServerConfig{
-    Dir:        "./",
-    DBFilename: "dump.rdb",
-    IsReplica:  false,
-    offset:     0,
+// ServerConfig holds a server's configuration. A *ServerConfig returned by
+// Server.Config is an immutable snapshot; changes go through
+// Server.UpdateConfig, so readers never see a half-applied update.
+type ServerConfig struct {
+    Port                   int
+    Dir                    string
+    DBFilename             string
+    IsReplica              bool
+    MasterHost             string
+    MasterPort             int
+    ReplCompression        bool
+    ReplQueueDepth         int
+    ReplPingPeriod         int
+    ReplTimeout            int
+    ReplBacklogSize        int
+    DiagnosticsOnPanic     bool
+    ReplicaRequireReadonly bool
+    ReplicaReadOnly        bool
+    MaxMemory              int64
+    MaxMemoryPolicy        string
+    NotifyKeyspaceEvents   int
+    RequirePass            string
+    MasterAuth             string
+    EnableDebugCommand     string
+    Minimal                bool
+    MaxClients             int
+    Timeout                int // seconds a normal client may idle; 0 disables
+    LogFile                string
+    UnixSocket             string
+    UnixSocketPerm         string
+    TLSPort                int
+    TLSCertFile            string
+    TLSKeyFile             string
+    TLSCACertFile          string
+    TLSReplication         bool
+    ProtoMaxBulkLen        int64 // largest bulk string a client may send
+    KeyspaceInfoVerbose    bool  // INFO keyspace adds the DBSTATS counters
 }
 
-// InitConfig initializes the server configuration from CLI parameters.
-func InitConfig(dir, dbfilename, replicaof string) error {
-    if dir != "" {
-        serverConfig.Dir = dir
-    }
-    if dbfilename != "" {
-        serverConfig.DBFilename = dbfilename
-    }
+// initConfig initializes the server configuration from CLI parameters.
+func (s *Server) initConfig(dir, dbfilename, replicaof string) error {
+    var host string
+    var port int
     if replicaof != "" {
         parts := strings.Fields(replicaof)
         if len(parts) != 2 {
             return fmt.Errorf("invalid --replicaof format: expected 'host port', got '%s'", replicaof)
         }
-        serverConfig.MasterHost = parts[0]
-        port, err := strconv.Atoi(parts[1])
+        var err error
+        port, err = strconv.Atoi(parts[1])
         if err != nil || port < 1 || port > 65535 {
             return fmt.Errorf("invalid master port: %s", parts[1])
         }
-        serverConfig.MasterPort = port
-        serverConfig.IsReplica = true
+        host = parts[0]
     }
+    s.UpdateConfig(func(c *ServerConfig) {
+        if dir != "" {
+            c.Dir = dir
+        }
+        if dbfilename != "" {
+            c.DBFilename = dbfilename
+        }
+        if host != "" {
+            c.MasterHost, c.MasterPort, c.IsReplica = host, port, true
+        }
+    })
     return nil
 }
 
-// GetServerConfig returns the global server configuration.
-func GetServerConfig() *ServerConfig {
-    return serverConfig
+// Config returns the current configuration snapshot. It must not be
+// modified; use UpdateConfig.
+func (s *Server) Config() *ServerConfig {
+    return s.config.Load()
+}
+
+// UpdateConfig applies update to a copy of the configuration and publishes
+// the copy.
+func (s *Server) UpdateConfig(update func(*ServerConfig)) {
+    s.configMu.Lock()
+    defer s.configMu.Unlock()
+    next := *s.config.Load()
+    update(&next)
+    s.config.Store(&next)
+}
+
+// errInvalidConfigValue is returned by a parameter's set function for a
+// value it does not accept.
+var errInvalidConfigValue = errors.New("invalid value")
+
+// configParam is one parameter known to CONFIG GET and CONFIG SET, read
+// from and applied to the server given. A nil set makes the parameter
+// read-only at runtime.
+type configParam struct {
+    name string
+    get  func(s *Server) string
+    set  func(s *Server, value string) error
+}
+
+// boolParam builds a yes/no parameter.
+func boolParam(name string, get func(*Server) bool, set func(*Server, bool)) configParam {
+    return configParam{
+        name: name,
+        get:  func(s *Server) string { return yesNo(get(s)) },
+        set: func(s *Server, value string) error {
+            switch strings.ToLower(value) {
+            case "yes":
+                set(s, true)
+            case "no":
+                set(s, false)
+            default:
+                return errInvalidConfigValue
+            }
+            return nil
+        },
+    }
+}
+
+// intParam builds an integer parameter accepting values of at least min.
+func intParam(name string, min int64, get func(*Server) int64, set func(*Server, int64)) configParam {
+    return configParam{
+        name: name,
+        get:  func(s *Server) string { return strconv.FormatInt(get(s), 10) },
+        set: func(s *Server, value string) error {
+            n, err := strconv.ParseInt(value, 10, 64)
+            if err != nil || n < min {
+                return errInvalidConfigValue
+            }
+            set(s, n)
+            return nil
+        },
+    }
+}
+
+// maxMemoryPolicies are the values maxmemory-policy accepts.
+var maxMemoryPolicies = []string{"noeviction", "allkeys-lru", "allkeys-random", "volatile-lru", "volatile-random", "volatile-ttl"}
+
+// configParams lists every parameter in the order CONFIG GET * reports them.
+var configParams = []configParam{
+    {
+        name: "dir",
+        get:  func(s *Server) string { return s.Config().Dir },
+        set: func(s *Server, value string) error {
+            if info, err := os.Stat(value); err != nil || !info.IsDir() {
+                return errInvalidConfigValue
+            }
+            s.UpdateConfig(func(c *ServerConfig) { c.Dir = value })
+            return nil
+        },
+    },
+    {
+        name: "dbfilename",
+        get:  func(s *Server) string { return s.Config().DBFilename },
+        set: func(s *Server, value string) error {
+            if value == "" || strings.ContainsRune(value, os.PathSeparator) {
+                return errInvalidConfigValue
+            }
+            s.UpdateConfig(func(c *ServerConfig) { c.DBFilename = value })
+            return nil
+        },
+    },
+    {
+        name: "databases",
+        get:  func(s *Server) string { return strconv.Itoa(s.dbs.Count()) },
+    },
+    {
+        name: "save",
+        get:  func(s *Server) string { return formatSaveRules(s.persistence.Rules()) },
+        set: func(s *Server, value string) error {
+            rules, err := ParseSaveRules(value)
+            if err != nil {
+                return errInvalidConfigValue
+            }
+            s.persistence.SetRules(rules)
+            return nil
+        },
+    },
+    boolParam("appendonly", func(s *Server) bool { return s.aof.Enabled() }, func(s *Server, b bool) { s.aof.SetEnabled(b) }),
+    {
+        name: "appendfilename",
+        get:  func(s *Server) string { return s.aof.filename },
+    },
+    {
+        name: "appendfsync",
+        get:  func(s *Server) string { return s.aof.Fsync() },
+        set: func(s *Server, value string) error {
+            policy := strings.ToLower(value)
+            if !slices.Contains(appendFsyncPolicies, policy) {
+                return errInvalidConfigValue
+            }
+            s.aof.SetFsync(policy)
+            return nil
+        },
+    },
+    intParam("auto-aof-rewrite-percentage", 0, func(s *Server) int64 { percentage, _ := s.aof.AutoRewrite(); return percentage },
+        func(s *Server, n int64) { s.aof.SetAutoRewritePercentage(n) }),
+    {
+        name: "auto-aof-rewrite-min-size",
+        get:  func(s *Server) string { _, minSize := s.aof.AutoRewrite(); return strconv.FormatInt(minSize, 10) },
+        set: func(s *Server, value string) error {
+            n, err := parseMemory(value)
+            if err != nil {
+                return errInvalidConfigValue
+            }
+            s.aof.SetAutoRewriteMinSize(n)
+            return nil
+        },
+    },
+    {
+        name: "maxmemory",
+        get:  func(s *Server) string { return strconv.FormatInt(s.Config().MaxMemory, 10) },
+        set: func(s *Server, value string) error {
+            n, err := parseMemory(value)
+            if err != nil {
+                return errInvalidConfigValue
+            }
+            s.UpdateConfig(func(c *ServerConfig) { c.MaxMemory = n })
+            return nil
+        },
+    },
+    {
+        name: "proto-max-bulk-len",
+        get:  func(s *Server) string { return strconv.FormatInt(s.Config().ProtoMaxBulkLen, 10) },
+        set: func(s *Server, value string) error {
+            n, err := parseMemory(value)
+            if err != nil || n < minMaxBulkLength {
+                return errInvalidConfigValue
+            }
+            s.UpdateConfig(func(c *ServerConfig) { c.ProtoMaxBulkLen = n })
+            return nil
+        },
+    },
+    {
+        name: "maxmemory-policy",
+        get:  func(s *Server) string { return s.Config().MaxMemoryPolicy },
+        set: func(s *Server, value string) error {
+            policy := strings.ToLower(value)
+            for _, p := range maxMemoryPolicies {
+                if p == policy {
+                    s.UpdateConfig(func(c *ServerConfig) { c.MaxMemoryPolicy = policy })
+                    return nil
+                }
+            }
+            return errInvalidConfigValue
+        },
+    },
+    {
+        name: "notify-keyspace-events",
+        get:  func(s *Server) string { return formatNotifyFlags(s.Config().NotifyKeyspaceEvents) },
+        set: func(s *Server, value string) error {
+            flags, err := parseNotifyFlags(value)
+            if err != nil {
+                return errInvalidConfigValue
+            }
+            s.UpdateConfig(func(c *ServerConfig) { c.NotifyKeyspaceEvents = flags })
+            return nil
+        },
+    },
+    {
+        name: "requirepass",
+        get:  func(s *Server) string { return s.Config().RequirePass },
+        set: func(s *Server, value string) error {
+            s.UpdateConfig(func(c *ServerConfig) { c.RequirePass = value })
+            return nil
+        },
+    },
+    {
+        name: "masterauth",
+        get:  func(s *Server) string { return s.Config().MasterAuth },
+        set: func(s *Server, value string) error {
+            s.UpdateConfig(func(c *ServerConfig) { c.MasterAuth = value })
+            return nil
+        },
+    },
+    {
+        name: "enable-debug-command",
+        get:  func(s *Server) string { return s.Config().EnableDebugCommand },
+    },
+    {
+        name: "loglevel",
+        get:  func(s *Server) string { return logLevelName(logLevel.Level()) },
+        set: func(s *Server, value string) error {
+            level, ok := parseLogLevel(value)
+            if !ok {
+                return errInvalidConfigValue
+            }
+            logLevel.Set(level)
+            return nil
+        },
+    },
+    {
+        name: "logfile",
+        get:  func(s *Server) string { return s.Config().LogFile },
+    },
+    {
+        name: "unixsocket",
+        get:  func(s *Server) string { return s.Config().UnixSocket },
+    },
+    {
+        name: "tls-port",
+        get:  func(s *Server) string { return strconv.Itoa(s.Config().TLSPort) },
+    },
+    {
+        name: "tls-cert-file",
+        get:  func(s *Server) string { return s.Config().TLSCertFile },
+    },
+    {
+        name: "tls-key-file",
+        get:  func(s *Server) string { return s.Config().TLSKeyFile },
+    },
+    {
+        name: "tls-ca-cert-file",
+        get:  func(s *Server) string { return s.Config().TLSCACertFile },
+    },
+    {
+        name: "tls-replication",
+        get:  func(s *Server) string { return yesNo(s.Config().TLSReplication) },
+    },
+    {
+        name: "unixsocketperm",
+        get: func(s *Server) string {
+            if perm := s.Config().UnixSocketPerm; perm != "" {
+                return perm
+            }
+            return "0"
+        },
+    },
+    boolParam("hotkeys-tracking", func(s *Server) bool { return s.hotKeys.Enabled() }, func(s *Server, b bool) { s.hotKeys.SetEnabled(b) }),
+    intParam("hotkeys-sample-rate", 1, func(s *Server) int64 { return s.hotKeys.SampleRate() }, func(s *Server, n int64) { s.hotKeys.SetSampleRate(n) }),
+    boolParam("repl-compression", func(s *Server) bool { return s.Config().ReplCompression },
+        func(s *Server, b bool) { s.UpdateConfig(func(c *ServerConfig) { c.ReplCompression = b }) }),
+    intParam("repl-queue-depth", 1, func(s *Server) int64 { return int64(s.Config().ReplQueueDepth) },
+        func(s *Server, n int64) { s.UpdateConfig(func(c *ServerConfig) { c.ReplQueueDepth = int(n) }) }),
+    intParam("repl-ping-replica-period", 1, func(s *Server) int64 { return int64(s.Config().ReplPingPeriod) },
+        func(s *Server, n int64) { s.UpdateConfig(func(c *ServerConfig) { c.ReplPingPeriod = int(n) }) }),
+    intParam("repl-timeout", 1, func(s *Server) int64 { return int64(s.Config().ReplTimeout) },
+        func(s *Server, n int64) { s.UpdateConfig(func(c *ServerConfig) { c.ReplTimeout = int(n) }) }),
+    intParam("repl-backlog-size", 1, func(s *Server) int64 { return int64(s.Config().ReplBacklogSize) },
+        func(s *Server, n int64) {
+            s.UpdateConfig(func(c *ServerConfig) { c.ReplBacklogSize = int(n) })
+            s.repl.ResizeReplBacklog(int(n))
+        }),
+    boolParam("latency-tracking", func(s *Server) bool { return s.latency.Enabled() }, func(s *Server, b bool) { s.latency.SetEnabled(b) }),
+    {
+        name: "latency-tracking-info-percentiles",
+        get:  latencyPercentilesConfig,
+        set: func(s *Server, value string) error {
+            if err := s.latency.SetPercentiles(value); err != nil {
+                return errInvalidConfigValue
+            }
+            return nil
+        },
+    },
+    intParam("admission-max-inflight", 0, func(s *Server) int64 { maxInFlight, _ := s.admission.Limits(); return maxInFlight },
+        func(s *Server, n int64) { s.admission.SetMaxInFlight(n) }),
+    intParam("admission-queue-depth", 0, func(s *Server) int64 { _, depth := s.admission.Limits(); return depth },
+        func(s *Server, n int64) { s.admission.SetQueueDepth(n) }),
+    intParam("slowlog-log-slower-than", -1, func(s *Server) int64 { return s.slowLog.SlowerThan() },
+        func(s *Server, n int64) { s.slowLog.SetSlowerThan(n) }),
+    intParam("slowlog-max-len", 0, func(s *Server) int64 { return int64(s.slowLog.MaxLen()) },
+        func(s *Server, n int64) { s.slowLog.SetMaxLen(int(n)) }),
+    boolParam("leak-detection", func(s *Server) bool { return s.leaks.Enabled() }, func(s *Server, b bool) { s.leaks.SetEnabled(b) }),
+    boolParam("replica-require-readonly", func(s *Server) bool { return s.Config().ReplicaRequireReadonly },
+        func(s *Server, b bool) { s.UpdateConfig(func(c *ServerConfig) { c.ReplicaRequireReadonly = b }) }),
+    boolParam("replica-read-only", func(s *Server) bool { return s.Config().ReplicaReadOnly },
+        func(s *Server, b bool) { s.UpdateConfig(func(c *ServerConfig) { c.ReplicaReadOnly = b }) }),
+    intParam("maxclients", 1, func(s *Server) int64 { return int64(s.Config().MaxClients) },
+        func(s *Server, n int64) { s.UpdateConfig(func(c *ServerConfig) { c.MaxClients = int(n) }) }),
+    intParam("timeout", 0, func(s *Server) int64 { return int64(s.Config().Timeout) },
+        func(s *Server, n int64) { s.UpdateConfig(func(c *ServerConfig) { c.Timeout = int(n) }) }),
+    boolParam("keyspace-info-verbose", func(s *Server) bool { return s.Config().KeyspaceInfoVerbose },
+        func(s *Server, b bool) { s.UpdateConfig(func(c *ServerConfig) { c.KeyspaceInfoVerbose = b }) }),
 }
 
-// IncrementOffset advances the local and master offsets by the given byte count.
-func IncrementOffset(bytesCount int64) {
-    serverConfig.offsetMutex.Lock()
-    defer serverConfig.offsetMutex.Unlock()
-    serverConfig.offset += bytesCount
-    IncrementMasterOffset(bytesCount)
+// lookupConfigParam returns the parameter with the given lowercase name.
+func lookupConfigParam(name string) (configParam, bool) {
+    for _, p := range configParams {
+        if p.name == name {
+            return p, true
+        }
+    }
+    return configParam{}, false
+}
+
+// setConfigParam validates and applies one parameter, as CONFIG SET does.
+func (s *Server) setConfigParam(name, value string) error {
+    param, ok := lookupConfigParam(name)
+    if !ok || param.set == nil {
+        return errInvalidConfigValue
+    }
+    return param.set(s, value)
+}
+
+// parseMemory parses a byte count with an optional Redis unit suffix:
+// k, m and g are powers of 1000, kb, mb and gb powers of 1024.
+func parseMemory(value string) (int64, error) {
+    units := []struct {
+        suffix string
+        factor int64
+    }{
+        {"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+        {"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+    }
+    lower := strings.ToLower(value)
+    factor := int64(1)
+    for _, u := range units {
+        if strings.HasSuffix(lower, u.suffix) {
+            lower = strings.TrimSuffix(lower, u.suffix)
+            factor = u.factor
+            break
+        }
+    }
+    n, err := strconv.ParseInt(lower, 10, 64)
+    if err != nil || n < 0 {
+        return 0, errInvalidConfigValue
+    }
+    return n * factor, nil
+}
+
+// configSubcommands are the subcommands of CONFIG.
+var configSubcommands = []Subcommand{
+    {Name: "GET", Handler: configGetCommand, MinArgs: 1, MaxArgs: -1, Usage: "<pattern> [<pattern> ...]",
+        Help: []string{"Return parameters matching the glob-like <pattern> and their values."}},
+    {Name: "SET", Handler: configSetCommand, MinArgs: 2, MaxArgs: 2, Usage: "<directive> <value>",
+        Help: []string{"Set the configuration <directive> to <value>."}},
+    {Name: "RESETSTAT", Handler: configResetstatCommand, MinArgs: 0, MaxArgs: 0,
+        Help: []string{"Reset statistics reported by the INFO command."}},
+}
+
+// configResetstatCommand clears the statistics INFO reports.
+func configResetstatCommand(ctx *CommandContext) (RESP, []byte) {
+    ctx.Server.latency.Reset()
+    ctx.Server.admission.ResetStats()
+    ctx.Server.stats.Reset()
+    ctx.Server.dbs.ResetStats()
+    return NewSimpleString("OK"), nil
+}
+
+// minimalDisabledOptions are the optional subsystems --minimal keeps switched off.
+var minimalDisabledOptions = map[string]bool{
+    "hotkeys-tracking": true,
+    "latency-tracking": true,
+    "leak-detection":   true,
+}
+
+// configSetCommand sets one parameter after validating its value.
+func configSetCommand(ctx *CommandContext) (RESP, []byte) {
+	args := ctx.Args
+    name := strings.ToLower(args[0].String)
+    value := args[1].String
+    if ctx.Config.Minimal && minimalDisabledOptions[name] && strings.ToLower(value) != "no" {
+        return NewError("ERR '" + name + "' is not available in --minimal mode"), nil
+    }
+    param, ok := lookupConfigParam(name)
+    if !ok {
+        return NewError("ERR Unknown option or number of arguments for CONFIG SET - '" + name + "'"), nil
+    }
+    if param.set == nil {
+        return NewError("ERR CONFIG SET failed (possibly related to argument '" + name + "') - can't set immutable config"), nil
+    }
+    if err := param.set(ctx.Server, value); err != nil {
+        return NewError("ERR Invalid argument '" + value + "' for CONFIG SET '" + name + "'"), nil
+    }
+    return NewSimpleString("OK"), nil
+}
+
+// configGetCommand returns every parameter matching any of the glob
+// patterns, each once.
+func configGetCommand(ctx *CommandContext) (RESP, []byte) {
+	args := ctx.Args
+    var pairs []RESP
+    for _, param := range configParams {
+        for _, arg := range args {
+            if matchGlob(strings.ToLower(arg.String), param.name) {
+                pairs = append(pairs, NewBulkString(param.name), NewBulkString(param.get(ctx.Server)))
+                break
+            }
+        }
+    }
+    return NewMap(pairs), nil
+}
+
+// latencyPercentilesConfig formats the configured latency percentiles.
+func latencyPercentilesConfig(s *Server) string {
+    var parts []string
+    for _, p := range s.latency.Percentiles() {
+        parts = append(parts, formatFloat(p))
+    }
+    return strings.Join(parts, " ")
+}
+
+// yesNo formats a boolean config value.
+func yesNo(b bool) string {
+    if b {
+        return "yes"
+    }
+    return "no"
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ConnMode identifies the protocol mode a connection is currently in.
+type ConnMode int
+
+const (
+	ModeNormal ConnMode = iota
+	ModeMulti
+	ModeSubscribed
+	ModeReplicaLink
+	ModeMonitor
+)
+
+// String returns the mode name used in errors and introspection.
+func (m ConnMode) String() string {
+	switch m {
+	case ModeNormal:
+		return "normal"
+	case ModeMulti:
+		return "multi"
+	case ModeSubscribed:
+		return "subscribed"
+	case ModeReplicaLink:
+		return "replica-link"
+	case ModeMonitor:
+		return "monitor"
+	default:
+		return "unknown"
+	}
+}
+
+// modeAction is what the dispatcher does with a command in a given mode.
+type modeAction int
+
+const (
+	actionExecute modeAction = iota
+	actionQueue
+	actionReject
+	actionDrop
+)
+
+// modeRule is a single cell of the mode compatibility matrix. An err
+// containing %s is formatted with the lowercase command name.
+type modeRule struct {
+	action modeAction
+	err    string
+}
+
+// errorFor returns the rejection message for cmdName.
+func (r modeRule) errorFor(cmdName string) string {
+	if strings.Contains(r.err, "%s") {
+		return fmt.Sprintf(r.err, strings.ToLower(cmdName))
+	}
+	return r.err
+}
+
+// modePolicy is a row of the matrix: a default rule plus per-command overrides.
+type modePolicy struct {
+	defaultRule modeRule
+	overrides   map[string]modeRule
+}
+
+// modeMatrix encodes how each connection mode treats each command. A new mode
+// must add a row here; commands without an override fall back to the row default.
+var modeMatrix = map[ConnMode]modePolicy{
+	ModeNormal: {
+		defaultRule: modeRule{action: actionExecute},
+	},
+	ModeMulti: {
+		defaultRule: modeRule{action: actionQueue},
+		overrides: map[string]modeRule{
+			"EXEC":    {action: actionExecute},
+			"DISCARD": {action: actionExecute},
+			"RESET":   {action: actionExecute},
+			"QUIT":    {action: actionExecute},
+			"MULTI":   {action: actionReject, err: "ERR MULTI calls can not be nested"},
+			"WATCH":   {action: actionReject, err: "ERR WATCH inside MULTI is not allowed"},
+			// Subscription confirmations are pushed outside the EXEC reply,
+			// which would leave the EXEC array short.
+			"SUBSCRIBE":    {action: actionReject, err: "ERR Command not allowed inside a transaction"},
+			"UNSUBSCRIBE":  {action: actionReject, err: "ERR Command not allowed inside a transaction"},
+			"PSUBSCRIBE":   {action: actionReject, err: "ERR Command not allowed inside a transaction"},
+			"PUNSUBSCRIBE": {action: actionReject, err: "ERR Command not allowed inside a transaction"},
+			"MONITOR":      {action: actionReject, err: "ERR Command not allowed inside a transaction"},
+		},
+	},
+	ModeSubscribed: {
+		defaultRule: modeRule{
+			action: actionReject,
+			err:    "ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context",
+		},
+		overrides: map[string]modeRule{
+			"SUBSCRIBE":    {action: actionExecute},
+			"UNSUBSCRIBE":  {action: actionExecute},
+			"PSUBSCRIBE":   {action: actionExecute},
+			"PUNSUBSCRIBE": {action: actionExecute},
+			"PING":         {action: actionExecute},
+			"RESET":        {action: actionExecute},
+			"QUIT":         {action: actionExecute},
+		},
+	},
+	ModeReplicaLink: {
+		// Replies on the replication link would be read by the replica as
+		// commands, so anything other than REPLCONF is silently ignored.
+		defaultRule: modeRule{action: actionDrop},
+		overrides: map[string]modeRule{
+			"REPLCONF": {action: actionExecute},
+		},
+	},
+	ModeMonitor: {
+		// Commands that touch keys are refused by checkMonitorKeyspace;
+		// the rest run, except ones that would switch modes again. A repeated
+		// MONITOR is ignored without a reply, as in Redis.
+		defaultRule: modeRule{action: actionExecute},
+		overrides: map[string]modeRule{
+			"MONITOR":    {action: actionDrop},
+			"MULTI":      {action: actionReject, err: errMonitorKeyspace},
+			"SUBSCRIBE":  {action: actionReject, err: errMonitorKeyspace},
+			"PSUBSCRIBE": {action: actionReject, err: errMonitorKeyspace},
+			"PSYNC":      {action: actionReject, err: errMonitorKeyspace},
+		},
+	},
+}
+
+// resolveModeRule looks up the matrix cell for a command in a mode.
+func resolveModeRule(mode ConnMode, cmdName string) modeRule {
+	policy, ok := modeMatrix[mode]
+	if !ok {
+		return modeRule{action: actionReject, err: "ERR connection is in an unknown mode"}
+	}
+	if rule, ok := policy.overrides[cmdName]; ok {
+		return rule
+	}
+	return policy.defaultRule
+}
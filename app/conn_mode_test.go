@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// allModes lists every connection mode; a new mode must be added here too.
+var allModes = []ConnMode{ModeNormal, ModeMulti, ModeSubscribed, ModeReplicaLink, ModeMonitor}
+
+func TestModeMatrixCoversEveryMode(t *testing.T) {
+	registry := NewRegistry(false)
+	if len(modeMatrix) != len(allModes) {
+		t.Fatalf("the matrix has %d rows, want one for each of %d modes", len(modeMatrix), len(allModes))
+	}
+	for _, mode := range allModes {
+		policy, ok := modeMatrix[mode]
+		if !ok {
+			t.Fatalf("mode %v has no row in the matrix", mode)
+		}
+		if mode.String() == "unknown" {
+			t.Fatalf("mode %d has no name", mode)
+		}
+		for name := range policy.overrides {
+			if _, exists := registry.Get(name); !exists {
+				t.Errorf("%v row overrides %s, which is not a command", mode, name)
+			}
+		}
+	}
+}
+
+// enterMode dials s, switches to proto, and puts the connection in mode.
+func enterMode(t *testing.T, s *Server, mode ConnMode, proto int) *testClient {
+	t.Helper()
+	c := dial(t, s)
+	if proto == RESP3 {
+		if reply := c.do("HELLO", "3"); reply.Type != Map {
+			t.Fatalf("HELLO 3 replied %q", reply.Marshal())
+		}
+	}
+	switch mode {
+	case ModeMulti:
+		expectReply(t, c.do("MULTI"), NewSimpleString("OK"))
+	case ModeSubscribed:
+		if reply := c.do("SUBSCRIBE", "ch"); reply.Type != Array {
+			t.Fatalf("SUBSCRIBE replied %q", reply.Marshal())
+		}
+	case ModeMonitor:
+		expectReply(t, c.do("MONITOR"), NewSimpleString("OK"))
+	}
+	return c
+}
+
+// placeholderArgs returns n filler arguments.
+func placeholderArgs(n int) []string {
+	args := make([]string, n)
+	for i := range args {
+		args[i] = "x"
+	}
+	return args
+}
+
+// arityProbe returns arguments that make name fail its arity check, so a
+// command that gets past the mode check stops there without running, and
+// whether it found any. Variadic commands that take no arguments cannot
+// fail it; they run bare, which is harmless for all of them.
+func arityProbe(registry *Registry, name string) ([]string, bool) {
+	bounds := registry.arity[name]
+	switch {
+	case bounds.min > 0:
+		return nil, true
+	case bounds.max >= 0:
+		return placeholderArgs(bounds.max + 1), true
+	}
+	return nil, false
+}
+
+func TestModeMatrixOnConnections(t *testing.T) {
+	rows := []struct {
+		mode  ConnMode
+		proto int
+	}{
+		{ModeNormal, RESP2},
+		{ModeNormal, RESP3},
+		{ModeMulti, RESP2},
+		{ModeMulti, RESP3},
+		{ModeSubscribed, RESP2},
+		{ModeSubscribed, RESP3},
+		{ModeMonitor, RESP2},
+		{ModeMonitor, RESP3},
+	}
+	s := startServer(t, nil)
+	for _, row := range rows {
+		t.Run(fmt.Sprintf("%v/RESP%d", row.mode, row.proto), func(t *testing.T) {
+			for _, name := range s.registry.Names() {
+				t.Run(name, func(t *testing.T) {
+					rule := resolveModeRule(row.mode, name)
+					c := enterMode(t, s, row.mode, row.proto)
+
+					// Queued commands never run, so they get arguments that
+					// pass the arity check; elsewhere arguments that fail it
+					// keep the command from doing anything once admitted.
+					args, probed := arityProbe(s.registry, name)
+					if row.mode == ModeMulti {
+						args, probed = placeholderArgs(s.registry.arity[name].min), false
+					}
+					c.send(append([]string{name}, args...)...)
+
+					switch rule.action {
+					case actionQueue:
+						expectReply(t, c.read(), NewSimpleString("QUEUED"))
+					case actionReject:
+						expectReply(t, c.read(), NewError(rule.errorFor(name)))
+					case actionDrop:
+						c.expectNoReply(50 * time.Millisecond)
+					case actionExecute:
+						reply := c.read()
+						if probed {
+							expectReply(t, reply, NewError(s.registry.CheckArity(name, len(args))))
+						} else if reply.Type == Error || sameReply(reply, NewSimpleString("QUEUED")) {
+							t.Fatalf("replied %q, want the command run", reply.Marshal())
+						}
+					}
+					c.conn.Close()
+				})
+			}
+		})
+	}
+}
+
+// TestModeMatrixReplicaLink checks the replica-link row. Once PSYNC turns a
+// connection into a link, serveReplicaLink reads it instead of the
+// dispatcher, so no command gets a reply and only REPLCONF ACK has an effect.
+func TestModeMatrixReplicaLink(t *testing.T) {
+	s := startServer(t, nil)
+	c := psyncLink(t, s)
+
+	// Each command gets arguments its arity accepts, so one the link ran
+	// by mistake would answer.
+	for _, name := range s.registry.Names() {
+		rule := resolveModeRule(ModeReplicaLink, name)
+		want := actionDrop
+		if name == "REPLCONF" {
+			want = actionExecute
+		}
+		if rule.action != want {
+			t.Fatalf("%s on a replica link resolves to action %d, want %d", name, rule.action, want)
+		}
+		c.send(append([]string{name}, placeholderArgs(s.registry.arity[name].min)...)...)
+	}
+	c.send("REPLCONF", "ACK", "424242")
+	eventually(t, "the ACK to be applied", func() bool { return s.repl.GetAcknowledgedReplicaCount(424242) == 1 })
+	c.expectNoReply(100 * time.Millisecond)
+}
+
+func TestSubscribeInMultiRESP3(t *testing.T) {
+	s := startServer(t, nil)
+	c := enterMode(t, s, ModeMulti, RESP3)
+	for _, cmd := range []string{"SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE"} {
+		expectReply(t, c.do(cmd, "ch"), NewError("ERR Command not allowed inside a transaction"))
+	}
+	expectReply(t, c.do("PUBLISH", "ch", "m"), NewSimpleString("QUEUED"))
+	expectReply(t, c.do("EXEC"), NewArray([]RESP{NewInteger(0)}))
+
+	// Nothing subscribed, so the connection is back to normal.
+	expectReply(t, c.do("GET", "k"), NewNullBulkString())
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultDatabases is how many numbered databases a server has unless --databases says otherwise.
+const defaultDatabases = 16
+
+// errDBIndexOutOfRange is returned for a database index outside 0..databases-1.
+const errDBIndexOutOfRange = "ERR DB index is out of range"
+
+// dbKey names a key in one database. The same key name in two databases is
+// two different keys to block on or watch.
+type dbKey struct {
+	db  int
+	key string
+}
+
+// Databases holds the numbered keyspaces. SWAPDB exchanges entries, so
+// commands resolve their store by index each time instead of holding on to
+// one.
+type Databases struct {
+	server *Server
+	mu     sync.RWMutex
+	dbs    []*KeyValueStore
+	// activeExpire gates the sweeper; DEBUG SET-ACTIVE-EXPIRE 0 leaves
+	// expired keys to be removed lazily when they are next accessed.
+	activeExpire atomic.Bool
+	// expireNextDB is where the next expiry cycle starts when the last one
+	// ran out of time. Only the sweeper goroutine uses it.
+	expireNextDB int
+}
+
+// newDatabases creates n empty databases belonging to server. The expiry
+// sweeper is started separately with expireCycle.
+func newDatabases(server *Server, n int) *Databases {
+	d := &Databases{server: server, dbs: make([]*KeyValueStore, n)}
+	for i := range d.dbs {
+		d.dbs[i] = NewKeyValueStore()
+		d.dbs[i].server = server
+	}
+	d.activeExpire.Store(true)
+	return d
+}
+
+// Count returns the number of databases.
+func (d *Databases) Count() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return len(d.dbs)
+}
+
+// DB returns the store for a database index, which callers must have validated.
+func (d *Databases) DB(index int) *KeyValueStore {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.dbs[index]
+}
+
+// IndexOf returns the index of db, or -1 when it is no longer one of the
+// databases because a loaded dump replaced it.
+func (d *Databases) IndexOf(db *KeyValueStore) int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for i, candidate := range d.dbs {
+		if candidate == db {
+			return i
+		}
+	}
+	return -1
+}
+
+// Valid reports whether index names a database.
+func (d *Databases) Valid(index int) bool {
+	return index >= 0 && index < d.Count()
+}
+
+// Swap exchanges the contents of two databases atomically: no command sees
+// one swapped without the other.
+func (d *Databases) Swap(a, b int) {
+	d.mu.Lock()
+	d.dbs[a], d.dbs[b] = d.dbs[b], d.dbs[a]
+	d.mu.Unlock()
+}
+
+// FlushAll empties every database. Holding the databases lock keeps a
+// concurrent SWAPDB from moving a database past the flush.
+func (d *Databases) FlushAll() {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, db := range d.dbs {
+		db.Flush()
+	}
+}
+
+// Replace installs stores as the databases' contents, as loading a dump
+// does. stores must hold one store per database.
+func (d *Databases) Replace(stores []*KeyValueStore) {
+	for _, store := range stores {
+		store.server = d.server
+	}
+	d.mu.Lock()
+	copy(d.dbs, stores)
+	d.mu.Unlock()
+}
+
+// Move moves key, with its TTL, from database from to database to. It
+// reports false when key is missing from the source or already exists in
+// the destination. Holding the databases lock keeps the indexes from
+// changing meanwhile, so the two shards are always locked lower index
+// first and concurrent moves cannot deadlock.
+func (d *Databases) Move(key string, from, to int) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	src, dst := d.dbs[from], d.dbs[to]
+	first, second := src.shard(key), dst.shard(key)
+	if from > to {
+		first, second = second, first
+	}
+	first.mu.Lock()
+	defer first.mu.Unlock()
+	second.mu.Lock()
+	defer second.mu.Unlock()
+
+	value, exists := src.lookupForWriteLocked(key)
+	if !exists {
+		return false
+	}
+	if _, exists := dst.lookupForWriteLocked(key); exists {
+		return false
+	}
+	expiry, hasExpiry := src.shard(key).expiryMap[key]
+	src.deleteLocked(key)
+	dst.storeLocked(key, value)
+	if hasExpiry {
+		dst.shard(key).expiryMap[key] = expiry
+	}
+	return true
+}
+
+// Snapshot copies every database's live keys, indexed by database.
+func (d *Databases) Snapshot() [][]SnapshotEntry {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	snapshot := make([][]SnapshotEntry, len(d.dbs))
+	for i, db := range d.dbs {
+		snapshot[i] = db.Snapshot()
+	}
+	return snapshot
+}
+
+// Stats sums the key and expiry counts across every database.
+func (d *Databases) Stats() (int, int) {
+	d.mu.RLock()
+	dbs := append([]*KeyValueStore(nil), d.dbs...)
+	d.mu.RUnlock()
+
+	keys, expires := 0, 0
+	for _, db := range dbs {
+		k, e := db.Stats()
+		keys += k
+		expires += e
+	}
+	return keys, expires
+}
+
+const (
+	// expireCyclePeriod is how often the sweeper runs.
+	expireCyclePeriod = 100 * time.Millisecond
+	// expireSampleSize is how many keys with a TTL one sampling pass looks at.
+	expireSampleSize = 20
+	// expireRepeatPercent is the share of a sample that must have expired
+	// for the sweeper to sample the same database again straight away.
+	expireRepeatPercent = 25
+	// expireCycleBudget bounds how long one sweep may run.
+	expireCycleBudget = time.Millisecond
+)
+
+// expireCycle periodically removes expired keys from every database until
+// ctx is cancelled.
+func (d *Databases) expireCycle(ctx context.Context) {
+	ticker := time.NewTicker(expireCyclePeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !d.activeExpire.Load() {
+			continue
+		}
+		failpoint(fpExpireCycle)
+		d.mu.RLock()
+		dbs := append([]*KeyValueStore(nil), d.dbs...)
+		d.mu.RUnlock()
+
+		d.activeExpireCycle(dbs, time.Now())
+	}
+}
+
+// activeExpireCycle samples keys with a TTL the way Redis does instead of
+// scanning them all. Each database is sampled expireSampleSize keys at a
+// time, again and again while more than expireRepeatPercent of a sample
+// had expired. Once expireCycleBudget has passed the cycle stops, and the
+// next one resumes at the database it stopped in.
+func (d *Databases) activeExpireCycle(dbs []*KeyValueStore, now time.Time) {
+	deadline := now.Add(expireCycleBudget)
+	first := d.expireNextDB % len(dbs)
+	d.expireNextDB = first
+	for i := range dbs {
+		index := (first + i) % len(dbs)
+		for {
+			if time.Now().After(deadline) {
+				d.expireNextDB = index
+				return
+			}
+			sampled, expired := dbs[index].expireSample(now)
+			if sampled == 0 || expired*100 <= sampled*expireRepeatPercent {
+				break
+			}
+		}
+	}
+}
+
+// SetActiveExpire turns the expiry sweeper on or off.
+func (d *Databases) SetActiveExpire(enabled bool) {
+	d.activeExpire.Store(enabled)
+}
+
+// parseDBIndex parses a database index argument naming one of dbs.
+func parseDBIndex(dbs *Databases, arg string) (int, string) {
+	index, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, "ERR value is not an integer or out of range"
+	}
+	if !dbs.Valid(index) {
+		return 0, errDBIndexOutOfRange
+	}
+	return index, ""
+}
+
+// selectCommand switches the connection to another database.
+func selectCommand(ctx *CommandContext) (RESP, []byte) {
+	index, msg := parseDBIndex(ctx.Server.dbs, ctx.Args[0].String)
+	if msg != "" {
+		return NewError(msg), nil
+	}
+
+	state := ctx.Client
+	state.mu.Lock()
+	state.DB = index
+	state.mu.Unlock()
+	return NewSimpleString("OK"), nil
+}
+
+// swapdbCommand exchanges two databases. Clients blocked on keys in either
+// database are re-checked, and every WATCH on a key in either database is
+// invalidated, since the data behind those keys just changed.
+func swapdbCommand(ctx *CommandContext) (RESP, []byte) {
+	a, msg := parseDBIndex(ctx.Server.dbs, ctx.Args[0].String)
+	if msg != "" {
+		return NewError(msg), nil
+	}
+	b, msg := parseDBIndex(ctx.Server.dbs, ctx.Args[1].String)
+	if msg != "" {
+		return NewError(msg), nil
+	}
+
+	dbs := ctx.Server.dbs
+	dbs.Swap(a, b)
+	ctx.Server.signalFlushedDBs(a, b)
+	for _, index := range []int{a, b} {
+		dbs.DB(index).ForEachKey(func(key string) bool {
+			ctx.markReady(index, key)
+			return true
+		})
+	}
+	return NewSimpleString("OK"), nil
+}
+
+// parseFlushMode accepts the optional ASYNC or SYNC argument of FLUSHDB and
+// FLUSHALL. Flushing swaps in empty maps under the store lock and leaves the
+// old ones to the garbage collector, so both modes already return without
+// walking the keyspace.
+func parseFlushMode(args []RESP) string {
+	if len(args) == 0 {
+		return ""
+	}
+	switch strings.ToUpper(args[0].String) {
+	case "ASYNC", "SYNC":
+		return ""
+	}
+	return "ERR syntax error"
+}
+
+// flushdbCommand removes every key from the selected database.
+func flushdbCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	if msg := parseFlushMode(args); msg != "" {
+		return NewError(msg), nil
+	}
+	db.Flush()
+	ctx.Server.signalFlushedDBs(ctx.selectedIndex())
+	return NewSimpleString("OK"), nil
+}
+
+// flushallCommand removes every key from every database.
+func flushallCommand(ctx *CommandContext) (RESP, []byte) {
+	args := ctx.Args
+	if msg := parseFlushMode(args); msg != "" {
+		return NewError(msg), nil
+	}
+	dbs := ctx.Server.dbs
+	dbs.FlushAll()
+	indexes := make([]int, dbs.Count())
+	for index := range indexes {
+		indexes[index] = index
+	}
+	ctx.Server.signalFlushedDBs(indexes...)
+	return NewSimpleString("OK"), nil
+}
+
+// moveCommand implements MOVE key db, moving key from the selected database
+// to db. It replies 1 when the key was moved and 0 when it does not exist
+// or db already has it.
+func moveCommand(ctx *CommandContext) (RESP, []byte) {
+	key := ctx.Args[0].String
+	to, msg := parseDBIndex(ctx.Server.dbs, ctx.Args[1].String)
+	if msg != "" {
+		return NewError(msg), nil
+	}
+	state := ctx.Client
+	state.mu.RLock()
+	from := state.DB
+	state.mu.RUnlock()
+	if from == to {
+		return NewError(ErrSameObject.Error()), nil
+	}
+
+	dbs := ctx.Server.dbs
+	if !dbs.Move(key, from, to) {
+		return NewInteger(0), nil
+	}
+	notifyKeyspaceEvent(dbs.DB(from), notifyGeneric, "move_from", key)
+	notifyKeyspaceEvent(dbs.DB(to), notifyGeneric, "move_to", key)
+	ctx.Server.signalModifiedKeys(to, key)
+	ctx.markReady(to, key)
+	return NewInteger(1), nil
+}
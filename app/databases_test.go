@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSwapDBWakesBlockedClients(t *testing.T) {
+	s := startServer(t, nil)
+	blocked, c := dial(t, s), dial(t, s)
+
+	blocked.send("BLMPOP", "0", "1", "list", "LEFT")
+	waitBlocked(t, s, 1)
+
+	expectReply(t, c.do("SELECT", "1"), NewSimpleString("OK"))
+	expectReply(t, c.do("RPUSH", "list", "a", "b"), NewInteger(2))
+	waitBlocked(t, s, 1)
+
+	// db 1's list is now db 0's, under the key the client waits on.
+	expectReply(t, c.do("SWAPDB", "0", "1"), NewSimpleString("OK"))
+	expectReply(t, blocked.read(), NewArray([]RESP{NewBulkString("list"), NewArray([]RESP{NewBulkString("a")})}))
+	waitBlocked(t, s, 0)
+
+	expectReply(t, c.do("LRANGE", "list", "0", "-1"), NewArray([]RESP{}))
+	expectReply(t, c.do("SELECT", "0"), NewSimpleString("OK"))
+	expectReply(t, c.do("LRANGE", "list", "0", "-1"), NewArray([]RESP{NewBulkString("b")}))
+}
+
+func TestSwapDBInvalidatesWatches(t *testing.T) {
+	s := startServer(t, nil)
+	c, other := dial(t, s), dial(t, s)
+
+	expectReply(t, c.do("SELECT", "1"), NewSimpleString("OK"))
+	expectReply(t, c.do("WATCH", "k"), NewSimpleString("OK"))
+
+	// Neither database holds k, but every watch in a swapped database is
+	// invalidated.
+	expectReply(t, other.do("SWAPDB", "1", "2"), NewSimpleString("OK"))
+	expectReply(t, c.do("MULTI"), NewSimpleString("OK"))
+	expectReply(t, c.do("SET", "k", "v"), NewSimpleString("QUEUED"))
+	expectReply(t, c.do("EXEC"), NewNullArray())
+
+	// A swap of other databases leaves the watch alone.
+	expectReply(t, c.do("WATCH", "k"), NewSimpleString("OK"))
+	expectReply(t, other.do("SWAPDB", "0", "2"), NewSimpleString("OK"))
+	expectReply(t, c.do("MULTI"), NewSimpleString("OK"))
+	expectReply(t, c.do("SET", "k", "v"), NewSimpleString("QUEUED"))
+	expectReply(t, c.do("EXEC"), NewArray([]RESP{NewSimpleString("OK")}))
+}
+
+func TestSwapDBReplicates(t *testing.T) {
+	master := startServer(t, nil)
+	replica := startServer(t, func(o *ServerOptions) {
+		o.ReplicaOf = fmt.Sprintf("127.0.0.1 %d", master.Config().Port)
+	})
+	mc, rc := dial(t, master), dial(t, replica)
+
+	expectReply(t, mc.do("SET", "k", "zero"), NewSimpleString("OK"))
+	expectReply(t, mc.do("SWAPDB", "0", "1"), NewSimpleString("OK"))
+	expectReply(t, mc.do("SET", "k", "new zero"), NewSimpleString("OK"))
+
+	eventually(t, "the replica to apply the swap", func() bool {
+		rc.do("SELECT", "1")
+		if !sameReply(rc.do("GET", "k"), NewBulkString("zero")) {
+			return false
+		}
+		rc.do("SELECT", "0")
+		return sameReply(rc.do("GET", "k"), NewBulkString("new zero"))
+	})
+}
+
+// statsFields flattens a DBSTATS reply, in either protocol, into its fields.
+func statsFields(t *testing.T, reply RESP) map[string]RESP {
+	t.Helper()
+	if reply.Type != Map && reply.Type != Array || len(reply.Array)%2 != 0 {
+		t.Fatalf("DBSTATS replied %q", reply.Marshal())
+	}
+	fields := make(map[string]RESP)
+	for i := 0; i < len(reply.Array); i += 2 {
+		fields[reply.Array[i].String] = reply.Array[i+1]
+	}
+	return fields
+}
+
+func TestDBStats(t *testing.T) {
+	s := startServer(t, nil)
+	// The test runs the expiry cycle itself, on a clock of its own.
+	s.dbs.SetActiveExpire(false)
+	c := dial(t, s)
+
+	// db 0: two strings and a list, read twice with a hit and once with a miss.
+	c.do("SET", "a", "1")
+	c.do("SET", "b", "2")
+	c.do("RPUSH", "l", "x")
+	expectReply(t, c.do("CONFIG", "RESETSTAT"), NewSimpleString("OK"))
+	c.do("GET", "a")
+	c.do("LRANGE", "l", "0", "-1")
+	c.do("GET", "missing")
+	s.dbs.DB(0).Evict("b")
+
+	// db 1: one key about to expire, two with 1000s left and one without a TTL.
+	c.do("SELECT", "1")
+	c.do("SET", "x", "1", "PX", "100")
+	c.do("SET", "y", "1", "EX", "1000")
+	c.do("SET", "z", "1", "EX", "1000")
+	c.do("SADD", "s", "m")
+	s.dbs.activeExpireCycle([]*KeyValueStore{s.dbs.DB(1)}, time.Now().Add(time.Second))
+
+	db0 := statsFields(t, c.do("DBSTATS", "0"))
+	for name, want := range map[string]int{
+		"keys": 2, "expires": 0, "avg_ttl": 0, "expired_keys": 0, "evicted_keys": 1,
+		"keyspace_hits": 2, "keyspace_misses": 1,
+	} {
+		expectReply(t, db0[name], NewInteger(want))
+	}
+	expectReply(t, db0["kinds"], NewArray([]RESP{
+		NewBulkString("list"), NewInteger(1), NewBulkString("string"), NewInteger(1),
+	}))
+
+	db1 := statsFields(t, c.do("DBSTATS", "1"))
+	for name, want := range map[string]int{
+		"keys": 3, "expires": 2, "expired_keys": 1, "evicted_keys": 0, "keyspace_hits": 0, "keyspace_misses": 0,
+	} {
+		expectReply(t, db1[name], NewInteger(want))
+	}
+	if avg := db1["avg_ttl"].Number; avg < 998000 || avg > 999000 {
+		t.Fatalf("avg_ttl = %d, want about 999000 a second into 1000s TTLs", avg)
+	}
+	expectReply(t, db1["kinds"], NewArray([]RESP{NewBulkString("string"), NewInteger(2), NewBulkString("set"), NewInteger(1)}))
+	expectReply(t, c.do("DBSTATS", "99"), NewError(errDBIndexOutOfRange))
+
+	info := c.do("INFO", "keyspace").String
+	if !strings.Contains(info, "db0:keys=2,expires=0,avg_ttl=0\r\n") || !strings.Contains(info, "db1:keys=3,expires=2,avg_ttl=") {
+		t.Fatalf("INFO keyspace = %q", info)
+	}
+	expectReply(t, c.do("CONFIG", "SET", "keyspace-info-verbose", "yes"), NewSimpleString("OK"))
+	info = c.do("INFO", "keyspace").String
+	if !strings.Contains(info, "db0:keys=2,expires=0,avg_ttl=0,expired_keys=0,evicted_keys=1,keyspace_hits=2,keyspace_misses=1,used_memory=") {
+		t.Fatalf("verbose INFO keyspace = %q", info)
+	}
+
+	// RESETSTAT clears the counters but not what describes the data.
+	expectReply(t, c.do("CONFIG", "RESETSTAT"), NewSimpleString("OK"))
+	db1 = statsFields(t, c.do("DBSTATS", "1"))
+	for name, want := range map[string]int{"keys": 3, "expires": 2, "expired_keys": 0} {
+		expectReply(t, db1[name], NewInteger(want))
+	}
+	if avg := db1["avg_ttl"].Number; avg == 0 {
+		t.Fatal("RESETSTAT cleared avg_ttl")
+	}
+	if stats := c.do("INFO", "stats").String; !strings.Contains(stats, "expired_keys:0\r\n") {
+		t.Fatalf("INFO stats after RESETSTAT = %q", stats)
+	}
+}
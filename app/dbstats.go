@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// dbStats counts what happened to one database's keys, for INFO keyspace
+// and DBSTATS. The counters live in the store, so SWAPDB takes them along
+// with the data they describe. CONFIG RESETSTAT zeroes the counters as it
+// does the server-wide ones; avgTTL describes the data and is kept.
+type dbStats struct {
+	hits        atomic.Int64
+	misses      atomic.Int64
+	expiredKeys atomic.Int64
+	evictedKeys atomic.Int64
+	// avgTTL is a running average, in milliseconds, of the TTL left on the
+	// keys the expiry cycle samples. Only the sweeper writes it.
+	avgTTL atomic.Int64
+}
+
+// reset zeroes the counters CONFIG RESETSTAT clears.
+func (st *dbStats) reset() {
+	st.hits.Store(0)
+	st.misses.Store(0)
+	st.expiredKeys.Store(0)
+	st.evictedKeys.Store(0)
+}
+
+// sampleTTL folds the mean TTL in milliseconds of one expiry sample into
+// the running average the way Redis does, giving each sample a weight of 1/50.
+func (st *dbStats) sampleTTL(ms int64) {
+	if old := st.avgTTL.Load(); old != 0 {
+		ms = old/50*49 + ms/50
+	}
+	st.avgTTL.Store(ms)
+}
+
+// KindCounts returns how many live keys hold each type of value, by TYPE name.
+func (s *KeyValueStore) KindCounts() map[string]int {
+	now := time.Now()
+	kinds := make(map[string]int)
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for key, value := range sh.data {
+			if expiry, ok := sh.expiryMap[key]; ok && now.After(expiry) {
+				continue
+			}
+			kinds[typeName(value)]++
+		}
+		sh.mu.RUnlock()
+	}
+	return kinds
+}
+
+// ResetStats zeroes every database's counters.
+func (d *Databases) ResetStats() {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, db := range d.dbs {
+		db.stats.reset()
+	}
+}
+
+// keyspaceLine renders a database's INFO keyspace line, or "" when it holds
+// no keys. verbose adds the counters DBSTATS reports.
+func keyspaceLine(index int, db *KeyValueStore, verbose bool) string {
+	keys, expires := db.Stats()
+	if keys == 0 {
+		return ""
+	}
+	line := fmt.Sprintf("db%d:keys=%d,expires=%d,avg_ttl=%d", index, keys, expires, db.stats.avgTTL.Load())
+	if verbose {
+		line += fmt.Sprintf(",expired_keys=%d,evicted_keys=%d,keyspace_hits=%d,keyspace_misses=%d,used_memory=%d",
+			db.stats.expiredKeys.Load(), db.stats.evictedKeys.Load(), db.stats.hits.Load(), db.stats.misses.Load(), db.UsedMemory())
+	}
+	return line + "\r\n"
+}
+
+// dbstatsCommand implements DBSTATS db, the full breakdown of one database:
+// its INFO keyspace fields and counters, and how many keys hold each type
+// of value, most common first.
+func dbstatsCommand(ctx *CommandContext) (RESP, []byte) {
+	index, msg := parseDBIndex(ctx.Server.dbs, ctx.Args[0].String)
+	if msg != "" {
+		return NewError(msg), nil
+	}
+	db := ctx.Server.dbs.DB(index)
+	keys, expires := db.Stats()
+
+	counts := db.KindCounts()
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Slice(kinds, func(i, j int) bool {
+		if counts[kinds[i]] != counts[kinds[j]] {
+			return counts[kinds[i]] > counts[kinds[j]]
+		}
+		return kinds[i] < kinds[j]
+	})
+	var kindPairs []RESP
+	for _, kind := range kinds {
+		kindPairs = append(kindPairs, NewBulkString(kind), NewInteger(counts[kind]))
+	}
+
+	field := func(name string, n int64) []RESP {
+		return []RESP{NewBulkString(name), NewInteger(int(n))}
+	}
+	var pairs []RESP
+	pairs = append(pairs, field("keys", int64(keys))...)
+	pairs = append(pairs, field("expires", int64(expires))...)
+	pairs = append(pairs, field("avg_ttl", db.stats.avgTTL.Load())...)
+	pairs = append(pairs, field("expired_keys", db.stats.expiredKeys.Load())...)
+	pairs = append(pairs, field("evicted_keys", db.stats.evictedKeys.Load())...)
+	pairs = append(pairs, field("keyspace_hits", db.stats.hits.Load())...)
+	pairs = append(pairs, field("keyspace_misses", db.stats.misses.Load())...)
+	pairs = append(pairs, field("used_memory", db.UsedMemory())...)
+	pairs = append(pairs, NewBulkString("kinds"), NewMap(kindPairs))
+	return NewMap(pairs), nil
+}
+
+// keyspaceInfo renders one line per non-empty database.
+func (s *Server) keyspaceInfo() string {
+	var builder strings.Builder
+	builder.WriteString("# Keyspace\r\n")
+	dbs := s.dbs
+	verbose := s.Config().KeyspaceInfoVerbose
+	for i := 0; i < dbs.Count(); i++ {
+		builder.WriteString(keyspaceLine(i, dbs.DB(i), verbose))
+	}
+	return builder.String()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errDebugNotAllowed is returned when enable-debug-command does not let
+// the connection run DEBUG.
+const errDebugNotAllowed = "ERR DEBUG command not allowed. If the enable-debug-command option is set to \"local\", you can run it from a local connection, otherwise you need to set this option in the configuration file, and then restart the server."
+
+// debugAllowed reports whether enable-debug-command lets the client run
+// DEBUG: always for "yes", never for "no", and only over loopback or a Unix
+// socket for "local".
+func debugAllowed(ctx *CommandContext) bool {
+	conn := ctx.Conn
+	switch ctx.Config.EnableDebugCommand {
+	case "yes":
+		return true
+	case "local":
+		if isUnixConn(conn) {
+			return true
+		}
+		host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			return false
+		}
+		ip := net.ParseIP(host)
+		return ip != nil && ip.IsLoopback()
+	default:
+		return false
+	}
+}
+
+// debugCommand handles DEBUG subcommands used for testing and recovery drills.
+func debugCommand(ctx *CommandContext) (RESP, []byte) {
+	if !debugAllowed(ctx) {
+		return NewError(errDebugNotAllowed), nil
+	}
+	sub := strings.ToUpper(ctx.Args[0].String)
+	switch sub {
+	case "CHANGE-REPL-ID":
+		// A restored or otherwise rewritten dataset must not let replicas
+		// continue from a history it no longer matches.
+		ctx.Server.repl.resetReplID()
+		return NewSimpleString("OK"), nil
+	case "DIAGNOSTICS":
+		// The snapshot goes to the log as well so it survives the client disconnecting.
+		snapshot := ctx.Server.buildDiagnostics()
+		ctx.Server.logDiagnostics("DEBUG DIAGNOSTICS")
+		return NewBulkString(snapshot), nil
+	case "SLEEP":
+		if len(ctx.Args) != 2 {
+			return NewError("ERR wrong number of arguments for 'debug|sleep' command"), nil
+		}
+		return debugSleep(ctx.Args[1].String), nil
+	case "OBJECT":
+		if len(ctx.Args) != 2 {
+			return NewError("ERR wrong number of arguments for 'debug|object' command"), nil
+		}
+		return debugObject(ctx.DB, ctx.Args[1].String), nil
+	case "SET-ACTIVE-EXPIRE":
+		if len(ctx.Args) != 2 || (ctx.Args[1].String != "0" && ctx.Args[1].String != "1") {
+			return NewError("ERR DEBUG SET-ACTIVE-EXPIRE takes 0 or 1"), nil
+		}
+		ctx.Server.dbs.SetActiveExpire(ctx.Args[1].String == "1")
+		return NewSimpleString("OK"), nil
+	}
+	return NewError("ERR unknown subcommand '" + sub + "'. Try DEBUG CHANGE-REPL-ID, DIAGNOSTICS, SLEEP, OBJECT or SET-ACTIVE-EXPIRE"), nil
+}
+
+// debugSleep blocks only the calling connection for the given number of
+// seconds, which may be fractional.
+func debugSleep(arg string) RESP {
+	seconds, err := strconv.ParseFloat(arg, 64)
+	if err != nil || seconds < 0 || math.IsInf(seconds, 0) || math.IsNaN(seconds) {
+		return NewError("ERR value is not a valid float")
+	}
+	time.Sleep(time.Duration(seconds * float64(time.Second)))
+	return NewSimpleString("OK")
+}
+
+// debugObject describes key the way Redis's DEBUG OBJECT does, adding its
+// remaining TTL in milliseconds (-1 when it has none). Like OBJECT, it does
+// not count as accessing the key.
+func debugObject(db *KeyValueStore, key string) RESP {
+	info, ok := db.DebugObject(key)
+	if !ok {
+		return NewError("ERR no such key")
+	}
+	return NewSimpleString(fmt.Sprintf("Value at:0x0 refcount:1 encoding:%s serializedlength:%d lru_seconds_idle:%d ttl:%d",
+		info.encoding, info.serializedLength, int(info.idle.Seconds()), info.ttl.Milliseconds()))
+}
+
+// debugObjectInfo is what DEBUG OBJECT reports about a key.
+type debugObjectInfo struct {
+	encoding         string
+	serializedLength int
+	idle             time.Duration
+	ttl              time.Duration // -1ms when the key has no expiry
+}
+
+// DebugObject inspects key without touching it.
+func (s *KeyValueStore) DebugObject(key string) (debugObjectInfo, bool) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	value, exists := s.peekLocked(key)
+	if !exists {
+		return debugObjectInfo{}, false
+	}
+	info := debugObjectInfo{
+		encoding:         objectEncoding(value),
+		serializedLength: serializedLength(value),
+		ttl:              -time.Millisecond,
+	}
+	if accessed, ok := s.lastAccess.Load(key); ok {
+		info.idle = time.Since(accessed.(time.Time))
+	}
+	if expiry, ok := sh.expiryMap[key]; ok {
+		info.ttl = time.Until(expiry)
+	}
+	return info, true
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// diagnosticsBlockedMinutes is how long a goroutine must have been
+	// waiting before its stack is included. The runtime only reports waits
+	// in whole minutes, so this is the finest useful threshold.
+	diagnosticsBlockedMinutes = 1
+	// diagnosticsMaxStacks caps how many goroutine stacks one dump contains.
+	diagnosticsMaxStacks = 20
+)
+
+var goroutineWaitPattern = regexp.MustCompile(`, (\d+) minutes\]:`)
+
+// buildDiagnostics assembles a one-shot snapshot of server state for the log.
+// The SIGUSR1 handler, DEBUG DIAGNOSTICS and the command panic handler all
+// share it, so it only reads from existing introspection sources and never
+// blocks on anything a misbehaving command might hold for long.
+func (s *Server) buildDiagnostics() string {
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("# Diagnostics %s\r\n", time.Now().Format(time.RFC3339)))
+	writeGoroutineDiagnostics(&builder)
+	s.writeClientDiagnostics(&builder)
+	s.writeReplicationDiagnostics(&builder)
+	s.writeStoreDiagnostics(&builder)
+	builder.WriteString(s.latency.Info())
+	builder.WriteString(s.statsInfo())
+	return builder.String()
+}
+
+// writeGoroutineDiagnostics reports the goroutine count and the stacks of long-blocked goroutines.
+func writeGoroutineDiagnostics(builder *strings.Builder) {
+	builder.WriteString("# Goroutines\r\n")
+	builder.WriteString(fmt.Sprintf("goroutines:%d\r\n", runtime.NumGoroutine()))
+
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	blocked := 0
+	for _, stack := range bytes.Split(buf, []byte("\n\n")) {
+		header, _, _ := bytes.Cut(stack, []byte("\n"))
+		match := goroutineWaitPattern.FindSubmatch(header)
+		if match == nil {
+			continue
+		}
+		if minutes, _ := strconv.Atoi(string(match[1])); minutes < diagnosticsBlockedMinutes {
+			continue
+		}
+		blocked++
+		if blocked <= diagnosticsMaxStacks {
+			builder.Write(bytes.TrimSpace(stack))
+			builder.WriteString("\r\n")
+		}
+	}
+	builder.WriteString(fmt.Sprintf("goroutines_blocked:%d\r\n", blocked))
+}
+
+// writeClientDiagnostics reports connections per mode and the longest-blocked client.
+func (s *Server) writeClientDiagnostics(builder *strings.Builder) {
+	builder.WriteString("# Clients\r\n")
+
+	counts := make(map[ConnMode]int)
+	s.clientStatesMu.RLock()
+	for _, state := range s.clientStates {
+		counts[state.Mode()]++
+	}
+	s.clientStatesMu.RUnlock()
+	for _, mode := range []ConnMode{ModeNormal, ModeMulti, ModeSubscribed, ModeReplicaLink, ModeMonitor} {
+		builder.WriteString(fmt.Sprintf("clients_%s:%d\r\n", mode, counts[mode]))
+	}
+
+	blocked := s.blocks.Blocked()
+	builder.WriteString(fmt.Sprintf("blocked_clients:%d\r\n", len(blocked)))
+	if len(blocked) > 0 {
+		oldest := blocked[0]
+		builder.WriteString(fmt.Sprintf("oldest_blocked:id=%d,cmd=%s,keys=%s,blocked_ms=%d\r\n",
+			oldest.ClientID, oldest.Cmd, strings.Join(oldest.Keys, " "), time.Since(oldest.Since).Milliseconds()))
+	}
+}
+
+// writeReplicationDiagnostics reports the role and per-replica offsets and lag.
+func (s *Server) writeReplicationDiagnostics(builder *strings.Builder) {
+	builder.WriteString("# Replication\r\n")
+	cfg := s.Config()
+	replID, replID2 := s.repl.GetReplID()
+	if cfg.IsReplica {
+		builder.WriteString(fmt.Sprintf("role:slave\r\nmaster_host:%s\r\nmaster_port:%d\r\nmaster_replid:%s\r\n%s\r\n",
+			cfg.MasterHost, cfg.MasterPort, replID, s.masterLink.Info()))
+		return
+	}
+
+	offset := s.repl.GetMasterOffset()
+	builder.WriteString(fmt.Sprintf("role:master\r\nmaster_replid:%s\r\nmaster_replid2:%s\r\nmaster_repl_offset:%d\r\n",
+		replID, replID2, offset))
+	for i, replica := range s.repl.GetReplicas() {
+		lastAck := "never"
+		if !replica.LastAckTime.IsZero() {
+			lastAck = strconv.FormatInt(time.Since(replica.LastAckTime).Milliseconds(), 10) + "ms"
+		}
+		builder.WriteString(fmt.Sprintf("slave%d:addr=%s,state=%s,offset=%d,lag_bytes=%d,last_ack=%s\r\n",
+			i, replica.Conn.RemoteAddr(), replica.SyncState, replica.Offset, offset-replica.Offset, lastAck))
+	}
+}
+
+// writeStoreDiagnostics reports the keyspace size and expiry index depth.
+func (s *Server) writeStoreDiagnostics(builder *strings.Builder) {
+	keys, expires := s.dbs.Stats()
+	builder.WriteString("# Store\r\n")
+	builder.WriteString(fmt.Sprintf("keys:%d\r\nexpires:%d\r\n", keys, expires))
+}
+
+// logDiagnostics writes a diagnostics snapshot to the server log.
+func (s *Server) logDiagnostics(reason string) {
+	logNotice("Diagnostics requested", "reason", reason, "snapshot", strings.ReplaceAll(s.buildDiagnostics(), "\r\n", "\n"))
+}
+
+// watchDiagnosticsSignal logs a diagnostics snapshot every time the process receives SIGUSR1.
+func (s *Server) watchDiagnosticsSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			s.logDiagnostics("SIGUSR1")
+		}
+	}()
+}
+
+// runHandler invokes a command handler, turning a panic into an error reply
+// so one bad command cannot take down the server.
+func runHandler(cmdName string, handler Handler, ctx *CommandContext) (response RESP, extraBytes []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			logWarning("Panic while executing command", "cmd", cmdName, "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+			if ctx.Config.DiagnosticsOnPanic {
+				ctx.Server.logDiagnostics("panic in " + cmdName)
+			}
+			response, extraBytes = NewError("ERR internal error while executing '"+strings.ToLower(cmdName)+"'"), nil
+		}
+	}()
+	return handler(ctx)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestDiagnostics builds a snapshot of a server with a client blocked on
+// XREAD and a replica link that never acknowledges the write, and checks each
+// section reports them.
+func TestDiagnostics(t *testing.T) {
+	s := startServer(t, nil)
+	link := psyncLink(t, s)
+	reader, writer := dial(t, s), dial(t, s)
+	expectReply(t, writer.do("SET", "k", "v"), NewSimpleString("OK"))
+	reader.send("XREAD", "BLOCK", "0", "STREAMS", "s", "$")
+	waitBlocked(t, s, 1)
+	id := s.blocks.Blocked()[0].ClientID
+	offset, acked := s.repl.GetMasterOffset(), s.repl.GetReplicas()[0].Offset
+
+	snapshot := s.buildDiagnostics()
+	for _, marker := range []string{
+		"# Goroutines\r\ngoroutines:",
+		"goroutines_blocked:0\r\n",
+		"# Clients\r\n",
+		"clients_normal:2\r\n",
+		"clients_replica-link:1\r\n",
+		"blocked_clients:1\r\n",
+		"oldest_blocked:id=" + strconv.FormatInt(id, 10) + ",cmd=",
+		",keys=s,",
+		"# Replication\r\nrole:master\r\n",
+		"master_repl_offset:" + strconv.FormatInt(offset, 10) + "\r\n",
+		"slave0:addr=" + link.conn.LocalAddr().String() + ",state=online,offset=",
+		",lag_bytes=" + strconv.FormatInt(offset-acked, 10) + ",last_ack=",
+		"# Store\r\nkeys:1\r\nexpires:0\r\n",
+		"# Stats\r\n",
+	} {
+		if !strings.Contains(snapshot, marker) {
+			t.Fatalf("diagnostics lack %q:\n%s", marker, snapshot)
+		}
+	}
+
+	// DEBUG DIAGNOSTICS returns the same snapshot.
+	reply := writer.do("DEBUG", "DIAGNOSTICS")
+	if reply.Type != BulkString || !strings.Contains(reply.String, "blocked_clients:1\r\n") {
+		t.Fatalf("DEBUG DIAGNOSTICS replied %q", reply.Marshal())
+	}
+}
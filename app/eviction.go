@@ -0,0 +1,243 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// evictionSamples is how many keys each database offers per eviction, as
+// Redis's maxmemory-samples default.
+const evictionSamples = 5
+
+// errOOM is returned for writes that could grow the dataset while it is
+// over maxmemory and nothing more can be evicted.
+const errOOM = "OOM command not allowed when used memory > 'maxmemory'."
+
+// oomAllowedWrites are writes that never grow the dataset, so they run even
+// when it is over maxmemory.
+var oomAllowedWrites = map[string]bool{
+	"DEL":      true,
+	"GETDEL":   true,
+	"HDEL":     true,
+	"SREM":     true,
+	"XTRIM":    true,
+	"LPOP":     true,
+	"RPOP":     true,
+	"LMPOP":    true,
+	"BLMPOP":   true,
+	"LREM":     true,
+	"LTRIM":    true,
+	"ZREM":     true,
+	"FLUSHDB":  true,
+	"FLUSHALL": true,
+	"SWAPDB":   true,
+	"MOVE":     true,
+	// These only read or adjust TTLs.
+	"GETEX":     true,
+	"EXPIRE":    true,
+	"PEXPIRE":   true,
+	"EXPIREAT":  true,
+	"PEXPIREAT": true,
+	"PERSIST":   true,
+}
+
+// valueSize approximates the bytes a value holds: string lengths only, with
+// no allowance for Go's per-object overhead.
+func valueSize(value interface{}) int64 {
+	switch v := value.(type) {
+	case string:
+		return int64(len(v))
+	case Hash:
+		var size int64
+		for field, val := range v {
+			size += int64(len(field) + len(val))
+		}
+		return size
+	case Set:
+		var size int64
+		for member := range v {
+			size += int64(len(member))
+		}
+		return size
+	case *List:
+		var size int64
+		for _, element := range v.Elements() {
+			size += int64(len(element))
+		}
+		return size
+	case *ZSet:
+		var size int64
+		for _, m := range v.Members() {
+			size += int64(len(m.Member) + zsetEntrySize)
+		}
+		return size
+	case *Stream:
+		return entriesSize(v.Entries)
+	default:
+		return 0
+	}
+}
+
+// entrySize approximates the bytes a stream entry holds.
+func entrySize(entry Entry) int64 {
+	size := int64(len(entry.ID))
+	for _, fv := range entry.Fields {
+		size += int64(len(fv.Field) + len(fv.Value))
+	}
+	return size
+}
+
+// entriesSize sums entrySize over entries.
+func entriesSize(entries []Entry) int64 {
+	var size int64
+	for _, entry := range entries {
+		size += entrySize(entry)
+	}
+	return size
+}
+
+// UsedMemory returns the approximate size of the keys held.
+func (s *KeyValueStore) UsedMemory() int64 {
+	return s.usedMemory.Load()
+}
+
+// evictionCandidate is a sampled key with what the policies rank it by.
+type evictionCandidate struct {
+	db         int
+	key        string
+	lastAccess time.Time
+	expiry     time.Time
+}
+
+// evictionSample returns up to n keys, or only keys with a TTL when
+// volatile is set. It starts at a random shard and map iteration starts at
+// a random position, so the sample differs from call to call; only one
+// shard is locked at a time.
+func (s *KeyValueStore) evictionSample(volatile bool, n int) []evictionCandidate {
+	var sample []evictionCandidate
+	start := rand.Intn(storeShards)
+	for i := 0; i < storeShards && len(sample) < n; i++ {
+		sh := s.shards[(start+i)%storeShards]
+		sh.mu.RLock()
+		add := func(key string) bool {
+			c := evictionCandidate{key: key, expiry: sh.expiryMap[key]}
+			if accessed, ok := s.lastAccess.Load(key); ok {
+				c.lastAccess = accessed.(time.Time)
+			}
+			sample = append(sample, c)
+			return len(sample) < n
+		}
+		if volatile {
+			for key := range sh.expiryMap {
+				if !add(key) {
+					break
+				}
+			}
+		} else {
+			for key := range sh.data {
+				if !add(key) {
+					break
+				}
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	return sample
+}
+
+// Evict removes key to free memory and raises the evicted notification. It
+// reports false when the key is already gone.
+func (s *KeyValueStore) Evict(key string) bool {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if _, exists := sh.data[key]; !exists {
+		return false
+	}
+	s.deleteLocked(key)
+	s.stats.evictedKeys.Add(1)
+	if s.server != nil {
+		s.server.tracking.Invalidate(key)
+	}
+	notifyKeyspaceEvent(s, notifyEvicted, "evicted", key)
+	return true
+}
+
+// UsedMemory sums the approximate size of every database.
+func (d *Databases) UsedMemory() int64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var used int64
+	for _, db := range d.dbs {
+		used += db.UsedMemory()
+	}
+	return used
+}
+
+// checkMaxMemory evicts keys until the dataset fits within maxmemory. It
+// returns the OOM error for a write that could grow the dataset when that
+// is not possible, or "" when the command may run. Replicas apply their
+// master's stream without this check and so never evict on their own.
+func (s *Server) checkMaxMemory(cmdName string) string {
+	cfg := s.Config()
+	if cfg.MaxMemory <= 0 || !s.registry.IsWriteCommand(cmdName) {
+		return ""
+	}
+	if s.freeMemory(cfg.MaxMemory, cfg.MaxMemoryPolicy) || oomAllowedWrites[cmdName] {
+		return ""
+	}
+	return errOOM
+}
+
+// freeMemory evicts keys under policy until the dataset is within limit,
+// reporting whether it got there.
+func (s *Server) freeMemory(limit int64, policy string) bool {
+	for s.dbs.UsedMemory() > limit {
+		if policy == "noeviction" || !s.evictOne(policy) {
+			return false
+		}
+	}
+	return true
+}
+
+// evictOne samples every database and evicts the best candidate for policy:
+// the least recently used key for the lru policies, the one closest to
+// expiring for volatile-ttl, or any sampled key for the random ones. It
+// reports false when there is nothing left to evict.
+func (s *Server) evictOne(policy string) bool {
+	dbs := s.dbs
+	volatile := strings.HasPrefix(policy, "volatile-")
+	var candidates []evictionCandidate
+	for i := 0; i < dbs.Count(); i++ {
+		for _, c := range dbs.DB(i).evictionSample(volatile, evictionSamples) {
+			c.db = i
+			candidates = append(candidates, c)
+		}
+	}
+	if len(candidates) == 0 {
+		return false
+	}
+
+	best := candidates[rand.Intn(len(candidates))]
+	for _, c := range candidates {
+		switch policy {
+		case "allkeys-lru", "volatile-lru":
+			if c.lastAccess.Before(best.lastAccess) {
+				best = c
+			}
+		case "volatile-ttl":
+			if c.expiry.Before(best.expiry) {
+				best = c
+			}
+		}
+	}
+
+	if dbs.DB(best.db).Evict(best.key) {
+		s.stats.KeyEvicted()
+		s.propagateDel(best.db, best.key)
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestEvictionUnderMaxMemory(t *testing.T) {
+	const keys, limit = 100, 20000
+	value := strings.Repeat("v", 1000)
+	for _, policy := range []string{"allkeys-lru", "allkeys-random"} {
+		t.Run(policy, func(t *testing.T) {
+			s := startServer(t, nil)
+			c, sub := dial(t, s), dial(t, s)
+			expectReply(t, c.do("CONFIG", "SET", "maxmemory", strconv.Itoa(limit)), NewSimpleString("OK"))
+			expectReply(t, c.do("CONFIG", "SET", "maxmemory-policy", policy), NewSimpleString("OK"))
+			expectReply(t, c.do("CONFIG", "SET", "notify-keyspace-events", "Ee"), NewSimpleString("OK"))
+			sub.send("SUBSCRIBE", "__keyevent@0__:evicted")
+			sub.read()
+
+			for i := 0; i < keys; i++ {
+				expectReply(t, c.do("SET", "k"+strconv.Itoa(i), value), NewSimpleString("OK"))
+				// Eviction runs before a write, so the dataset may
+				// exceed the limit by the one value just written.
+				if used := s.dbs.UsedMemory(); used > limit+int64(len(value))+8 {
+					t.Fatalf("used memory %d after SET k%d, maxmemory %d", used, i, limit)
+				}
+			}
+			expectReply(t, c.do("EXISTS", "k"+strconv.Itoa(keys-1)), NewInteger(1))
+			kept := c.do("DBSIZE").Number
+			if kept > limit/len(value)+1 {
+				t.Fatalf("%d keys kept, want at most %d", kept, limit/len(value)+1)
+			}
+			if policy == "allkeys-lru" {
+				// Each eviction takes the least recently used key it
+				// samples, so after eighty of them the oldest are gone.
+				for i := 0; i < 10; i++ {
+					expectReply(t, c.do("EXISTS", "k"+strconv.Itoa(i)), NewInteger(0))
+				}
+			}
+
+			evicted := keys - kept
+			if !strings.Contains(c.do("INFO", "stats").String, "evicted_keys:"+strconv.Itoa(evicted)+"\r\n") {
+				t.Fatalf("INFO stats does not report %d evicted keys", evicted)
+			}
+			for i := 0; i < evicted; i++ {
+				reply := sub.read()
+				if len(reply.Array) != 3 || reply.Array[1].String != "__keyevent@0__:evicted" {
+					t.Fatalf("subscriber got %q, want an evicted event", reply.Marshal())
+				}
+			}
+		})
+	}
+}
+
+func TestEvictionNoeviction(t *testing.T) {
+	s := startServer(t, nil)
+	c := dial(t, s)
+	expectReply(t, c.do("CONFIG", "SET", "maxmemory", "5000"), NewSimpleString("OK"))
+	value := strings.Repeat("v", 1000)
+	for i := 0; i < 5; i++ {
+		expectReply(t, c.do("SET", "k"+strconv.Itoa(i), value), NewSimpleString("OK"))
+	}
+	expectReply(t, c.do("SET", "k5", value), NewError(errOOM))
+	expectReply(t, c.do("DBSIZE"), NewInteger(5))
+	// A write that frees memory still runs, and makes room for the next.
+	expectReply(t, c.do("DEL", "k0", "k1"), NewInteger(2))
+	expectReply(t, c.do("SET", "k5", value), NewSimpleString("OK"))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// expireCommand implements EXPIRE key seconds [NX|XX|GT|LT] and its
+// variants: PEXPIRE when unit is time.Millisecond, and EXPIREAT and
+// PEXPIREAT when absolute is set, taking a Unix timestamp instead. A
+// deadline that has already passed deletes the key. Whatever the form, the
+// change replicates as PEXPIREAT at the absolute deadline, or as DEL, and a
+// change the flags refused replicates nothing. GETEX replicates TTL changes
+// as PEXPIREAT too.
+func expireCommand(cmd string, unit time.Duration, absolute bool) Handler {
+	return func(ctx *CommandContext) (RESP, []byte) {
+		db, key := ctx.DB, ctx.Args[0].String
+		n, err := strconv.ParseInt(ctx.Args[1].String, 10, 64)
+		if err != nil {
+			return NewError("ERR value is not an integer or out of range"), nil
+		}
+		cond, msg := parseExpireCondition(ctx.Args[2:])
+		if msg != "" {
+			return NewError(msg), nil
+		}
+		ms, ok := expireMillis(n, unit, absolute)
+		if !ok {
+			return NewError("ERR invalid expire time in '" + cmd + "' command"), nil
+		}
+
+		at := time.UnixMilli(ms)
+		applied, deleted := db.ExpireAt(key, at, cond)
+		switch {
+		case !applied:
+			ctx.suppressPropagation()
+			return NewInteger(0), nil
+		case deleted:
+			notifyKeyspaceEvent(db, notifyGeneric, "del", key)
+			ctx.rewritePropagation(NewArray([]RESP{NewBulkString("DEL"), NewBulkString(key)}))
+		default:
+			notifyKeyspaceEvent(db, notifyGeneric, "expire", key)
+			ctx.rewritePropagation(NewArray([]RESP{
+				NewBulkString("PEXPIREAT"), NewBulkString(key), NewBulkString(strconv.FormatInt(ms, 10)),
+			}))
+		}
+		return NewInteger(1), nil
+	}
+}
+
+// expireMillis converts an EXPIRE-style argument n, counted in unit and
+// relative to now unless absolute, into a Unix time in milliseconds. It
+// reports false when that overflows, as Redis does.
+func expireMillis(n int64, unit time.Duration, absolute bool) (int64, bool) {
+	perUnit := int64(unit / time.Millisecond)
+	if n > math.MaxInt64/perUnit || n < math.MinInt64/perUnit {
+		return 0, false
+	}
+	ms := n * perUnit
+	if absolute {
+		return ms, true
+	}
+	now := time.Now().UnixMilli()
+	if ms > math.MaxInt64-now {
+		return 0, false
+	}
+	return ms + now, true
+}
+
+// parseExpireCondition parses the NX, XX, GT and LT flags following an
+// EXPIRE-style deadline, returning Redis's error message for an unknown
+// flag or a combination that can never hold.
+func parseExpireCondition(args []RESP) (ExpireCondition, string) {
+	var cond ExpireCondition
+	for _, arg := range args {
+		switch strings.ToUpper(arg.String) {
+		case "NX":
+			cond |= ExpireNX
+		case "XX":
+			cond |= ExpireXX
+		case "GT":
+			cond |= ExpireGT
+		case "LT":
+			cond |= ExpireLT
+		default:
+			return 0, "ERR Unsupported option " + arg.String
+		}
+	}
+	if cond&ExpireNX != 0 && cond&(ExpireXX|ExpireGT|ExpireLT) != 0 {
+		return 0, "ERR NX and XX, GT or LT options at the same time are not compatible"
+	}
+	if cond&ExpireGT != 0 && cond&ExpireLT != 0 {
+		return 0, "ERR GT and LT options at the same time are not compatible"
+	}
+	return cond, ""
+}
+
+// persistCommand removes a key's TTL, returning 1 if it had one.
+func persistCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	if !db.Persist(args[0].String) {
+		return NewInteger(0), nil
+	}
+	notifyKeyspaceEvent(db, notifyGeneric, "persist", args[0].String)
+	return NewInteger(1), nil
+}
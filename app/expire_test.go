@@ -0,0 +1,141 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpireConditions(t *testing.T) {
+	const (
+		errNX   = "ERR NX and XX, GT or LT options at the same time are not compatible"
+		errGTLT = "ERR GT and LT options at the same time are not compatible"
+	)
+	// The key starts with no TTL, or with 100s; the new TTL is 50s
+	// (shorter) or 200s (longer). A key without a TTL counts as never
+	// expiring, so GT never applies to it and LT always does.
+	tests := []struct {
+		flags string
+		err   string
+		want  [3]int // replies with no TTL, a shorter one and a longer one
+	}{
+		{"", "", [3]int{1, 1, 1}},
+		{"NX", "", [3]int{1, 0, 0}},
+		{"XX", "", [3]int{0, 1, 1}},
+		{"GT", "", [3]int{0, 0, 1}},
+		{"LT", "", [3]int{1, 1, 0}},
+		{"XX GT", "", [3]int{0, 0, 1}},
+		{"XX LT", "", [3]int{0, 1, 0}},
+		{"NX XX", errNX, [3]int{}},
+		{"NX GT", errNX, [3]int{}},
+		{"NX LT", errNX, [3]int{}},
+		{"GT LT", errGTLT, [3]int{}},
+		{"NX XX GT", errNX, [3]int{}},
+		{"NX XX LT", errNX, [3]int{}},
+		{"NX GT LT", errNX, [3]int{}},
+		{"XX GT LT", errGTLT, [3]int{}},
+		{"NX XX GT LT", errNX, [3]int{}},
+	}
+	seen := map[string]bool{}
+	for _, tt := range tests {
+		seen[tt.flags] = true
+	}
+	if len(seen) != 16 {
+		t.Fatalf("the table has %d flag combinations, want all 16", len(seen))
+	}
+
+	expire := expireCommand("expire", time.Second, false)
+	cases := []struct {
+		name    string
+		current time.Duration // 0 for no TTL
+		ttl     time.Duration
+	}{
+		{"no TTL", 0, 50 * time.Second},
+		{"shorter", 100 * time.Second, 50 * time.Second},
+		{"longer", 100 * time.Second, 200 * time.Second},
+	}
+	for _, tt := range tests {
+		for i, c := range cases {
+			t.Run(tt.flags+"/"+c.name, func(t *testing.T) {
+				db := NewKeyValueStore()
+				if c.current > 0 {
+					db.SetWithExpiry("k", "v", c.current)
+				} else {
+					db.SetValue("k", "v")
+				}
+				seconds := strconv.Itoa(int(c.ttl / time.Second))
+				args := append([]string{"k", seconds}, strings.Fields(tt.flags)...)
+				reply, _ := expire(testContext(db, args...))
+				if tt.err != "" {
+					expectReply(t, reply, NewError(tt.err))
+					return
+				}
+				expectReply(t, reply, NewInteger(tt.want[i]))
+
+				info, _ := db.DebugObject("k")
+				want := c.current
+				if tt.want[i] == 1 {
+					want = c.ttl
+				}
+				if want == 0 {
+					if info.ttl != -time.Millisecond {
+						t.Fatalf("TTL = %v, want none", info.ttl)
+					}
+				} else if info.ttl > want || info.ttl < want-time.Second {
+					t.Fatalf("TTL = %v, want about %v", info.ttl, want)
+				}
+			})
+		}
+	}
+}
+
+func TestExpireFlagsMissingKeyAndCase(t *testing.T) {
+	expire := expireCommand("expire", time.Second, false)
+	db := NewKeyValueStore()
+
+	reply, _ := expire(testContext(db, "missing", "10"))
+	expectReply(t, reply, NewInteger(0))
+
+	db.SetWithExpiry("k", "v", 100*time.Second)
+	reply, _ = expire(testContext(db, "k", "200", "xx", "gt"))
+	expectReply(t, reply, NewInteger(1))
+	reply, _ = expire(testContext(db, "k", "10", "SOON"))
+	expectReply(t, reply, NewError("ERR Unsupported option SOON"))
+}
+
+func TestExpiryOverflow(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler Handler
+		args    []string
+		want    RESP
+	}{
+		{"SETEX", setexCommand("setex", time.Second), []string{"k", "10000000000", "v"}, NewError("ERR invalid expire time in 'setex' command")},
+		{"SETEX", setexCommand("setex", time.Second), []string{"k", "9223372036854775807", "v"}, NewError("ERR invalid expire time in 'setex' command")},
+		{"PSETEX", setexCommand("psetex", time.Millisecond), []string{"k", "9223372036854775807", "v"}, NewError("ERR invalid expire time in 'psetex' command")},
+		{"SETEX", setexCommand("setex", time.Second), []string{"k", "100", "v"}, NewSimpleString("OK")},
+		{"GETEX", getexCommand, []string{"k", "EX", "10000000000"}, NewError("ERR invalid expire time in 'getex' command")},
+		{"GETEX", getexCommand, []string{"k", "PX", "9223372036854775807"}, NewError("ERR invalid expire time in 'getex' command")},
+		{"GETEX", getexCommand, []string{"k", "EXAT", "9223372036854775807"}, NewError("ERR invalid expire time in 'getex' command")},
+		{"GETEX", getexCommand, []string{"k", "EX", "100"}, NewBulkString("v")},
+		{"SET", setCommand, []string{"k", "v", "EX", "10000000000"}, NewError("ERR invalid expire time in 'set' command")},
+		{"SET", setCommand, []string{"k", "v", "EX", "9223372036854775807"}, NewError("ERR invalid expire time in 'set' command")},
+		{"SET", setCommand, []string{"k", "v", "PX", "9223372036854775807"}, NewError("ERR invalid expire time in 'set' command")},
+		{"SET", setCommand, []string{"k", "v", "EXAT", "9223372036854775807"}, NewError("ERR invalid expire time in 'set' command")},
+		{"SET", setCommand, []string{"k", "v", "EX", "100"}, NewSimpleString("OK")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+" "+strings.Join(tt.args, " "), func(t *testing.T) {
+			db := NewKeyValueStore()
+			db.SetValue("k", "v")
+			reply, _ := tt.handler(testContext(db, tt.args...))
+			expectReply(t, reply, tt.want)
+			if ttl := ttlOf(t, db, "k"); tt.want.Type == Error && ttl != -time.Millisecond {
+				t.Fatalf("a refused expiry left a TTL of %v", ttl)
+			} else if tt.want.Type != Error && (ttl > 100*time.Second || ttl < 99*time.Second) {
+				t.Fatalf("TTL = %v, want about 100s", ttl)
+			}
+		})
+	}
+}
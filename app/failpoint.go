@@ -0,0 +1,112 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Named synchronization points in concurrency-sensitive code paths. Tests
+// attach hooks to them to force a specific interleaving deterministically.
+const (
+	fpAfterStoreSetBeforePropagate = "after-store-set-before-propagate"
+	fpBeforePsyncAddReplica        = "before-psync-add-replica"
+	fpReplicaSendBulk              = "replica-send-bulk"
+	fpExecBeforePropagate          = "exec-before-propagate"
+	fpBeforeReplicaSend            = "before-replica-send"
+	fpBeforeRemoveReplica          = "before-remove-replica"
+	fpWaitAfterGetAck              = "wait-after-getack"
+	fpBeforeReplicaAckSend         = "before-replica-ack-send"
+	fpReplicaAfterRDB              = "replica-after-rdb"
+	fpReplicaBeforeApply           = "replica-before-apply"
+	fpBeforeServeReadyKeys         = "before-serve-ready-keys"
+	fpNotifyBeforeDeliver          = "notify-before-deliver"
+	fpAfterRegisterBlockedClient   = "after-register-blocked-client"
+	fpBlockingReadBeforeSelect     = "blocking-read-before-select"
+	fpBeforeRemoveClientState      = "before-remove-client-state"
+	fpExpireCycle                  = "expire-cycle"
+	fpAOFRewriteEntry              = "aof-rewrite-entry"
+)
+
+var (
+	failpointsActive atomic.Int32
+	failpointMu      sync.RWMutex
+	failpointHooks   = make(map[string]func())
+)
+
+// failpoint runs the hook attached to name, if any. With nothing attached it
+// costs a single atomic load and branch.
+func failpoint(name string) {
+	if failpointsActive.Load() == 0 {
+		return
+	}
+	failpointMu.RLock()
+	hook := failpointHooks[name]
+	failpointMu.RUnlock()
+	if hook != nil {
+		hook()
+	}
+}
+
+// EnableFailpoint attaches hook to the named point, replacing any previous hook.
+func EnableFailpoint(name string, hook func()) {
+	failpointMu.Lock()
+	defer failpointMu.Unlock()
+	if _, exists := failpointHooks[name]; !exists {
+		failpointsActive.Add(1)
+	}
+	failpointHooks[name] = hook
+}
+
+// DisableFailpoint detaches any hook from the named point.
+func DisableFailpoint(name string) {
+	failpointMu.Lock()
+	defer failpointMu.Unlock()
+	if _, exists := failpointHooks[name]; exists {
+		delete(failpointHooks, name)
+		failpointsActive.Add(-1)
+	}
+}
+
+// FailpointLatch parks every goroutine reaching a failpoint until released.
+type FailpointLatch struct {
+	name        string
+	reached     chan struct{}
+	release     chan struct{}
+	releaseOnce sync.Once
+}
+
+// LatchFailpoint attaches a latch to the named point.
+func LatchFailpoint(name string) *FailpointLatch {
+	latch := &FailpointLatch{
+		name:    name,
+		reached: make(chan struct{}, 64),
+		release: make(chan struct{}),
+	}
+	EnableFailpoint(name, func() {
+		select {
+		case latch.reached <- struct{}{}:
+		default:
+		}
+		<-latch.release
+	})
+	return latch
+}
+
+// WaitReached blocks until a goroutine hits the point or the timeout elapses.
+func (l *FailpointLatch) WaitReached(timeout time.Duration) bool {
+	select {
+	case <-l.reached:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Release detaches the latch and resumes every parked goroutine.
+func (l *FailpointLatch) Release() {
+	l.releaseOnce.Do(func() {
+		DisableFailpoint(l.name)
+		close(l.release)
+	})
+}
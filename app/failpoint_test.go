@@ -0,0 +1,366 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// latch attaches a latch to the named failpoint for the rest of the test.
+// Failpoints are process-wide, so it is always released on the way out.
+func latch(t *testing.T, name string) *FailpointLatch {
+	t.Helper()
+	l := LatchFailpoint(name)
+	t.Cleanup(l.Release)
+	return l
+}
+
+// reach waits for a goroutine to park at l.
+func reach(t *testing.T, l *FailpointLatch) {
+	t.Helper()
+	if !l.WaitReached(5 * time.Second) {
+		t.Fatalf("nothing reached failpoint %s", l.name)
+	}
+}
+
+func TestFailpointAfterRegisterBlockedClient(t *testing.T) {
+	s := startServer(t, nil)
+	blocked, writer := dial(t, s), dial(t, s)
+
+	// The push lands after the waiter registered but before it waits; the
+	// wake-up must not be lost.
+	l := latch(t, fpAfterRegisterBlockedClient)
+	blocked.send("BLMPOP", "0", "1", "k", "LEFT")
+	reach(t, l)
+	expectReply(t, writer.do("RPUSH", "k", "v"), NewInteger(1))
+	l.Release()
+	expectReply(t, blocked.read(), popped("k", "v"))
+}
+
+func TestFailpointBlockingReadBeforeSelect(t *testing.T) {
+	s := startServer(t, nil)
+	reader, writer := dial(t, s), dial(t, s)
+
+	// By the time the reader selects, its timeout has fired and it has
+	// also been served; the entry wins.
+	l := latch(t, fpBlockingReadBeforeSelect)
+	reader.send("XREAD", "BLOCK", "10", "STREAMS", "s", "$")
+	reach(t, l)
+	time.Sleep(30 * time.Millisecond)
+	id := writer.do("XADD", "s", "*", "f", "v").String
+	l.Release()
+	reply := reader.read()
+	if reply.Type != Array || len(reply.Array) != 1 || reply.Array[0].Array[1].Array[0].Array[0].String != id {
+		t.Fatalf("XREAD replied %q, want entry %s", reply.Marshal(), id)
+	}
+}
+
+func TestFailpointNotifyBeforeDeliver(t *testing.T) {
+	s := startServer(t, nil)
+	reader, writer := dial(t, s), dial(t, s)
+
+	reader.send("XREAD", "BLOCK", "50", "STREAMS", "s", "$")
+	waitBlocked(t, s, 1)
+
+	// The writer finds the reader ready and parks before delivering; the
+	// reader's timeout fires meanwhile and must still get the entry.
+	l := latch(t, fpNotifyBeforeDeliver)
+	writer.send("XADD", "s", "1-1", "f", "v")
+	reach(t, l)
+	time.Sleep(100 * time.Millisecond)
+	l.Release()
+	expectReply(t, writer.read(), NewBulkString("1-1"))
+	reply := reader.read()
+	if reply.Type != Array || len(reply.Array) != 1 {
+		t.Fatalf("XREAD replied %q after a concurrent timeout, want the entry", reply.Marshal())
+	}
+}
+
+func TestFailpointBeforeServeReadyKeys(t *testing.T) {
+	s := startServer(t, nil)
+	blocked, writer, observer := dial(t, s), dial(t, s), dial(t, s)
+	blocked.send("BLMPOP", "0", "1", "k", "LEFT")
+	waitBlocked(t, s, 1)
+
+	// The push is stored and propagated but nobody has been served yet.
+	l := latch(t, fpBeforeServeReadyKeys)
+	writer.send("RPUSH", "k", "v")
+	reach(t, l)
+	expectReply(t, observer.do("LLEN", "k"), NewInteger(1))
+	blocked.expectNoReply(50 * time.Millisecond)
+	l.Release()
+
+	expectReply(t, writer.read(), NewInteger(1))
+	expectReply(t, blocked.read(), popped("k", "v"))
+	expectReply(t, observer.do("LLEN", "k"), NewInteger(0))
+}
+
+func TestFailpointAfterStoreSetBeforePropagate(t *testing.T) {
+	master := startServer(t, nil)
+	replica := startReplica(t, master)
+	blocked, writer, rc := dial(t, master), dial(t, master), dial(t, replica)
+	blocked.send("BLMPOP", "0", "1", "k", "LEFT")
+	waitBlocked(t, master, 1)
+
+	// A blocked client is only served once the push that fed it has been
+	// propagated, so replicas never see the pop before the push.
+	l := latch(t, fpAfterStoreSetBeforePropagate)
+	writer.send("RPUSH", "k", "a", "b")
+	reach(t, l)
+	blocked.expectNoReply(50 * time.Millisecond)
+	l.Release()
+
+	expectReply(t, writer.read(), NewInteger(2))
+	expectReply(t, blocked.read(), popped("k", "a"))
+	eventually(t, "the replica to apply the push and the pop", func() bool {
+		return sameReply(rc.do("LRANGE", "k", "0", "-1"), NewArray([]RESP{NewBulkString("b")}))
+	})
+}
+
+func TestFailpointExecBeforePropagate(t *testing.T) {
+	s := startServer(t, nil)
+	blocked, c := dial(t, s), dial(t, s)
+	blocked.send("BLMPOP", "0", "1", "k", "LEFT")
+	waitBlocked(t, s, 1)
+
+	// Keys a transaction makes ready are served when it has finished.
+	l := latch(t, fpExecBeforePropagate)
+	expectReply(t, c.do("MULTI"), NewSimpleString("OK"))
+	expectReply(t, c.do("RPUSH", "k", "v"), NewSimpleString("QUEUED"))
+	c.send("EXEC")
+	reach(t, l)
+	blocked.expectNoReply(50 * time.Millisecond)
+	l.Release()
+
+	expectReply(t, c.read(), NewArray([]RESP{NewInteger(1)}))
+	expectReply(t, blocked.read(), popped("k", "v"))
+}
+
+func TestFailpointBeforePsyncAddReplica(t *testing.T) {
+	master := startServer(t, nil)
+	mc := dial(t, master)
+	expectReply(t, mc.do("SET", "before", "1"), NewSimpleString("OK"))
+
+	// A write made while the snapshot is taken waits for the replica to be
+	// registered, so it is neither in the snapshot nor lost.
+	l := latch(t, fpBeforePsyncAddReplica)
+	replica := startServer(t, func(o *ServerOptions) {
+		o.ReplicaOf = "127.0.0.1 " + strconv.Itoa(master.Config().Port)
+	})
+	reach(t, l)
+	mc.send("SET", "during", "1")
+	mc.expectNoReply(50 * time.Millisecond)
+	l.Release()
+	expectReply(t, mc.read(), NewSimpleString("OK"))
+
+	rc := dial(t, replica)
+	eventually(t, "the replica to have both keys", func() bool {
+		return sameReply(rc.do("EXISTS", "before", "during"), NewInteger(2))
+	})
+}
+
+func TestFailpointReplicaSendBulk(t *testing.T) {
+	master := startServer(t, nil)
+	mc := dial(t, master)
+
+	// Writes while the snapshot is on its way are queued for the replica
+	// without holding up the client.
+	l := latch(t, fpReplicaSendBulk)
+	replica := startServer(t, func(o *ServerOptions) {
+		o.ReplicaOf = "127.0.0.1 " + strconv.Itoa(master.Config().Port)
+	})
+	reach(t, l)
+	for i := 0; i < 10; i++ {
+		expectReply(t, mc.do("INCR", "n"), NewInteger(i+1))
+	}
+	l.Release()
+
+	rc := dial(t, replica)
+	eventually(t, "the replica to apply the queued writes", func() bool {
+		return sameReply(rc.do("GET", "n"), NewBulkString("10"))
+	})
+}
+
+func TestFailpointReplicaAfterRDB(t *testing.T) {
+	master := startServer(t, nil)
+	mc := dial(t, master)
+	expectReply(t, mc.do("SET", "k", "snapshot"), NewSimpleString("OK"))
+
+	// The replica has loaded the snapshot but not started on the stream.
+	l := latch(t, fpReplicaAfterRDB)
+	replica := startServer(t, func(o *ServerOptions) {
+		o.ReplicaOf = "127.0.0.1 " + strconv.Itoa(master.Config().Port)
+	})
+	reach(t, l)
+	rc := dial(t, replica)
+	expectReply(t, rc.do("GET", "k"), NewBulkString("snapshot"))
+	expectReply(t, mc.do("SET", "k", "stream"), NewSimpleString("OK"))
+	l.Release()
+
+	eventually(t, "the replica to apply the write made during the load", func() bool {
+		return sameReply(rc.do("GET", "k"), NewBulkString("stream"))
+	})
+}
+
+func TestFailpointReplicaBeforeApply(t *testing.T) {
+	master := startServer(t, nil)
+	replica := startReplica(t, master)
+	mc, rc := dial(t, master), dial(t, replica)
+
+	l := latch(t, fpReplicaBeforeApply)
+	expectReply(t, mc.do("SET", "k", "v"), NewSimpleString("OK"))
+	reach(t, l)
+	expectReply(t, rc.do("GET", "k"), NewNullBulkString())
+	l.Release()
+
+	eventually(t, "the replica to apply the write", func() bool {
+		return sameReply(rc.do("GET", "k"), NewBulkString("v"))
+	})
+}
+
+func TestFailpointBeforeReplicaAckSend(t *testing.T) {
+	master := startServer(t, nil)
+	replica := startReplica(t, master)
+	mc, rc := dial(t, master), dial(t, replica)
+
+	// The replica answers GETACK from its stream loop, so writes behind the
+	// GETACK wait for the ACK to go out.
+	l := latch(t, fpBeforeReplicaAckSend)
+	expectReply(t, mc.do("SET", "a", "1"), NewSimpleString("OK"))
+	mc.send("WAIT", "1", "0")
+	reach(t, l)
+	other := dial(t, master)
+	expectReply(t, other.do("SET", "b", "1"), NewSimpleString("OK"))
+	expectReply(t, rc.do("EXISTS", "b"), NewInteger(0))
+	l.Release()
+
+	expectReply(t, mc.read(), NewInteger(1))
+	eventually(t, "the replica to apply the write behind the GETACK", func() bool {
+		return sameReply(rc.do("EXISTS", "b"), NewInteger(1))
+	})
+}
+
+func TestFailpointWaitAfterGetAck(t *testing.T) {
+	master := startServer(t, nil)
+	startReplica(t, master)
+	mc := dial(t, master)
+	expectReply(t, mc.do("SET", "k", "v"), NewSimpleString("OK"))
+
+	// The ACK arrives before WAIT starts waiting for it, and still counts.
+	l := latch(t, fpWaitAfterGetAck)
+	mc.send("WAIT", "1", "5000")
+	reach(t, l)
+	eventually(t, "the replica to acknowledge", func() bool {
+		return master.repl.GetAcknowledgedReplicaCount(master.repl.GetMasterOffset()) == 1
+	})
+	start := time.Now()
+	l.Release()
+	expectReply(t, mc.read(), NewInteger(1))
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("WAIT took %v to see an ACK that had already arrived", elapsed)
+	}
+}
+
+func TestFailpointBeforeReplicaSend(t *testing.T) {
+	master := startServer(t, nil)
+	mc := dial(t, master)
+
+	// A replica that connects while a write is between the store and the
+	// stream gets the write exactly once.
+	l := latch(t, fpBeforeReplicaSend)
+	mc.send("INCR", "n")
+	reach(t, l)
+	replica := startServer(t, func(o *ServerOptions) {
+		o.ReplicaOf = "127.0.0.1 " + strconv.Itoa(master.Config().Port)
+	})
+	time.Sleep(50 * time.Millisecond)
+	l.Release()
+	expectReply(t, mc.read(), NewInteger(1))
+
+	rc := dial(t, replica)
+	eventually(t, "the replica to sync", func() bool {
+		return sameReply(rc.do("GET", "n"), NewBulkString("1"))
+	})
+	expectReply(t, mc.do("INCR", "n"), NewInteger(2))
+	eventually(t, "the replica to apply the next write", func() bool {
+		return sameReply(rc.do("GET", "n"), NewBulkString("2"))
+	})
+}
+
+func TestFailpointBeforeRemoveReplica(t *testing.T) {
+	master := startServer(t, nil)
+	replica := startReplica(t, master)
+	mc := dial(t, master)
+
+	// Writes keep flowing while a departed replica is being removed.
+	l := latch(t, fpBeforeRemoveReplica)
+	expectReply(t, dial(t, replica).do("REPLICAOF", "NO", "ONE"), NewSimpleString("OK"))
+	reach(t, l)
+	for i := 0; i < 100; i++ {
+		expectReply(t, mc.do("INCR", "n"), NewInteger(i+1))
+	}
+	l.Release()
+	eventually(t, "the master to drop the replica", func() bool { return master.repl.GetReplicaCount() == 0 })
+}
+
+func TestFailpointBeforeRemoveClientState(t *testing.T) {
+	s := startServer(t, nil)
+	c, admin := dial(t, s), dial(t, s)
+	expectReply(t, c.do("CLIENT", "SETNAME", "leaving"), NewSimpleString("OK"))
+
+	// Introspection keeps working while a closed connection is torn down.
+	l := latch(t, fpBeforeRemoveClientState)
+	c.conn.Close()
+	reach(t, l)
+	if reply := admin.do("CLIENT", "LIST"); reply.Type != BulkString {
+		t.Fatalf("CLIENT LIST replied %q", reply.Marshal())
+	}
+	l.Release()
+	eventually(t, "the closed client to leave CLIENT LIST", func() bool {
+		return !strings.Contains(admin.do("CLIENT", "LIST").String, "name=leaving")
+	})
+}
+
+func TestFailpointExpireCycle(t *testing.T) {
+	s := startServer(t, nil)
+	c := dial(t, s)
+
+	// With the active cycle held up, an expired key is still gone for
+	// readers; the cycle reclaims it once it runs.
+	l := latch(t, fpExpireCycle)
+	reach(t, l)
+	expectReply(t, c.do("SET", "k", "v", "PX", "10"), NewSimpleString("OK"))
+	expectReply(t, c.do("SET", "other", "v", "PX", "10"), NewSimpleString("OK"))
+	time.Sleep(30 * time.Millisecond)
+	expectReply(t, c.do("GET", "k"), NewNullBulkString())
+	expectReply(t, c.do("DBSIZE"), NewInteger(0))
+	// GET reclaimed k; other is expired but still stored.
+	if keys, _ := s.dbs.DB(0).Stats(); keys != 1 {
+		t.Fatalf("%d keys stored while the cycle is held, want 1", keys)
+	}
+	l.Release()
+	eventually(t, "the expiry cycle to reclaim the other key", func() bool {
+		keys, _ := s.dbs.DB(0).Stats()
+		return keys == 0
+	})
+}
+
+// BenchmarkFailpoint measures the cost of a failpoint call on the paths it
+// sits on: with nothing attached anywhere, as in production, and with a
+// hook attached to some other point.
+func BenchmarkFailpoint(b *testing.B) {
+	b.Run("disabled", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			failpoint(fpBeforeReplicaSend)
+		}
+	})
+	b.Run("other-enabled", func(b *testing.B) {
+		EnableFailpoint(fpExpireCycle, func() {})
+		defer DisableFailpoint(fpExpireCycle)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			failpoint(fpBeforeReplicaSend)
+		}
+	})
+}
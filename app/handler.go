@@ -1,66 +1,192 @@
 package main
 
 import (
+    "bytes"
+    "errors"
     "fmt"
-    "net"
+    "math"
     "strconv"
     "strings"
-    "sync"
     "time"
 )
 
 // Handler implements a command with arguments and connection context.
-type Handler func(args []RESP, conn net.Conn) (RESP, []byte)
+type Handler func(ctx *CommandContext) (RESP, []byte)
 
 // Registry stores command handlers and their write semantics.
 type Registry struct {
-    commands   map[string]Handler
-    isWriteCmd map[string]bool
+    commands    map[string]Handler
+    isWriteCmd  map[string]bool
+    arity       map[string]arityRange
+    // subcommands holds what RegisterSubcommands registered, for HELP.
+    subcommands map[string][]Subcommand
 }
 
-// adaptHandler wraps a stateless handler to the Handler signature.
-func adaptHandler(fn func(args []RESP) (RESP, []byte)) Handler {
-    return func(args []RESP, conn net.Conn) (RESP, []byte) {
-        return fn(args)
-    }
+// arityRange bounds how many arguments a command takes after its name; a
+// max of -1 means variadic.
+type arityRange struct {
+	min int
+	max int
 }
 
-// NewRegistry creates a command registry with all handlers registered.
-func NewRegistry() *Registry {
+// NewRegistry creates a command registry with all handlers registered. A
+// minimal registry leaves out the admin and debugging commands.
+func NewRegistry(minimal bool) *Registry {
     r := &Registry{
-        commands:   make(map[string]Handler),
-        isWriteCmd: make(map[string]bool),
+        commands:    make(map[string]Handler),
+        isWriteCmd:  make(map[string]bool),
+        arity:       make(map[string]arityRange),
+        subcommands: make(map[string][]Subcommand),
     }
-    r.registerCommands()
+    r.registerCommands(minimal)
     return r
 }
 
-func (r *Registry) registerCommands() {
-    r.Register("PING", adaptHandler(pingCommand), false)
-    r.Register("ECHO", adaptHandler(echoCommand), false)
-    r.Register("SET", adaptHandler(setCommand), true)
-    r.Register("GET", adaptHandler(getCommand), false)
-    r.Register("CONFIG", adaptHandler(configCommand), false)
-    r.Register("KEYS", adaptHandler(keysCommand), false)
-    r.Register("INFO", adaptHandler(infoCommand), false)
-    r.Register("REPLCONF", adaptHandler(replconfCommand), false)
-    r.Register("PSYNC", adaptHandler(psyncCommand), false)
-    r.Register("WAIT", adaptHandler(waitCommand), false)
-    r.Register("TYPE", adaptHandler(typeCommand), false)
-    r.Register("XADD", adaptHandler(xaddCommand), true)
-    r.Register("XRANGE", adaptHandler(xrangeCommand), false)
-    r.Register("XREAD", adaptHandler(xreadCommand), false)
-    r.Register("INCR", adaptHandler(incrCommand), true)
-    r.Register("MULTI", multiCommand, true)
-    r.Register("EXEC", execCommand, true)
-    r.Register("DISCARD", discardCommand, false)
-}
-
-// Register adds a handler to the registry.
-func (r *Registry) Register(name string, handler Handler, isWrite bool) {
+func (r *Registry) registerCommands(minimal bool) {
+    r.Register("PING", pingCommand, false, 0, 1)
+    r.Register("ECHO", echoCommand, false, 1, 1)
+    r.Register("QUIT", quitCommand, false, 0, -1)
+    r.Register("LOLWUT", lolwutCommand, false, 0, -1)
+    r.Register("SET", setCommand, true, 2, -1)
+    r.Register("GET", getCommand, false, 1, 1)
+    r.RegisterSubcommands("CONFIG", false, configSubcommands)
+    r.Register("KEYS", keysCommand, false, 1, 1)
+    r.Register("EXISTS", existsCommand, false, 1, -1)
+    r.Register("DEL", delCommand, true, 1, -1)
+    r.Register("DBSIZE", dbsizeCommand, false, 0, 0)
+    r.Register("DBSTATS", dbstatsCommand, false, 1, 1)
+    r.Register("RANDOMKEY", randomkeyCommand, false, 0, 0)
+    r.Register("INFO", infoCommand, false, 0, -1)
+    r.RegisterSubcommands("REPLCONF", false, replconfSubcommands)
+    r.Register("PSYNC", psyncCommand, false, 2, 2)
+    r.Register("WAIT", waitCommand, false, 2, 2)
+    r.Register("TYPE", typeCommand, false, 1, 1)
+    r.Register("OBJECT", objectCommand, false, 1, 2)
+    r.Register("XADD", xaddCommand, true, 4, -1)
+    r.Register("XTRIM", xtrimCommand, true, 3, -1)
+    r.Register("XRANGE", xrangeCommand, false, 3, 5)
+    r.Register("XREVRANGE", xrevrangeCommand, false, 3, 5)
+    r.Register("XREAD", xreadCommand, false, 3, -1)
+    r.Register("INCR", incrCommand, true, 1, 1)
+    r.Register("INCRBY", incrbyCommand, true, 2, 2)
+    r.Register("DECR", decrCommand, true, 1, 1)
+    r.Register("DECRBY", decrbyCommand, true, 2, 2)
+    r.Register("INCRBYFLOAT", incrbyfloatCommand, true, 2, 2)
+    r.Register("GETSET", getsetCommand, true, 2, 2)
+    r.Register("GETDEL", getdelCommand, true, 1, 1)
+    r.Register("COPY", copyCommand, true, 2, 5)
+    r.Register("SETEX", setexCommand("setex", time.Second), true, 3, 3)
+    r.Register("PSETEX", setexCommand("psetex", time.Millisecond), true, 3, 3)
+    r.Register("SETNX", setnxCommand, true, 2, 2)
+    r.Register("GETEX", getexCommand, true, 1, -1)
+    r.Register("EXPIRE", expireCommand("expire", time.Second, false), true, 2, -1)
+    r.Register("PEXPIRE", expireCommand("pexpire", time.Millisecond, false), true, 2, -1)
+    r.Register("EXPIREAT", expireCommand("expireat", time.Second, true), true, 2, -1)
+    r.Register("PEXPIREAT", expireCommand("pexpireat", time.Millisecond, true), true, 2, -1)
+    r.Register("PERSIST", persistCommand, true, 1, 1)
+    r.Register("APPEND", appendCommand, true, 2, 2)
+    r.Register("STRLEN", strlenCommand, false, 1, 1)
+    r.Register("SETRANGE", setrangeCommand, true, 3, 3)
+    r.Register("GETRANGE", getrangeCommand, false, 3, 3)
+    r.Register("HSET", hsetCommand, true, 3, -1)
+    r.Register("HGET", hgetCommand, false, 2, 2)
+    r.Register("HGETALL", hgetallCommand, false, 1, 1)
+    r.Register("HDEL", hdelCommand, true, 2, -1)
+    r.Register("HEXISTS", hexistsCommand, false, 2, 2)
+    r.Register("HSETNX", hsetnxCommand, true, 3, 3)
+    r.Register("HINCRBY", hincrbyCommand, true, 3, 3)
+    r.Register("HINCRBYFLOAT", hincrbyfloatCommand, true, 3, 3)
+    r.Register("HMGET", hmgetCommand, false, 2, -1)
+    r.Register("HLEN", hlenCommand, false, 1, 1)
+    r.Register("HKEYS", hkeysCommand, false, 1, 1)
+    r.Register("HVALS", hvalsCommand, false, 1, 1)
+    r.Register("HRANDFIELD", hrandfieldCommand, false, 1, 3)
+    r.Register("SADD", saddCommand, true, 2, -1)
+    r.Register("SREM", sremCommand, true, 2, -1)
+    r.Register("SMEMBERS", smembersCommand, false, 1, 1)
+    r.Register("SISMEMBER", sismemberCommand, false, 2, 2)
+    r.Register("SCARD", scardCommand, false, 1, 1)
+    r.Register("SINTER", setCombineCommand(setInter), false, 1, -1)
+    r.Register("SINTERCARD", sintercardCommand, false, 2, -1)
+    r.Register("SUNION", setCombineCommand(setUnion), false, 1, -1)
+    r.Register("SDIFF", setCombineCommand(setDiff), false, 1, -1)
+    r.Register("SINTERSTORE", setCombineStoreCommand(setInter), true, 2, -1)
+    r.Register("SUNIONSTORE", setCombineStoreCommand(setUnion), true, 2, -1)
+    r.Register("SDIFFSTORE", setCombineStoreCommand(setDiff), true, 2, -1)
+    r.Register("LPUSH", pushCommand(true, "lpush"), true, 2, -1)
+    r.Register("RPUSH", pushCommand(false, "rpush"), true, 2, -1)
+    r.Register("LPOP", popCommand(true, "lpop"), true, 1, 2)
+    r.Register("RPOP", popCommand(false, "rpop"), true, 1, 2)
+    r.Register("LLEN", llenCommand, false, 1, 1)
+    r.Register("LRANGE", lrangeCommand, false, 3, 3)
+    r.Register("LINDEX", lindexCommand, false, 2, 2)
+    r.Register("LSET", lsetCommand, true, 3, 3)
+    r.Register("LINSERT", linsertCommand, true, 4, 4)
+    r.Register("LREM", lremCommand, true, 3, 3)
+    r.Register("LTRIM", ltrimCommand, true, 3, 3)
+    r.Register("LPOS", lposCommand, false, 2, -1)
+    r.Register("LMPOP", lmpopCommand, true, 2, -1)
+    r.Register("BLMPOP", blmpopCommand, true, 3, -1)
+    r.Register("ZADD", zaddCommand, true, 3, -1)
+    r.Register("ZSCORE", zscoreCommand, false, 2, 2)
+    r.Register("ZCARD", zcardCommand, false, 1, 1)
+    r.Register("ZREM", zremCommand, true, 2, -1)
+    r.Register("ZRANGE", zrangeCommand, false, 3, -1)
+    r.Register("ZRANGEBYSCORE", zrangebyscoreCommand, false, 3, -1)
+    r.Register("ZRANGESTORE", zrangestoreCommand, true, 4, -1)
+    r.Register("MULTI", multiCommand, false, 0, 0)
+    r.Register("EXEC", execCommand, false, 0, 0)
+    r.Register("DISCARD", discardCommand, false, 0, 0)
+    r.Register("WATCH", watchCommand, false, 1, -1)
+    r.Register("UNWATCH", unwatchCommand, false, 0, 0)
+    r.Register("RESET", resetCommand, false, 0, 0)
+    r.Register("EVAL", evalCommand, false, 2, -1)
+    r.Register("EVALSHA", evalshaCommand, false, 2, -1)
+    r.Register("SCRIPT", scriptCommand, false, 1, -1)
+    r.Register("SUBSCRIBE", subscribeCommand, false, 1, -1)
+    r.Register("UNSUBSCRIBE", unsubscribeCommand, false, 0, -1)
+    r.Register("PSUBSCRIBE", psubscribeCommand, false, 1, -1)
+    r.Register("PUNSUBSCRIBE", punsubscribeCommand, false, 0, -1)
+    r.Register("PUBLISH", publishCommand, false, 2, 2)
+    r.Register("PUBSUB", pubsubCommand, false, 1, -1)
+    r.RegisterSubcommands("CLIENT", false, clientSubcommands)
+    r.Register("HELLO", helloCommand, false, 0, -1)
+    r.Register("AUTH", authCommand, false, 1, 2)
+    r.Register("READONLY", readonlyCommand, false, 0, 2)
+    r.Register("READWRITE", readwriteCommand, false, 0, 0)
+    r.Register("COMMAND", commandCommand, false, 0, -1)
+    r.Register("SELECT", selectCommand, false, 1, 1)
+    r.Register("SWAPDB", swapdbCommand, true, 2, 2)
+    r.Register("MOVE", moveCommand, true, 2, 2)
+    r.Register("FLUSHDB", flushdbCommand, true, 0, 1)
+    r.Register("FLUSHALL", flushallCommand, true, 0, 1)
+    r.Register("SAVE", saveCommand, false, 0, 0)
+    r.Register("BGSAVE", bgsaveCommand, false, 0, 0)
+    r.Register("BGREWRITEAOF", bgrewriteaofCommand, false, 0, 0)
+    r.Register("SHUTDOWN", shutdownCommand, false, 0, 1)
+    r.Register("MONITOR", monitorCommand, false, 0, 0)
+    r.Register("SLOWLOG", slowlogCommand, false, 1, 2)
+    r.Register("LASTSAVE", lastsaveCommand, false, 0, 0)
+    r.Register("REPLICAOF", replicaofCommand, false, 2, 2)
+    r.Register("SLAVEOF", replicaofCommand, false, 2, 2)
+    r.Register("RL.LIMIT", rlLimitCommand, true, 4, 4)
+    r.Register("RL.SLIDING", rlSlidingCommand, true, 3, 3)
+
+    // Admin and debugging commands are left out of --minimal servers.
+    if !minimal {
+        r.Register("HOTKEYS", hotkeysCommand, false, 0, 2)
+        r.Register("DEBUG", debugCommand, false, 1, -1)
+    }
+}
+
+// Register adds a handler to the registry. minArgs and maxArgs bound the
+// arguments after the command name; maxArgs -1 means variadic. Calls outside
+// the bounds are rejected before the handler runs.
+func (r *Registry) Register(name string, handler Handler, isWrite bool, minArgs, maxArgs int) {
     name = strings.ToUpper(name)
     r.commands[name] = handler
     r.isWriteCmd[name] = isWrite
+    r.arity[name] = arityRange{min: minArgs, max: maxArgs}
 }
 
 // Get looks up a handler by name.
@@ -69,211 +195,811 @@ func (r *Registry) Get(name string) (Handler, bool) {
     return handler, ok
 }
 
+// Arity returns a command's arity in the Redis convention COMMAND reports: it
+// counts the command name, and -N means at least N. A bounded range that is
+// not exact is reported by its minimum.
+func (r *Registry) Arity(name string) int {
+    bounds := r.arity[strings.ToUpper(name)]
+    if bounds.max == bounds.min {
+        return bounds.min + 1
+    }
+    return -(bounds.min + 1)
+}
+
+// CheckArity returns the error for calling a command with argc arguments
+// after its name, or "" when the count is in range.
+func (r *Registry) CheckArity(name string, argc int) string {
+    bounds := r.arity[strings.ToUpper(name)]
+    if argc < bounds.min || (bounds.max >= 0 && argc > bounds.max) {
+        return fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name))
+    }
+    return ""
+}
+
 // IsWriteCommand reports whether a command mutates state.
 func (r *Registry) IsWriteCommand(name string) bool {
     return r.isWriteCmd[strings.ToUpper(name)]
 }
 
-// pingCommand replies with PONG or echoes an argument.
-func pingCommand(args []RESP) (RESP, []byte) {
+// keySpec describes where key arguments sit in a command's argument list.
+// Positions are zero-based after the command name; a negative last counts from the end.
+type keySpec struct {
+	first int
+	last  int
+	step  int
+}
+
+// commandKeySpecs gives the key positions of commands whose keys sit at
+// fixed offsets; GetKeys handles the rest.
+var commandKeySpecs = map[string]keySpec{
+	"SET":           {0, 0, 1},
+	"GET":           {0, 0, 1},
+	"TYPE":          {0, 0, 1},
+	"OBJECT":        {1, 1, 1},
+	"EXISTS":        {0, -1, 1},
+	"WATCH":         {0, -1, 1},
+	"DEL":           {0, -1, 1},
+	"XADD":          {0, 0, 1},
+	"XTRIM":         {0, 0, 1},
+	"RL.LIMIT":      {0, 0, 1},
+	"RL.SLIDING":    {0, 0, 1},
+	"XRANGE":        {0, 0, 1},
+	"XREVRANGE":     {0, 0, 1},
+	"INCR":          {0, 0, 1},
+	"INCRBY":        {0, 0, 1},
+	"DECR":          {0, 0, 1},
+	"DECRBY":        {0, 0, 1},
+	"INCRBYFLOAT":   {0, 0, 1},
+	"GETSET":        {0, 0, 1},
+	"GETDEL":        {0, 0, 1},
+	"COPY":          {0, 1, 1},
+	"MOVE":          {0, 0, 1},
+	"SETEX":         {0, 0, 1},
+	"PSETEX":        {0, 0, 1},
+	"SETNX":         {0, 0, 1},
+	"GETEX":         {0, 0, 1},
+	"EXPIRE":        {0, 0, 1},
+	"PEXPIRE":       {0, 0, 1},
+	"EXPIREAT":      {0, 0, 1},
+	"PEXPIREAT":     {0, 0, 1},
+	"PERSIST":       {0, 0, 1},
+	"APPEND":        {0, 0, 1},
+	"STRLEN":        {0, 0, 1},
+	"SETRANGE":      {0, 0, 1},
+	"GETRANGE":      {0, 0, 1},
+	"HSET":          {0, 0, 1},
+	"HGET":          {0, 0, 1},
+	"HGETALL":       {0, 0, 1},
+	"HDEL":          {0, 0, 1},
+	"HEXISTS":       {0, 0, 1},
+	"HSETNX":        {0, 0, 1},
+	"HINCRBY":       {0, 0, 1},
+	"HINCRBYFLOAT":  {0, 0, 1},
+	"HMGET":         {0, 0, 1},
+	"HLEN":          {0, 0, 1},
+	"HKEYS":         {0, 0, 1},
+	"HVALS":         {0, 0, 1},
+	"HRANDFIELD":    {0, 0, 1},
+	"SADD":          {0, 0, 1},
+	"SREM":          {0, 0, 1},
+	"SMEMBERS":      {0, 0, 1},
+	"SISMEMBER":     {0, 0, 1},
+	"SCARD":         {0, 0, 1},
+	"SINTER":        {0, -1, 1},
+	"SUNION":        {0, -1, 1},
+	"SDIFF":         {0, -1, 1},
+	"SINTERSTORE":   {0, -1, 1},
+	"SUNIONSTORE":   {0, -1, 1},
+	"SDIFFSTORE":    {0, -1, 1},
+	"LPUSH":         {0, 0, 1},
+	"RPUSH":         {0, 0, 1},
+	"LPOP":          {0, 0, 1},
+	"RPOP":          {0, 0, 1},
+	"LLEN":          {0, 0, 1},
+	"LRANGE":        {0, 0, 1},
+	"LINDEX":        {0, 0, 1},
+	"LSET":          {0, 0, 1},
+	"LINSERT":       {0, 0, 1},
+	"LREM":          {0, 0, 1},
+	"LTRIM":         {0, 0, 1},
+	"LPOS":          {0, 0, 1},
+	"ZADD":          {0, 0, 1},
+	"ZSCORE":        {0, 0, 1},
+	"ZCARD":         {0, 0, 1},
+	"ZREM":          {0, 0, 1},
+	"ZRANGE":        {0, 0, 1},
+	"ZRANGEBYSCORE": {0, 0, 1},
+	"ZRANGESTORE":   {0, 1, 1},
+}
+
+// GetKeys extracts the key arguments of a command.
+func (r *Registry) GetKeys(name string, args []RESP) []string {
+	name = strings.ToUpper(name)
+	switch name {
+	case "XREAD":
+		return xreadKeys(args)
+	case "EVAL", "EVALSHA":
+		return evalKeys(args)
+	case "LMPOP", "SINTERCARD":
+		return mpopKeys(args)
+	case "BLMPOP":
+		if len(args) == 0 {
+			return nil
+		}
+		return mpopKeys(args[1:])
+	}
+
+	spec, ok := commandKeySpecs[name]
+	if !ok || spec.first >= len(args) {
+		return nil
+	}
+	last := spec.last
+	if last < 0 {
+		last = len(args) + last
+	}
+	if last >= len(args) {
+		last = len(args) - 1
+	}
+
+	var keys []string
+	for i := spec.first; i <= last; i += spec.step {
+		keys = append(keys, args[i].String)
+	}
+	return keys
+}
+
+// xreadKeys returns the stream names following the STREAMS keyword.
+func xreadKeys(args []RESP) []string {
+	for i, arg := range args {
+		if strings.ToUpper(arg.String) == "STREAMS" {
+			rest := args[i+1:]
+			return argStrings(rest[:len(rest)/2])
+		}
+	}
+	return nil
+}
+
+// pingCommand replies with PONG or echoes an argument. A RESP2 subscriber
+// gets ["pong", argument] instead, shaped like the messages it is reading,
+// with "" when there is no argument.
+func pingCommand(ctx *CommandContext) (RESP, []byte) {
+    args := ctx.Args
+    if ctx.Client.Mode() == ModeSubscribed && ctx.Client.Proto() == RESP2 {
+        message := ""
+        if len(args) > 0 {
+            message = args[0].String
+        }
+        return NewArray([]RESP{NewBulkString("pong"), NewBulkString(message)}), nil
+    }
     if len(args) == 0 {
         return NewSimpleString("PONG"), nil
     }
     return NewBulkString(args[0].String), nil
 }
 
-// echoCommand replies with the provided bulk string.
-func echoCommand(args []RESP) (RESP, []byte) {
-    if len(args) == 0 {
-        return NewError("ERR wrong number of arguments for 'echo' command"), nil
+// quitCommand replies OK and has handleClient hang up once the reply is
+// written. Arguments are ignored, as in Redis.
+func quitCommand(ctx *CommandContext) (RESP, []byte) {
+    ctx.Client.mu.Lock()
+    ctx.Client.closeAfterReply = true
+    ctx.Client.mu.Unlock()
+    return NewSimpleString("OK"), nil
+}
+
+// lolwutCommand implements LOLWUT [VERSION version]. There is no artwork,
+// only the line Redis ends every version's output with.
+func lolwutCommand(ctx *CommandContext) (RESP, []byte) {
+	args := ctx.Args
+    if len(args) >= 2 && strings.EqualFold(args[0].String, "VERSION") {
+        if _, err := strconv.Atoi(args[1].String); err != nil {
+            return NewError(ErrNotInteger.Error()), nil
+        }
     }
+    return NewBulkString("Redis ver. " + ServerVersion + "\n"), nil
+}
+
+// echoCommand replies with the provided bulk string.
+func echoCommand(ctx *CommandContext) (RESP, []byte) {
+	args := ctx.Args
     return NewBulkString(args[0].String), nil
 }
 
-// setCommand assigns a key to a string with options NX/XX and EX/PX.
-func setCommand(args []RESP) (RESP, []byte) {
-    if len(args) < 2 {
-        return NewError("ERR wrong number of arguments for 'set' command"), nil
-    }
+// setCommand assigns a key to a string with options NX/XX, GET, KEEPTTL and
+// EX/PX/EXAT/PXAT. With GET it replies with the previous value, even when
+// NX or XX stops the write. A relative EX or PX replicates as PXAT so
+// replicas expire the key at the master's deadline rather than their own,
+// and a write NX or XX stopped replicates nothing.
+func setCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
 	key := args[0].String
 	value := args[1].String
-	expiry := time.Duration(0)
-	var nx, xx bool
+	var opts SetOptions
+	var expirySet, relative bool
 	for i := 2; i < len(args); i++ {
 		option := strings.ToUpper(args[i].String)
 		switch option {
-		case "PX":
-			if i+1 >= len(args) {
+		case "EX", "PX", "EXAT", "PXAT":
+			if expirySet || opts.KeepTTL || i+1 >= len(args) {
 				return NewError("ERR syntax error"), nil
 			}
-			ms, err := strconv.ParseInt(args[i+1].String, 10, 64)
-			if err != nil || ms <= 0 {
-				return NewError("ERR value is not an integer or out of range"), nil
+			unit := time.Second
+			if option[0] == 'P' {
+				unit = time.Millisecond
 			}
-			expiry = time.Duration(ms) * time.Millisecond
+			relative = !strings.HasSuffix(option, "AT")
+			var msg string
+			if opts.ExpireAt, msg = parseExpiry(args[i+1].String, "set", unit, !relative); msg != "" {
+				return NewError(msg), nil
+			}
+			expirySet = true
 			i++
-		case "EX":
-			if i+1 >= len(args) {
+		case "KEEPTTL":
+			if expirySet {
 				return NewError("ERR syntax error"), nil
 			}
-			seconds, err := strconv.ParseInt(args[i+1].String, 10, 64)
-			if err != nil || seconds <= 0 {
-				return NewError("ERR value is not an integer or out of range"), nil
-			}
-			expiry = time.Duration(seconds) * time.Second
-			i++
+			opts.KeepTTL = true
 		case "NX":
-			nx = true
-			if xx {
+			if opts.Condition == SetIfExists {
 				return NewError("ERR syntax error"), nil
 			}
+			opts.Condition = SetIfAbsent
 		case "XX":
-			xx = true
-			if nx {
+			if opts.Condition == SetIfAbsent {
 				return NewError("ERR syntax error"), nil
 			}
+			opts.Condition = SetIfExists
+		case "GET":
+			opts.Get = true
 		default:
 			return NewError("ERR syntax error"), nil
 		}
 	}
-	if nx {
-		if GetStore().Exists(key) {
-			return NewNullBulkString(), nil
-		}
-	} else if xx {
-		if !GetStore().Exists(key) {
-			return NewNullBulkString(), nil
+
+	old, existed, stored, err := db.SetWithOptions(key, value, opts)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	switch {
+	case !stored:
+		ctx.suppressPropagation()
+	case relative:
+		ctx.rewritePropagation(setPXATCommand(key, value, opts.ExpireAt))
+	}
+	if stored {
+		notifyKeyspaceEvent(db, notifyString, "set", key)
+		if expirySet {
+			notifyKeyspaceEvent(db, notifyGeneric, "expire", key)
 		}
 	}
-    GetStore().Set(key, value, expiry)
-    return NewSimpleString("OK"), nil
+	switch {
+	case opts.Get && existed:
+		return NewBulkString(old), nil
+	case opts.Get || !stored:
+		return NewNullBulkString(), nil
+	}
+	return NewSimpleString("OK"), nil
+}
+
+// setPXATCommand is the SET that stores value at key with an absolute
+// deadline, the form relative expiries replicate as.
+func setPXATCommand(key, value string, at time.Time) RESP {
+	return NewArray([]RESP{
+		NewBulkString("SET"), NewBulkString(key), NewBulkString(value),
+		NewBulkString("PXAT"), NewBulkString(strconv.FormatInt(at.UnixMilli(), 10)),
+	})
 }
 
 // getCommand retrieves a string value or null bulk string.
-func getCommand(args []RESP) (RESP, []byte) {
-    if len(args) != 1 {
-        return NewError("ERR wrong number of arguments for 'get' command"), nil
-    }
+func getCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
 	key := args[0].String
-	value, exists := GetStore().Get(key)
+	value, exists := db.Get(key)
 	if !exists {
 		return NewNullBulkString(), nil
 	}
     return NewBulkString(value), nil
 }
 
-// keysCommand returns keys matching a simple glob pattern.
-func keysCommand(args []RESP) (RESP, []byte) {
-    if len(args) != 1 {
-        return NewError("ERR wrong number of arguments for 'keys' command"), nil
-    }
+// getsetCommand sets a string value and returns the previous one or null.
+func getsetCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	old, existed, err := db.GetSet(args[0].String, args[1].String)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	notifyKeyspaceEvent(db, notifyString, "set", args[0].String)
+	if !existed {
+		return NewNullBulkString(), nil
+	}
+	return NewBulkString(old), nil
+}
+
+// getdelCommand returns the string at a key and deletes it, or null when
+// the key does not exist.
+func getdelCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	key := args[0].String
+	value, existed, err := db.GetAndDelete(key)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	if !existed {
+		return NewNullBulkString(), nil
+	}
+	notifyKeyspaceEvent(db, notifyGeneric, "del", key)
+	return NewBulkString(value), nil
+}
+
+// copyCommand implements COPY source destination [DB index] [REPLACE],
+// returning 1 when the value was copied and 0 when it was not.
+func copyCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	src, dst := args[0].String, args[1].String
+	dstDB, dstIndex := db, ctx.selectedIndex()
+	replace := false
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i].String) {
+		case "REPLACE":
+			replace = true
+		case "DB":
+			if i+1 >= len(args) {
+				return NewError("ERR syntax error"), nil
+			}
+			i++
+			index, msg := parseDBIndex(ctx.Server.dbs, args[i].String)
+			if msg != "" {
+				return NewError(msg), nil
+			}
+			dstDB, dstIndex = ctx.Server.dbs.DB(index), index
+		default:
+			return NewError("ERR syntax error"), nil
+		}
+	}
+
+	copied, err := db.Copy(src, dstDB, dst, replace)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	if !copied {
+		return NewInteger(0), nil
+	}
+	notifyKeyspaceEvent(dstDB, notifyGeneric, "copy_to", dst)
+	ctx.Server.signalModifiedKeys(dstIndex, dst)
+	ctx.markReady(dstIndex, dst)
+	return NewInteger(1), nil
+}
+
+// parseExpireArg parses a relative or absolute expiry argument, which must
+// be a positive integer, for the error messages of cmd.
+func parseExpireArg(arg, cmd string) (int64, string) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, "ERR value is not an integer or out of range"
+	}
+	if n <= 0 {
+		return 0, "ERR invalid expire time in '" + cmd + "' command"
+	}
+	return n, ""
+}
+
+// parseExpiry parses an expiry argument counted in unit, relative to now
+// unless absolute, into a deadline truncated to the millisecond so the PXAT
+// it may replicate as names exactly the deadline the master keeps. Besides
+// what parseExpireArg refuses, it refuses a deadline that overflows and a
+// relative expiry too long for the time.Duration TTLs are measured in.
+func parseExpiry(arg, cmd string, unit time.Duration, absolute bool) (time.Time, string) {
+	n, msg := parseExpireArg(arg, cmd)
+	if msg != "" {
+		return time.Time{}, msg
+	}
+	if !absolute && n > math.MaxInt64/int64(unit) {
+		return time.Time{}, "ERR invalid expire time in '" + cmd + "' command"
+	}
+	ms, ok := expireMillis(n, unit, absolute)
+	if !ok {
+		return time.Time{}, "ERR invalid expire time in '" + cmd + "' command"
+	}
+	return time.UnixMilli(ms), ""
+}
+
+// setexCommand implements SETEX key seconds value, or PSETEX key
+// milliseconds value when unit is time.Millisecond. Like SET EX, it
+// replicates as SET ... PXAT.
+func setexCommand(cmd string, unit time.Duration) Handler {
+	return func(ctx *CommandContext) (RESP, []byte) {
+		db, args := ctx.DB, ctx.Args
+		at, msg := parseExpiry(args[1].String, cmd, unit, false)
+		if msg != "" {
+			return NewError(msg), nil
+		}
+		key, value := args[0].String, args[2].String
+		if _, _, _, err := db.SetWithOptions(key, value, SetOptions{ExpireAt: at}); err != nil {
+			return NewError(err.Error()), nil
+		}
+		ctx.rewritePropagation(setPXATCommand(key, value, at))
+		notifyKeyspaceEvent(db, notifyString, "set", key)
+		notifyKeyspaceEvent(db, notifyGeneric, "expire", key)
+		return NewSimpleString("OK"), nil
+	}
+}
+
+// setnxCommand sets a string only if the key is absent, returning 1 if it did.
+func setnxCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	if !db.SetNX(args[0].String, args[1].String, 0) {
+		return NewInteger(0), nil
+	}
+	notifyKeyspaceEvent(db, notifyString, "set", args[0].String)
+	return NewInteger(1), nil
+}
+
+// getexCommand implements GETEX key [EX seconds|PX ms|EXAT ts|PXAT ts-ms|PERSIST].
+// A changed TTL replicates as PEXPIREAT (or PERSIST, or DEL when the new
+// expiry has already passed) so replicas don't depend on their own clock;
+// a plain read replicates nothing.
+func getexCommand(ctx *CommandContext) (RESP, []byte) {
+	key := ctx.Args[0].String
+	change := ExpiryKeep
+	var at time.Time
+	if len(ctx.Args) > 1 {
+		option := strings.ToUpper(ctx.Args[1].String)
+		switch {
+		case option == "PERSIST" && len(ctx.Args) == 2:
+			change = ExpiryPersist
+		case (option == "EX" || option == "PX" || option == "EXAT" || option == "PXAT") && len(ctx.Args) == 3:
+			unit := time.Second
+			if option[0] == 'P' {
+				unit = time.Millisecond
+			}
+			var msg string
+			at, msg = parseExpiry(ctx.Args[2].String, "getex", unit, strings.HasSuffix(option, "AT"))
+			if msg != "" {
+				return NewError(msg), nil
+			}
+			change = ExpirySet
+		default:
+			return NewError("ERR syntax error"), nil
+		}
+	}
+
+	db := ctx.DB
+	value, exists, deleted, err := db.GetEx(key, change, at)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	if !exists {
+		ctx.suppressPropagation()
+		return NewNullBulkString(), nil
+	}
+	switch {
+	case deleted:
+		notifyKeyspaceEvent(db, notifyGeneric, "del", key)
+		ctx.rewritePropagation(NewArray([]RESP{NewBulkString("DEL"), NewBulkString(key)}))
+	case change == ExpirySet:
+		notifyKeyspaceEvent(db, notifyGeneric, "expire", key)
+		ctx.rewritePropagation(NewArray([]RESP{
+			NewBulkString("PEXPIREAT"), NewBulkString(key), NewBulkString(strconv.FormatInt(at.UnixMilli(), 10)),
+		}))
+	case change == ExpiryPersist:
+		notifyKeyspaceEvent(db, notifyGeneric, "persist", key)
+		ctx.rewritePropagation(NewArray([]RESP{NewBulkString("PERSIST"), NewBulkString(key)}))
+	default:
+		ctx.suppressPropagation()
+	}
+	return NewBulkString(value), nil
+}
+
+// appendCommand appends to a string value and returns its new length.
+func appendCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	length, err := db.Append(args[0].String, args[1].String)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	notifyKeyspaceEvent(db, notifyString, "append", args[0].String)
+	return NewInteger(length), nil
+}
+
+// strlenCommand returns the length of a string value, or 0 for a missing key.
+func strlenCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	value, _, err := db.GetString(args[0].String)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	return NewInteger(len(value)), nil
+}
+
+// setrangeCommand overwrites part of a string value and returns its new length.
+func setrangeCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	offset, err := strconv.Atoi(args[1].String)
+	if err != nil {
+		return NewError("ERR value is not an integer or out of range"), nil
+	}
+	if offset < 0 {
+		return NewError("ERR offset is out of range"), nil
+	}
+
+	length, err := db.SetRange(args[0].String, offset, args[2].String)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	if len(args[2].String) > 0 {
+		notifyKeyspaceEvent(db, notifyString, "setrange", args[0].String)
+	}
+	return NewInteger(length), nil
+}
+
+// getrangeCommand returns a substring of a string value; negative offsets count from the end.
+func getrangeCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	start, err := strconv.Atoi(args[1].String)
+	if err != nil {
+		return NewError("ERR value is not an integer or out of range"), nil
+	}
+	end, err := strconv.Atoi(args[2].String)
+	if err != nil {
+		return NewError("ERR value is not an integer or out of range"), nil
+	}
+
+	value, _, err := db.GetString(args[0].String)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+
+	length := len(value)
+	if start < 0 {
+		start += length
+	}
+	if end < 0 {
+		end += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= length {
+		end = length - 1
+	}
+	if length == 0 || start > end {
+		return NewBulkString(""), nil
+	}
+	return NewBulkString(value[start : end+1]), nil
+}
+
+// existsCommand counts how many of the given keys exist, counting repeats separately.
+func existsCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	count := 0
+	for _, arg := range args {
+		if db.Exists(arg.String) {
+			count++
+		}
+	}
+	return NewInteger(count), nil
+}
+
+// dbsizeCommand returns the number of live keys in the selected database.
+func dbsizeCommand(ctx *CommandContext) (RESP, []byte) {
+	db := ctx.DB
+	return NewInteger(db.Count()), nil
+}
+
+// randomkeyCommand returns a random live key, or nil when the database is empty.
+func randomkeyCommand(ctx *CommandContext) (RESP, []byte) {
+	db := ctx.DB
+	key, ok := db.RandomKey()
+	if !ok {
+		return NewNullBulkString(), nil
+	}
+	return NewBulkString(key), nil
+}
+
+// delCommand removes keys and returns how many existed.
+func delCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	return NewInteger(db.Delete(argStrings(args))), nil
+}
+
+// keysCommand returns keys matching a glob pattern.
+func keysCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
 	pattern := args[0].String
-	allKeys := GetStore().Keys()
-	var matchedKeys []string
+	var items []RESP
 	if pattern == "*" {
-		matchedKeys = allKeys
-	} else if strings.HasSuffix(pattern, "*") {
-		prefix := pattern[:len(pattern)-1]
-		for _, key := range allKeys {
-			if strings.HasPrefix(key, prefix) {
-				matchedKeys = append(matchedKeys, key)
-			}
+		stored, _ := db.Stats()
+		items = make([]RESP, 0, stored)
+	}
+	db.ForEachKey(func(key string) bool {
+		if pattern == "*" || matchGlob(pattern, key) {
+			items = append(items, NewBulkString(key))
 		}
-	} else {
-		for _, key := range allKeys {
-			if key == pattern {
-				matchedKeys = append(matchedKeys, key)
+		return true
+	})
+	return NewArray(items), nil
+}
+
+// hotkeysInfo renders the hot-key section of INFO.
+func (s *Server) hotkeysInfo() string {
+	tracker := s.hotKeys
+	var builder strings.Builder
+	builder.WriteString("# Hotkeys\r\n")
+	enabled := 0
+	if tracker.Enabled() {
+		enabled = 1
+	}
+	builder.WriteString(fmt.Sprintf("hotkeys_tracking:%d\r\n", enabled))
+	builder.WriteString(fmt.Sprintf("hotkeys_sample_rate:%d\r\n", tracker.SampleRate()))
+	for i, hot := range tracker.Top(10) {
+		builder.WriteString(fmt.Sprintf("hotkey%d:key=%s,hits=%d,reads=%d,writes=%d\r\n",
+			i, hot.Key, hot.Hits, hot.Reads, hot.Writes))
+	}
+	return builder.String()
+}
+
+// hotkeysCommand reports the most accessed keys, or resets tracking with RESET.
+func hotkeysCommand(ctx *CommandContext) (RESP, []byte) {
+	args := ctx.Args
+	count := 10
+	if len(args) > 0 {
+		switch strings.ToUpper(args[0].String) {
+		case "RESET":
+			if len(args) != 1 {
+				return NewError("ERR syntax error"), nil
 			}
+			ctx.Server.hotKeys.Reset()
+			return NewSimpleString("OK"), nil
+		case "COUNT":
+			if len(args) != 2 {
+				return NewError("ERR syntax error"), nil
+			}
+			n, err := strconv.Atoi(args[1].String)
+			if err != nil || n < 0 {
+				return NewError("ERR value is not an integer or out of range"), nil
+			}
+			count = n
+		default:
+			return NewError("ERR syntax error"), nil
 		}
 	}
-	items := make([]RESP, len(matchedKeys))
-	for i, key := range matchedKeys {
-		items[i] = NewBulkString(key)
+
+	var items []RESP
+	for _, hot := range ctx.Server.hotKeys.Top(count) {
+		items = append(items, NewArray([]RESP{
+			NewBulkString("key"), NewBulkString(hot.Key),
+			NewBulkString("hits"), NewInteger(int(hot.Hits)),
+			NewBulkString("reads"), NewInteger(int(hot.Reads)),
+			NewBulkString("writes"), NewInteger(int(hot.Writes)),
+		}))
 	}
-    return NewArray(items), nil
+	return NewArray(items), nil
 }
 
-// infoCommand returns replication info.
-func infoCommand(args []RESP) (RESP, []byte) {
-    if len(args) != 1 {
-        return NewError("ERR wrong number of arguments for 'info' command"), nil
-    }
-    if strings.ToUpper(args[0].String) != "REPLICATION" {
-        return NewError("ERR only replication section is supported"), nil
-    }
-    role := "master"
-    if GetServerConfig().IsReplica {
-        role = "slave"
-    }
-    var info string
-    if role == "master" {
-        replicaCount := GetReplicaCount()
-        info = fmt.Sprintf("role:%s\r\nmaster_replid:%s\r\nmaster_repl_offset:%d\r\nconnected_slaves:%d",
-            role, masterReplID, masterReplOffset, replicaCount)
-    } else {
-        info = fmt.Sprintf("role:%s", role)
+// replconfSubcommands are the REPLCONF exchanges between a master and its
+// replicas.
+var replconfSubcommands = []Subcommand{
+    {Name: "LISTENING-PORT", Handler: replconfListeningPortCommand, MinArgs: 1, MaxArgs: 1, Usage: "<port>",
+        Help: []string{"Set the port the replica listens on, as INFO replication reports it."}},
+    {Name: "CAPA", Handler: replconfOKCommand, MinArgs: 1, MaxArgs: -1, Usage: "<capability> [CAPA <capability> ...]",
+        Help: []string{"Announce replica capabilities. They are accepted and ignored."}},
+    {Name: "COMPRESS", Handler: replconfCompressCommand, MinArgs: 1, MaxArgs: 1, Usage: "FLATE",
+        Help: []string{"Ask for the replication stream to be compressed, when repl-compression allows it."}},
+    {Name: "GETACK", Handler: replconfGetackCommand, MinArgs: 1, MaxArgs: 1, Usage: "*",
+        Help: []string{"Ask for the replication offset, answered with REPLCONF ACK <offset>."}},
+    {Name: "ACK", Handler: replconfAckCommand, MinArgs: 1, MaxArgs: -1, Usage: "<offset>",
+        Help: []string{"Report a replica's offset. Only the replication link reads it."}},
+}
+
+// replconfOKCommand accepts a REPLCONF setting it has nothing to do for.
+func replconfOKCommand(ctx *CommandContext) (RESP, []byte) {
+    return NewSimpleString("OK"), nil
+}
+
+// replconfListeningPortCommand records the port a replica listens on.
+func replconfListeningPortCommand(ctx *CommandContext) (RESP, []byte) {
+    port, err := strconv.Atoi(ctx.Args[0].String)
+    if err != nil || port < 0 || port > 65535 {
+        return NewError("ERR invalid listening port"), nil
     }
-    return NewBulkString(info), nil
+    state := ctx.Client
+    state.mu.Lock()
+    state.ReplListeningPort = port
+    state.mu.Unlock()
+    return NewSimpleString("OK"), nil
 }
 
-// replconfCommand handles replica configuration and ACK/GETACK exchange.
-func replconfCommand(args []RESP) (RESP, []byte) {
-    if len(args) == 0 {
-        return NewError("ERR wrong number of arguments for 'replconf' command"), nil
+// replconfCompressCommand turns on compression of the stream sent to a
+// replica, if it asked for flate and repl-compression is enabled.
+func replconfCompressCommand(ctx *CommandContext) (RESP, []byte) {
+    if strings.ToLower(ctx.Args[0].String) != "flate" || !ctx.Config.ReplCompression {
+        return NewError("ERR replication compression not available"), nil
     }
-    subCommand := strings.ToUpper(args[0].String)
-    switch subCommand {
-    case "GETACK":
-        offset := GetOffset()
-        if GetServerConfig().IsReplica {
-            if offset < 0 {
-                offset = 0
-            }
-        }
-        offsetStr := strconv.FormatInt(offset, 10)
-        return NewArray([]RESP{
-            NewBulkString("REPLCONF"),
-            NewBulkString("ACK"),
-            NewBulkString(offsetStr),
-        }), nil
-    case "ACK":
-        if len(args) >= 2 {
-            offset, err := strconv.ParseInt(args[1].String, 10, 64)
-            if err == nil {
-                _ = offset
-            }
+    state := ctx.Client
+    state.mu.Lock()
+    state.ReplCompress = true
+    state.mu.Unlock()
+    return NewSimpleString("OK"), nil
+}
+
+// replconfGetackCommand answers GETACK with the processed replication offset.
+func replconfGetackCommand(ctx *CommandContext) (RESP, []byte) {
+    offset := ctx.Server.repl.GetOffset()
+    if ctx.Config.IsReplica {
+        if offset < 0 {
+            offset = 0
         }
-        return RESP{}, nil
-    case "LISTENING-PORT", "CAPA":
-        return NewSimpleString("OK"), nil
     }
-    return NewSimpleString("OK"), nil
+    offsetStr := strconv.FormatInt(offset, 10)
+    return NewArray([]RESP{
+        NewBulkString("REPLCONF"),
+        NewBulkString("ACK"),
+        NewBulkString(offsetStr),
+    }), nil
+}
+
+// replconfAckCommand ignores an ACK outside the replication link.
+func replconfAckCommand(ctx *CommandContext) (RESP, []byte) {
+    // Replicas' ACKs are read by serveReplicaLink. Like Redis, an ACK
+    // from any other connection is ignored without a reply.
+    return RESP{}, nil
 }
 
-// psyncCommand performs a full resync and returns an empty RDB snapshot.
-func psyncCommand(args []RESP) (RESP, []byte) {
-    response := fmt.Sprintf("FULLRESYNC %s %d", masterReplID, masterReplOffset)
-    emptyRDB := []byte{
-        0x52, 0x45, 0x44, 0x49, 0x53, 0x30, 0x30, 0x31, 0x31, 0xfa, 0x09, 0x72, 0x65, 0x64, 0x69,
-        0x73, 0x2d, 0x76, 0x65, 0x72, 0x05, 0x37, 0x2e, 0x32, 0x2e, 0x30, 0xfa, 0x0a, 0x72, 0x65,
-        0x64, 0x69, 0x73, 0x2d, 0x62, 0x69, 0x74, 0x73, 0xc0, 0x40, 0xfa, 0x05, 0x63, 0x74, 0x69,
-        0x6d, 0x65, 0xc2, 0x6d, 0x08, 0xbc, 0x65, 0xfa, 0x08, 0x75, 0x73, 0x65, 0x64, 0x2d, 0x6d,
-        0x65, 0x6d, 0xc2, 0xb0, 0xc4, 0x10, 0x00, 0xfa, 0x08, 0x61, 0x6f, 0x66, 0x2d, 0x62, 0x61,
-        0x73, 0x65, 0xc0, 0x00, 0xff, 0xf0, 0x6e, 0x3b, 0xfe, 0xc0, 0xff, 0x5a, 0xa2,
+// psyncCommand continues a replica's stream from the backlog when it names
+// the current replication ID and an offset the backlog still covers, and
+// performs a full resync otherwise. For a full resync, writes are held off
+// while it snapshots every database, encodes the RDB, reads the offset and
+// registers conn as a replica, so each write is either in the snapshot or
+// streamed after it.
+func psyncCommand(ctx *CommandContext) (RESP, []byte) {
+    state := ctx.Client
+    state.mu.Lock()
+    state.IsReplicaLink = true
+    compress := state.ReplCompress
+    listeningPort := state.ReplListeningPort
+    state.mu.Unlock()
+
+    server := ctx.Server
+    replID, _ := server.repl.GetReplID()
+    if ctx.Args[0].String == replID {
+        offset, err := strconv.ParseInt(ctx.Args[1].String, 10, 64)
+        if err == nil && server.repl.ResumeReplica(ctx.Conn, listeningPort, compress, offset) {
+            logNotice("Partial resync accepted", "replica", ctx.Conn.RemoteAddr().String(), "offset", offset)
+            return NewSimpleString("CONTINUE " + replID), nil
+        }
+    }
+
+    server.repl.snapshotMu.Lock()
+    var payload bytes.Buffer
+    // Writing to a bytes.Buffer cannot fail; a value without an encoding can.
+    if err := WriteRDB(&payload, server.dbs.Snapshot(), time.Now()); err != nil {
+        server.repl.snapshotMu.Unlock()
+        logWarning("Full resync failed", "replica", ctx.Conn.RemoteAddr().String(), "error", err)
+        return NewError("ERR " + err.Error()), nil
     }
-    rdbBytes := make([]byte, 0, len(emptyRDB)+16)
+    failpoint(fpBeforePsyncAddReplica)
+    offset := server.addReplicaToStream(ctx.Conn, listeningPort, compress)
+    server.repl.snapshotMu.Unlock()
+
+    logNotice("Full resync requested by replica", "replica", ctx.Conn.RemoteAddr().String(), "offset", offset)
+
+    response := fmt.Sprintf("FULLRESYNC %s %d", replID, offset)
+    rdbBytes := make([]byte, 0, payload.Len()+16)
     rdbBytes = append(rdbBytes, '$')
-    rdbBytes = append(rdbBytes, []byte(strconv.Itoa(len(emptyRDB)))...)
+    rdbBytes = append(rdbBytes, []byte(strconv.Itoa(payload.Len()))...)
     rdbBytes = append(rdbBytes, '\r', '\n')
-    rdbBytes = append(rdbBytes, emptyRDB...)
+    rdbBytes = append(rdbBytes, payload.Bytes()...)
     return NewSimpleString(response), rdbBytes
 }
 
-// waitCommand blocks until a number of replicas acknowledge current offset or timeout.
-func waitCommand(args []RESP) (RESP, []byte) {
-	if len(args) != 2 {
-		return NewError("ERR wrong number of arguments for 'wait' command"), nil
-	}
+// waitCommand blocks until a number of replicas acknowledge the current
+// offset or the timeout in milliseconds passes; 0 waits forever. It returns
+// at once, without asking replicas for ACKs, when enough have already
+// acknowledged the offset.
+func waitCommand(ctx *CommandContext) (RESP, []byte) {
+	args := ctx.Args
 	numReplicas, err := strconv.Atoi(args[0].String)
 	if err != nil {
 		return NewError("ERR value is not an integer or out of range"), nil
@@ -282,61 +1008,27 @@ func waitCommand(args []RESP) (RESP, []byte) {
 	if err != nil {
 		return NewError("ERR value is not an integer or out of range"), nil
 	}
-	replicaConns := GetReplicaConnections()
-	if len(replicaConns) == 0 {
+	if timeout < 0 {
+		return NewError("ERR timeout is negative"), nil
+	}
+	repl := ctx.Server.repl
+	if repl.GetOnlineReplicaCount() == 0 {
 		return NewInteger(0), nil
 	}
+	// The GETACK below advances the offset too, but replicas acknowledge
+	// what precedes it, so the target is taken first.
+	currentOffset := repl.GetMasterOffset()
+	if acked := repl.GetAcknowledgedReplicaCount(currentOffset); acked >= numReplicas {
+		return NewInteger(acked), nil
+	}
 	getAckCmd := NewArray([]RESP{
 		NewBulkString("REPLCONF"),
 		NewBulkString("GETACK"),
 		NewBulkString("*"),
 	})
-	cmdBytes := []byte(getAckCmd.Marshal())
-	for _, conn := range replicaConns {
-		_, _ = conn.Write(cmdBytes)
-	}
-	endTime := time.Now().Add(time.Duration(timeout) * time.Millisecond)
-	currentOffset := GetMasterOffset()
-	for time.Now().Before(endTime) {
-		acked := GetAcknowledgedReplicaCount(currentOffset)
-		if acked >= numReplicas {
-			return NewInteger(acked), nil
-		}
-		time.Sleep(10 * time.Millisecond)
-	}
-	return NewInteger(GetAcknowledgedReplicaCount(currentOffset)), nil
-}
-
-// configCommand handles CONFIG subcommands.
-func configCommand(args []RESP) (RESP, []byte) {
-	if len(args) < 1 {
-		return NewError("ERR wrong number of arguments for 'config' command"), nil
-	}
-	sub := strings.ToUpper(args[0].String)
-	if sub == "GET" {
-		return configGetCommand(args[1:])
-	}
-	return NewError("ERR unknown subcommand '" + sub + "'. Try CONFIG GET"), nil
-}
-
-func configGetCommand(args []RESP) (RESP, []byte) {
-	if len(args) < 1 {
-		return NewError("ERR wrong number of arguments for 'config get' command"), nil
-	}
-	pattern := strings.ToLower(args[0].String)
-	var pairs []RESP
-	cfg := GetServerConfig()
-	switch pattern {
-	case "dir":
-		pairs = append(pairs, NewBulkString("dir"), NewBulkString(cfg.Dir))
-	case "dbfilename":
-		pairs = append(pairs, NewBulkString("dbfilename"), NewBulkString(cfg.DBFilename))
-	case "*":
-		pairs = append(pairs, NewBulkString("dir"), NewBulkString(cfg.Dir), NewBulkString("dbfilename"), NewBulkString(cfg.DBFilename))
-	default:
-		return NewArray(pairs), nil
-	}
-	return NewArray(pairs), nil
+	repl.sendToReplicas(getAckCmd.MarshalBytes())
+	failpoint(fpWaitAfterGetAck)
+	return NewInteger(repl.WaitForReplicas(numReplicas, currentOffset, time.Duration(timeout)*time.Millisecond)), nil
 }
 
 // parseStreamID parses a provided ID for XADD, handling auto-generation modes.
@@ -402,179 +1094,230 @@ func parseStreamID(id string, lastID string) (int64, int64, bool, error) {
 	return ms, seq, false, nil
 }
 
-// xaddCommand appends a new entry to a stream.
-func xaddCommand(args []RESP) (RESP, []byte) {
-	if len(args) < 3 {
-		return NewError("ERR wrong number of arguments for 'xadd' command"), nil
+// parseMaxLen parses "MAXLEN [~|=] count" starting at args[i], returning the
+// count and the index after it. Approximate trimming is treated as exact.
+func parseMaxLen(args []RESP, i int) (int, int, error) {
+	i++
+	if i < len(args) && (args[i].String == "~" || args[i].String == "=") {
+		i++
 	}
-
-	if (len(args)-2)%2 != 0 {
-		return NewError("ERR wrong number of arguments for 'xadd' command"), nil
+	if i >= len(args) {
+		return 0, 0, errors.New("ERR syntax error")
 	}
-
-	key := args[0].String
-	id := args[1].String
-
-	stream, exists := GetStore().GetStream(key)
-	if !exists {
-		stream = &Stream{Entries: []Entry{}}
+	maxLen, err := strconv.Atoi(args[i].String)
+	if err != nil {
+		return 0, 0, ErrNotInteger
 	}
-
-	var lastID string
-	if len(stream.Entries) > 0 {
-		lastID = stream.Entries[len(stream.Entries)-1].ID
-	}
-
-	ms, seq, autoSeq, err := parseStreamID(id, lastID)
-	if err != nil {
-		if err.Error() == "ID must be greater than 0-0" {
-			return NewError("ERR The ID specified in XADD must be greater than 0-0"), nil
-		} else if err.Error() == "ID is not greater than last entry" {
-			return NewError("ERR The ID specified in XADD is equal or smaller than the target stream top item"), nil
-		}
-		return NewError("ERR invalid stream ID specified as stream command argument"), nil
-	}
-
-	if autoSeq {
-		if strings.HasSuffix(id, "-*") {
-			if ms == 0 {
-				seq = 1
-			} else {
-				maxSeq := int64(-1)
-				for _, entry := range stream.Entries {
-					entryParts := strings.Split(entry.ID, "-")
-					if len(entryParts) == 2 {
-						entryMs, _ := strconv.ParseInt(entryParts[0], 10, 64)
-						if entryMs == ms {
-							entrySeq, _ := strconv.ParseInt(entryParts[1], 10, 64)
-							if entrySeq > maxSeq {
-								maxSeq = entrySeq
-							}
-						}
-					}
-				}
-				seq = maxSeq + 1
-			}
-		}
-
-		id = fmt.Sprintf("%d-%d", ms, seq)
+	if maxLen < 0 {
+		return 0, 0, errors.New("ERR The MAXLEN argument must be >= 0.")
 	}
+	return maxLen, i + 1, nil
+}
 
-	for _, entry := range stream.Entries {
-		if entry.ID == id {
-			return NewError("ERR The ID specified in XADD already exists in the target stream"), nil
+// xaddCommand appends a new entry to a stream, optionally capping its length.
+// It replicates with the ID it generated in place of the one given, so an
+// auto-generated ID comes out the same on replicas. Readers blocked on the
+// stream are served before the reply is written, so a client that sees the
+// ID can count on a blocked XREAD having been woken by it.
+func xaddCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	key := args[0].String
+	maxLen := -1
+	i := 1
+	var err error
+	if strings.ToUpper(args[i].String) == "MAXLEN" {
+		maxLen, i, err = parseMaxLen(args, i)
+		if err != nil {
+			return NewError(err.Error()), nil
 		}
 	}
 
-	fields := make(map[string]string)
-	for i := 2; i < len(args); i += 2 {
-		fieldName := args[i].String
-		fieldValue := args[i+1].String
-		fields[fieldName] = fieldValue
+	if i >= len(args) || (len(args)-i-1) == 0 || (len(args)-i-1)%2 != 0 {
+		return NewError("ERR wrong number of arguments for 'xadd' command"), nil
 	}
+	id := args[i].String
 
-	newEntry := Entry{
-		ID:     id,
-		Fields: fields,
+	fields := make([]FieldValue, 0, (len(args)-i-1)/2)
+	for j := i + 1; j < len(args); j += 2 {
+		fields = append(fields, FieldValue{Field: args[j].String, Value: args[j+1].String})
 	}
 
-	stream.Entries = append(stream.Entries, newEntry)
-	GetStore().Set(key, stream, 0)
-
+	entry := Entry{ID: id, Fields: fields}
+	if maxLen >= 0 {
+		id, err = db.AppendToStreamMaxLen(key, entry, maxLen)
+	} else {
+		id, err = db.AppendToStream(key, entry)
+	}
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	effect := append([]RESP{NewBulkString("XADD")}, args...)
+	effect[i+1] = NewBulkString(id)
+	ctx.rewritePropagation(NewArray(effect))
+	notifyKeyspaceEvent(db, notifyStream, "xadd", key)
+	ctx.markReady(ctx.selectedIndex(), key)
 	return NewBulkString(id), nil
 }
 
-// typeCommand returns the Redis type of a key.
-func typeCommand(args []RESP) (RESP, []byte) {
-	if len(args) != 1 {
-		return NewError("ERR wrong number of arguments for 'type' command"), nil
+// xtrimCommand trims a stream to a maximum length and returns the number of evicted entries.
+func xtrimCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	if strings.ToUpper(args[1].String) != "MAXLEN" {
+		return NewError("ERR syntax error"), nil
 	}
 
-	key := args[0].String
-	keyType := GetStore().GetType(key)
-
-	return NewSimpleString(keyType), nil
-}
-
-// xrangeCommand returns entries between start and end IDs.
-func xrangeCommand(args []RESP) (RESP, []byte) {
-	if len(args) != 3 {
-		return NewError("ERR wrong number of arguments for 'xrange' command"), nil
+	maxLen, next, err := parseMaxLen(args, 1)
+	if err != nil {
+		return NewError(err.Error()), nil
 	}
+	if next != len(args) {
+		return NewError("ERR syntax error"), nil
+	}
+
+	evicted, err := db.XTrim(args[0].String, maxLen)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	if evicted > 0 {
+		notifyKeyspaceEvent(db, notifyStream, "xtrim", args[0].String)
+	}
+	return NewInteger(evicted), nil
+}
 
+// typeCommand returns the Redis type of a key.
+func typeCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
 	key := args[0].String
-	startID := args[1].String
-	endID := args[2].String
+	keyType := db.GetType(key)
 
-	stream, exists := GetStore().GetStream(key)
-	if !exists {
-		return NewArray([]RESP{}), nil
-	}
+	return NewSimpleString(keyType), nil
+}
 
-	startMs, startSeq, err := parseRangeID(startID, false, key)
-	if err != nil {
-		return NewError("ERR invalid stream ID specified as stream command argument"), nil
+// xrangeCommand returns entries between start and end IDs in ascending order.
+func xrangeCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	return streamRange(db, args, "xrange", false)
+}
+
+// xrevrangeCommand returns entries between end and start IDs in descending order.
+func xrevrangeCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	return streamRange(db, args, "xrevrange", true)
+}
+
+// streamRange implements XRANGE key start end [COUNT n] and XREVRANGE key end
+// start [COUNT n]. Bounds are inclusive unless prefixed with "(".
+func streamRange(db *KeyValueStore, args []RESP, name string, reverse bool) (RESP, []byte) {
+	if len(args) == 4 {
+		return NewError("ERR wrong number of arguments for '" + name + "' command"), nil
 	}
 
-	endMs, endSeq, err := parseRangeID(endID, true, key)
-	if err != nil {
-		return NewError("ERR invalid stream ID specified as stream command argument"), nil
+	key := args[0].String
+	startID, endID := args[1].String, args[2].String
+	if reverse {
+		startID, endID = endID, startID
 	}
 
-	var results []RESP
-	for _, entry := range stream.Entries {
-		entryMs, entrySeq, err := splitStreamID(entry.ID)
+	count := -1
+	if len(args) == 5 {
+		if strings.ToUpper(args[3].String) != "COUNT" {
+			return NewError("ERR syntax error"), nil
+		}
+		n, err := strconv.Atoi(args[4].String)
 		if err != nil {
-			continue
+			return NewError("ERR value is not an integer or out of range"), nil
 		}
+		count = max(n, 0)
+	}
 
-		if compareStreamIDs(startMs, startSeq, entryMs, entrySeq) <= 0 &&
-			compareStreamIDs(entryMs, entrySeq, endMs, endSeq) <= 0 {
-
-			fieldValues := make([]RESP, 0, len(entry.Fields)*2)
-			for field, value := range entry.Fields {
-				fieldValues = append(fieldValues, NewBulkString(field))
-				fieldValues = append(fieldValues, NewBulkString(value))
-			}
+	startMs, startSeq, ok, err := parseRangeBound(startID, false)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	endMs, endSeq, ok2, err := parseRangeBound(endID, true)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
 
-			entryArray := NewArray([]RESP{
-				NewBulkString(entry.ID),
-				NewArray(fieldValues),
-			})
+	stream, exists := db.GetStream(key)
+	if !exists || !ok || !ok2 || count == 0 {
+		return NewArray([]RESP{}), nil
+	}
 
-			results = append(results, entryArray)
+	// Entries are sorted, so the range is the slice between the first entry
+	// at or after start and the first one after end.
+	first := stream.search(startMs, startSeq, true)
+	last := stream.search(endMs, endSeq, false)
+	if first >= last {
+		return NewArray([]RESP{}), nil
+	}
+	entries := stream.Entries[first:last]
+	if count >= 0 && len(entries) > count {
+		if reverse {
+			entries = entries[len(entries)-count:]
+		} else {
+			entries = entries[:count]
 		}
 	}
 
+	results := make([]RESP, len(entries))
+	for i, entry := range entries {
+		if reverse {
+			i = len(entries) - 1 - i
+		}
+		results[i] = entryToRESP(entry)
+	}
 	return NewArray(results), nil
 }
 
-// parseRangeID parses an ID used in range or XREAD queries.
-func parseRangeID(id string, isEnd bool, key string) (int64, int64, error) {
-	if id == "-" {
-		return 0, 0, nil
+// parseRangeBound parses an XRANGE/XREVRANGE bound into an inclusive ID. An
+// exclusive "(id" bound is shifted to the adjacent ID; ok is false when that
+// leaves the ID space, meaning the range is empty.
+func parseRangeBound(id string, isEnd bool) (ms, seq int64, ok bool, err error) {
+	exclusive := strings.HasPrefix(id, "(")
+	if exclusive {
+		id = id[1:]
+		if id == "-" || id == "+" {
+			return 0, 0, false, errors.New("ERR invalid start or end ID: exclusive ranges can't use - or +")
+		}
 	}
 
-	if id == "+" {
-		return int64(^uint64(0) >> 1), int64(^uint64(0) >> 1), nil
+	ms, seq, err = parseRangeID(id, isEnd)
+	if err != nil || id == "$" {
+		return 0, 0, false, ErrInvalidStreamID
+	}
+	if !exclusive {
+		return ms, seq, true, nil
 	}
 
-	if id == "$" {
-		if key == "" {
-			return 0, 0, fmt.Errorf("key is required for $ ID")
+	const maxID = int64(^uint64(0) >> 1)
+	if isEnd {
+		switch {
+		case seq > 0:
+			return ms, seq - 1, true, nil
+		case ms > 0:
+			return ms - 1, maxID, true, nil
 		}
+		return 0, 0, false, nil
+	}
+	switch {
+	case seq < maxID:
+		return ms, seq + 1, true, nil
+	case ms < maxID:
+		return ms + 1, 0, true, nil
+	}
+	return 0, 0, false, nil
+}
 
-		stream, exists := GetStore().GetStream(key)
-		if !exists || len(stream.Entries) == 0 {
-			return 0, 0, nil
-		}
+// parseRangeID parses an ID used in range or XREAD queries. XREAD resolves
+// "$" to a concrete ID before parsing.
+func parseRangeID(id string, isEnd bool) (int64, int64, error) {
+	if id == "-" {
+		return 0, 0, nil
+	}
 
-		lastEntry := stream.Entries[len(stream.Entries)-1]
-		ms, seq, err := splitStreamID(lastEntry.ID)
-		if err != nil {
-			return 0, 0, err
-		}
-		return ms, seq, nil
+	if id == "+" {
+		return int64(^uint64(0) >> 1), int64(^uint64(0) >> 1), nil
 	}
 
 	parts := strings.Split(id, "-")
@@ -645,21 +1388,18 @@ func compareStreamIDs(ms1, seq1, ms2, seq2 int64) int {
 }
 
 // xreadCommand reads from one or more streams, optionally blocking.
-func xreadCommand(args []RESP) (RESP, []byte) {
-	if len(args) < 3 {
-		return NewError("ERR wrong number of arguments for 'xread' command"), nil
-	}
-
+func xreadCommand(ctx *CommandContext) (RESP, []byte) {
+	db := ctx.DB
 	var blockMs int64 = 0
 	argIndex := 0
 	hasBlock := false
 
-	if strings.ToUpper(args[argIndex].String) == "BLOCK" {
-		if argIndex+1 >= len(args) {
+	if strings.ToUpper(ctx.Args[argIndex].String) == "BLOCK" {
+		if argIndex+1 >= len(ctx.Args) {
 			return NewError("ERR syntax error"), nil
 		}
 
-		ms, err := strconv.ParseInt(args[argIndex+1].String, 10, 64)
+		ms, err := strconv.ParseInt(ctx.Args[argIndex+1].String, 10, 64)
 		if err != nil || ms < 0 {
 			return NewError("ERR timeout is not a valid integer or out of range"), nil
 		}
@@ -669,12 +1409,12 @@ func xreadCommand(args []RESP) (RESP, []byte) {
 		hasBlock = true
 	}
 
-	if strings.ToUpper(args[argIndex].String) != "STREAMS" {
+	if strings.ToUpper(ctx.Args[argIndex].String) != "STREAMS" {
 		return NewError("ERR syntax error"), nil
 	}
 	argIndex++
 
-	argsAfterStreams := args[argIndex:]
+	argsAfterStreams := ctx.Args[argIndex:]
 	if len(argsAfterStreams)%2 != 0 {
 		return NewError("ERR syntax error"), nil
 	}
@@ -689,265 +1429,1632 @@ func xreadCommand(args []RESP) (RESP, []byte) {
 		}
 	}
 
-	var results []RESP
-
+	streamKeys := make([]string, numStreams)
+	startIDs := make([]string, numStreams)
 	for i := range numStreams {
-		key := keys[i].String
-		startID := ids[i].String
-
-		startMs, startSeq, err := parseRangeID(startID, false, key)
-		if err != nil {
+		streamKeys[i] = keys[i].String
+		startIDs[i] = ids[i].String
+		if startIDs[i] == "$" {
+			// Resolve "$" once, up front, so every later scan (including
+			// the one after waking up) reads from the same position.
+			startIDs[i] = lastStreamID(db, streamKeys[i])
+			continue
+		}
+		if _, _, err := parseRangeID(startIDs[i], false); err != nil {
 			return NewError("ERR invalid stream ID specified as stream command argument"), nil
 		}
+	}
 
-		stream, exists := GetStore().GetStream(key)
-		if !exists {
-			continue
-		}
+	if results := readStreamsAfter(db, streamKeys, startIDs); len(results) > 0 {
+		return NewArray(results), nil
+	}
 
-		var streamEntries []RESP
-		for _, entry := range stream.Entries {
-			entryMs, entrySeq, err := splitStreamID(entry.ID)
-			if err != nil {
-				continue
-			}
+	if hasBlock {
+		return handleBlockingRead(ctx, streamKeys, startIDs, blockMs)
+	}
+
+	return NewNullArray(), nil
+}
 
-			if compareStreamIDs(startMs, startSeq, entryMs, entrySeq) < 0 {
+// lastStreamID returns the ID of the newest entry ever added to the stream at key, or 0-0.
+func lastStreamID(db *KeyValueStore, key string) string {
+	stream, exists := db.GetStream(key)
+	if !exists {
+		return "0-0"
+	}
+	if stream.LastID != "" {
+		return stream.LastID
+	}
+	if len(stream.Entries) > 0 {
+		return stream.Entries[len(stream.Entries)-1].ID
+	}
+	return "0-0"
+}
 
-				fieldValues := make([]RESP, 0, len(entry.Fields)*2)
-				for field, value := range entry.Fields {
-					fieldValues = append(fieldValues, NewBulkString(field))
-					fieldValues = append(fieldValues, NewBulkString(value))
-				}
+// readStreamsAfter returns, for each stream with entries newer than its start
+// ID, a [key, entries] pair in request order. Streams with nothing new are omitted.
+func readStreamsAfter(db *KeyValueStore, keys []string, startIDs []string) []RESP {
+	var results []RESP
+	for i, key := range keys {
+		stream, exists := db.GetStream(key)
+		if !exists {
+			continue
+		}
 
-				entryArray := NewArray([]RESP{
-					NewBulkString(entry.ID),
-					NewArray(fieldValues),
-				})
+		startMs, startSeq, err := parseRangeID(startIDs[i], false)
+		if err != nil {
+			continue
+		}
 
-				streamEntries = append(streamEntries, entryArray)
-			}
+		var streamEntries []RESP
+		for _, entry := range stream.Entries[stream.search(startMs, startSeq, false):] {
+			streamEntries = append(streamEntries, entryToRESP(entry))
 		}
 
 		if len(streamEntries) > 0 {
-			streamResult := NewArray([]RESP{
+			results = append(results, NewArray([]RESP{
 				NewBulkString(key),
 				NewArray(streamEntries),
-			})
-			results = append(results, streamResult)
+			}))
 		}
 	}
+	return results
+}
 
-	if len(results) > 0 {
-		return NewArray(results), nil
+// entryToRESP encodes a stream entry as [id, [field, value, ...]].
+func entryToRESP(entry Entry) RESP {
+	fieldValues := make([]RESP, 0, len(entry.Fields)*2)
+	for _, fv := range entry.Fields {
+		fieldValues = append(fieldValues, NewBulkString(fv.Field))
+		fieldValues = append(fieldValues, NewBulkString(fv.Value))
 	}
+	return NewArray([]RESP{
+		NewBulkString(entry.ID),
+		NewArray(fieldValues),
+	})
+}
 
-	if blockMs >= 0 {
-		return handleBlockingRead(keys, ids, blockMs)
+// handleBlockingRead waits until any of the streams gets entries past its
+// start ID, then replies with every stream that has new entries, in the same
+// per-stream shape as a non-blocking read. It returns a null array on timeout.
+func handleBlockingRead(ctx *CommandContext, keys []string, startIDs []string, blockMs int64) (RESP, []byte) {
+	predicate := func() (RESP, bool) {
+		results := readStreamsAfter(ctx.selectedDB(), keys, startIDs)
+		return NewArray(results), len(results) > 0
 	}
 
-	return NewArray(results), nil
+	timeout := time.Duration(blockMs) * time.Millisecond
+	reply, ok := ctx.Server.blocks.Block(ctx.Client, "xread", keys, BlockBroadcast, timeout, predicate, nil)
+	if !ok {
+		return NewNullArray(), nil
+	}
+	return reply, nil
 }
 
-// handleBlockingRead orchestrates multi-key blocking reads and returns on first result or timeout.
-func handleBlockingRead(keys []RESP, ids []RESP, blockMs int64) (RESP, []byte) {
-    sm := GetStreamManager()
-    var blockTimeout time.Duration
-    hasTimeout := blockMs > 0
+// incrCommand increments an integer value stored at a key.
+func incrCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	return incrementBy(db, args[0].String, 1)
+}
+
+// decrCommand decrements an integer value stored at a key.
+func decrCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	return incrementBy(db, args[0].String, -1)
+}
 
-	if hasTimeout {
-		blockTimeout = time.Duration(blockMs) * time.Millisecond
+// incrbyCommand adds a signed delta to an integer value stored at a key.
+func incrbyCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	delta, err := strconv.ParseInt(args[1].String, 10, 64)
+	if err != nil {
+		return NewError("ERR value is not an integer or out of range"), nil
 	}
+	return incrementBy(db, args[0].String, delta)
+}
 
-	numStreams := len(keys)
-	resultChs := make([]chan []RESP, numStreams)
-	timers := make([]*time.Timer, numStreams)
-	clientInfos := make([]*BlockedClient, numStreams)
+// decrbyCommand subtracts a signed delta from an integer value stored at a key.
+func decrbyCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	delta, err := strconv.ParseInt(args[1].String, 10, 64)
+	if err != nil {
+		return NewError("ERR value is not an integer or out of range"), nil
+	}
+	if delta == math.MinInt64 {
+		return NewError("ERR decrement would overflow"), nil
+	}
+	return incrementBy(db, args[0].String, -delta)
+}
 
-	var overallTimeoutChan <-chan time.Time
-	var overallTimer *time.Timer
+// incrementBy applies delta to the integer stored at key, treating a missing key as 0.
+func incrementBy(db *KeyValueStore, key string, delta int64) (RESP, []byte) {
+	value, err := db.Incr(key, delta)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	notifyKeyspaceEvent(db, notifyString, "incrby", key)
+	return NewInteger(int(value)), nil
+}
 
-	if hasTimeout {
-		overallTimer = time.NewTimer(blockTimeout)
-		overallTimeoutChan = overallTimer.C
-		defer overallTimer.Stop()
-	} else {
-		overallTimeoutChan = nil
+// incrbyfloatCommand adds a floating point delta to the value stored at a key.
+func incrbyfloatCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	delta, err := strconv.ParseFloat(args[1].String, 64)
+	if err != nil || math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return NewError("ERR value is not an integer or out of range"), nil
 	}
 
-	var wg sync.WaitGroup
-	var mu sync.Mutex
+	formatted, err := db.IncrByFloat(args[0].String, delta)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	notifyKeyspaceEvent(db, notifyString, "incrbyfloat", args[0].String)
+	return NewBulkString(formatted), nil
+}
 
-    for i := range numStreams {
-        wg.Add(1)
-        go func(index int) {
-            defer wg.Done()
-            key := keys[index].String
-            startID := ids[index].String
+// formatFloat renders a float the way Redis does, without trailing zeros or exponent.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
 
-			clientTimeoutDuration := time.Duration(0)
-			if hasTimeout {
-				clientTimeoutDuration = blockTimeout
-			}
+// hsetCommand sets one or more fields in a hash and returns the number of new fields.
+func hsetCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	if len(args)%2 == 0 {
+		return NewError("ERR wrong number of arguments for 'hset' command"), nil
+	}
 
-			resCh, timer := sm.RegisterBlockedClient(key, startID, clientTimeoutDuration)
+	added, err := db.HSet(args[0].String, argStrings(args[1:]))
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	notifyKeyspaceEvent(db, notifyHash, "hset", args[0].String)
+	return NewInteger(added), nil
+}
 
-            mu.Lock()
-            resultChs[index] = resCh
-            timers[index] = timer
-            clientInfos[index] = &BlockedClient{key: key, resultCh: resCh}
-            mu.Unlock()
-        }(i)
-    }
-    wg.Wait()
-
-    firstResultCh := make(chan []RESP, 1)
-
-    for i := range numStreams {
-        listenerIndex := i
-        go func() {
-            result, ok := <-resultChs[listenerIndex]
-            if ok && len(result) > 0 {
-                select {
-                case firstResultCh <- result:
-                default:
-                    _ = listenerIndex
-                }
-            } else {
-                _ = listenerIndex
-            }
-        }()
-    }
+// hgetCommand returns the value of a hash field or null.
+func hgetCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	value, exists, err := db.HGet(args[0].String, args[1].String)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	if !exists {
+		return NewNullBulkString(), nil
+	}
+	return NewBulkString(value), nil
+}
 
-    select {
-    case firstResult := <-firstResultCh:
-        for i := range numStreams {
-            if clientInfos[i] != nil {
-                sm.RemoveBlockedClient(clientInfos[i].key, clientInfos[i].resultCh)
-            }
-        }
-        return NewArray([]RESP{NewArray(firstResult)}), nil
+// hgetallCommand returns every field and value of a hash as a flat array.
+func hgetallCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	pairs, err := db.HGetAll(args[0].String)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
 
-    case <-overallTimeoutChan:
-        for i := range numStreams {
-            if clientInfos[i] != nil {
-                sm.RemoveBlockedClient(clientInfos[i].key, clientInfos[i].resultCh)
-            }
-        }
-        return NewNullArray(), nil
-    }
+	items := make([]RESP, len(pairs))
+	for i, item := range pairs {
+		items[i] = NewBulkString(item)
+	}
+	return NewMap(items), nil
 }
 
-// incrCommand increments an integer value stored at a key.
-func incrCommand(args []RESP) (RESP, []byte) {
-	if len(args) != 1 {
-		return NewError("ERR wrong number of arguments for 'incr' command"), nil
+// hdelCommand removes fields from a hash and returns the number deleted.
+func hdelCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	deleted, err := db.HDel(args[0].String, argStrings(args[1:]))
+	if err != nil {
+		return NewError(err.Error()), nil
 	}
+	if deleted > 0 {
+		notifyKeyspaceEvent(db, notifyHash, "hdel", args[0].String)
+		notifyIfDeleted(db, args[0].String)
+	}
+	return NewInteger(deleted), nil
+}
 
-	key := args[0].String
-	value, exists := GetStore().Get(key)
-
-	if !exists {
-		GetStore().Set(key, "1", 0)
+// hexistsCommand reports whether a hash field exists.
+func hexistsCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	exists, err := db.HExists(args[0].String, args[1].String)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	if exists {
 		return NewInteger(1), nil
 	}
+	return NewInteger(0), nil
+}
 
-	intVal, err := strconv.ParseInt(value, 10, 64)
+// hsetnxCommand sets a hash field only if it does not exist yet.
+func hsetnxCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	set, err := db.HSetNX(args[0].String, args[1].String, args[2].String)
 	if err != nil {
-		return NewError("ERR value is not an integer or out of range"), nil
+		return NewError(err.Error()), nil
+	}
+	if !set {
+		return NewInteger(0), nil
 	}
+	notifyKeyspaceEvent(db, notifyHash, "hset", args[0].String)
+	return NewInteger(1), nil
+}
 
-	intVal++
-	GetStore().Set(key, strconv.FormatInt(intVal, 10), 0)
+// hincrbyCommand adds a signed delta to the integer in a hash field.
+func hincrbyCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	delta, err := strconv.ParseInt(args[2].String, 10, 64)
+	if err != nil {
+		return NewError("ERR value is not an integer or out of range"), nil
+	}
 
-	return NewInteger(int(intVal)), nil
+	value, err := db.HIncrBy(args[0].String, args[1].String, delta)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	notifyKeyspaceEvent(db, notifyHash, "hincrby", args[0].String)
+	return NewInteger(int(value)), nil
 }
 
-// multiCommand begins a transaction, queueing subsequent commands.
-func multiCommand(args []RESP, conn net.Conn) (RESP, []byte) {
-	if len(args) > 0 {
-		return NewError("ERR wrong number of arguments for 'multi' command"), nil
+// hincrbyfloatCommand adds a floating point delta to a hash field.
+func hincrbyfloatCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	delta, err := strconv.ParseFloat(args[2].String, 64)
+	if err != nil || math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return NewError("ERR value is not a valid float"), nil
 	}
 
-	state := getClientState(conn)
-	state.mu.Lock()
-	state.InTransaction = true
-	state.QueuedCommands = make([]RESP, 0)
-	state.mu.Unlock()
-
-	return NewSimpleString("OK"), nil
+	formatted, err := db.HIncrByFloat(args[0].String, args[1].String, delta)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	notifyKeyspaceEvent(db, notifyHash, "hincrbyfloat", args[0].String)
+	return NewBulkString(formatted), nil
 }
 
-// execCommand executes queued transactional commands.
-func execCommand(args []RESP, conn net.Conn) (RESP, []byte) {
-	if len(args) > 0 {
-		return NewError("ERR wrong number of arguments for 'exec' command"), nil
+// hmgetCommand returns the values of the given hash fields, null for missing ones.
+func hmgetCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	values, found, err := db.HMGet(args[0].String, argStrings(args[1:]))
+	if err != nil {
+		return NewError(err.Error()), nil
 	}
 
-	state := getClientState(conn)
-	state.mu.Lock()
-	inTransaction := state.InTransaction
-	queuedCommands := state.QueuedCommands
-	state.InTransaction = false
-	state.QueuedCommands = nil
-	state.mu.Unlock()
+	items := make([]RESP, len(values))
+	for i, value := range values {
+		if found[i] {
+			items[i] = NewBulkString(value)
+		} else {
+			items[i] = NewNullBulkString()
+		}
+	}
+	return NewArray(items), nil
+}
 
-	if !inTransaction {
-		return NewError("ERR EXEC without MULTI"), nil
+// hlenCommand returns the number of fields in a hash.
+func hlenCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	n, err := db.HLen(args[0].String)
+	if err != nil {
+		return NewError(err.Error()), nil
 	}
+	return NewInteger(n), nil
+}
 
-    registry := NewRegistry()
-    results := make([]RESP, len(queuedCommands))
+// hkeysCommand returns every field of a hash.
+func hkeysCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	fields, err := db.HKeys(args[0].String)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	return bulkStrings(fields), nil
+}
 
-	for i, cmd := range queuedCommands {
-		if cmd.Type != Array || len(cmd.Array) == 0 {
-			results[i] = NewError("ERR invalid command format")
-			continue
-		}
+// hvalsCommand returns every value of a hash.
+func hvalsCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	values, err := db.HVals(args[0].String)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	return bulkStrings(values), nil
+}
 
-		cmdNameResp := cmd.Array[0]
-		if cmdNameResp.Type != BulkString {
-			results[i] = NewError("ERR command must be a bulk string")
-			continue
+// maxRandFieldCount bounds the count HRANDFIELD accepts, as Redis does, so
+// that negating it cannot overflow.
+const maxRandFieldCount = math.MaxInt64 / 2
+
+// hrandfieldCommand implements HRANDFIELD key [count [WITHVALUES]]. Without
+// a count it returns one field or null; with one, an array that is empty
+// when the key does not exist.
+func hrandfieldCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	if len(args) == 1 {
+		fields, err := db.HRandField(args[0].String, 1, false)
+		if err != nil {
+			return NewError(err.Error()), nil
 		}
+		if len(fields) == 0 {
+			return NewNullBulkString(), nil
+		}
+		return NewBulkString(fields[0]), nil
+	}
 
-		cmdName := strings.ToUpper(cmdNameResp.String)
-		handler, exists := registry.Get(cmdName)
-		if !exists {
-			results[i] = NewError(fmt.Sprintf("ERR unknown command '%s'", cmdName))
-			continue
+	count, err := strconv.ParseInt(args[1].String, 10, 64)
+	if err != nil {
+		return NewError("ERR value is not an integer or out of range"), nil
+	}
+	withValues := false
+	if len(args) == 3 {
+		if !strings.EqualFold(args[2].String, "WITHVALUES") {
+			return NewError("ERR syntax error"), nil
 		}
+		withValues = true
+	}
+	if count < -maxRandFieldCount || count > maxRandFieldCount {
+		return NewError("ERR value is out of range"), nil
+	}
 
-		args := cmd.Array[1:]
-		resp, _ := handler(args, conn)
-		results[i] = resp
+	fields, err := db.HRandField(args[0].String, int(count), withValues)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	return bulkStrings(fields), nil
+}
 
-        if registry.IsWriteCommand(cmdName) && !GetServerConfig().IsReplica {
-            bytesWritten := int64(len(resp.Marshal()))
-            IncrementOffset(bytesWritten)
-            propagateCommand(cmd)
-        }
+// argStrings returns the String field of each argument.
+func argStrings(args []RESP) []string {
+	values := make([]string, len(args))
+	for i, arg := range args {
+		values[i] = arg.String
 	}
+	return values
+}
 
-	return NewArray(results), nil
+// saddCommand adds members to a set and returns the number newly added.
+func saddCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	added, err := db.SAdd(args[0].String, argStrings(args[1:]))
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	if added > 0 {
+		notifyKeyspaceEvent(db, notifySet, "sadd", args[0].String)
+	}
+	return NewInteger(added), nil
 }
 
-// discardCommand aborts a transaction, clearing queued commands.
-func discardCommand(args []RESP, conn net.Conn) (RESP, []byte) {
-	if len(args) > 0 {
-		return NewError("ERR wrong number of arguments for 'discard' command"), nil
+// sremCommand removes members from a set and returns the number removed.
+func sremCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	removed, err := db.SRem(args[0].String, argStrings(args[1:]))
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	if removed > 0 {
+		notifyKeyspaceEvent(db, notifySet, "srem", args[0].String)
+		notifyIfDeleted(db, args[0].String)
 	}
+	return NewInteger(removed), nil
+}
 
-	state := getClientState(conn)
-	state.mu.Lock()
-	inTransaction := state.InTransaction
-	state.InTransaction = false
-	state.QueuedCommands = nil
-	state.mu.Unlock()
+// smembersCommand returns all members of a set.
+func smembersCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	members, err := db.SMembers(args[0].String)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
 
-	if !inTransaction {
-		return NewError("ERR DISCARD without MULTI"), nil
+	items := make([]RESP, len(members))
+	for i, member := range members {
+		items[i] = NewBulkString(member)
 	}
+	return NewSet(items), nil
+}
 
-	return NewSimpleString("OK"), nil
+// sismemberCommand reports whether a value is a member of a set.
+func sismemberCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	isMember, err := db.SIsMember(args[0].String, args[1].String)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	if isMember {
+		return NewInteger(1), nil
+	}
+	return NewInteger(0), nil
+}
+
+// scardCommand returns the number of members in a set.
+func scardCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	count, err := db.SCard(args[0].String)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	return NewInteger(count), nil
+}
+
+// setCombineCommand builds a handler returning the members of a set operation.
+func setCombineCommand(op setOp) Handler {
+	return func(ctx *CommandContext) (RESP, []byte) {
+		db, args := ctx.DB, ctx.Args
+		members, err := db.SCombine(op, argStrings(args))
+		if err != nil {
+			return NewError(err.Error()), nil
+		}
+
+		items := make([]RESP, len(members))
+		for i, member := range members {
+			items[i] = NewBulkString(member)
+		}
+		return NewSet(items), nil
+	}
+}
+
+// sintercardCommand implements SINTERCARD numkeys key [key ...] [LIMIT
+// limit], replying with the size of the intersection of the sets at keys,
+// or with limit once that many members are found. LIMIT 0 means no limit.
+func sintercardCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	numKeys, err := strconv.Atoi(args[0].String)
+	if err != nil || numKeys <= 0 {
+		return NewError("ERR numkeys should be greater than 0"), nil
+	}
+	if numKeys > len(args)-1 {
+		return NewError("ERR Number of keys can't be greater than number of args"), nil
+	}
+	keys := argStrings(args[1 : 1+numKeys])
+	limit := 0
+	for rest := args[1+numKeys:]; len(rest) > 0; rest = rest[2:] {
+		if len(rest) < 2 || !strings.EqualFold(rest[0].String, "LIMIT") {
+			return NewError("ERR syntax error"), nil
+		}
+		limit, err = strconv.Atoi(rest[1].String)
+		if err != nil || limit < 0 {
+			return NewError("ERR LIMIT can't be negative"), nil
+		}
+	}
+
+	count, err := db.SInterCard(keys, limit)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	return NewInteger(count), nil
+}
+
+// setCombineStoreCommand builds a handler storing a set operation into a destination key.
+func setCombineStoreCommand(op setOp) Handler {
+	return func(ctx *CommandContext) (RESP, []byte) {
+		db, args := ctx.DB, ctx.Args
+		count, existed, err := db.SCombineStore(op, args[0].String, argStrings(args[1:]))
+		if err != nil {
+			return NewError(err.Error()), nil
+		}
+		return storeReply(ctx, args[0].String, count, existed, notifySet, setStoreEvents[op])
+	}
+}
+
+// storeReply finishes a *STORE command that wrote count elements to dest
+// through storeDestinationLocked. A non-empty result raises event; an empty
+// one deleted dest, so it raises del if dest existed and replicates as
+// DEL dest, which is what it amounted to.
+func storeReply(ctx *CommandContext, dest string, count int, existed bool, class int, event string) (RESP, []byte) {
+	if count > 0 {
+		notifyKeyspaceEvent(ctx.DB, class, event, dest)
+		return NewInteger(count), nil
+	}
+	if existed {
+		notifyKeyspaceEvent(ctx.DB, notifyGeneric, "del", dest)
+	}
+	ctx.rewritePropagation(NewArray([]RESP{NewBulkString("DEL"), NewBulkString(dest)}))
+	return NewInteger(0), nil
+}
+
+// bulkStrings encodes values as an array of bulk strings.
+func bulkStrings(values []string) RESP {
+	items := make([]RESP, len(values))
+	for i, value := range values {
+		items[i] = NewBulkString(value)
+	}
+	return NewArray(items)
+}
+
+// pushCommand builds LPUSH (front) and RPUSH, which return the new length.
+func pushCommand(front bool, event string) Handler {
+	return func(ctx *CommandContext) (RESP, []byte) {
+		key := ctx.Args[0].String
+		length, err := ctx.DB.Push(key, argStrings(ctx.Args[1:]), front)
+		if err != nil {
+			return NewError(err.Error()), nil
+		}
+		notifyKeyspaceEvent(ctx.DB, notifyList, event, key)
+		ctx.markReady(ctx.selectedIndex(), key)
+		return NewInteger(length), nil
+	}
+}
+
+// popCommand builds LPOP (front) and RPOP. Without a count they reply with
+// one element; with one, with an array of up to count elements.
+func popCommand(front bool, event string) Handler {
+	return func(ctx *CommandContext) (RESP, []byte) {
+		db, args := ctx.DB, ctx.Args
+		count := 1
+		if len(args) == 2 {
+			n, err := strconv.Atoi(args[1].String)
+			if err != nil || n < 0 {
+				return NewError("ERR value is out of range, must be positive"), nil
+			}
+			count = n
+		}
+
+		popped, exists, err := db.Pop(args[0].String, count, front)
+		if err != nil {
+			return NewError(err.Error()), nil
+		}
+		if len(popped) > 0 {
+			notifyKeyspaceEvent(db, notifyList, event, args[0].String)
+			notifyIfDeleted(db, args[0].String)
+		}
+		if len(args) == 1 {
+			if len(popped) == 0 {
+				return NewNullBulkString(), nil
+			}
+			return NewBulkString(popped[0]), nil
+		}
+		if !exists {
+			return NewNullArray(), nil
+		}
+		return bulkStrings(popped), nil
+	}
+}
+
+// parseMPopArgs parses the numkeys key [key ...] LEFT|RIGHT [COUNT count]
+// arguments of LMPOP and BLMPOP. The commands are registered to accept a
+// call with no key, so that numkeys 0 is refused for what it is rather
+// than for the arity it implies.
+func parseMPopArgs(args []RESP) (keys []string, front bool, count int, msg string) {
+	numKeys, err := strconv.Atoi(args[0].String)
+	if err != nil || numKeys <= 0 {
+		return nil, false, 0, "ERR numkeys should be greater than 0"
+	}
+	if numKeys > len(args)-2 {
+		return nil, false, 0, "ERR syntax error"
+	}
+	keys = argStrings(args[1 : 1+numKeys])
+	rest := args[1+numKeys:]
+	switch strings.ToUpper(rest[0].String) {
+	case "LEFT":
+		front = true
+	case "RIGHT":
+	default:
+		return nil, false, 0, "ERR syntax error"
+	}
+	count = 1
+	switch {
+	case len(rest) == 1:
+	case len(rest) == 3 && strings.EqualFold(rest[1].String, "COUNT"):
+		count, err = strconv.Atoi(rest[2].String)
+		if err != nil || count <= 0 {
+			return nil, false, 0, "ERR count should be greater than 0"
+		}
+	default:
+		return nil, false, 0, "ERR syntax error"
+	}
+	return keys, front, count, ""
+}
+
+// mpopKeys returns the keys an LMPOP or SINTERCARD call names, given the
+// arguments from numkeys on.
+func mpopKeys(args []RESP) []string {
+	if len(args) < 2 {
+		return nil
+	}
+	numKeys, err := strconv.Atoi(args[0].String)
+	if err != nil || numKeys <= 0 || numKeys > len(args)-1 {
+		return nil
+	}
+	return argStrings(args[1 : 1+numKeys])
+}
+
+// mpop pops up to count elements from the first of keys holding a list. It
+// returns the reply, and the LPOP or RPOP replicas must apply instead; ok is
+// false when none of the keys holds a list.
+func mpop(db *KeyValueStore, keys []string, front bool, count int) (reply, effect RESP, ok bool) {
+	key, popped, err := db.MPop(keys, count, front)
+	if err != nil {
+		return NewError(err.Error()), RESP{}, true
+	}
+	if key == "" {
+		return RESP{}, RESP{}, false
+	}
+	cmd, event := "RPOP", "rpop"
+	if front {
+		cmd, event = "LPOP", "lpop"
+	}
+	notifyKeyspaceEvent(db, notifyList, event, key)
+	notifyIfDeleted(db, key)
+	effect = NewArray([]RESP{NewBulkString(cmd), NewBulkString(key), NewBulkString(strconv.Itoa(len(popped)))})
+	return NewArray([]RESP{NewBulkString(key), bulkStrings(popped)}), effect, true
+}
+
+// lmpopCommand implements LMPOP numkeys key [key ...] LEFT|RIGHT [COUNT
+// count], replying with the key popped from and its elements, or null when
+// every key is empty. It replicates as the LPOP or RPOP it amounted to.
+func lmpopCommand(ctx *CommandContext) (RESP, []byte) {
+	keys, front, count, msg := parseMPopArgs(ctx.Args)
+	if msg != "" {
+		return NewError(msg), nil
+	}
+	reply, effect, ok := mpop(ctx.DB, keys, front, count)
+	switch {
+	case !ok:
+		ctx.suppressPropagation()
+		return NewNullArray(), nil
+	case reply.Type == Error:
+		return reply, nil
+	}
+	ctx.rewritePropagation(effect)
+	return reply, nil
+}
+
+// blmpopCommand implements BLMPOP timeout numkeys key [key ...] LEFT|RIGHT
+// [COUNT count]: LMPOP that waits up to timeout seconds, 0 meaning forever,
+// for one of the keys to get a list, replying null if none does. Waiters are
+// served in the order they blocked, and each pops from the first of its keys
+// holding a list, in argument order.
+//
+// A waiter may be served by the command that pushed to its key, so the pop
+// replicates itself as an LPOP or RPOP when it happens, and BLMPOP is never
+// replicated. BLMPOP is one of the blockingWrites: it holds the locks writes
+// run under only for its first check, taken here, since the pushers that
+// serve it later already hold them.
+func blmpopCommand(ctx *CommandContext) (RESP, []byte) {
+	seconds, err := strconv.ParseFloat(ctx.Args[0].String, 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return NewError("ERR timeout is not a float or out of range"), nil
+	}
+	if seconds < 0 {
+		return NewError("ERR timeout is negative"), nil
+	}
+	keys, front, count, msg := parseMPopArgs(ctx.Args[1:])
+	if msg != "" {
+		return NewError(msg), nil
+	}
+	ctx.suppressPropagation()
+
+	predicate := func() (RESP, bool) {
+		db := ctx.selectedDB()
+		reply, effect, ok := mpop(db, keys, front, count)
+		if ok && reply.Type != Error {
+			ctx.Server.persistence.MarkDirty()
+			if index := ctx.Server.dbs.IndexOf(db); index >= 0 {
+				ctx.Server.propagateToDB(index, effect)
+			}
+		}
+		return reply, ok
+	}
+
+	ctx.Client.mu.RLock()
+	executing := ctx.Client.Executing
+	ctx.Client.mu.RUnlock()
+	var release func()
+	if !executing {
+		// Inside EXEC or a script these are already held.
+		server := ctx.Server
+		server.scriptMu.RLock()
+		server.repl.snapshotMu.RLock()
+		release = func() {
+			server.repl.snapshotMu.RUnlock()
+			server.scriptMu.RUnlock()
+		}
+	}
+
+	timeout := time.Duration(seconds * float64(time.Second))
+	reply, ok := ctx.Server.blocks.Block(ctx.Client, "blmpop", keys, BlockConsume, timeout, predicate, release)
+	if !ok {
+		return NewNullArray(), nil
+	}
+	return reply, nil
+}
+
+// llenCommand returns the length of a list.
+func llenCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	length, err := db.LLen(args[0].String)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	return NewInteger(length), nil
+}
+
+// lrangeCommand returns the elements between two inclusive indexes; negative
+// indexes count from the tail.
+func lrangeCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	start, err := strconv.Atoi(args[1].String)
+	if err != nil {
+		return NewError("ERR value is not an integer or out of range"), nil
+	}
+	stop, err := strconv.Atoi(args[2].String)
+	if err != nil {
+		return NewError("ERR value is not an integer or out of range"), nil
+	}
+
+	elements, err := db.LRange(args[0].String, start, stop)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	return bulkStrings(elements), nil
+}
+
+// lindexCommand returns the element at an index, or null.
+func lindexCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	index, err := strconv.Atoi(args[1].String)
+	if err != nil {
+		return NewError("ERR value is not an integer or out of range"), nil
+	}
+
+	element, ok, err := db.LIndex(args[0].String, index)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	if !ok {
+		return NewNullBulkString(), nil
+	}
+	return NewBulkString(element), nil
+}
+
+// lsetCommand replaces the element at an index.
+func lsetCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	index, err := strconv.Atoi(args[1].String)
+	if err != nil {
+		return NewError("ERR value is not an integer or out of range"), nil
+	}
+
+	if err := db.LSet(args[0].String, index, args[2].String); err != nil {
+		return NewError(err.Error()), nil
+	}
+	notifyKeyspaceEvent(db, notifyList, "lset", args[0].String)
+	return NewSimpleString("OK"), nil
+}
+
+// linsertCommand implements LINSERT key BEFORE|AFTER pivot element.
+func linsertCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	var before bool
+	switch strings.ToUpper(args[1].String) {
+	case "BEFORE":
+		before = true
+	case "AFTER":
+	default:
+		return NewError("ERR syntax error"), nil
+	}
+
+	length, err := db.LInsert(args[0].String, before, args[2].String, args[3].String)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	if length > 0 {
+		notifyKeyspaceEvent(db, notifyList, "linsert", args[0].String)
+	}
+	return NewInteger(length), nil
+}
+
+// lremCommand removes occurrences of an element and returns how many went.
+func lremCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	count, err := strconv.Atoi(args[1].String)
+	if err != nil {
+		return NewError("ERR value is not an integer or out of range"), nil
+	}
+
+	removed, err := db.LRem(args[0].String, count, args[2].String)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	if removed > 0 {
+		notifyKeyspaceEvent(db, notifyList, "lrem", args[0].String)
+		notifyIfDeleted(db, args[0].String)
+	}
+	return NewInteger(removed), nil
+}
+
+// ltrimCommand keeps only the elements between two inclusive indexes.
+func ltrimCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	start, err := strconv.Atoi(args[1].String)
+	if err != nil {
+		return NewError("ERR value is not an integer or out of range"), nil
+	}
+	stop, err := strconv.Atoi(args[2].String)
+	if err != nil {
+		return NewError("ERR value is not an integer or out of range"), nil
+	}
+
+	trimmed, err := db.LTrim(args[0].String, start, stop)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	if trimmed {
+		notifyKeyspaceEvent(db, notifyList, "ltrim", args[0].String)
+		notifyIfDeleted(db, args[0].String)
+	}
+	return NewSimpleString("OK"), nil
+}
+
+// lposCommand implements LPOS key element [RANK rank] [COUNT num-matches]
+// [MAXLEN len]. Without COUNT it replies with the first match or null; with
+// it, with an array of matches.
+func lposCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	opts := LPosOptions{Rank: 1}
+	withCount := false
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return NewError("ERR syntax error"), nil
+		}
+		n, err := strconv.Atoi(args[i+1].String)
+		if err != nil {
+			return NewError("ERR value is not an integer or out of range"), nil
+		}
+		switch strings.ToUpper(args[i].String) {
+		case "RANK":
+			if n == 0 {
+				return NewError("ERR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list"), nil
+			}
+			opts.Rank = n
+		case "COUNT":
+			if n < 0 {
+				return NewError("ERR COUNT can't be negative"), nil
+			}
+			opts.Count, withCount = n, true
+		case "MAXLEN":
+			if n < 0 {
+				return NewError("ERR MAXLEN can't be negative"), nil
+			}
+			opts.MaxLen = n
+		default:
+			return NewError("ERR syntax error"), nil
+		}
+	}
+	if !withCount {
+		opts.Count = 1
+	}
+
+	matches, err := db.LPos(args[0].String, args[1].String, opts)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	if !withCount {
+		if len(matches) == 0 {
+			return NewNullBulkString(), nil
+		}
+		return NewInteger(matches[0]), nil
+	}
+	items := make([]RESP, len(matches))
+	for i, index := range matches {
+		items[i] = NewInteger(index)
+	}
+	return NewArray(items), nil
+}
+
+// zaddCommand implements ZADD key [NX|XX] [GT|LT] [CH] score member
+// [score member ...], returning how many members were added, or added and
+// updated with CH.
+func zaddCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	var opts ZAddOptions
+	ch := false
+	i := 1
+flags:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i].String) {
+		case "NX":
+			opts.NX = true
+		case "XX":
+			opts.XX = true
+		case "GT":
+			opts.GT = true
+		case "LT":
+			opts.LT = true
+		case "CH":
+			ch = true
+		default:
+			break flags
+		}
+	}
+	pairs := args[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return NewError("ERR syntax error"), nil
+	}
+	if opts.NX && opts.XX {
+		return NewError("ERR XX and NX options at the same time are not compatible"), nil
+	}
+	if (opts.GT && opts.LT) || (opts.NX && (opts.GT || opts.LT)) {
+		return NewError("ERR GT, LT, and/or NX options at the same time are not compatible"), nil
+	}
+	members := make([]ZMember, len(pairs)/2)
+	for j := range members {
+		score, ok := parseScore(pairs[2*j].String)
+		if !ok {
+			return NewError("ERR value is not a valid float"), nil
+		}
+		members[j] = ZMember{Member: pairs[2*j+1].String, Score: score}
+	}
+
+	added, updated, err := db.ZAdd(args[0].String, members, opts)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	if added+updated > 0 {
+		notifyKeyspaceEvent(db, notifyZset, "zadd", args[0].String)
+	}
+	if ch {
+		return NewInteger(added + updated), nil
+	}
+	return NewInteger(added), nil
+}
+
+// zscoreCommand returns the score of a sorted set member or null.
+func zscoreCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	score, exists, err := db.ZScore(args[0].String, args[1].String)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	if !exists {
+		return NewNullBulkString(), nil
+	}
+	return NewDouble(score), nil
+}
+
+// zcardCommand returns the number of members in a sorted set.
+func zcardCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	n, err := db.ZCard(args[0].String)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	return NewInteger(n), nil
+}
+
+// zremCommand removes members from a sorted set and returns how many were removed.
+func zremCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	removed, err := db.ZRem(args[0].String, argStrings(args[1:]))
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	if removed > 0 {
+		notifyKeyspaceEvent(db, notifyZset, "zrem", args[0].String)
+		notifyIfDeleted(db, args[0].String)
+	}
+	return NewInteger(removed), nil
+}
+
+// zrangeCommand implements ZRANGE key start stop [BYSCORE] [REV]
+// [LIMIT offset count] [WITHSCORES].
+func zrangeCommand(ctx *CommandContext) (RESP, []byte) {
+	return zrangeGeneric(ctx, false)
+}
+
+// zrangebyscoreCommand implements ZRANGEBYSCORE key min max [WITHSCORES]
+// [LIMIT offset count], the older spelling of ZRANGE BYSCORE.
+func zrangebyscoreCommand(ctx *CommandContext) (RESP, []byte) {
+	return zrangeGeneric(ctx, true)
+}
+
+// zrangeGeneric serves ZRANGE and ZRANGEBYSCORE; legacy is set for the
+// latter, which takes neither BYSCORE nor REV. WITHSCORES interleaves the
+// scores with the members under RESP2; RESP3 clients get a [member, score]
+// pair per member, as Redis sends them.
+func zrangeGeneric(ctx *CommandContext, legacy bool) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	spec, withScores, msg := parseZRange(args[1:], legacy, true)
+	if msg != "" {
+		return NewError(msg), nil
+	}
+	members, err := db.ZRange(args[0].String, spec)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+
+	pairs := withScores && ctx.Client.Proto() == RESP3
+	items := make([]RESP, 0, len(members)*2)
+	for _, m := range members {
+		switch {
+		case pairs:
+			items = append(items, NewArray([]RESP{NewBulkString(m.Member), NewDouble(m.Score)}))
+		case withScores:
+			items = append(items, NewBulkString(m.Member), NewDouble(m.Score))
+		default:
+			items = append(items, NewBulkString(m.Member))
+		}
+	}
+	return NewArray(items), nil
+}
+
+// zrangestoreCommand implements ZRANGESTORE dst src min max [BYSCORE] [REV]
+// [LIMIT offset count], storing what ZRANGE would return as a new sorted
+// set at dst.
+func zrangestoreCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	spec, _, msg := parseZRange(args[2:], false, false)
+	if msg != "" {
+		return NewError(msg), nil
+	}
+	count, existed, err := db.ZRangeStore(args[0].String, args[1].String, spec)
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	return storeReply(ctx, args[0].String, count, existed, notifyZset, "zrangestore")
+}
+
+// parseZRange parses min, max and the options that follow them in ZRANGE
+// and its relatives. legacy is set for ZRANGEBYSCORE, which is always by
+// score and takes neither BYSCORE nor REV; WITHSCORES is a syntax error
+// unless withScoresOK. With REV the score bounds come highest first, as in
+// Redis. On failure it returns the error message to reply with.
+func parseZRange(args []RESP, legacy, withScoresOK bool) (spec ZRangeSpec, withScores bool, msg string) {
+	spec.ByScore, spec.Count = legacy, -1
+	limited := false
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i].String) {
+		case "BYSCORE":
+			if legacy {
+				return spec, false, "ERR syntax error"
+			}
+			spec.ByScore = true
+		case "REV":
+			if legacy {
+				return spec, false, "ERR syntax error"
+			}
+			spec.Rev = true
+		case "WITHSCORES":
+			if !withScoresOK {
+				return spec, false, "ERR syntax error"
+			}
+			withScores = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return spec, false, "ERR syntax error"
+			}
+			var err error
+			if spec.Offset, err = strconv.Atoi(args[i+1].String); err != nil {
+				return spec, false, "ERR value is not an integer or out of range"
+			}
+			if spec.Count, err = strconv.Atoi(args[i+2].String); err != nil {
+				return spec, false, "ERR value is not an integer or out of range"
+			}
+			limited = true
+			i += 2
+		default:
+			return spec, false, "ERR syntax error"
+		}
+	}
+	if limited && !spec.ByScore {
+		return spec, false, "ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX"
+	}
+
+	if spec.ByScore {
+		lowerArg, upperArg := args[0].String, args[1].String
+		if spec.Rev {
+			lowerArg, upperArg = upperArg, lowerArg
+		}
+		var ok, ok2 bool
+		spec.Lower, ok = parseScoreBound(lowerArg)
+		spec.Upper, ok2 = parseScoreBound(upperArg)
+		if !ok || !ok2 {
+			return spec, false, "ERR min or max is not a float"
+		}
+		return spec, withScores, ""
+	}
+	var err1, err2 error
+	spec.Start, err1 = strconv.Atoi(args[0].String)
+	spec.Stop, err2 = strconv.Atoi(args[1].String)
+	if err1 != nil || err2 != nil {
+		return spec, false, "ERR value is not an integer or out of range"
+	}
+	return spec, withScores, ""
+}
+
+// multiCommand begins a transaction, queueing subsequent commands.
+func multiCommand(ctx *CommandContext) (RESP, []byte) {
+	state := ctx.Client
+	state.mu.Lock()
+	state.InTransaction = true
+	state.TxAborted = false
+	state.QueuedCommands = make([]RESP, 0)
+	state.mu.Unlock()
+
+	return NewSimpleString("OK"), nil
+}
+
+// execCommand executes queued transactional commands through the same
+// dispatch path as top-level commands.
+func execCommand(ctx *CommandContext) (RESP, []byte) {
+	state := ctx.Client
+	state.mu.Lock()
+	inTransaction, aborted := state.InTransaction, state.TxAborted
+	queuedCommands := state.QueuedCommands
+	state.InTransaction = false
+	state.TxAborted = false
+	state.QueuedCommands = nil
+	state.mu.Unlock()
+
+	if !inTransaction {
+		return NewError("ERR EXEC without MULTI"), nil
+	}
+	dirty := ctx.Server.watches.Unwatch(ctx.Conn)
+	if aborted {
+		return NewError("EXECABORT Transaction discarded because of previous errors"), nil
+	}
+	if dirty {
+		return NewNullArray(), nil
+	}
+
+	// Blocking commands inside a transaction must not wait.
+	state.mu.Lock()
+	state.Executing = true
+	state.mu.Unlock()
+	defer func() {
+		state.mu.Lock()
+		state.Executing = false
+		state.mu.Unlock()
+	}()
+
+	results := make([]RESP, len(queuedCommands))
+	wrapped := false
+
+	for i, cmd := range queuedCommands {
+		if cmd.Type != Array || len(cmd.Array) == 0 {
+			results[i] = NewError("ERR invalid command format")
+			continue
+		}
+
+		cmdNameResp := cmd.Array[0]
+		if cmdNameResp.Type != BulkString {
+			results[i] = NewError("ERR command must be a bulk string")
+			continue
+		}
+
+		cmdName := strings.ToUpper(cmdNameResp.String)
+		handler, exists := ctx.Registry.Get(cmdName)
+		if !exists {
+			results[i] = NewError(fmt.Sprintf("ERR unknown command '%s'", cmdName))
+			continue
+		}
+
+		// Replicas see the transaction's writes as a MULTI/EXEC block so
+		// they apply them together; read-only transactions send nothing.
+		if !wrapped && ctx.Registry.IsWriteCommand(cmdName) && !ctx.Config.IsReplica {
+			ctx.Server.propagateCommand(NewArray([]RESP{NewBulkString("MULTI")}))
+			wrapped = true
+		}
+		results[i], _ = ctx.Server.dispatchCommand(cmd, cmdName, handler, ctx.Conn)
+	}
+
+	if wrapped {
+		ctx.Server.propagateCommand(NewArray([]RESP{NewBulkString("EXEC")}))
+	}
+	return NewArray(results), nil
+}
+
+// subscribeCommand subscribes the connection to channels and enters subscriber mode.
+func subscribeCommand(ctx *CommandContext) (RESP, []byte) {
+	ctx.Server.pubsub.Subscribe(ctx.Conn, argStrings(ctx.Args))
+	updateSubscribedMode(ctx)
+
+	// Confirmations are written through the subscriber queue so they can't
+	// be overtaken by messages published right after subscribing.
+	return RESP{}, nil
+}
+
+// unsubscribeCommand removes channel subscriptions, leaving subscriber mode when none remain.
+func unsubscribeCommand(ctx *CommandContext) (RESP, []byte) {
+	reply, queued := ctx.Server.pubsub.Unsubscribe(ctx.Conn, argStrings(ctx.Args))
+	updateSubscribedMode(ctx)
+	if queued {
+		return RESP{}, nil
+	}
+	return reply, nil
+}
+
+// psubscribeCommand subscribes the connection to glob patterns and enters subscriber mode.
+func psubscribeCommand(ctx *CommandContext) (RESP, []byte) {
+	ctx.Server.pubsub.PSubscribe(ctx.Conn, argStrings(ctx.Args))
+	updateSubscribedMode(ctx)
+	return RESP{}, nil
+}
+
+// punsubscribeCommand removes pattern subscriptions, leaving subscriber mode when none remain.
+func punsubscribeCommand(ctx *CommandContext) (RESP, []byte) {
+	reply, queued := ctx.Server.pubsub.PUnsubscribe(ctx.Conn, argStrings(ctx.Args))
+	updateSubscribedMode(ctx)
+	if queued {
+		return RESP{}, nil
+	}
+	return reply, nil
+}
+
+// pubsubCommand implements the PUBSUB introspection subcommands.
+func pubsubCommand(ctx *CommandContext) (RESP, []byte) {
+	args := ctx.Args
+	pm := ctx.Server.pubsub
+	sub := strings.ToUpper(args[0].String)
+	switch sub {
+	case "CHANNELS":
+		if len(args) > 2 {
+			return NewError("ERR wrong number of arguments for 'pubsub|channels' command"), nil
+		}
+		pattern := ""
+		if len(args) == 2 {
+			pattern = args[1].String
+		}
+		channels := pm.ActiveChannels(pattern)
+		items := make([]RESP, len(channels))
+		for i, channel := range channels {
+			items[i] = NewBulkString(channel)
+		}
+		return NewArray(items), nil
+	case "NUMSUB":
+		items := make([]RESP, 0, (len(args)-1)*2)
+		for _, arg := range args[1:] {
+			items = append(items, NewBulkString(arg.String), NewInteger(pm.NumSub(arg.String)))
+		}
+		return NewArray(items), nil
+	case "NUMPAT":
+		if len(args) != 1 {
+			return NewError("ERR wrong number of arguments for 'pubsub|numpat' command"), nil
+		}
+		return NewInteger(pm.NumPat()), nil
+	}
+	return NewError("ERR unknown subcommand '" + sub + "'. Try PUBSUB CHANNELS, NUMSUB or NUMPAT"), nil
+}
+
+// clientSubcommands are the CLIENT subcommands, dispatched by the Registry.
+var clientSubcommands = []Subcommand{
+	{Name: "ID", Handler: clientIDCommand,
+		Help: []string{"Return the ID of the current connection."}},
+	{Name: "GETNAME", Handler: clientGetnameCommand,
+		Help: []string{"Return the name of the current connection."}},
+	{Name: "SETNAME", Handler: clientSetnameCommand, MinArgs: 1, MaxArgs: 1, Usage: "<connection-name>",
+		Help: []string{"Assign the name <connection-name> to the current connection."}},
+	{Name: "LIST", Handler: clientListCommand, MaxArgs: -1, Usage: "[ID <id> [<id> ...]]",
+		Help: []string{"Return information about client connections."}},
+	{Name: "KILL", Handler: clientKillCommand, MinArgs: 1, MaxArgs: -1, Usage: "<ip:port> | [ID <id>] [ADDR <ip:port>] [SKIPME yes|no]",
+		Help: []string{"Kill the connection at <ip:port>, or every connection matching the filters."}},
+	{Name: "UNBLOCK", Handler: clientUnblockCommand, MinArgs: 1, MaxArgs: 2, Usage: "<clientid> [TIMEOUT|ERROR]",
+		Help: []string{"Unblock the specified blocked client."}},
+	{Name: "TRACKING", Handler: clientTrackingCommand, MinArgs: 1, MaxArgs: -1, Usage: "(ON|OFF) [REDIRECT <id>]",
+		Help: []string{"Control server assisted client side caching."}},
+	{Name: "GETREDIR", Handler: clientGetredirCommand,
+		Help: []string{"Return the client ID invalidations are redirected to, 0 for none or -1 when not tracking."}},
+}
+
+// clientIDCommand returns the connection's ID.
+func clientIDCommand(ctx *CommandContext) (RESP, []byte) {
+	state := ctx.Client
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+	return NewInteger(int(state.ID)), nil
+}
+
+// clientUnblockCommand wakes a client blocked in a blocking command, as if
+// it timed out or, with ERROR, with an UNBLOCKED error.
+func clientUnblockCommand(ctx *CommandContext) (RESP, []byte) {
+	id, err := strconv.ParseInt(ctx.Args[0].String, 10, 64)
+	if err != nil {
+		return NewError("ERR value is not an integer or out of range"), nil
+	}
+	withError := false
+	if len(ctx.Args) == 2 {
+		switch strings.ToUpper(ctx.Args[1].String) {
+		case "TIMEOUT":
+		case "ERROR":
+			withError = true
+		default:
+			return NewError("ERR CLIENT UNBLOCK reason should be TIMEOUT or ERROR"), nil
+		}
+	}
+	if ctx.Server.blocks.Unblock(id, withError) {
+		return NewInteger(1), nil
+	}
+	return NewInteger(0), nil
+}
+
+// clientSetnameCommand names the connection.
+func clientSetnameCommand(ctx *CommandContext) (RESP, []byte) {
+	if !validClientName(ctx.Args[0].String) {
+		return NewError("ERR Client names cannot contain spaces, newlines or special characters."), nil
+	}
+	state := ctx.Client
+	state.mu.Lock()
+	state.Name = ctx.Args[0].String
+	state.mu.Unlock()
+	return NewSimpleString("OK"), nil
+}
+
+// clientGetnameCommand returns the connection's name, or nil if it has none.
+func clientGetnameCommand(ctx *CommandContext) (RESP, []byte) {
+	state := ctx.Client
+	state.mu.RLock()
+	name := state.Name
+	state.mu.RUnlock()
+	if name == "" {
+		return NewNullBulkString(), nil
+	}
+	return NewBulkString(name), nil
+}
+
+// clientGetredirCommand returns where the connection's invalidations go.
+func clientGetredirCommand(ctx *CommandContext) (RESP, []byte) {
+	return NewInteger(int(ctx.Server.tracking.Redirect(ctx.Client))), nil
+}
+
+// clientListCommand renders one line per connection, optionally only the given IDs.
+func clientListCommand(ctx *CommandContext) (RESP, []byte) {
+	server, args := ctx.Server, ctx.Args
+	var ids map[int64]bool
+	if len(args) > 0 {
+		if strings.ToUpper(args[0].String) != "ID" || len(args) < 2 {
+			return NewError("ERR syntax error"), nil
+		}
+		ids = make(map[int64]bool)
+		for _, arg := range args[1:] {
+			id, err := strconv.ParseInt(arg.String, 10, 64)
+			if err != nil || id <= 0 {
+				return NewError("ERR Invalid client ID"), nil
+			}
+			ids[id] = true
+		}
+	}
+
+	var builder strings.Builder
+	for _, client := range server.snapshotClients() {
+		if ids != nil && !ids[client.ID] {
+			continue
+		}
+		builder.WriteString(client.String())
+		builder.WriteByte('\n')
+	}
+	return NewBulkString(builder.String()), nil
+}
+
+// clientKillCommand closes matching connections. The old single-argument form
+// takes an address and replies OK; the filter form takes ID, ADDR and SKIPME
+// pairs and replies with the number of clients killed.
+func clientKillCommand(ctx *CommandContext) (RESP, []byte) {
+	server, args, conn := ctx.Server, ctx.Args, ctx.Conn
+	if len(args) == 1 {
+		for _, client := range server.snapshotClients() {
+			if client.Addr == args[0].String {
+				server.killClient(conn, client)
+				return NewSimpleString("OK"), nil
+			}
+		}
+		return NewError("ERR No such client"), nil
+	}
+	if len(args)%2 != 0 {
+		return NewError("ERR syntax error"), nil
+	}
+
+	var id int64
+	addr := ""
+	skipMe := true
+	for i := 0; i < len(args); i += 2 {
+		value := args[i+1].String
+		switch strings.ToUpper(args[i].String) {
+		case "ID":
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || parsed <= 0 {
+				return NewError("ERR client-id should be greater than 0"), nil
+			}
+			id = parsed
+		case "ADDR":
+			addr = value
+		case "SKIPME":
+			switch strings.ToLower(value) {
+			case "yes":
+				skipMe = true
+			case "no":
+				skipMe = false
+			default:
+				return NewError("ERR syntax error"), nil
+			}
+		default:
+			return NewError("ERR syntax error"), nil
+		}
+	}
+
+	killed := 0
+	for _, client := range server.snapshotClients() {
+		if (id != 0 && client.ID != id) || (addr != "" && client.Addr != addr) {
+			continue
+		}
+		if skipMe && client.conn == conn {
+			continue
+		}
+		server.killClient(conn, client)
+		killed++
+	}
+	return NewInteger(killed), nil
+}
+
+// helloCommand negotiates the connection's protocol version and returns the
+// server info map. HELLO version AUTH username password authenticates in the
+// same step, which is the only way HELLO runs before AUTH.
+func helloCommand(ctx *CommandContext) (RESP, []byte) {
+	state := ctx.Client
+	proto := state.Proto()
+	var credentials []RESP
+	if len(ctx.Args) > 0 {
+		version, err := strconv.Atoi(ctx.Args[0].String)
+		if err != nil {
+			return NewError("ERR Protocol version is not an integer or out of range"), nil
+		}
+		if version != RESP2 && version != RESP3 {
+			return NewError("NOPROTO unsupported protocol version"), nil
+		}
+		for i := 1; i < len(ctx.Args); i++ {
+			if strings.EqualFold(ctx.Args[i].String, "AUTH") && i+2 < len(ctx.Args) {
+				credentials = ctx.Args[i+1 : i+3]
+				i += 2
+				continue
+			}
+			return NewError("ERR Syntax error in HELLO option '" + ctx.Args[i].String + "'"), nil
+		}
+		proto = version
+	}
+	if credentials != nil {
+		if msg := authenticate(ctx.Client, ctx.Config, credentials[0].String, credentials[1].String); msg != "" {
+			return NewError(msg), nil
+		}
+	} else if !authenticated(ctx.Client, ctx.Config) {
+		return NewError(errHelloAuth), nil
+	}
+
+	state.mu.Lock()
+	state.Protocol = proto
+	id := state.ID
+	state.mu.Unlock()
+
+	role := "master"
+	if ctx.Config.IsReplica {
+		role = "replica"
+	}
+	return NewMap([]RESP{
+		NewBulkString("server"), NewBulkString("redis"),
+		NewBulkString("version"), NewBulkString(ServerVersion),
+		NewBulkString("proto"), NewInteger(proto),
+		NewBulkString("id"), NewInteger(int(id)),
+		NewBulkString("mode"), NewBulkString("standalone"),
+		NewBulkString("role"), NewBulkString(role),
+		NewBulkString("modules"), NewArray([]RESP{}),
+	}), nil
+}
+
+// updateSubscribedMode syncs the connection's subscriber flag with its subscriptions.
+func updateSubscribedMode(ctx *CommandContext) {
+	subscribed := ctx.Server.pubsub.SubscriptionCount(ctx.Conn) > 0
+	state := ctx.Client
+	state.mu.Lock()
+	state.Subscribed = subscribed
+	state.mu.Unlock()
+}
+
+// publishCommand posts a message to a channel and returns the number of receivers.
+func publishCommand(ctx *CommandContext) (RESP, []byte) {
+	args := ctx.Args
+	return NewInteger(ctx.Server.pubsub.Publish(args[0].String, args[1].String)), nil
+}
+
+// discardCommand aborts a transaction, clearing queued commands.
+func discardCommand(ctx *CommandContext) (RESP, []byte) {
+	state := ctx.Client
+	state.mu.Lock()
+	inTransaction := state.InTransaction
+	state.InTransaction = false
+	state.TxAborted = false
+	state.QueuedCommands = nil
+	state.mu.Unlock()
+
+	if !inTransaction {
+		return NewError("ERR DISCARD without MULTI"), nil
+	}
+	ctx.Server.watches.Unwatch(ctx.Conn)
+
+	return NewSimpleString("OK"), nil
+}
+
+// watchCommand watches keys of the selected database, so that the next EXEC
+// runs nothing if any of them is written first.
+func watchCommand(ctx *CommandContext) (RESP, []byte) {
+	ctx.Server.watches.Watch(ctx.Conn, ctx.selectedIndex(), argStrings(ctx.Args))
+	return NewSimpleString("OK"), nil
+}
+
+// unwatchCommand forgets every key the connection watches.
+func unwatchCommand(ctx *CommandContext) (RESP, []byte) {
+	ctx.Server.watches.Unwatch(ctx.Conn)
+	return NewSimpleString("OK"), nil
+}
+
+// resetCommand returns the connection to the state of a new one, for
+// connection pools handing it to the next user: it discards any transaction
+// and watched keys, drops subscriptions and monitor mode, and clears the
+// settings ClientState.reset covers.
+func resetCommand(ctx *CommandContext) (RESP, []byte) {
+	ctx.Server.watches.Unwatch(ctx.Conn)
+	ctx.Server.pubsub.Reset(ctx.Conn)
+	ctx.Server.monitors.Reset(ctx.Conn)
+	ctx.Server.tracking.Disable(ctx.Client)
+	ctx.Client.reset(ctx.Config)
+	return NewSimpleString("RESET"), nil
+}
+
+// rateLimitReply formats a limiter result as [allowed, remaining, retry-after-ms]
+// and replicates the resulting state instead of the clock-dependent command.
+func rateLimitReply(ctx *CommandContext, key string, result RateLimitResult) RESP {
+	ttlMs := strconv.FormatInt(result.TTL.Milliseconds(), 10)
+	ctx.rewritePropagation(NewArray([]RESP{
+		NewBulkString("SET"), NewBulkString(key), NewBulkString(result.State),
+		NewBulkString("PX"), NewBulkString(ttlMs),
+	}))
+
+	allowed := 0
+	if result.Allowed {
+		allowed = 1
+	}
+	return NewArray([]RESP{
+		NewInteger(allowed),
+		NewInteger(int(result.Remaining)),
+		NewInteger(int(result.RetryAfter)),
+	})
+}
+
+// rlLimitCommand implements RL.LIMIT key max-tokens refill-per-second cost as a token bucket.
+func rlLimitCommand(ctx *CommandContext) (RESP, []byte) {
+	maxTokens, err := strconv.ParseInt(ctx.Args[1].String, 10, 64)
+	if err != nil || maxTokens <= 0 {
+		return NewError("ERR max-tokens must be a positive integer"), nil
+	}
+	refill, err := strconv.ParseFloat(ctx.Args[2].String, 64)
+	if err != nil || refill <= 0 || math.IsInf(refill, 0) {
+		return NewError("ERR refill-per-second must be a positive number"), nil
+	}
+	cost, err := strconv.ParseInt(ctx.Args[3].String, 10, 64)
+	if err != nil || cost < 0 {
+		return NewError("ERR cost must be a non-negative integer"), nil
+	}
+
+	result, err := ctx.DB.TokenBucket(ctx.Args[0].String, maxTokens, refill, cost, time.Now())
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	return rateLimitReply(ctx, ctx.Args[0].String, result), nil
+}
+
+// rlSlidingCommand implements RL.SLIDING key window-ms max-events as a sliding-window counter.
+func rlSlidingCommand(ctx *CommandContext) (RESP, []byte) {
+	windowMs, err := strconv.ParseInt(ctx.Args[1].String, 10, 64)
+	if err != nil || windowMs <= 0 {
+		return NewError("ERR window-ms must be a positive integer"), nil
+	}
+	maxEvents, err := strconv.ParseInt(ctx.Args[2].String, 10, 64)
+	if err != nil || maxEvents <= 0 {
+		return NewError("ERR max-events must be a positive integer"), nil
+	}
+
+	result, err := ctx.DB.SlidingWindow(ctx.Args[0].String, windowMs, maxEvents, time.Now())
+	if err != nil {
+		return NewError(err.Error()), nil
+	}
+	return rateLimitReply(ctx, ctx.Args[0].String, result), nil
 }
@@ -0,0 +1,885 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testContext returns a context that runs args against db with a client,
+// configuration and server of its own, so handlers can be called directly.
+func testContext(db *KeyValueStore, args ...string) *CommandContext {
+	resp := make([]RESP, len(args))
+	for i, arg := range args {
+		resp[i] = NewBulkString(arg)
+	}
+	server := newServer(1)
+	server.registry = NewRegistry(false)
+	return &CommandContext{
+		Args:     resp,
+		Client:   &ClientState{},
+		DB:       db,
+		Registry: server.registry,
+		Config:   server.Config(),
+		Server:   server,
+	}
+}
+
+// expectReply fails the test unless got encodes the same as want.
+func expectReply(t *testing.T, got, want RESP) {
+	t.Helper()
+	if got.Marshal() != want.Marshal() {
+		t.Fatalf("reply = %q, want %q", got.Marshal(), want.Marshal())
+	}
+}
+
+func TestSetGet(t *testing.T) {
+	db := NewKeyValueStore()
+
+	reply, _ := getCommand(testContext(db, "k"))
+	expectReply(t, reply, NewNullBulkString())
+
+	reply, _ = setCommand(testContext(db, "k", "v"))
+	expectReply(t, reply, NewSimpleString("OK"))
+
+	reply, _ = getCommand(testContext(db, "k"))
+	expectReply(t, reply, NewBulkString("v"))
+}
+
+func TestExists(t *testing.T) {
+	db := NewKeyValueStore()
+	db.SetValue("a", "v")
+	db.SetValue("b", "v")
+	db.SetWithExpiry("expired", "v", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	tests := []struct {
+		keys []string
+		want int
+	}{
+		{[]string{"a"}, 1},
+		{[]string{"missing"}, 0},
+		{[]string{"a", "b", "missing"}, 2},
+		{[]string{"a", "a", "a"}, 3},
+		{[]string{"a", "missing", "a", "b"}, 3},
+		{[]string{"expired"}, 0},
+		{[]string{"expired", "a", "expired"}, 1},
+	}
+	for _, tt := range tests {
+		reply, _ := existsCommand(testContext(db, tt.keys...))
+		if !sameReply(reply, NewInteger(tt.want)) {
+			t.Fatalf("EXISTS %v = %q, want %d", tt.keys, reply.Marshal(), tt.want)
+		}
+	}
+}
+
+func TestDBSizeAndRandomKey(t *testing.T) {
+	db := NewKeyValueStore()
+	dbsize := func() RESP { reply, _ := dbsizeCommand(testContext(db)); return reply }
+	randomkey := func() RESP { reply, _ := randomkeyCommand(testContext(db)); return reply }
+
+	expectReply(t, dbsize(), NewInteger(0))
+	expectReply(t, randomkey(), NewNullBulkString())
+
+	// Expired keys the sweeper hasn't removed yet are neither counted nor picked.
+	for i := 0; i < 50; i++ {
+		db.SetWithExpiry("expired:"+strconv.Itoa(i), "v", time.Millisecond)
+	}
+	time.Sleep(5 * time.Millisecond)
+	expectReply(t, dbsize(), NewInteger(0))
+	expectReply(t, randomkey(), NewNullBulkString())
+
+	live := []string{"a", "b", "c"}
+	for _, key := range live {
+		db.SetValue(key, "v")
+	}
+	expectReply(t, dbsize(), NewInteger(len(live)))
+	seen := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		key := randomkey().String
+		if !slices.Contains(live, key) {
+			t.Fatalf("RANDOMKEY returned %q, not a live key", key)
+		}
+		seen[key]++
+	}
+	for _, key := range live {
+		if seen[key] < 50 {
+			t.Fatalf("RANDOMKEY picked %s %d times in 300, want about 100", key, seen[key])
+		}
+	}
+}
+
+func TestSetOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing bool
+		args     []string
+		want     RESP
+		value    string // what GET sees afterwards; "" for no key
+	}{
+		{"NX on a missing key", false, []string{"NX"}, NewSimpleString("OK"), "new"},
+		{"NX on an existing key", true, []string{"NX"}, NewNullBulkString(), "old"},
+		{"XX on a missing key", false, []string{"XX"}, NewNullBulkString(), ""},
+		{"XX on an existing key", true, []string{"XX"}, NewSimpleString("OK"), "new"},
+		{"GET on a missing key", false, []string{"GET"}, NewNullBulkString(), "new"},
+		{"GET on an existing key", true, []string{"GET"}, NewBulkString("old"), "new"},
+		{"NX GET stopped", true, []string{"NX", "GET"}, NewBulkString("old"), "old"},
+		{"NX and XX", false, []string{"NX", "XX"}, NewError("ERR syntax error"), ""},
+		{"EX and PX", false, []string{"EX", "10", "PX", "10"}, NewError("ERR syntax error"), ""},
+		{"EX and KEEPTTL", false, []string{"EX", "10", "KEEPTTL"}, NewError("ERR syntax error"), ""},
+		{"EX without a value", false, []string{"EX"}, NewError("ERR syntax error"), ""},
+		{"EX zero", false, []string{"EX", "0"}, NewError("ERR invalid expire time in 'set' command"), ""},
+		{"EX not a number", false, []string{"EX", "ten"}, NewError("ERR value is not an integer or out of range"), ""},
+		{"unknown option", false, []string{"FOREVER"}, NewError("ERR syntax error"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := NewKeyValueStore()
+			if tt.existing {
+				db.SetValue("k", "old")
+			}
+			reply, _ := setCommand(testContext(db, append([]string{"k", "new"}, tt.args...)...))
+			expectReply(t, reply, tt.want)
+
+			value, exists := db.Get("k")
+			if tt.value == "" {
+				if exists && !tt.existing {
+					t.Fatalf("key was stored as %q", value)
+				}
+				return
+			}
+			if value != tt.value {
+				t.Fatalf("value = %q, want %q", value, tt.value)
+			}
+		})
+	}
+}
+
+func TestSetPropagation(t *testing.T) {
+	db := NewKeyValueStore()
+	db.SetValue("k", "old")
+
+	ctx := testContext(db, "k", "new", "NX")
+	setCommand(ctx)
+	if !ctx.Client.PropagateNone {
+		t.Fatal("SET NX that stored nothing should replicate nothing")
+	}
+
+	ctx = testContext(db, "k", "new", "EX", "100")
+	setCommand(ctx)
+	if len(ctx.Client.PropagateAs) != 1 {
+		t.Fatalf("SET EX replicates as %d commands, want 1", len(ctx.Client.PropagateAs))
+	}
+	effect := ctx.Client.PropagateAs[0].Array
+	if len(effect) != 5 || effect[3].String != "PXAT" {
+		t.Fatalf("SET EX replicates as %q, want SET ... PXAT", ctx.Client.PropagateAs[0].Marshal())
+	}
+	at, err := strconv.ParseInt(effect[4].String, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if until := time.Until(time.UnixMilli(at)); until <= 90*time.Second || until > 100*time.Second {
+		t.Fatalf("PXAT is %v away, want about 100s", until)
+	}
+
+	ctx = testContext(db, "k", "plain")
+	setCommand(ctx)
+	if ctx.Client.PropagateAs != nil || ctx.Client.PropagateNone {
+		t.Fatal("plain SET should replicate as itself")
+	}
+}
+
+func TestXAdd(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want RESP
+	}{
+		{"explicit ID", []string{"1-1", "f", "v"}, NewBulkString("1-1")},
+		{"auto sequence", []string{"1-*", "f", "v"}, NewBulkString("1-2")},
+		{"new millisecond", []string{"2-*", "f", "v"}, NewBulkString("2-0")},
+		{"equal ID", []string{"2-0", "f", "v"}, NewError(ErrStreamIDTooSmall.Error())},
+		{"older ID", []string{"1-5", "f", "v"}, NewError(ErrStreamIDTooSmall.Error())},
+		{"zero ID", []string{"0-0", "f", "v"}, NewError(ErrStreamIDZero.Error())},
+		{"bad ID", []string{"x-1", "f", "v"}, NewError(ErrInvalidStreamID.Error())},
+		{"odd fields", []string{"3-0", "f"}, NewError("ERR wrong number of arguments for 'xadd' command")},
+		{"bad MAXLEN", []string{"MAXLEN", "-1", "3-0", "f", "v"}, NewError("ERR The MAXLEN argument must be >= 0.")},
+	}
+	db := NewKeyValueStore()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply, _ := xaddCommand(testContext(db, append([]string{"s"}, tt.args...)...))
+			expectReply(t, reply, tt.want)
+		})
+	}
+
+	stream, _ := db.GetStream("s")
+	if len(stream.Entries) != 3 {
+		t.Fatalf("stream has %d entries, want 3", len(stream.Entries))
+	}
+}
+
+func TestXAddMaxLenAndPropagation(t *testing.T) {
+	db := NewKeyValueStore()
+	var ids []string
+	for i := 0; i < 5; i++ {
+		ctx := testContext(db, "s", "MAXLEN", "=", "2", "*", "n", strconv.Itoa(i))
+		reply, _ := xaddCommand(ctx)
+		if reply.Type != BulkString {
+			t.Fatalf("XADD replied %q", reply.Marshal())
+		}
+		ids = append(ids, reply.String)
+
+		// Replicas must get the generated ID, not "*".
+		effect := ctx.Client.PropagateAs
+		if len(effect) != 1 || effect[0].Array[5].String != reply.String {
+			t.Fatalf("XADD replicates as %v, want the ID %s", effect, reply.String)
+		}
+		if len(ctx.Client.ReadyKeys) != 1 || ctx.Client.ReadyKeys[0] != (dbKey{0, "s"}) {
+			t.Fatalf("ready keys = %v, want [s]", ctx.Client.ReadyKeys)
+		}
+	}
+
+	stream, _ := db.GetStream("s")
+	if len(stream.Entries) != 2 || stream.Entries[0].ID != ids[3] || stream.Entries[1].ID != ids[4] {
+		t.Fatalf("stream kept %v, want the last two of %v", stream.Entries, ids)
+	}
+	if stream.LastID != ids[4] {
+		t.Fatalf("last ID = %s, want %s", stream.LastID, ids[4])
+	}
+
+	reply, _ := setCommand(testContext(db, "str", "v"))
+	expectReply(t, reply, NewSimpleString("OK"))
+	reply, _ = xaddCommand(testContext(db, "str", "*", "f", "v"))
+	expectReply(t, reply, NewError(ErrWrongType.Error()))
+}
+
+func TestMultiDiscard(t *testing.T) {
+	ctx := testContext(NewKeyValueStore())
+
+	reply, _ := execCommand(ctx)
+	expectReply(t, reply, NewError("ERR EXEC without MULTI"))
+	reply, _ = discardCommand(ctx)
+	expectReply(t, reply, NewError("ERR DISCARD without MULTI"))
+
+	reply, _ = multiCommand(ctx)
+	expectReply(t, reply, NewSimpleString("OK"))
+	if ctx.Client.Mode() != ModeMulti {
+		t.Fatalf("mode after MULTI = %v, want MULTI", ctx.Client.Mode())
+	}
+	ctx.Client.QueuedCommands = append(ctx.Client.QueuedCommands, NewArray([]RESP{NewBulkString("PING")}))
+
+	reply, _ = discardCommand(ctx)
+	expectReply(t, reply, NewSimpleString("OK"))
+	if ctx.Client.InTransaction || ctx.Client.QueuedCommands != nil {
+		t.Fatal("DISCARD left the transaction open")
+	}
+
+	multiCommand(ctx)
+	reply, _ = execCommand(ctx)
+	expectReply(t, reply, NewArray([]RESP{}))
+	if ctx.Client.InTransaction {
+		t.Fatal("EXEC left the transaction open")
+	}
+}
+
+func TestExecAborted(t *testing.T) {
+	ctx := testContext(NewKeyValueStore())
+	multiCommand(ctx)
+	ctx.Client.TxAborted = true
+
+	reply, _ := execCommand(ctx)
+	if reply.Type != Error || !strings.HasPrefix(reply.String, "EXECABORT") {
+		t.Fatalf("EXEC of an aborted transaction replied %q", reply.Marshal())
+	}
+	if ctx.Client.InTransaction || ctx.Client.TxAborted {
+		t.Fatal("EXECABORT left the transaction open")
+	}
+}
+
+// TestExecPropagation checks what a replica link receives for a
+// transaction: its writes once each, between MULTI and EXEC, with the
+// master offset advanced by exactly the bytes sent.
+func TestExecPropagation(t *testing.T) {
+	s := startServer(t, nil)
+	link := psyncLink(t, s)
+	c := dial(t, s)
+	before := s.repl.GetMasterOffset()
+
+	expectReply(t, c.do("MULTI"), NewSimpleString("OK"))
+	expectReply(t, c.do("SET", "k", "v"), NewSimpleString("QUEUED"))
+	expectReply(t, c.do("GET", "k"), NewSimpleString("QUEUED"))
+	expectReply(t, c.do("EXEC"), NewArray([]RESP{NewSimpleString("OK"), NewBulkString("v")}))
+
+	var names []string
+	var sent int64
+	for sent < s.repl.GetMasterOffset()-before {
+		cmd := link.read()
+		sent += int64(len(cmd.MarshalBytes()))
+		if name := cmd.Array[0].String; name != "SELECT" && name != "PING" {
+			names = append(names, name)
+		}
+	}
+	if !slices.Equal(names, []string{"MULTI", "SET", "EXEC"}) {
+		t.Fatalf("replica link got %v, want one SET in MULTI/EXEC", names)
+	}
+	if offset := s.repl.GetMasterOffset(); sent != offset-before {
+		t.Fatalf("link got %d bytes, master offset moved %d", sent, offset-before)
+	}
+}
+
+func TestReset(t *testing.T) {
+	s := startServer(t, nil)
+	c, other := dial(t, s), dial(t, s)
+	expectReply(t, c.do("SELECT", "2"), NewSimpleString("OK"))
+	expectReply(t, c.do("CLIENT", "SETNAME", "pooled"), NewSimpleString("OK"))
+	expectReply(t, c.do("WATCH", "w"), NewSimpleString("OK"))
+	expectReply(t, c.do("MULTI"), NewSimpleString("OK"))
+	expectReply(t, c.do("SET", "k", "v"), NewSimpleString("QUEUED"))
+
+	expectReply(t, c.do("RESET"), NewSimpleString("RESET"))
+	expectReply(t, c.do("EXEC"), NewError("ERR EXEC without MULTI"))
+	expectReply(t, c.do("CLIENT", "GETNAME"), NewNullBulkString())
+	expectReply(t, c.do("GET", "k"), NewNullBulkString())
+	expectReply(t, other.do("SELECT", "2"), NewSimpleString("OK"))
+	expectReply(t, other.do("EXISTS", "k"), NewInteger(0))
+
+	// w is no longer watched, so changing it aborts nothing.
+	expectReply(t, other.do("SET", "w", "changed"), NewSimpleString("OK"))
+	expectReply(t, c.do("MULTI"), NewSimpleString("OK"))
+	expectReply(t, c.do("SET", "k", "v"), NewSimpleString("QUEUED"))
+	expectReply(t, c.do("EXEC"), NewArray([]RESP{NewSimpleString("OK")}))
+
+	// RESET also leaves pub/sub mode.
+	c.do("SUBSCRIBE", "ch")
+	expectReply(t, c.do("RESET"), NewSimpleString("RESET"))
+	expectReply(t, other.do("PUBLISH", "ch", "m"), NewInteger(0))
+	expectReply(t, c.do("PING"), NewSimpleString("PONG"))
+}
+
+func TestSInterCard(t *testing.T) {
+	db := NewKeyValueStore()
+	db.SAdd("a", []string{"1", "2", "3", "4", "5"})
+	db.SAdd("b", []string{"3", "4", "5", "6", "7"})
+	db.SAdd("c", []string{"5", "6", "7", "8", "9"})
+	db.SetValue("str", "v")
+
+	tests := []struct {
+		name string
+		args []string
+		want RESP
+	}{
+		{"no limit", []string{"2", "a", "b"}, NewInteger(3)},
+		{"LIMIT 0 is no limit", []string{"2", "a", "b", "LIMIT", "0"}, NewInteger(3)},
+		{"LIMIT 1", []string{"2", "a", "b", "LIMIT", "1"}, NewInteger(1)},
+		{"LIMIT 2", []string{"2", "a", "b", "LIMIT", "2"}, NewInteger(2)},
+		{"LIMIT at the size", []string{"2", "a", "b", "LIMIT", "3"}, NewInteger(3)},
+		{"LIMIT past the size", []string{"2", "a", "b", "LIMIT", "10"}, NewInteger(3)},
+		{"lowercase limit", []string{"2", "a", "b", "limit", "2"}, NewInteger(2)},
+		{"last LIMIT wins", []string{"2", "a", "b", "LIMIT", "1", "LIMIT", "2"}, NewInteger(2)},
+		{"three sets", []string{"3", "a", "b", "c"}, NewInteger(1)},
+		{"three sets LIMIT 1", []string{"3", "a", "b", "c", "LIMIT", "1"}, NewInteger(1)},
+		{"one set", []string{"1", "a", "LIMIT", "4"}, NewInteger(4)},
+		{"missing set", []string{"2", "a", "none", "LIMIT", "1"}, NewInteger(0)},
+		{"negative LIMIT", []string{"2", "a", "b", "LIMIT", "-1"}, NewError("ERR LIMIT can't be negative")},
+		{"LIMIT not a number", []string{"2", "a", "b", "LIMIT", "x"}, NewError("ERR LIMIT can't be negative")},
+		{"LIMIT without a value", []string{"2", "a", "b", "LIMIT"}, NewError("ERR syntax error")},
+		{"unknown option", []string{"2", "a", "b", "MAX", "1"}, NewError("ERR syntax error")},
+		{"numkeys zero", []string{"0", "a"}, NewError("ERR numkeys should be greater than 0")},
+		{"numkeys past the args", []string{"3", "a", "b"}, NewError("ERR Number of keys can't be greater than number of args")},
+		{"wrong type", []string{"2", "a", "str", "LIMIT", "1"}, NewError(ErrWrongType.Error())},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply, _ := sintercardCommand(testContext(db, tt.args...))
+			expectReply(t, reply, tt.want)
+		})
+	}
+}
+
+// TestMPopArgs runs the argument checks of LMPOP and BLMPOP through the
+// server, so numkeys is seen to be checked ahead of the arity.
+func TestMPopArgs(t *testing.T) {
+	c := dial(t, startServer(t, nil))
+	c.do("RPUSH", "k", "a", "b", "c")
+	tests := []struct {
+		args []string
+		want RESP
+	}{
+		{[]string{"LMPOP", "0", "LEFT"}, NewError("ERR numkeys should be greater than 0")},
+		{[]string{"LMPOP", "-1", "k", "LEFT"}, NewError("ERR numkeys should be greater than 0")},
+		{[]string{"BLMPOP", "0", "0", "LEFT"}, NewError("ERR numkeys should be greater than 0")},
+		{[]string{"LMPOP", "1", "k"}, NewError("ERR syntax error")},
+		{[]string{"LMPOP", "1"}, NewError("ERR wrong number of arguments for 'lmpop' command")},
+		{[]string{"LMPOP", "1", "k", "UP"}, NewError("ERR syntax error")},
+		{[]string{"LMPOP", "1", "k", "LEFT", "COUNT", "0"}, NewError("ERR count should be greater than 0")},
+		{[]string{"LMPOP", "2", "none", "k", "RIGHT", "COUNT", "2"}, NewArray([]RESP{NewBulkString("k"), NewArray([]RESP{NewBulkString("c"), NewBulkString("b")})})},
+	}
+	for _, tt := range tests {
+		expectReply(t, c.do(tt.args...), tt.want)
+	}
+}
+
+// ttlOf returns key's remaining TTL, or -1ms when it has none.
+func ttlOf(t *testing.T, db *KeyValueStore, key string) time.Duration {
+	t.Helper()
+	info, ok := db.DebugObject(key)
+	if !ok {
+		t.Fatalf("%s does not exist", key)
+	}
+	return info.ttl
+}
+
+// TestStoreDestination runs every *STORE command through the rules they
+// share: an empty result deletes dest and replicates as DEL, dest loses its
+// TTL and its old type, and dest may be one of the sources.
+func TestStoreDestination(t *testing.T) {
+	members := []string{"a", "b", "c"}
+	fillSet := func(db *KeyValueStore, key string) { db.SAdd(key, members) }
+	fillZSet := func(db *KeyValueStore, key string) {
+		var zm []ZMember
+		for i, m := range members {
+			zm = append(zm, ZMember{Member: m, Score: float64(i)})
+		}
+		db.ZAdd(key, zm, ZAddOptions{})
+	}
+	commands := []struct {
+		name    string
+		handler Handler
+		fill    func(db *KeyValueStore, key string)
+		card    func(db *KeyValueStore, key string) (int, error)
+		// full stores all of src into dest; empty stores nothing.
+		full, empty func(dest, src string) []string
+	}{
+		{"SINTERSTORE", setCombineStoreCommand(setInter), fillSet, (*KeyValueStore).SCard,
+			func(dest, src string) []string { return []string{dest, src, src} },
+			func(dest, src string) []string { return []string{dest, src, "missing"} }},
+		{"SUNIONSTORE", setCombineStoreCommand(setUnion), fillSet, (*KeyValueStore).SCard,
+			func(dest, src string) []string { return []string{dest, src, "missing"} },
+			func(dest, src string) []string { return []string{dest, "missing"} }},
+		{"SDIFFSTORE", setCombineStoreCommand(setDiff), fillSet, (*KeyValueStore).SCard,
+			func(dest, src string) []string { return []string{dest, src, "missing"} },
+			func(dest, src string) []string { return []string{dest, src, src} }},
+		{"ZRANGESTORE", zrangestoreCommand, fillZSet, (*KeyValueStore).ZCard,
+			func(dest, src string) []string { return []string{dest, src, "0", "-1"} },
+			func(dest, src string) []string { return []string{dest, src, "5", "10"} }},
+	}
+	for _, cmd := range commands {
+		t.Run(cmd.name+"/empty result deletes dest", func(t *testing.T) {
+			db := NewKeyValueStore()
+			cmd.fill(db, "src")
+			db.SetValue("dest", "v")
+			ctx := testContext(db, cmd.empty("dest", "src")...)
+			reply, _ := cmd.handler(ctx)
+			expectReply(t, reply, NewInteger(0))
+			if db.Exists("dest") {
+				t.Fatal("dest survived an empty result")
+			}
+			if len(ctx.Client.PropagateAs) != 1 {
+				t.Fatalf("replicates as %d commands, want DEL dest", len(ctx.Client.PropagateAs))
+			}
+			expectReply(t, ctx.Client.PropagateAs[0], NewArray([]RESP{NewBulkString("DEL"), NewBulkString("dest")}))
+		})
+		t.Run(cmd.name+"/dest had a TTL", func(t *testing.T) {
+			db := NewKeyValueStore()
+			cmd.fill(db, "src")
+			cmd.fill(db, "dest")
+			db.ExpireAt("dest", time.Now().Add(100*time.Second), 0)
+			reply, _ := cmd.handler(testContext(db, cmd.full("dest", "src")...))
+			expectReply(t, reply, NewInteger(len(members)))
+			if ttl := ttlOf(t, db, "dest"); ttl != -time.Millisecond {
+				t.Fatalf("dest kept a TTL of %v", ttl)
+			}
+		})
+		t.Run(cmd.name+"/dest of another type", func(t *testing.T) {
+			db := NewKeyValueStore()
+			cmd.fill(db, "src")
+			db.SetValue("dest", "v")
+			ctx := testContext(db, cmd.full("dest", "src")...)
+			reply, _ := cmd.handler(ctx)
+			expectReply(t, reply, NewInteger(len(members)))
+			if n, err := cmd.card(db, "dest"); err != nil || n != len(members) {
+				t.Fatalf("dest holds %d members (%v), want %d", n, err, len(members))
+			}
+			if ctx.Client.PropagateAs != nil {
+				t.Fatalf("a non-empty result replicates as %q, want the command itself", ctx.Client.PropagateAs[0].Marshal())
+			}
+		})
+		t.Run(cmd.name+"/dest is the source", func(t *testing.T) {
+			db := NewKeyValueStore()
+			cmd.fill(db, "src")
+			reply, _ := cmd.handler(testContext(db, cmd.full("src", "src")...))
+			expectReply(t, reply, NewInteger(len(members)))
+			if n, err := cmd.card(db, "src"); err != nil || n != len(members) {
+				t.Fatalf("src holds %d members (%v), want %d", n, err, len(members))
+			}
+		})
+	}
+}
+
+func TestZRangeStore(t *testing.T) {
+	db := NewKeyValueStore()
+	db.ZAdd("z", []ZMember{{"a", 1}, {"b", 2}, {"c", 3}, {"d", 4}}, ZAddOptions{})
+	db.SetValue("str", "v")
+
+	tests := []struct {
+		args []string
+		want RESP
+		kept []string // dest's members after, lowest score first
+	}{
+		{[]string{"0", "1"}, NewInteger(2), []string{"a", "b"}},
+		{[]string{"0", "1", "REV"}, NewInteger(2), []string{"c", "d"}},
+		{[]string{"2", "+inf", "BYSCORE"}, NewInteger(3), []string{"b", "c", "d"}},
+		{[]string{"+inf", "(1", "BYSCORE", "REV", "LIMIT", "1", "2"}, NewInteger(2), []string{"b", "c"}},
+		{[]string{"0", "-1", "WITHSCORES"}, NewError("ERR syntax error"), nil},
+		{[]string{"0", "-1", "LIMIT", "0", "1"}, NewError("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			db.Delete([]string{"dest"})
+			reply, _ := zrangestoreCommand(testContext(db, append([]string{"dest", "z"}, tt.args...)...))
+			expectReply(t, reply, tt.want)
+			if tt.kept == nil {
+				return
+			}
+			got, _ := db.ZRange("dest", ZRangeSpec{Start: 0, Stop: -1})
+			var names []string
+			for _, m := range got {
+				names = append(names, m.Member)
+			}
+			if !slices.Equal(names, tt.kept) {
+				t.Fatalf("dest holds %v, want %v", names, tt.kept)
+			}
+		})
+	}
+
+	reply, _ := zrangestoreCommand(testContext(db, "dest", "str", "0", "-1"))
+	expectReply(t, reply, NewError(ErrWrongType.Error()))
+}
+
+// TestZRangeWithScores checks WITHSCORES interleaves scores under RESP2
+// and pairs each member with its double score under RESP3.
+func TestZRangeWithScores(t *testing.T) {
+	db := NewKeyValueStore()
+	db.ZAdd("z", []ZMember{{"a", 1}, {"b", 2.5}}, ZAddOptions{})
+	for _, proto := range []int{RESP2, RESP3} {
+		want := NewArray([]RESP{NewBulkString("a"), NewDouble(1), NewBulkString("b"), NewDouble(2.5)})
+		if proto == RESP3 {
+			want = NewArray([]RESP{
+				NewArray([]RESP{NewBulkString("a"), NewDouble(1)}),
+				NewArray([]RESP{NewBulkString("b"), NewDouble(2.5)}),
+			})
+		}
+		for _, tt := range []struct {
+			handler Handler
+			args    []string
+		}{
+			{zrangeCommand, []string{"z", "0", "-1", "WITHSCORES"}},
+			{zrangebyscoreCommand, []string{"z", "-inf", "+inf", "WITHSCORES"}},
+		} {
+			ctx := testContext(db, tt.args...)
+			ctx.Client.Protocol = proto
+			reply, _ := tt.handler(ctx)
+			if got := reply.MarshalBytesFor(proto); string(got) != string(want.MarshalBytesFor(proto)) {
+				t.Fatalf("RESP%d %v replied %q", proto, tt.args, got)
+			}
+		}
+	}
+}
+
+func TestWritesKeepTTL(t *testing.T) {
+	tests := []struct {
+		name    string
+		create  []string // SET, or another command that makes the key
+		handler Handler
+		args    []string
+	}{
+		{"INCR", []string{"SET", "k", "1"}, incrCommand, []string{"k"}},
+		{"INCRBY", []string{"SET", "k", "1"}, incrbyCommand, []string{"k", "5"}},
+		{"DECR", []string{"SET", "k", "1"}, decrCommand, []string{"k"}},
+		{"INCRBYFLOAT", []string{"SET", "k", "1"}, incrbyfloatCommand, []string{"k", "0.5"}},
+		{"APPEND", []string{"SET", "k", "v"}, appendCommand, []string{"k", "w"}},
+		{"SETRANGE", []string{"SET", "k", "v"}, setrangeCommand, []string{"k", "3", "w"}},
+		{"SET KEEPTTL", []string{"SET", "k", "v"}, setCommand, []string{"k", "w", "KEEPTTL"}},
+		{"XADD", []string{"XADD", "k", "1-1", "f", "v"}, xaddCommand, []string{"k", "*", "f", "v"}},
+		{"HSET", []string{"HSET", "k", "f", "v"}, hsetCommand, []string{"k", "g", "v"}},
+		{"SADD", []string{"SADD", "k", "a"}, saddCommand, []string{"k", "b"}},
+	}
+	creators := map[string]Handler{"SET": setCommand, "XADD": xaddCommand, "HSET": hsetCommand, "SADD": saddCommand}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := NewKeyValueStore()
+			creators[tt.create[0]](testContext(db, tt.create[1:]...))
+			db.ExpireAt("k", time.Now().Add(100*time.Second), 0)
+
+			reply, _ := tt.handler(testContext(db, tt.args...))
+			if reply.Type == Error {
+				t.Fatalf("%s replied %q", tt.name, reply.Marshal())
+			}
+			if ttl := ttlOf(t, db, "k"); ttl < 99*time.Second || ttl > 100*time.Second {
+				t.Fatalf("TTL after %s = %v, want about 100s", tt.name, ttl)
+			}
+		})
+	}
+}
+
+func TestWritesDropTTL(t *testing.T) {
+	db := NewKeyValueStore()
+	db.SetWithExpiry("k", "1", 100*time.Second)
+	setCommand(testContext(db, "k", "2"))
+	if ttl := ttlOf(t, db, "k"); ttl != -time.Millisecond {
+		t.Fatalf("TTL after a plain SET = %v, want none", ttl)
+	}
+
+	// An expired key's TTL must not carry over to the value that replaces it.
+	db.SetWithExpiry("k", "1", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	reply, _ := incrCommand(testContext(db, "k"))
+	expectReply(t, reply, NewInteger(1))
+	if ttl := ttlOf(t, db, "k"); ttl != -time.Millisecond {
+		t.Fatalf("TTL after INCR on an expired key = %v, want none", ttl)
+	}
+
+	xaddCommand(testContext(db, "s", "1-1", "f", "v"))
+	db.ExpireAt("s", time.Now().Add(time.Millisecond), 0)
+	time.Sleep(5 * time.Millisecond)
+	reply, _ = xaddCommand(testContext(db, "s", "1-1", "f", "v"))
+	expectReply(t, reply, NewBulkString("1-1"))
+	if ttl := ttlOf(t, db, "s"); ttl != -time.Millisecond {
+		t.Fatalf("TTL after XADD on an expired stream = %v, want none", ttl)
+	}
+}
+
+func TestSetRangeLimits(t *testing.T) {
+	const tooLong = "ERR string exceeds maximum allowed size (proto-max-bulk-len)"
+	tests := []struct {
+		offset, value string
+		want          RESP
+	}{
+		{"9223372036854775807", "x", NewError(tooLong)},
+		{strconv.Itoa(maxStringLength), "x", NewError(tooLong)},
+		{strconv.Itoa(maxStringLength - 1), "xy", NewError(tooLong)},
+		{"9223372036854775807", "", NewInteger(0)},
+		{"-1", "x", NewError("ERR offset is out of range")},
+		{"9223372036854775808", "x", NewError("ERR value is not an integer or out of range")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.offset+"/"+tt.value, func(t *testing.T) {
+			db := NewKeyValueStore()
+			reply, _ := setrangeCommand(testContext(db, "k", tt.offset, tt.value))
+			expectReply(t, reply, tt.want)
+			if db.Exists("k") {
+				t.Fatal("a refused SETRANGE created the key")
+			}
+		})
+	}
+}
+
+func TestArity(t *testing.T) {
+	// Arguments after the command name; max -1 means variadic.
+	tests := []struct {
+		name     string
+		min, max int
+	}{
+		{"APPEND", 2, 2},
+		{"AUTH", 1, 2},
+		{"BGREWRITEAOF", 0, 0},
+		{"BGSAVE", 0, 0},
+		{"BLMPOP", 3, -1},
+		{"CLIENT", 1, -1},
+		{"COMMAND", 0, -1},
+		{"CONFIG", 1, -1},
+		{"COPY", 2, 5},
+		{"DBSIZE", 0, 0},
+		{"DBSTATS", 1, 1},
+		{"DEBUG", 1, -1},
+		{"DECR", 1, 1},
+		{"DECRBY", 2, 2},
+		{"DEL", 1, -1},
+		{"DISCARD", 0, 0},
+		{"ECHO", 1, 1},
+		{"EVAL", 2, -1},
+		{"EVALSHA", 2, -1},
+		{"EXEC", 0, 0},
+		{"EXISTS", 1, -1},
+		{"EXPIRE", 2, -1},
+		{"EXPIREAT", 2, -1},
+		{"FLUSHALL", 0, 1},
+		{"FLUSHDB", 0, 1},
+		{"GET", 1, 1},
+		{"GETDEL", 1, 1},
+		{"GETEX", 1, -1},
+		{"GETRANGE", 3, 3},
+		{"GETSET", 2, 2},
+		{"HDEL", 2, -1},
+		{"HELLO", 0, -1},
+		{"HEXISTS", 2, 2},
+		{"HGET", 2, 2},
+		{"HGETALL", 1, 1},
+		{"HINCRBY", 3, 3},
+		{"HINCRBYFLOAT", 3, 3},
+		{"HKEYS", 1, 1},
+		{"HLEN", 1, 1},
+		{"HMGET", 2, -1},
+		{"HOTKEYS", 0, 2},
+		{"HRANDFIELD", 1, 3},
+		{"HSET", 3, -1},
+		{"HSETNX", 3, 3},
+		{"HVALS", 1, 1},
+		{"INCR", 1, 1},
+		{"INCRBY", 2, 2},
+		{"INCRBYFLOAT", 2, 2},
+		{"INFO", 0, -1},
+		{"KEYS", 1, 1},
+		{"LASTSAVE", 0, 0},
+		{"LINDEX", 2, 2},
+		{"LINSERT", 4, 4},
+		{"LLEN", 1, 1},
+		{"LMPOP", 2, -1},
+		{"LOLWUT", 0, -1},
+		{"LPOP", 1, 2},
+		{"LPOS", 2, -1},
+		{"LPUSH", 2, -1},
+		{"LRANGE", 3, 3},
+		{"LREM", 3, 3},
+		{"LSET", 3, 3},
+		{"LTRIM", 3, 3},
+		{"MONITOR", 0, 0},
+		{"MOVE", 2, 2},
+		{"MULTI", 0, 0},
+		{"OBJECT", 1, 2},
+		{"PERSIST", 1, 1},
+		{"PEXPIRE", 2, -1},
+		{"PEXPIREAT", 2, -1},
+		{"PING", 0, 1},
+		{"PSETEX", 3, 3},
+		{"PSUBSCRIBE", 1, -1},
+		{"PSYNC", 2, 2},
+		{"PUBLISH", 2, 2},
+		{"PUBSUB", 1, -1},
+		{"PUNSUBSCRIBE", 0, -1},
+		{"QUIT", 0, -1},
+		{"RANDOMKEY", 0, 0},
+		{"READONLY", 0, 2},
+		{"READWRITE", 0, 0},
+		{"REPLCONF", 1, -1},
+		{"REPLICAOF", 2, 2},
+		{"RESET", 0, 0},
+		{"RL.LIMIT", 4, 4},
+		{"RL.SLIDING", 3, 3},
+		{"RPOP", 1, 2},
+		{"RPUSH", 2, -1},
+		{"SADD", 2, -1},
+		{"SAVE", 0, 0},
+		{"SCARD", 1, 1},
+		{"SCRIPT", 1, -1},
+		{"SDIFF", 1, -1},
+		{"SDIFFSTORE", 2, -1},
+		{"SELECT", 1, 1},
+		{"SET", 2, -1},
+		{"SETEX", 3, 3},
+		{"SETNX", 2, 2},
+		{"SETRANGE", 3, 3},
+		{"SHUTDOWN", 0, 1},
+		{"SINTER", 1, -1},
+		{"SINTERCARD", 2, -1},
+		{"SINTERSTORE", 2, -1},
+		{"SISMEMBER", 2, 2},
+		{"SLAVEOF", 2, 2},
+		{"SLOWLOG", 1, 2},
+		{"SMEMBERS", 1, 1},
+		{"SREM", 2, -1},
+		{"STRLEN", 1, 1},
+		{"SUBSCRIBE", 1, -1},
+		{"SUNION", 1, -1},
+		{"SUNIONSTORE", 2, -1},
+		{"SWAPDB", 2, 2},
+		{"TYPE", 1, 1},
+		{"UNSUBSCRIBE", 0, -1},
+		{"UNWATCH", 0, 0},
+		{"WAIT", 2, 2},
+		{"WATCH", 1, -1},
+		{"XADD", 4, -1},
+		{"XRANGE", 3, 5},
+		{"XREAD", 3, -1},
+		{"XREVRANGE", 3, 5},
+		{"XTRIM", 3, -1},
+		{"ZADD", 3, -1},
+		{"ZCARD", 1, 1},
+		{"ZRANGE", 3, -1},
+		{"ZRANGEBYSCORE", 3, -1},
+		{"ZRANGESTORE", 4, -1},
+		{"ZREM", 2, -1},
+		{"ZSCORE", 2, 2},
+	}
+	registry := NewRegistry(false)
+	if names := registry.Names(); len(names) != len(tests) {
+		t.Fatalf("%d commands are registered, the table has %d", len(names), len(tests))
+	}
+
+	s := startServer(t, nil)
+	c := dial(t, s)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, exists := registry.Get(tt.name); !exists {
+				t.Fatal("not registered")
+			}
+			if got := registry.arity[tt.name]; got.min != tt.min || got.max != tt.max {
+				t.Fatalf("registered with %d to %d arguments, want %d to %d", got.min, got.max, tt.min, tt.max)
+			}
+			for _, argc := range []int{tt.min, tt.max} {
+				if argc >= 0 && registry.CheckArity(tt.name, argc) != "" {
+					t.Fatalf("%d arguments refused", argc)
+				}
+			}
+
+			// Out of range, the command is refused before it runs.
+			want := NewError("ERR wrong number of arguments for '" + strings.ToLower(tt.name) + "' command")
+			if tt.min > 0 {
+				expectReply(t, c.do(append([]string{tt.name}, placeholderArgs(tt.min-1)...)...), want)
+			}
+			if tt.max >= 0 {
+				expectReply(t, c.do(append([]string{tt.name}, placeholderArgs(tt.max+1)...)...), want)
+			}
+		})
+	}
+}
+
+func TestClientSubcommands(t *testing.T) {
+	ctx := testContext(NewKeyValueStore())
+	client, _ := ctx.Registry.Get("CLIENT")
+	for _, tt := range []struct {
+		args []string
+		want RESP
+	}{
+		{[]string{"BOGUS"}, NewError("ERR unknown subcommand 'BOGUS'. Try CLIENT HELP.")},
+		{[]string{"ID", "x"}, NewError("ERR Unknown subcommand or wrong number of arguments for 'ID'. Try CLIENT HELP.")},
+		{[]string{"UNBLOCK", "1", "TIMEOUT", "x"}, NewError("ERR Unknown subcommand or wrong number of arguments for 'UNBLOCK'. Try CLIENT HELP.")},
+		{[]string{"setname", "conn"}, NewSimpleString("OK")},
+		{[]string{"GETNAME"}, NewBulkString("conn")},
+		{[]string{"GETREDIR"}, NewInteger(-1)},
+	} {
+		sub := *ctx
+		sub.Args = nil
+		for _, arg := range tt.args {
+			sub.Args = append(sub.Args, NewBulkString(arg))
+		}
+		reply, _ := client(&sub)
+		expectReply(t, reply, tt.want)
+	}
+
+	sub := *ctx
+	sub.Args = []RESP{NewBulkString("HELP")}
+	reply, _ := client(&sub)
+	var lines []string
+	for _, line := range reply.Array {
+		lines = append(lines, line.String)
+	}
+	for _, want := range []string{"TRACKING (ON|OFF) [REDIRECT <id>]", "GETREDIR", "HELP"} {
+		if !slices.Contains(lines, want) {
+			t.Fatalf("HELP lacks %q: %q", want, lines)
+		}
+	}
+}
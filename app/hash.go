@@ -0,0 +1,336 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"strconv"
+)
+
+var (
+	// ErrHashNotInteger is returned by HINCRBY when the field does not hold an integer.
+	ErrHashNotInteger = errors.New("ERR hash value is not an integer")
+	// ErrHashNotFloat is returned by HINCRBYFLOAT when the field does not hold a float.
+	ErrHashNotFloat = errors.New("ERR hash value is not a float")
+)
+
+// Hash holds the field/value pairs stored under a single key.
+type Hash map[string]string
+
+// getHashLocked returns the hash at key; callers must hold at least the read lock.
+func (s *KeyValueStore) getHashLocked(key string) (Hash, bool, error) {
+	value, exists := s.lookupLocked(key)
+	if !exists {
+		return nil, false, nil
+	}
+	hash, ok := value.(Hash)
+	if !ok {
+		return nil, false, ErrWrongType
+	}
+	return hash, true, nil
+}
+
+// getHashForWriteLocked is getHashLocked for writers, dropping the key first
+// if it has expired and creating an empty hash when create is set; callers
+// must hold the write lock.
+func (s *KeyValueStore) getHashForWriteLocked(key string, create bool) (Hash, bool, error) {
+	value, exists := s.lookupForWriteLocked(key)
+	if !exists {
+		if !create {
+			return nil, false, nil
+		}
+		hash := make(Hash)
+		s.storeLocked(key, hash)
+		return hash, true, nil
+	}
+	hash, ok := value.(Hash)
+	if !ok {
+		return nil, false, ErrWrongType
+	}
+	return hash, true, nil
+}
+
+// setFieldLocked assigns field in hash, keeping the memory accounting for
+// key in step, and reports whether the field is new.
+func (s *KeyValueStore) setFieldLocked(key string, hash Hash, field, value string) bool {
+	old, ok := hash[field]
+	if ok {
+		s.growLocked(key, int64(len(value)-len(old)))
+	} else {
+		s.growLocked(key, int64(len(field)+len(value)))
+	}
+	hash[field] = value
+	return !ok
+}
+
+// HSet assigns field/value pairs, creating the hash if needed, and returns the number of new fields.
+func (s *KeyValueStore) HSet(key string, pairs []string) (int, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	hash, _, err := s.getHashForWriteLocked(key, true)
+	if err != nil {
+		return 0, err
+	}
+
+	added := 0
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if s.setFieldLocked(key, hash, pairs[i], pairs[i+1]) {
+			added++
+		}
+	}
+	return added, nil
+}
+
+// HGet returns the value of a field in the hash at key.
+func (s *KeyValueStore) HGet(key, field string) (string, bool, error) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	hash, exists, err := s.getHashLocked(key)
+	if err != nil || !exists {
+		return "", false, err
+	}
+	value, ok := hash[field]
+	return value, ok, nil
+}
+
+// HGetAll returns the hash at key as a flat field/value slice.
+func (s *KeyValueStore) HGetAll(key string) ([]string, error) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	hash, exists, err := s.getHashLocked(key)
+	if err != nil || !exists {
+		return nil, err
+	}
+	pairs := make([]string, 0, len(hash)*2)
+	for field, value := range hash {
+		pairs = append(pairs, field, value)
+	}
+	return pairs, nil
+}
+
+// HDel removes fields from the hash at key and returns how many were deleted.
+func (s *KeyValueStore) HDel(key string, fields []string) (int, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	value, exists := s.lookupForWriteLocked(key)
+	if !exists {
+		return 0, nil
+	}
+	hash, ok := value.(Hash)
+	if !ok {
+		return 0, ErrWrongType
+	}
+
+	deleted := 0
+	for _, field := range fields {
+		if old, ok := hash[field]; ok {
+			s.growLocked(key, -int64(len(field)+len(old)))
+			delete(hash, field)
+			deleted++
+		}
+	}
+	if len(hash) == 0 {
+		s.deleteLocked(key)
+	}
+	return deleted, nil
+}
+
+// HExists reports whether a field is present in the hash at key.
+func (s *KeyValueStore) HExists(key, field string) (bool, error) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	hash, exists, err := s.getHashLocked(key)
+	if err != nil || !exists {
+		return false, err
+	}
+	_, ok := hash[field]
+	return ok, nil
+}
+
+// HSetNX assigns field only when it is not already in the hash, creating the
+// hash if needed, and reports whether it did.
+func (s *KeyValueStore) HSetNX(key, field, value string) (bool, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	hash, _, err := s.getHashForWriteLocked(key, true)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := hash[field]; ok {
+		return false, nil
+	}
+	return s.setFieldLocked(key, hash, field, value), nil
+}
+
+// HIncrBy atomically adds delta to the integer in field, treating a missing
+// field as 0, and returns the result.
+func (s *KeyValueStore) HIncrBy(key, field string, delta int64) (int64, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	hash, _, err := s.getHashForWriteLocked(key, true)
+	if err != nil {
+		return 0, err
+	}
+	var current int64
+	if value, ok := hash[field]; ok {
+		current, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, ErrHashNotInteger
+		}
+	}
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return 0, ErrOverflow
+	}
+
+	current += delta
+	s.setFieldLocked(key, hash, field, strconv.FormatInt(current, 10))
+	return current, nil
+}
+
+// HIncrByFloat atomically adds delta to the float in field, treating a
+// missing field as 0, and returns the formatted result.
+func (s *KeyValueStore) HIncrByFloat(key, field string, delta float64) (string, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	hash, _, err := s.getHashForWriteLocked(key, true)
+	if err != nil {
+		return "", err
+	}
+	var current float64
+	if value, ok := hash[field]; ok {
+		current, err = strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(current) || math.IsInf(current, 0) {
+			return "", ErrHashNotFloat
+		}
+	}
+
+	current += delta
+	if math.IsNaN(current) || math.IsInf(current, 0) {
+		return "", ErrNaNOrInfinity
+	}
+
+	formatted := formatFloat(current)
+	s.setFieldLocked(key, hash, field, formatted)
+	return formatted, nil
+}
+
+// HMGet returns the values of fields in order, with false marking the ones
+// that are missing.
+func (s *KeyValueStore) HMGet(key string, fields []string) ([]string, []bool, error) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	hash, _, err := s.getHashLocked(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	values := make([]string, len(fields))
+	found := make([]bool, len(fields))
+	for i, field := range fields {
+		values[i], found[i] = hash[field]
+	}
+	return values, found, nil
+}
+
+// HLen returns the number of fields in the hash at key, 0 when it does not exist.
+func (s *KeyValueStore) HLen(key string) (int, error) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	hash, _, err := s.getHashLocked(key)
+	return len(hash), err
+}
+
+// HKeys returns the fields of the hash at key.
+func (s *KeyValueStore) HKeys(key string) ([]string, error) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	hash, _, err := s.getHashLocked(key)
+	if err != nil {
+		return nil, err
+	}
+	fields := make([]string, 0, len(hash))
+	for field := range hash {
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// HVals returns the values of the hash at key.
+func (s *KeyValueStore) HVals(key string) ([]string, error) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	hash, _, err := s.getHashLocked(key)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]string, 0, len(hash))
+	for _, value := range hash {
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// HRandField picks fields from the hash at key as HRANDFIELD does: up to
+// count distinct ones when count is positive, or exactly -count that may
+// repeat when it is negative. With withValues the result interleaves each
+// field with its value.
+func (s *KeyValueStore) HRandField(key string, count int, withValues bool) ([]string, error) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	hash, _, err := s.getHashLocked(key)
+	if err != nil || len(hash) == 0 || count == 0 {
+		return nil, err
+	}
+	fields := make([]string, 0, len(hash))
+	for field := range hash {
+		fields = append(fields, field)
+	}
+	var picked []string
+	if count > 0 {
+		n := min(count, len(fields))
+		// A partial Fisher-Yates shuffle leaves n distinct fields in front.
+		for i := 0; i < n; i++ {
+			j := i + rand.Intn(len(fields)-i)
+			fields[i], fields[j] = fields[j], fields[i]
+		}
+		picked = fields[:n]
+	} else {
+		picked = make([]string, -count)
+		for i := range picked {
+			picked[i] = fields[rand.Intn(len(fields))]
+		}
+	}
+	if !withValues {
+		return picked, nil
+	}
+	pairs := make([]string, 0, len(picked)*2)
+	for _, field := range picked {
+		pairs = append(pairs, field, hash[field])
+	}
+	return pairs, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// hotKeysCapacity bounds how many distinct keys the tracker remembers.
+const hotKeysCapacity = 128
+
+// HotKey is an approximate access count for a single key.
+type HotKey struct {
+	Key    string
+	Hits   uint64
+	Error  uint64
+	Reads  uint64
+	Writes uint64
+}
+
+// HotKeyTracker approximates the most frequently accessed keys using the
+// SpaceSaving algorithm, so memory stays bounded by its capacity no matter
+// how many distinct keys are seen.
+type HotKeyTracker struct {
+	enabled    atomic.Bool
+	sampleRate atomic.Int64
+	seen       atomic.Uint64
+	mu         sync.Mutex
+	capacity   int
+	counters   map[string]*HotKey
+}
+
+// NewHotKeyTracker creates a disabled tracker remembering at most capacity
+// keys. Its counter table is only allocated while tracking is enabled.
+func NewHotKeyTracker(capacity int) *HotKeyTracker {
+	t := &HotKeyTracker{capacity: capacity}
+	t.sampleRate.Store(1)
+	return t
+}
+
+// Enabled reports whether tracking is on.
+func (t *HotKeyTracker) Enabled() bool {
+	return t.enabled.Load()
+}
+
+// SetEnabled turns tracking on or off. Turning it off frees the counters.
+func (t *HotKeyTracker) SetEnabled(enabled bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.enabled.Store(enabled)
+	switch {
+	case !enabled:
+		t.counters = nil
+	case t.counters == nil:
+		t.counters = make(map[string]*HotKey, t.capacity)
+	}
+}
+
+// SampleRate returns N where one in every N commands is sampled.
+func (t *HotKeyTracker) SampleRate() int64 {
+	return t.sampleRate.Load()
+}
+
+// SetSampleRate samples one in every n commands.
+func (t *HotKeyTracker) SetSampleRate(n int64) {
+	if n < 1 {
+		n = 1
+	}
+	t.sampleRate.Store(n)
+}
+
+// Record counts an access to keys if tracking is enabled and the command is sampled.
+func (t *HotKeyTracker) Record(keys []string, isWrite bool) {
+	if !t.enabled.Load() || len(keys) == 0 {
+		return
+	}
+	if rate := t.sampleRate.Load(); rate > 1 && t.seen.Add(1)%uint64(rate) != 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.counters == nil {
+		// Disabled while this call was in flight.
+		return
+	}
+
+	for _, key := range keys {
+		counter, ok := t.counters[key]
+		if !ok {
+			counter = t.admitLocked(key)
+		}
+		counter.Hits++
+		if isWrite {
+			counter.Writes++
+		} else {
+			counter.Reads++
+		}
+	}
+}
+
+// admitLocked makes room for key, evicting the least counted entry when full.
+func (t *HotKeyTracker) admitLocked(key string) *HotKey {
+	if len(t.counters) < t.capacity {
+		counter := &HotKey{Key: key}
+		t.counters[key] = counter
+		return counter
+	}
+
+	var victim *HotKey
+	for _, counter := range t.counters {
+		if victim == nil || counter.Hits < victim.Hits {
+			victim = counter
+		}
+	}
+	delete(t.counters, victim.Key)
+
+	// The newcomer inherits the evicted count as its overestimation bound.
+	counter := &HotKey{Key: key, Hits: victim.Hits, Error: victim.Hits}
+	t.counters[key] = counter
+	return counter
+}
+
+// Top returns up to n keys ordered by descending estimated hits, scaled by the sample rate.
+func (t *HotKeyTracker) Top(n int) []HotKey {
+	t.mu.Lock()
+	result := make([]HotKey, 0, len(t.counters))
+	for _, counter := range t.counters {
+		result = append(result, *counter)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Hits != result[j].Hits {
+			return result[i].Hits > result[j].Hits
+		}
+		return result[i].Key < result[j].Key
+	})
+	if n >= 0 && len(result) > n {
+		result = result[:n]
+	}
+
+	rate := uint64(t.sampleRate.Load())
+	for i := range result {
+		result[i].Hits *= rate
+		result[i].Error *= rate
+		result[i].Reads *= rate
+		result[i].Writes *= rate
+	}
+	return result
+}
+
+// Reset forgets every tracked key.
+func (t *HotKeyTracker) Reset() {
+	t.mu.Lock()
+	if t.counters != nil {
+		t.counters = make(map[string]*HotKey, t.capacity)
+	}
+	t.mu.Unlock()
+	t.seen.Store(0)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// zipfKeys returns n keys drawn from a zipfian distribution over distinct
+// keys, the same for every run.
+func zipfKeys(n int, distinct uint64) []string {
+	zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.2, 1, distinct-1)
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = "key:" + strconv.FormatUint(zipf.Uint64(), 10)
+	}
+	return keys
+}
+
+// uniformKeys returns n keys drawn uniformly from distinct keys.
+func uniformKeys(n int, distinct int) []string {
+	r := rand.New(rand.NewSource(1))
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = "key:" + strconv.Itoa(r.Intn(distinct))
+	}
+	return keys
+}
+
+// counts tallies keys.
+func counts(keys []string) map[string]uint64 {
+	c := make(map[string]uint64)
+	for _, key := range keys {
+		c[key]++
+	}
+	return c
+}
+
+// hottest returns the n most frequent keys of c, ties broken by name.
+func hottest(c map[string]uint64, n int) []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if c[keys[i]] != c[keys[j]] {
+			return c[keys[i]] > c[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	return keys[:min(n, len(keys))]
+}
+
+func TestHotKeyTrackerExactBelowCapacity(t *testing.T) {
+	tracker := NewHotKeyTracker(8)
+	tracker.SetEnabled(true)
+	for i := 0; i < 5; i++ {
+		tracker.Record([]string{"a"}, false)
+	}
+	tracker.Record([]string{"a", "b"}, true)
+	tracker.Record([]string{"b"}, false)
+
+	want := []HotKey{{Key: "a", Hits: 6, Reads: 5, Writes: 1}, {Key: "b", Hits: 2, Reads: 1, Writes: 1}}
+	if got := tracker.Top(-1); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("top = %+v, want %+v", got, want)
+	}
+}
+
+// TestHotKeyTrackerBounds checks SpaceSaving's guarantees on known
+// distributions: every count is overestimated by at most its Error, which
+// never exceeds n/capacity; every key seen more than n/capacity times is
+// tracked; and no more than capacity keys are held.
+func TestHotKeyTrackerBounds(t *testing.T) {
+	const n, capacity = 100000, 128
+	streams := map[string][]string{
+		"zipf":    zipfKeys(n, 10000),
+		"uniform": uniformKeys(n, 10000),
+	}
+	for name, stream := range streams {
+		t.Run(name, func(t *testing.T) {
+			tracker := NewHotKeyTracker(capacity)
+			tracker.SetEnabled(true)
+			for _, key := range stream {
+				tracker.Record([]string{key}, false)
+			}
+			truth := counts(stream)
+
+			top := tracker.Top(-1)
+			if len(top) > capacity {
+				t.Fatalf("tracking %d keys, capacity %d", len(top), capacity)
+			}
+			var total uint64
+			tracked := make(map[string]bool)
+			for _, hot := range top {
+				total += hot.Hits
+				tracked[hot.Key] = true
+				if hot.Hits < truth[hot.Key] || hot.Hits-hot.Error > truth[hot.Key] {
+					t.Fatalf("%s: estimate %d with error %d, true count %d", hot.Key, hot.Hits, hot.Error, truth[hot.Key])
+				}
+				if hot.Error > n/capacity {
+					t.Fatalf("%s: error %d exceeds n/capacity = %d", hot.Key, hot.Error, n/capacity)
+				}
+			}
+			if total != n {
+				t.Fatalf("estimates sum to %d, want the stream length %d", total, n)
+			}
+			for key, count := range truth {
+				if count > n/capacity && !tracked[key] {
+					t.Fatalf("%s was seen %d times, more than n/capacity, but is not tracked", key, count)
+				}
+			}
+		})
+	}
+}
+
+func TestHotKeyTrackerTopTenZipf(t *testing.T) {
+	stream := zipfKeys(100000, 10000)
+	tracker := NewHotKeyTracker(hotKeysCapacity)
+	tracker.SetEnabled(true)
+	for _, key := range stream {
+		tracker.Record([]string{key}, false)
+	}
+
+	reported := make(map[string]bool)
+	for _, hot := range tracker.Top(10) {
+		reported[hot.Key] = true
+	}
+	for _, key := range hottest(counts(stream), 10) {
+		if !reported[key] {
+			t.Fatalf("%s is among the ten hottest keys but was not reported", key)
+		}
+	}
+}
+
+func TestHotKeyTrackerSampling(t *testing.T) {
+	tracker := NewHotKeyTracker(8)
+	tracker.SetEnabled(true)
+	tracker.SetSampleRate(10)
+	for i := 0; i < 1000; i++ {
+		tracker.Record([]string{"a"}, i%2 == 0)
+	}
+	if top := tracker.Top(1); len(top) != 1 || top[0].Hits != 1000 || top[0].Reads+top[0].Writes != 1000 {
+		t.Fatalf("top = %+v, want a with 1000 hits scaled up from the sample", top)
+	}
+
+	tracker.Reset()
+	if top := tracker.Top(-1); len(top) != 0 {
+		t.Fatalf("top after a reset = %+v, want nothing", top)
+	}
+	tracker.SetEnabled(false)
+	tracker.Record([]string{"a"}, false)
+	if tracker.counters != nil {
+		t.Fatal("a disabled tracker holds counters")
+	}
+}
+
+func TestHotKeysZipfWorkload(t *testing.T) {
+	s := startServer(t, nil)
+	c := dial(t, s)
+	expectReply(t, c.do("CONFIG", "SET", "hotkeys-tracking", "yes"), NewSimpleString("OK"))
+
+	// One connection sends the workload in order, so the tracker sees the
+	// same sequence every run. Every tenth command is a write.
+	stream := zipfKeys(50000, 1000)
+	writes := make(map[string]uint64)
+	const batch = 1000
+	for start := 0; start < len(stream); start += batch {
+		for i, key := range stream[start : start+batch] {
+			if (start+i)%10 == 0 {
+				c.send("SET", key, "v")
+				writes[key]++
+			} else {
+				c.send("GET", key)
+			}
+		}
+		for range batch {
+			c.read()
+		}
+	}
+
+	reply := c.do("HOTKEYS", "COUNT", "10")
+	if reply.Type != Array || len(reply.Array) != 10 {
+		t.Fatalf("HOTKEYS COUNT 10 replied %q", reply.Marshal())
+	}
+	reported := make(map[string]RESP)
+	for _, item := range reply.Array {
+		reported[item.Array[1].String] = item
+	}
+	truth := counts(stream)
+	top := hottest(truth, 10)
+	for _, key := range top {
+		if _, ok := reported[key]; !ok {
+			t.Fatalf("%s is among the ten hottest keys but HOTKEYS reported %q", key, reply.Marshal())
+		}
+	}
+
+	// The hottest key is tracked from its first access, so its counts are exact.
+	want := NewArray([]RESP{
+		NewBulkString("key"), NewBulkString(top[0]),
+		NewBulkString("hits"), NewInteger(int(truth[top[0]])),
+		NewBulkString("reads"), NewInteger(int(truth[top[0]] - writes[top[0]])),
+		NewBulkString("writes"), NewInteger(int(writes[top[0]])),
+	})
+	expectReply(t, reply.Array[0], want)
+
+	s.hotKeys.mu.Lock()
+	held := len(s.hotKeys.counters)
+	s.hotKeys.mu.Unlock()
+	if held > hotKeysCapacity {
+		t.Fatalf("tracking %d keys, capacity %d", held, hotKeysCapacity)
+	}
+
+	expectReply(t, c.do("HOTKEYS", "RESET"), NewSimpleString("OK"))
+	expectReply(t, c.do("HOTKEYS"), NewArray(nil))
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ServerStats holds the counters reported by INFO server and INFO stats.
+type ServerStats struct {
+	startTime           time.Time
+	connectionsReceived atomic.Int64
+	commandsProcessed   atomic.Int64
+	keyspaceHits        atomic.Int64
+	keyspaceMisses      atomic.Int64
+	expiredKeys         atomic.Int64
+	evictedKeys         atomic.Int64
+	rejectedConnections atomic.Int64
+}
+
+// ConnectionReceived counts an accepted client connection.
+func (s *ServerStats) ConnectionReceived() {
+	s.connectionsReceived.Add(1)
+}
+
+// ConnectionRejected counts a connection refused because maxclients was reached.
+func (s *ServerStats) ConnectionRejected() {
+	s.rejectedConnections.Add(1)
+}
+
+// CommandProcessed counts a command read from a client.
+func (s *ServerStats) CommandProcessed() {
+	s.commandsProcessed.Add(1)
+}
+
+// KeyLookup counts a key read as a keyspace hit or miss.
+func (s *ServerStats) KeyLookup(hit bool) {
+	if hit {
+		s.keyspaceHits.Add(1)
+	} else {
+		s.keyspaceMisses.Add(1)
+	}
+}
+
+// KeyExpired counts a key removed because its TTL passed.
+func (s *ServerStats) KeyExpired() {
+	s.expiredKeys.Add(1)
+}
+
+// KeyEvicted counts a key evicted for maxmemory.
+func (s *ServerStats) KeyEvicted() {
+	s.evictedKeys.Add(1)
+}
+
+// Reset zeroes the counters cleared by CONFIG RESETSTAT.
+func (s *ServerStats) Reset() {
+	s.connectionsReceived.Store(0)
+	s.commandsProcessed.Store(0)
+	s.keyspaceHits.Store(0)
+	s.keyspaceMisses.Store(0)
+	s.expiredKeys.Store(0)
+	s.evictedKeys.Store(0)
+}
+
+// infoSection renders one INFO section of a server, including its
+// "# Name" header.
+type infoSection struct {
+	name   string
+	render func(s *Server) string
+}
+
+// infoSections lists the sections in the order INFO without arguments
+// prints them.
+var infoSections = []infoSection{
+	{"server", (*Server).serverInfo},
+	{"clients", (*Server).clientsInfo},
+	{"memory", (*Server).memoryInfo},
+	{"persistence", (*Server).persistenceInfo},
+	{"stats", (*Server).statsInfo},
+	{"replication", (*Server).replicationInfo},
+	{"keyspace", (*Server).keyspaceInfo},
+	{"hotkeys", (*Server).hotkeysInfo},
+	{"latencystats", func(s *Server) string { return s.latency.Info() }},
+	{"runtime", (*Server).runtimeInfo},
+}
+
+// infoCommand renders the requested INFO sections, or all of them when
+// called without arguments or with "all", "everything" or "default".
+// Section names are case-insensitive and unknown ones are left out.
+func infoCommand(ctx *CommandContext) (RESP, []byte) {
+	args := ctx.Args
+	wanted := make(map[string]bool)
+	all := len(args) == 0
+	for _, arg := range args {
+		name := strings.ToLower(arg.String)
+		switch name {
+		case "all", "everything", "default":
+			all = true
+		default:
+			wanted[name] = true
+		}
+	}
+
+	var parts []string
+	for _, section := range infoSections {
+		if all || wanted[section.name] {
+			parts = append(parts, section.render(ctx.Server))
+		}
+	}
+	return NewBulkString(strings.Join(parts, "\r\n")), nil
+}
+
+// serverInfo renders the server section.
+func (s *Server) serverInfo() string {
+	uptime := time.Since(s.stats.startTime)
+	var builder strings.Builder
+	builder.WriteString("# Server\r\n")
+	builder.WriteString(fmt.Sprintf("redis_version:%s\r\n", ServerVersion))
+	builder.WriteString(fmt.Sprintf("process_id:%d\r\n", os.Getpid()))
+	builder.WriteString(fmt.Sprintf("tcp_port:%d\r\n", s.Config().Port))
+	builder.WriteString(fmt.Sprintf("uptime_in_seconds:%d\r\n", int64(uptime.Seconds())))
+	builder.WriteString(fmt.Sprintf("uptime_in_days:%d\r\n", int64(uptime.Hours()/24)))
+	return builder.String()
+}
+
+// clientsInfo renders the clients section.
+func (s *Server) clientsInfo() string {
+	s.clientStatesMu.RLock()
+	connected := len(s.clientStates)
+	s.clientStatesMu.RUnlock()
+
+	var builder strings.Builder
+	builder.WriteString("# Clients\r\n")
+	builder.WriteString(fmt.Sprintf("connected_clients:%d\r\n", connected))
+	builder.WriteString(fmt.Sprintf("maxclients:%d\r\n", s.Config().MaxClients))
+	builder.WriteString(fmt.Sprintf("blocked_clients:%d\r\n", len(s.blocks.Blocked())))
+	return builder.String()
+}
+
+// memoryInfo renders the memory section from the Go heap statistics and
+// the dataset size maxmemory is checked against.
+func (s *Server) memoryInfo() string {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	var builder strings.Builder
+	builder.WriteString("# Memory\r\n")
+	builder.WriteString(fmt.Sprintf("used_memory:%d\r\n", mem.HeapAlloc))
+	builder.WriteString(fmt.Sprintf("used_memory_human:%s\r\n", humanBytes(mem.HeapAlloc)))
+	cfg := s.Config()
+	builder.WriteString(fmt.Sprintf("used_memory_dataset:%d\r\n", s.dbs.UsedMemory()))
+	builder.WriteString(fmt.Sprintf("maxmemory:%d\r\n", cfg.MaxMemory))
+	builder.WriteString(fmt.Sprintf("maxmemory_human:%s\r\n", humanBytes(uint64(cfg.MaxMemory))))
+	builder.WriteString(fmt.Sprintf("maxmemory_policy:%s\r\n", cfg.MaxMemoryPolicy))
+	return builder.String()
+}
+
+// persistenceInfo renders the persistence section: the RDB save state
+// followed by the AOF's.
+func (s *Server) persistenceInfo() string {
+	saving, lastFailed := s.persistence.Status()
+	bgsaveStatus := "ok"
+	if lastFailed {
+		bgsaveStatus = "err"
+	}
+
+	var builder strings.Builder
+	builder.WriteString("# Persistence\r\n")
+	builder.WriteString(fmt.Sprintf("rdb_changes_since_last_save:%d\r\n", s.persistence.Dirty()))
+	builder.WriteString(fmt.Sprintf("rdb_bgsave_in_progress:%d\r\n", boolInt(saving)))
+	builder.WriteString(fmt.Sprintf("rdb_last_save_time:%d\r\n", s.persistence.LastSave().Unix()))
+	builder.WriteString(fmt.Sprintf("rdb_last_bgsave_status:%s\r\n", bgsaveStatus))
+	builder.WriteString(s.aof.Info())
+	return builder.String()
+}
+
+// boolInt renders b as the 1 or 0 INFO flags use.
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// humanBytes formats a byte count the way Redis's *_human fields do.
+func humanBytes(n uint64) string {
+	units := []string{"B", "K", "M", "G", "T"}
+	value := float64(n)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%dB", n)
+	}
+	return fmt.Sprintf("%.2f%s", value, units[unit])
+}
+
+// statsInfo renders the stats section: the server counters followed by
+// the admission counters.
+func (s *Server) statsInfo() string {
+	var builder strings.Builder
+	builder.WriteString("# Stats\r\n")
+	builder.WriteString(fmt.Sprintf("total_connections_received:%d\r\n", s.stats.connectionsReceived.Load()))
+	builder.WriteString(fmt.Sprintf("total_commands_processed:%d\r\n", s.stats.commandsProcessed.Load()))
+	builder.WriteString(fmt.Sprintf("rejected_connections:%d\r\n", s.stats.rejectedConnections.Load()))
+	builder.WriteString(fmt.Sprintf("keyspace_hits:%d\r\n", s.stats.keyspaceHits.Load()))
+	builder.WriteString(fmt.Sprintf("keyspace_misses:%d\r\n", s.stats.keyspaceMisses.Load()))
+	builder.WriteString(fmt.Sprintf("expired_keys:%d\r\n", s.stats.expiredKeys.Load()))
+	builder.WriteString(fmt.Sprintf("evicted_keys:%d\r\n", s.stats.evictedKeys.Load()))
+	builder.WriteString(s.admission.Info())
+	return builder.String()
+}
+
+// replicationInfo renders the replication section for either role.
+func (s *Server) replicationInfo() string {
+	var builder strings.Builder
+	builder.WriteString("# Replication\r\n")
+	cfg := s.Config()
+	if cfg.IsReplica {
+		replID, _ := s.repl.GetReplID()
+		builder.WriteString(fmt.Sprintf("role:slave\r\nmaster_host:%s\r\nmaster_port:%d\r\nmaster_replid:%s\r\n%s\r\n",
+			cfg.MasterHost, cfg.MasterPort, replID, s.masterLink.Info()))
+		return builder.String()
+	}
+
+	replID, replID2 := s.repl.GetReplID()
+	states := s.repl.GetReplicaSyncStateCounts()
+	builder.WriteString(fmt.Sprintf("role:master\r\nmaster_replid:%s\r\nmaster_replid2:%s\r\nmaster_repl_offset:%d\r\nconnected_slaves:%d\r\n",
+		replID, replID2, s.repl.GetMasterOffset(), s.repl.GetReplicaCount()))
+	builder.WriteString(fmt.Sprintf("slaves_wait_bgsave:%d\r\nslaves_send_bulk:%d\r\nslaves_online:%d\r\n",
+		states[ReplicaWaitBgsave], states[ReplicaSendBulk], states[ReplicaOnline]))
+	now := time.Now()
+	for i, replica := range s.repl.GetReplicas() {
+		compression := "none"
+		if replica.Compressed() {
+			compression = "flate"
+		}
+		ip, _, _ := net.SplitHostPort(replica.Conn.RemoteAddr().String())
+		builder.WriteString(fmt.Sprintf("slave%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d,queued=%d,compression=%s,compression_ratio=%.2f\r\n",
+			i, ip, replica.ListeningPort, replica.SyncState, replica.Offset, int64(replica.AckLag(now).Seconds()),
+			replica.Queued(), compression, replica.CompressionRatio()))
+	}
+	size, firstOffset, histLen, active := s.repl.ReplBacklogInfo()
+	activeFlag := 0
+	if active {
+		activeFlag = 1
+	} else {
+		size = cfg.ReplBacklogSize
+	}
+	builder.WriteString(fmt.Sprintf("repl_backlog_active:%d\r\nrepl_backlog_size:%d\r\nrepl_backlog_first_byte_offset:%d\r\nrepl_backlog_histlen:%d\r\n",
+		activeFlag, size, firstOffset, histLen))
+	return builder.String()
+}
+
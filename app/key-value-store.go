@@ -1,68 +1,203 @@
 package main
 
 import (
+    "errors"
+    "maps"
+    "math"
+    "math/rand"
+    "strconv"
     "sync"
+    "sync/atomic"
     "time"
 )
 
-// KeyValueStore provides a concurrent in-memory key/value store with expirations.
-type KeyValueStore struct {
+var (
+    // ErrWrongType is returned when an operation targets a key holding another data type.
+    ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+    // ErrNotInteger is returned when a value cannot be parsed as a 64-bit integer.
+    ErrNotInteger = errors.New("ERR value is not an integer or out of range")
+    // ErrOverflow is returned when an increment would overflow a 64-bit integer.
+    ErrOverflow = errors.New("ERR increment or decrement would overflow")
+    // ErrNaNOrInfinity is returned when a float increment would produce NaN or Inf.
+    ErrNaNOrInfinity = errors.New("ERR increment would produce NaN or Infinity")
+)
+
+// storeShards is how many independently locked shards a store splits its
+// keys across, so commands on unrelated keys rarely wait on each other.
+const storeShards = 16
+
+// storeShard holds the keys that hash to it. Its lock guards its maps; the
+// "read lock" and "write lock" the *Locked helpers ask for are the lock of
+// the shard holding their key.
+type storeShard struct {
+    mu        sync.RWMutex
     data      map[string]interface{}
     expiryMap map[string]time.Time
-    mu        sync.RWMutex
+    // sizes holds each key's approximate size in bytes, for maxmemory.
+    sizes     map[string]int64
 }
 
-// NewKeyValueStore constructs a new store and starts background expiry cleanup.
+// KeyValueStore provides a concurrent in-memory key/value store with expirations.
+type KeyValueStore struct {
+    shards     [storeShards]*storeShard
+    // lastAccess maps each key to the time.Time it was last read or
+    // written, for OBJECT IDLETIME. Reads update it under the read lock.
+    lastAccess sync.Map
+    // usedMemory is the sum of every shard's sizes.
+    usedMemory atomic.Int64
+    // server owns the databases the store is one of, for keyspace
+    // statistics and notifications. A standalone store has none.
+    server     *Server
+    stats      dbStats
+}
+
+// NewKeyValueStore constructs an empty store. Expired keys are swept by the
+// owning Databases.
 func NewKeyValueStore() *KeyValueStore {
-    store := &KeyValueStore{
+    s := &KeyValueStore{}
+    for i := range s.shards {
+        s.shards[i] = newStoreShard()
+    }
+    return s
+}
+
+// keyLookup counts a read of a key as a keyspace hit or miss.
+func (s *KeyValueStore) keyLookup(hit bool) {
+    if hit {
+        s.stats.hits.Add(1)
+    } else {
+        s.stats.misses.Add(1)
+    }
+    if s.server != nil {
+        s.server.stats.KeyLookup(hit)
+    }
+}
+
+// newStoreShard returns a shard with empty maps.
+func newStoreShard() *storeShard {
+    return &storeShard{
         data:      make(map[string]interface{}),
         expiryMap: make(map[string]time.Time),
+        sizes:     make(map[string]int64),
     }
+}
 
-	go store.cleanupExpiredKeys()
-
-    return store
+// shardIndex hashes key with 32-bit FNV-1a to pick its shard.
+func shardIndex(key string) int {
+    h := uint32(2166136261)
+    for i := 0; i < len(key); i++ {
+        h ^= uint32(key[i])
+        h *= 16777619
+    }
+    return int(h % storeShards)
 }
 
-// Set assigns a value with an optional expiry duration.
-func (s *KeyValueStore) Set(key string, value interface{}, expiry time.Duration) {
-    s.mu.Lock()
-    defer s.mu.Unlock()
+// shard returns the shard holding key.
+func (s *KeyValueStore) shard(key string) *storeShard {
+    return s.shards[shardIndex(key)]
+}
 
-	isStreamUpdate := false
-	if _, ok := value.(*Stream); ok {
-		isStreamUpdate = true
-	}
+// lockKeys write-locks the shards holding keys and returns a function that
+// unlocks them. Shards are always locked in index order so that commands
+// touching several keys cannot deadlock one another.
+func (s *KeyValueStore) lockKeys(keys ...string) func() {
+    held := shardSet(keys)
+    for i, sh := range s.shards {
+        if held[i] {
+            sh.mu.Lock()
+        }
+    }
+    return func() {
+        for i, sh := range s.shards {
+            if held[i] {
+                sh.mu.Unlock()
+            }
+        }
+    }
+}
 
-	s.data[key] = value
+// rlockKeys is lockKeys for commands that only read keys.
+func (s *KeyValueStore) rlockKeys(keys ...string) func() {
+    held := shardSet(keys)
+    for i, sh := range s.shards {
+        if held[i] {
+            sh.mu.RLock()
+        }
+    }
+    return func() {
+        for i, sh := range s.shards {
+            if held[i] {
+                sh.mu.RUnlock()
+            }
+        }
+    }
+}
 
-	if expiry > 0 {
-		s.expiryMap[key] = time.Now().Add(expiry)
-	} else if _, exists := s.expiryMap[key]; exists {
-		delete(s.expiryMap, key)
-	}
+// shardSet marks the shards holding keys.
+func shardSet(keys []string) [storeShards]bool {
+    var held [storeShards]bool
+    for _, key := range keys {
+        held[shardIndex(key)] = true
+    }
+    return held
+}
 
-    if isStreamUpdate {
-        go GetStreamManager().NotifyNewEntry(key)
+// lockAll write-locks every shard, for operations on the whole keyspace
+// that must see it at one instant, and returns a function that unlocks them.
+func (s *KeyValueStore) lockAll() func() {
+    for _, sh := range s.shards {
+        sh.mu.Lock()
     }
+    return func() {
+        for _, sh := range s.shards {
+            sh.mu.Unlock()
+        }
+    }
+}
+
+// SetValue assigns a value, keeping the expiry the key already has, as
+// commands that update a value rather than replace the key do. An expired
+// key is dropped first so its old TTL cannot carry over.
+func (s *KeyValueStore) SetValue(key string, value interface{}) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	s.lookupForWriteLocked(key)
+	s.storeLocked(key, value)
+}
+
+// SetWithExpiry assigns a value that expires after expiry, replacing any
+// expiry the key had.
+func (s *KeyValueStore) SetWithExpiry(key string, value interface{}, expiry time.Duration) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	s.storeLocked(key, value)
+	sh.expiryMap[key] = time.Now().Add(expiry)
 }
 
 // Get returns a string value for a key if present and not expired.
 func (s *KeyValueStore) Get(key string) (string, bool) {
-    s.mu.RLock()
-    defer s.mu.RUnlock()
+    sh := s.shard(key)
+    sh.mu.RLock()
+    defer sh.mu.RUnlock()
 
-	if expiry, hasExpiry := s.expiryMap[key]; hasExpiry {
+	if expiry, hasExpiry := sh.expiryMap[key]; hasExpiry {
 		if time.Now().After(expiry) {
 			go s.deleteExpiredKey(key)
+			s.keyLookup(false)
 			return "", false
 		}
 	}
 
-	value, exists := s.data[key]
+	value, exists := sh.data[key]
+	s.keyLookup(exists)
 	if !exists {
 		return "", false
 	}
+	s.touch(key)
 
 	str, ok := value.(string)
 	if !ok {
@@ -74,20 +209,24 @@ func (s *KeyValueStore) Get(key string) (string, bool) {
 
 // GetStream returns a stream value for a key if present and not expired.
 func (s *KeyValueStore) GetStream(key string) (*Stream, bool) {
-    s.mu.RLock()
-    defer s.mu.RUnlock()
+    sh := s.shard(key)
+    sh.mu.RLock()
+    defer sh.mu.RUnlock()
 
-	if expiry, hasExpiry := s.expiryMap[key]; hasExpiry {
+	if expiry, hasExpiry := sh.expiryMap[key]; hasExpiry {
 		if time.Now().After(expiry) {
 			go s.deleteExpiredKey(key)
+			s.keyLookup(false)
 			return nil, false
 		}
 	}
 
-	value, exists := s.data[key]
+	value, exists := sh.data[key]
+	s.keyLookup(exists)
 	if !exists {
 		return nil, false
 	}
+	s.touch(key)
 
 	stream, ok := value.(*Stream)
 	if !ok {
@@ -97,35 +236,121 @@ func (s *KeyValueStore) GetStream(key string) (*Stream, bool) {
     return stream, true
 }
 
-// Keys returns all non-expired keys.
-func (s *KeyValueStore) Keys() []string {
-    s.mu.RLock()
-    defer s.mu.RUnlock()
+// Stats returns the number of stored keys and how many of them carry an
+// expiry. Shards are counted one at a time, so the totals are approximate
+// while writes are in flight.
+func (s *KeyValueStore) Stats() (int, int) {
+    keys, expires := 0, 0
+    for _, sh := range s.shards {
+        sh.mu.RLock()
+        keys += len(sh.data)
+        expires += len(sh.expiryMap)
+        sh.mu.RUnlock()
+    }
+    return keys, expires
+}
+
+// forEachKeyChunk is how many keys ForEachKey collects under a shard's read
+// lock before releasing it to hand them to its callback.
+const forEachKeyChunk = 1024
 
-	keys := make([]string, 0, len(s.data))
-	now := time.Now()
+// ForEachKey calls fn with each non-expired key until fn returns false. It
+// walks one shard at a time and releases the shard's read lock after every
+// forEachKeyChunk keys, so writers never wait on more than a chunk and fn
+// may use the store. The walk resumes where it stopped once the lock is
+// retaken: a map may change between steps of a range over it, and the lock
+// makes those changes ordinary interleavings rather than races. As with any
+// such range, keys written or deleted during the walk may or may not be seen.
+func (s *KeyValueStore) ForEachKey(fn func(key string) bool) {
+	keys := make([]string, 0, forEachKeyChunk)
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		now := time.Now()
+		for key := range sh.data {
+			if expiry, hasExpiry := sh.expiryMap[key]; hasExpiry && now.After(expiry) {
+				continue
+			}
+			keys = append(keys, key)
+			if len(keys) < forEachKeyChunk {
+				continue
+			}
+			sh.mu.RUnlock()
+			if !yieldKeys(keys, fn) {
+				return
+			}
+			keys = keys[:0]
+			sh.mu.RLock()
+			now = time.Now()
+		}
+		sh.mu.RUnlock()
+		if !yieldKeys(keys, fn) {
+			return
+		}
+		keys = keys[:0]
+	}
+}
 
-	for key := range s.data {
-		if expiry, hasExpiry := s.expiryMap[key]; hasExpiry && now.After(expiry) {
-			continue
+// yieldKeys calls fn with each of keys, reporting whether fn asked for more.
+func yieldKeys(keys []string, fn func(key string) bool) bool {
+	for _, key := range keys {
+		if !fn(key) {
+			return false
 		}
-		keys = append(keys, key)
 	}
+	return true
+}
 
-    return keys
+// Count returns the number of non-expired keys without collecting them.
+func (s *KeyValueStore) Count() int {
+	count := 0
+	now := time.Now()
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		count += len(sh.data)
+		for _, expiry := range sh.expiryMap {
+			if now.After(expiry) {
+				count--
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	return count
+}
+
+// RandomKey returns a uniformly chosen non-expired key, or false when there
+// is none. Maps have no random access, so it reservoir-samples one pass.
+func (s *KeyValueStore) RandomKey() (string, bool) {
+	var chosen string
+	seen := 0
+	now := time.Now()
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for key := range sh.data {
+			if expiry, hasExpiry := sh.expiryMap[key]; hasExpiry && now.After(expiry) {
+				continue
+			}
+			seen++
+			if rand.Intn(seen) == 0 {
+				chosen = key
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	return chosen, seen > 0
 }
 
 // Exists reports whether a non-expired key exists.
 func (s *KeyValueStore) Exists(key string) bool {
-    s.mu.RLock()
-    defer s.mu.RUnlock()
+    sh := s.shard(key)
+    sh.mu.RLock()
+    defer sh.mu.RUnlock()
 
-	_, exists := s.data[key]
+	_, exists := sh.data[key]
 	if !exists {
 		return false
 	}
 
-	if expiry, hasExpiry := s.expiryMap[key]; hasExpiry {
+	if expiry, hasExpiry := sh.expiryMap[key]; hasExpiry {
 		if time.Now().After(expiry) {
 			go s.deleteExpiredKey(key)
 			return false
@@ -135,74 +360,713 @@ func (s *KeyValueStore) Exists(key string) bool {
     return true
 }
 
-// GetType returns the data type of a key.
-func (s *KeyValueStore) GetType(key string) string {
-    s.mu.RLock()
-    defer s.mu.RUnlock()
+// Delete removes the given keys, raising a del notification for each, and
+// returns how many existed. A key named twice is counted once.
+func (s *KeyValueStore) Delete(keys []string) int {
+	defer s.lockKeys(keys...)()
 
-	if !s.Exists(key) {
-		return "none"
+	deleted := 0
+	for _, key := range keys {
+		if _, exists := s.lookupForWriteLocked(key); exists {
+			s.deleteLocked(key)
+			notifyKeyspaceEvent(s, notifyGeneric, "del", key)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// ErrSameObject is returned by COPY when the source and destination are the
+// same key in the same database.
+var ErrSameObject = errors.New("ERR source and destination objects are the same")
+
+// Copy stores a copy of the value at src, with its TTL, under dst in dstDB,
+// which may be s. It reports false without copying when src does not exist
+// or, unless replace is set, when dst already does. Within one database
+// both keys are locked together; across databases the source is cloned
+// before the destination is locked, so copies running in opposite
+// directions between two databases cannot deadlock.
+func (s *KeyValueStore) Copy(src string, dstDB *KeyValueStore, dst string, replace bool) (bool, error) {
+	if dstDB == s {
+		if src == dst {
+			return false, ErrSameObject
+		}
+		defer s.lockKeys(src, dst)()
+		value, expiry, exists := s.cloneLocked(src)
+		if !exists {
+			return false, nil
+		}
+		return s.putCopyLocked(dst, value, expiry, replace), nil
+	}
+
+	sh := s.shard(src)
+	sh.mu.RLock()
+	value, expiry, exists := s.cloneLocked(src)
+	sh.mu.RUnlock()
+	if !exists {
+		return false, nil
+	}
+	dsh := dstDB.shard(dst)
+	dsh.mu.Lock()
+	defer dsh.mu.Unlock()
+	return dstDB.putCopyLocked(dst, value, expiry, replace), nil
+}
+
+// cloneLocked returns a copy of the live value at key that shares nothing
+// with it, and its expiry or the zero time; callers must hold at least the
+// read lock.
+func (s *KeyValueStore) cloneLocked(key string) (interface{}, time.Time, bool) {
+	value, exists := s.lookupLocked(key)
+	if !exists {
+		return nil, time.Time{}, false
+	}
+	switch v := value.(type) {
+	case Hash:
+		value = maps.Clone(v)
+	case Set:
+		value = maps.Clone(v)
+	case *List:
+		value = v.clone()
+	case *ZSet:
+		value = v.clone()
+	case *Stream:
+		value = v.clone()
+	}
+	return value, s.shard(key).expiryMap[key], true
+}
+
+// putCopyLocked stores a value copied by cloneLocked under key with expiry,
+// replacing whatever is there only when replace is set. It reports whether
+// it stored the value; callers must hold the write lock.
+func (s *KeyValueStore) putCopyLocked(key string, value interface{}, expiry time.Time, replace bool) bool {
+	if _, exists := s.lookupForWriteLocked(key); exists {
+		if !replace {
+			return false
+		}
+		s.deleteLocked(key)
 	}
+	s.storeLocked(key, value)
+	if !expiry.IsZero() {
+		s.shard(key).expiryMap[key] = expiry
+	}
+	return true
+}
+
+// GetType returns the data type of a key, or "none" when it does not exist.
+// It does not count as an access.
+func (s *KeyValueStore) GetType(key string) string {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
 
-	value, exists := s.data[key]
+	value, exists := s.peekLocked(key)
 	if !exists {
 		return "none"
 	}
+	return typeName(value)
+}
 
+// typeName returns the TYPE name of a stored value.
+func typeName(value interface{}) string {
 	switch value.(type) {
 	case string:
 		return "string"
 	case *Stream:
 		return "stream"
+	case Hash:
+		return "hash"
+	case Set:
+		return "set"
+	case *List:
+		return "list"
+	case *ZSet:
+		return "zset"
 	default:
 		return "none"
 	}
 }
 
-func (s *KeyValueStore) deleteExpiredKey(key string) {
-    s.mu.Lock()
-    defer s.mu.Unlock()
+// Object returns the encoding of the value at key and how long the key has
+// gone unaccessed, without counting as an access or a keyspace hit. The
+// encoding is worked out under the lock because hashes and sets are mutated
+// in place.
+func (s *KeyValueStore) Object(key string) (string, time.Duration, bool) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
 
-	if expiry, hasExpiry := s.expiryMap[key]; hasExpiry {
-		if time.Now().After(expiry) {
-			delete(s.data, key)
-			delete(s.expiryMap, key)
+	value, exists := s.peekLocked(key)
+	if !exists {
+		return "", 0, false
+	}
+	var idle time.Duration
+	if accessed, ok := s.lastAccess.Load(key); ok {
+		idle = time.Since(accessed.(time.Time))
+	}
+	return objectEncoding(value), idle, true
+}
+
+// Incr atomically adds delta to the integer stored at key, treating a missing key as 0.
+func (s *KeyValueStore) Incr(key string, delta int64) (int64, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	var current int64
+	if value, exists := s.lookupForWriteLocked(key); exists {
+		str, ok := value.(string)
+		if !ok {
+			return 0, ErrWrongType
+		}
+		parsed, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return 0, ErrNotInteger
 		}
+		current = parsed
+	}
+
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return 0, ErrOverflow
 	}
+
+	current += delta
+	s.storeLocked(key, strconv.FormatInt(current, 10))
+	return current, nil
 }
 
-// cleanupExpiredKeys periodically removes expired keys.
-func (s *KeyValueStore) cleanupExpiredKeys() {
-    ticker := time.NewTicker(100 * time.Millisecond)
-    defer ticker.Stop()
+// IncrByFloat atomically adds delta to the float stored at key and returns its formatted result.
+func (s *KeyValueStore) IncrByFloat(key string, delta float64) (string, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 
-	for range ticker.C {
-		s.mu.Lock()
-		now := time.Now()
+	var current float64
+	if value, exists := s.lookupForWriteLocked(key); exists {
+		str, ok := value.(string)
+		if !ok {
+			return "", ErrWrongType
+		}
+		parsed, err := strconv.ParseFloat(str, 64)
+		if err != nil || math.IsNaN(parsed) || math.IsInf(parsed, 0) {
+			return "", ErrNotInteger
+		}
+		current = parsed
+	}
 
-		expiredKeys := make([]string, 0)
-		for key, expiry := range s.expiryMap {
-			if now.After(expiry) {
-				expiredKeys = append(expiredKeys, key)
-			}
+	current += delta
+	if math.IsNaN(current) || math.IsInf(current, 0) {
+		return "", ErrNaNOrInfinity
+	}
+
+	formatted := formatFloat(current)
+	s.storeLocked(key, formatted)
+	return formatted, nil
+}
+
+// maxStringLength caps the size a string can grow to through SETRANGE.
+const maxStringLength = 512 * 1024 * 1024
+
+// GetString returns the string at key, reporting WRONGTYPE for other types.
+func (s *KeyValueStore) GetString(key string) (string, bool, error) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	value, exists := s.lookupLocked(key)
+	if !exists {
+		return "", false, nil
+	}
+	str, ok := value.(string)
+	if !ok {
+		return "", false, ErrWrongType
+	}
+	return str, true, nil
+}
+
+// GetSet atomically replaces the string at key, clearing its TTL, and returns the old value.
+func (s *KeyValueStore) GetSet(key, value string) (string, bool, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	var old string
+	existing, exists := s.lookupForWriteLocked(key)
+	if exists {
+		str, ok := existing.(string)
+		if !ok {
+			return "", false, ErrWrongType
+		}
+		old = str
+	}
+
+	s.storeLocked(key, value)
+	delete(sh.expiryMap, key)
+	return old, exists, nil
+}
+
+// GetAndDelete atomically removes the string at key and returns it,
+// reporting false when the key does not exist.
+func (s *KeyValueStore) GetAndDelete(key string) (string, bool, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	value, exists := s.lookupForWriteLocked(key)
+	if !exists {
+		return "", false, nil
+	}
+	str, ok := value.(string)
+	if !ok {
+		return "", false, ErrWrongType
+	}
+	s.deleteLocked(key)
+	return str, true, nil
+}
+
+// SetNX stores value under key, with expiry when it is positive, only if
+// key does not already exist. It reports whether it stored the value.
+func (s *KeyValueStore) SetNX(key, value string, expiry time.Duration) bool {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if _, exists := s.lookupForWriteLocked(key); exists {
+		return false
+	}
+	s.storeLocked(key, value)
+	if expiry > 0 {
+		sh.expiryMap[key] = time.Now().Add(expiry)
+	}
+	return true
+}
+
+// SetCondition restricts when SetWithOptions stores a value.
+type SetCondition int
+
+const (
+	SetAlways   SetCondition = iota
+	SetIfAbsent              // NX
+	SetIfExists              // XX
+)
+
+// SetOptions are the SET options that SetWithOptions applies. ExpireAt is
+// the absolute expiry, or the zero time for none; KeepTTL leaves an existing
+// key's expiry as it is instead. Get asks for the previous value, which
+// must then be a string.
+type SetOptions struct {
+	Condition SetCondition
+	ExpireAt  time.Time
+	KeepTTL   bool
+	Get       bool
+}
+
+// SetWithOptions stores the string value under key as SET does, reading the
+// old value, checking the condition and updating the expiry under one lock.
+// It returns the previous string when opts.Get is set, whether there was
+// one, and whether the value was stored.
+func (s *KeyValueStore) SetWithOptions(key, value string, opts SetOptions) (old string, existed, stored bool, err error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	existing, existed := s.lookupForWriteLocked(key)
+	if existed && opts.Get {
+		str, ok := existing.(string)
+		if !ok {
+			return "", false, false, ErrWrongType
 		}
+		old = str
+	}
+	if (opts.Condition == SetIfAbsent && existed) || (opts.Condition == SetIfExists && !existed) {
+		return old, existed, false, nil
+	}
 
-		for _, key := range expiredKeys {
-			delete(s.data, key)
-			delete(s.expiryMap, key)
+	s.storeLocked(key, value)
+	switch {
+	case !opts.ExpireAt.IsZero():
+		sh.expiryMap[key] = opts.ExpireAt
+	case !opts.KeepTTL:
+		delete(sh.expiryMap, key)
+	}
+	return old, existed, true, nil
+}
+
+// ExpiryChange is how GETEX adjusts a key's TTL.
+type ExpiryChange int
+
+const (
+	ExpiryKeep ExpiryChange = iota
+	ExpirySet
+	ExpiryPersist
+)
+
+// GetEx atomically returns the string at key and applies change: ExpirySet
+// moves the expiry to at, deleting the key if at has already passed, and
+// ExpiryPersist removes the TTL. It reports whether the key was deleted.
+func (s *KeyValueStore) GetEx(key string, change ExpiryChange, at time.Time) (value string, exists, deleted bool, err error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	existing, exists := s.lookupForWriteLocked(key)
+	s.keyLookup(exists)
+	if !exists {
+		return "", false, false, nil
+	}
+	str, ok := existing.(string)
+	if !ok {
+		return "", false, false, ErrWrongType
+	}
+	switch change {
+	case ExpirySet:
+		deleted = s.expireAtLocked(key, at)
+	case ExpiryPersist:
+		delete(sh.expiryMap, key)
+	}
+	return str, true, deleted, nil
+}
+
+// ExpireCondition holds the NX, XX, GT and LT flags of EXPIRE and its
+// variants, which make the change depend on the key's current TTL.
+type ExpireCondition uint8
+
+const (
+	ExpireNX ExpireCondition = 1 << iota // only when the key has no TTL
+	ExpireXX                             // only when the key has a TTL
+	ExpireGT                             // only when later than the current TTL
+	ExpireLT                             // only when earlier than the current TTL
+)
+
+// allows reports whether a key whose expiry is current, or which has none
+// when hasExpiry is false, may be given the expiry at. A key without a TTL
+// counts as expiring never, so GT refuses it and LT lets it through.
+func (c ExpireCondition) allows(current time.Time, hasExpiry bool, at time.Time) bool {
+	switch {
+	case c&ExpireNX != 0 && hasExpiry,
+		c&ExpireXX != 0 && !hasExpiry,
+		c&ExpireGT != 0 && (!hasExpiry || at.UnixMilli() <= current.UnixMilli()),
+		c&ExpireLT != 0 && hasExpiry && at.UnixMilli() >= current.UnixMilli():
+		return false
+	}
+	return true
+}
+
+// ExpireAt sets key's expiry to at when cond allows it, deleting the key
+// instead if at has already passed. The current TTL is read under the same
+// lock the change is made with. It reports whether the expiry was applied
+// and whether the key was deleted.
+func (s *KeyValueStore) ExpireAt(key string, at time.Time, cond ExpireCondition) (applied, deleted bool) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if _, exists := s.lookupForWriteLocked(key); !exists {
+		return false, false
+	}
+	current, hasExpiry := sh.expiryMap[key]
+	if !cond.allows(current, hasExpiry, at) {
+		return false, false
+	}
+	return true, s.expireAtLocked(key, at)
+}
+
+// Persist removes key's TTL, reporting whether it had one.
+func (s *KeyValueStore) Persist(key string) bool {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if _, exists := s.lookupForWriteLocked(key); !exists {
+		return false
+	}
+	if _, hasExpiry := sh.expiryMap[key]; !hasExpiry {
+		return false
+	}
+	delete(sh.expiryMap, key)
+	return true
+}
+
+// expireAtLocked sets the expiry of an existing key, deleting it instead
+// when at is not in the future, and reports whether it deleted it; callers
+// must hold the write lock.
+func (s *KeyValueStore) expireAtLocked(key string, at time.Time) bool {
+	if !at.After(time.Now()) {
+		s.deleteLocked(key)
+		return true
+	}
+	s.shard(key).expiryMap[key] = at
+	return false
+}
+
+// Append atomically appends to the string at key, creating it if absent, and returns the new length.
+func (s *KeyValueStore) Append(key, value string) (int, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	var current string
+	if existing, exists := s.lookupForWriteLocked(key); exists {
+		str, ok := existing.(string)
+		if !ok {
+			return 0, ErrWrongType
 		}
+		current = str
+	}
+
+	current += value
+	s.storeLocked(key, current)
+	return len(current), nil
+}
 
-		s.mu.Unlock()
+// SetRange atomically overwrites the string at key starting at offset, zero-padding
+// as needed, and returns the new length.
+func (s *KeyValueStore) SetRange(key string, offset int, value string) (int, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	var current string
+	existing, exists := s.lookupForWriteLocked(key)
+	if exists {
+		str, ok := existing.(string)
+		if !ok {
+			return 0, ErrWrongType
+		}
+		current = str
+	}
+
+	if value == "" {
+		return len(current), nil
+	}
+	// Compared this way round, a huge offset cannot overflow the sum.
+	if offset > maxStringLength-len(value) {
+		return 0, errors.New("ERR string exceeds maximum allowed size (proto-max-bulk-len)")
+	}
+
+	buf := []byte(current)
+	if end := offset + len(value); end > len(buf) {
+		buf = append(buf, make([]byte, end-len(buf))...)
+	}
+	copy(buf[offset:], value)
+	s.storeLocked(key, string(buf))
+	return len(buf), nil
+}
+
+// storeDestinationLocked writes the computed result of a *STORE command to dest
+// and reports whether dest held a live key before. An empty result deletes dest
+// rather than leaving an empty container, and any previous TTL on dest is
+// discarded. Callers must compute the result in full before calling, since dest
+// may also be one of the sources. Callers must hold the write lock.
+func (s *KeyValueStore) storeDestinationLocked(dest string, value interface{}, empty bool) bool {
+	_, existed := s.lookupForWriteLocked(dest)
+	if empty {
+		if existed {
+			s.deleteLocked(dest)
+		}
+		return existed
+	}
+	delete(s.shard(dest).expiryMap, dest)
+	s.storeLocked(dest, value)
+	return existed
+}
+
+// storeLocked assigns a value and marks the key as just accessed, keeping
+// its expiry; callers must hold the write lock.
+func (s *KeyValueStore) storeLocked(key string, value interface{}) {
+	s.storeSizedLocked(key, value, int64(len(key))+valueSize(value))
+}
+
+// storeSizedLocked is storeLocked for callers that already know the key's
+// new size, so large values are not measured on every write.
+func (s *KeyValueStore) storeSizedLocked(key string, value interface{}, size int64) {
+	sh := s.shard(key)
+	sh.data[key] = value
+	s.usedMemory.Add(size - sh.sizes[key])
+	sh.sizes[key] = size
+	s.touch(key)
+}
+
+// sizeLocked returns the accounted size of key, or just its name's length
+// when it does not exist yet; callers must hold at least the read lock.
+func (s *KeyValueStore) sizeLocked(key string) int64 {
+	if size, ok := s.shard(key).sizes[key]; ok {
+		return size
+	}
+	return int64(len(key))
+}
+
+// growLocked adjusts the accounted size of a value mutated in place;
+// callers must hold the write lock.
+func (s *KeyValueStore) growLocked(key string, delta int64) {
+	s.shard(key).sizes[key] += delta
+	s.usedMemory.Add(delta)
+}
+
+// deleteLocked removes a key with its expiry, access time and size;
+// callers must hold the write lock.
+func (s *KeyValueStore) deleteLocked(key string) {
+	sh := s.shard(key)
+	delete(sh.data, key)
+	delete(sh.expiryMap, key)
+	s.lastAccess.Delete(key)
+	s.usedMemory.Add(-sh.sizes[key])
+	delete(sh.sizes, key)
+}
+
+// expireLocked removes a key whose TTL has passed and raises the expired
+// notification; callers must hold the write lock.
+func (s *KeyValueStore) expireLocked(key string) {
+	s.deleteLocked(key)
+	s.stats.expiredKeys.Add(1)
+	if s.server != nil {
+		s.server.stats.KeyExpired()
+		s.server.tracking.Invalidate(key)
+	}
+	notifyKeyspaceEvent(s, notifyExpired, "expired", key)
+}
+
+// touch records that a key was just accessed. It only needs the read lock,
+// since lastAccess is safe for concurrent use.
+func (s *KeyValueStore) touch(key string) {
+	s.lastAccess.Store(key, time.Now())
+}
+
+// lookupLocked returns the live value for a key, counting a keyspace hit or
+// miss; callers must hold at least the read lock.
+func (s *KeyValueStore) lookupLocked(key string) (interface{}, bool) {
+	sh := s.shard(key)
+	if expiry, hasExpiry := sh.expiryMap[key]; hasExpiry && time.Now().After(expiry) {
+		s.keyLookup(false)
+		return nil, false
+	}
+	value, exists := sh.data[key]
+	s.keyLookup(exists)
+	if exists {
+		s.touch(key)
 	}
+	return value, exists
 }
 
-var storeInstance *KeyValueStore
+// peekLocked returns the live value for a key without counting a keyspace
+// hit or touching it; callers must hold at least the read lock.
+func (s *KeyValueStore) peekLocked(key string) (interface{}, bool) {
+	sh := s.shard(key)
+	if expiry, hasExpiry := sh.expiryMap[key]; hasExpiry && time.Now().After(expiry) {
+		return nil, false
+	}
+	value, exists := sh.data[key]
+	return value, exists
+}
+
+// lookupForWriteLocked returns the live value for a key, dropping it if expired; callers must hold the write lock.
+func (s *KeyValueStore) lookupForWriteLocked(key string) (interface{}, bool) {
+	sh := s.shard(key)
+	if expiry, hasExpiry := sh.expiryMap[key]; hasExpiry && time.Now().After(expiry) {
+		s.expireLocked(key)
+		return nil, false
+	}
+	value, exists := sh.data[key]
+	if exists {
+		s.touch(key)
+	}
+	return value, exists
+}
+
+func (s *KeyValueStore) deleteExpiredKey(key string) {
+    sh := s.shard(key)
+    sh.mu.Lock()
+    defer sh.mu.Unlock()
+
+	if expiry, hasExpiry := sh.expiryMap[key]; hasExpiry {
+		if time.Now().After(expiry) {
+			s.expireLocked(key)
+		}
+	}
+}
+
+// SnapshotEntry is one live key captured for serialization.
+type SnapshotEntry struct {
+	Key    string
+	Value  interface{}
+	Expiry time.Time // zero when the key has no TTL
+}
+
+// Snapshot copies the live keys with every shard locked, so the copy is of
+// one instant. Hashes, sets and lists are cloned because commands mutate
+// them in place; strings and streams are never modified once stored, so they are
+// shared.
+func (s *KeyValueStore) Snapshot() []SnapshotEntry {
+	defer s.lockAll()()
+
+	now := time.Now()
+	var entries []SnapshotEntry
+	for _, sh := range s.shards {
+		for key, value := range sh.data {
+			expiry, hasExpiry := sh.expiryMap[key]
+			if hasExpiry && now.After(expiry) {
+				continue
+			}
+			switch v := value.(type) {
+			case Hash:
+				value = maps.Clone(v)
+			case Set:
+				value = maps.Clone(v)
+			case *List:
+				value = v.clone()
+			case *ZSet:
+				value = v.clone()
+			}
+			entries = append(entries, SnapshotEntry{Key: key, Value: value, Expiry: expiry})
+		}
+	}
+	return entries
+}
 
-func init() {
-    storeInstance = NewKeyValueStore()
+// Flush removes every key by swapping in empty maps; the old ones are
+// reclaimed by the garbage collector rather than cleared under the lock.
+func (s *KeyValueStore) Flush() {
+	defer s.lockAll()()
+	for _, sh := range s.shards {
+		sh.data = make(map[string]interface{})
+		sh.expiryMap = make(map[string]time.Time)
+		sh.sizes = make(map[string]int64)
+	}
+	s.usedMemory.Store(0)
+	s.lastAccess.Clear()
 }
 
-// GetStore returns the global store instance.
-func GetStore() *KeyValueStore {
-    return storeInstance
+// expireSample samples up to expireSampleSize keys with a TTL, starting
+// from a random shard and moving on while that one has too few, and
+// removes those whose expiry is before now. The TTLs left on the rest feed
+// the store's avg_ttl. It reports how many keys it sampled and how many of
+// them had expired. Only one shard is locked at a time.
+func (s *KeyValueStore) expireSample(now time.Time) (sampled, expired int) {
+	var ttlSum int64 // milliseconds, which cannot overflow over a sample
+	start := rand.Intn(storeShards)
+	for i := 0; i < storeShards && sampled < expireSampleSize; i++ {
+		sh := s.shards[(start+i)%storeShards]
+		sh.mu.Lock()
+		// Map iteration starts at a random entry, which makes this a sample.
+		for key, expiry := range sh.expiryMap {
+			if sampled == expireSampleSize {
+				break
+			}
+			sampled++
+			if now.After(expiry) {
+				s.expireLocked(key)
+				expired++
+			} else {
+				ttlSum += expiry.Sub(now).Milliseconds()
+			}
+		}
+		sh.mu.Unlock()
+	}
+	switch {
+	case sampled == 0:
+		// Every shard was looked at, so no key has a TTL.
+		s.stats.avgTTL.Store(0)
+	case sampled > expired:
+		s.stats.sampleTTL(ttlSum / int64(sampled-expired))
+	}
+	return sampled, expired
 }
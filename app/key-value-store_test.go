@@ -0,0 +1,189 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIncrConcurrent(t *testing.T) {
+	const goroutines, increments = 100, 100
+	db := NewKeyValueStore()
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				if _, err := db.Incr("n", 1); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if value, _ := db.Get("n"); value != "10000" {
+		t.Fatalf("n = %q after %d increments, want 10000", value, goroutines*increments)
+	}
+}
+
+func TestIncrConcurrentClients(t *testing.T) {
+	const clients, increments = 100, 100
+	s := startServer(t, nil)
+	conns := make([]*testClient, clients)
+	for i := range conns {
+		conns[i] = dial(t, s)
+	}
+
+	// Each client pipelines its INCRs so they overlap with the others'.
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				c.send("INCR", "n")
+			}
+			for j := 0; j < increments; j++ {
+				if reply := c.read(); reply.Type != Integer {
+					t.Errorf("INCR replied %q", reply.Marshal())
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	expectReply(t, conns[0].do("GET", "n"), NewBulkString("10000"))
+}
+
+// keysOverShards returns keys spread evenly over the first n shards, so a
+// benchmark on them contends as a store of n shards would: with n = 1
+// every operation takes the same lock, with n = storeShards none is
+// shared more than sharding makes it.
+func keysOverShards(n int) []string {
+	const perShard = 64
+	buckets := make([][]string, n)
+	for i, full := 0, 0; full < n; i++ {
+		key := "key:" + strconv.Itoa(i)
+		shard := shardIndex(key)
+		if shard >= n || len(buckets[shard]) == perShard {
+			continue
+		}
+		if buckets[shard] = append(buckets[shard], key); len(buckets[shard]) == perShard {
+			full++
+		}
+	}
+	keys := make([]string, 0, n*perShard)
+	for i := 0; i < perShard; i++ {
+		for _, bucket := range buckets {
+			keys = append(keys, bucket[i])
+		}
+	}
+	return keys
+}
+
+// benchmarkShards runs op in parallel over keys spread across 1, 4 and
+// all of the store's shards. Run it with -cpu 1,4,8,16: on one core the
+// spread makes no difference, while with more cores the one-shard case
+// stops scaling and the full spread keeps improving. With 8 cores busy, a
+// command shares its shard with another about a third of the time at 16
+// shards against nine times in ten at 4; more shards would cut that
+// further but make every walk over all of them, such as DBSIZE, KEYS and
+// snapshots, take more locks.
+func benchmarkShards(b *testing.B, op func(db *KeyValueStore, key string)) {
+	for _, n := range []int{1, 4, storeShards} {
+		b.Run("shards="+strconv.Itoa(n), func(b *testing.B) {
+			db := NewKeyValueStore()
+			keys := keysOverShards(n)
+			for _, key := range keys {
+				db.SetValue(key, "v")
+			}
+			var next atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				// Goroutines start at different keys so they spread out.
+				i := int(next.Add(1)) * 7
+				for pb.Next() {
+					op(db, keys[i%len(keys)])
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkGetParallel(b *testing.B) {
+	benchmarkShards(b, func(db *KeyValueStore, key string) { db.Get(key) })
+}
+
+func BenchmarkSetParallel(b *testing.B) {
+	benchmarkShards(b, func(db *KeyValueStore, key string) { db.SetValue(key, "v") })
+}
+
+// lockedKeys builds the KEYS * reply the way it was built before
+// ForEachKey, holding each shard's lock while it walks the whole shard.
+func lockedKeys(db *KeyValueStore) RESP {
+	var items []RESP
+	for _, sh := range db.shards {
+		sh.mu.RLock()
+		for key := range sh.data {
+			items = append(items, NewBulkString(key))
+		}
+		sh.mu.RUnlock()
+	}
+	return NewArray(items)
+}
+
+// BenchmarkSetDuringKeys times SETs into a 2M-key store while KEYS * walks
+// it over and over, and reports their 99th percentile. ForEachKey gives the
+// lock up every forEachKeyChunk keys, so a SET waits for at most one chunk;
+// walking each shard under one lock, as "locked" does, makes it wait for
+// the whole shard. Run it with -cpu 4 or more: on one core the walk and the
+// SETs take turns rather than contending for the lock.
+func BenchmarkSetDuringKeys(b *testing.B) {
+	db := NewKeyValueStore()
+	for i := 0; i < 2000000; i++ {
+		db.SetValue("key:"+strconv.Itoa(i), "v")
+	}
+	ctx := testContext(db, "*")
+	walks := map[string]func(){
+		"foreach": func() { keysCommand(ctx) },
+		"locked":  func() { lockedKeys(db) },
+	}
+	for _, name := range []string{"foreach", "locked"} {
+		b.Run(name, func(b *testing.B) {
+			stop := make(chan struct{})
+			var walking sync.WaitGroup
+			walking.Add(1)
+			go func() {
+				defer walking.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+						walks[name]()
+					}
+				}
+			}()
+
+			latencies := make([]time.Duration, b.N)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				db.SetValue("key:"+strconv.Itoa(i%2000000), "w")
+				latencies[i] = time.Since(start)
+			}
+			b.StopTimer()
+			close(stop)
+			walking.Wait()
+
+			slices.Sort(latencies)
+			b.ReportMetric(float64(latencies[(len(latencies)-1)*99/100].Nanoseconds()), "p99-ns")
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// latencyGrowth is the ratio between consecutive bucket bounds (~5% precision).
+	latencyGrowth = 1.05
+	// latencyMaxUsec is the largest latency tracked; slower calls land in the last bucket.
+	latencyMaxUsec = 10_000_000
+)
+
+var latencyBucketCount = int(math.Ceil(math.Log(latencyMaxUsec)/math.Log(latencyGrowth))) + 1
+
+// latencyHistogram counts command durations in log-scaled microsecond buckets.
+type latencyHistogram struct {
+	counts []atomic.Uint64
+	total  atomic.Uint64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{counts: make([]atomic.Uint64, latencyBucketCount)}
+}
+
+// latencyBucket maps a duration in microseconds to its bucket index.
+func latencyBucket(usec float64) int {
+	if usec <= 1 {
+		return 0
+	}
+	idx := int(math.Ceil(math.Log(usec) / math.Log(latencyGrowth)))
+	if idx >= latencyBucketCount {
+		idx = latencyBucketCount - 1
+	}
+	return idx
+}
+
+// record adds a single observation.
+func (h *latencyHistogram) record(d time.Duration) {
+	usec := float64(d.Nanoseconds()) / 1e3
+	h.counts[latencyBucket(usec)].Add(1)
+	h.total.Add(1)
+}
+
+// percentile returns the upper bound in microseconds of the bucket holding the p-th percentile.
+func (h *latencyHistogram) percentile(p float64) float64 {
+	total := h.total.Load()
+	if total == 0 {
+		return 0
+	}
+	target := uint64(math.Ceil(p / 100 * float64(total)))
+	if target == 0 {
+		target = 1
+	}
+	var seen uint64
+	for i := range h.counts {
+		seen += h.counts[i].Load()
+		if seen >= target {
+			return math.Pow(latencyGrowth, float64(i))
+		}
+	}
+	return latencyMaxUsec
+}
+
+// LatencyTracker records per-command latency histograms.
+type LatencyTracker struct {
+	enabled     atomic.Bool
+	histograms  sync.Map
+	mu          sync.RWMutex
+	percentiles []float64
+}
+
+func newLatencyTracker() *LatencyTracker {
+	t := &LatencyTracker{percentiles: []float64{50, 99, 99.9}}
+	t.enabled.Store(true)
+	return t
+}
+
+// Enabled reports whether latency tracking is on.
+func (t *LatencyTracker) Enabled() bool {
+	return t.enabled.Load()
+}
+
+// SetEnabled turns latency tracking on or off. Turning it off drops the
+// histograms; they are recreated per command as calls are recorded again.
+func (t *LatencyTracker) SetEnabled(enabled bool) {
+	t.enabled.Store(enabled)
+	if !enabled {
+		t.Reset()
+	}
+}
+
+// Record adds a command execution time to that command's histogram.
+func (t *LatencyTracker) Record(cmdName string, d time.Duration) {
+	if !t.enabled.Load() {
+		return
+	}
+	h, ok := t.histograms.Load(cmdName)
+	if !ok {
+		h, _ = t.histograms.LoadOrStore(cmdName, newLatencyHistogram())
+	}
+	h.(*latencyHistogram).record(d)
+}
+
+// Percentiles returns the percentiles reported by INFO latencystats.
+func (t *LatencyTracker) Percentiles() []float64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return append([]float64(nil), t.percentiles...)
+}
+
+// SetPercentiles parses a space separated list of percentiles between 0 and 100.
+func (t *LatencyTracker) SetPercentiles(value string) error {
+	var percentiles []float64
+	for _, field := range strings.Fields(value) {
+		p, err := strconv.ParseFloat(field, 64)
+		if err != nil || p < 0 || p > 100 {
+			return fmt.Errorf("invalid percentile %q", field)
+		}
+		percentiles = append(percentiles, p)
+	}
+	t.mu.Lock()
+	t.percentiles = percentiles
+	t.mu.Unlock()
+	return nil
+}
+
+// Reset discards every recorded histogram.
+func (t *LatencyTracker) Reset() {
+	t.histograms.Range(func(key, _ any) bool {
+		t.histograms.Delete(key)
+		return true
+	})
+}
+
+// Info renders the latencystats INFO section in the Redis format.
+func (t *LatencyTracker) Info() string {
+	var names []string
+	t.histograms.Range(func(key, _ any) bool {
+		names = append(names, key.(string))
+		return true
+	})
+	sort.Strings(names)
+
+	percentiles := t.Percentiles()
+	var builder strings.Builder
+	builder.WriteString("# Latencystats\r\n")
+	for _, name := range names {
+		h, _ := t.histograms.Load(name)
+		parts := make([]string, len(percentiles))
+		for i, p := range percentiles {
+			parts[i] = fmt.Sprintf("p%s=%.3f", formatFloat(p), h.(*latencyHistogram).percentile(p))
+		}
+		builder.WriteString(fmt.Sprintf("latency_percentiles_usec_%s:%s\r\n", strings.ToLower(name), strings.Join(parts, ",")))
+	}
+	return builder.String()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+// TestLatencyPercentiles feeds known distributions to a histogram and
+// checks every reported percentile is the upper bound of the true value's
+// bucket: no lower than the true value and less than latencyGrowth above it.
+func TestLatencyPercentiles(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	distributions := map[string]func() float64{
+		"uniform":   func() float64 { return 1 + r.Float64()*9999 },
+		"lognormal": func() float64 { return math.Exp(5 + 2*r.NormFloat64()) },
+		"bimodal": func() float64 {
+			if r.Intn(100) == 0 {
+				return 50000 + r.Float64()*1000
+			}
+			return 20 + r.Float64()*10
+		},
+	}
+	for name, draw := range distributions {
+		t.Run(name, func(t *testing.T) {
+			const n = 100000
+			h := newLatencyHistogram()
+			samples := make([]float64, n)
+			for i := range samples {
+				// Whole nanoseconds, as the dispatch path records them.
+				d := time.Duration(min(draw(), latencyMaxUsec) * 1e3)
+				h.record(d)
+				samples[i] = float64(d.Nanoseconds()) / 1e3
+			}
+			sort.Float64s(samples)
+			for _, p := range []float64{0, 1, 50, 90, 99, 99.9, 99.99, 100} {
+				rank := max(int(math.Ceil(p/100*n)), 1)
+				want := math.Max(samples[rank-1], 1)
+				got := h.percentile(p)
+				if got < want*(1-1e-9) || got >= want*latencyGrowth {
+					t.Fatalf("p%v = %.3f, true value %.3f", p, got, want)
+				}
+			}
+		})
+	}
+
+	if got := newLatencyHistogram().percentile(99); got != 0 {
+		t.Fatalf("p99 of an empty histogram = %v, want 0", got)
+	}
+	h := newLatencyHistogram()
+	h.record(time.Minute)
+	if got := h.percentile(50); got < latencyMaxUsec || got >= latencyMaxUsec*latencyGrowth {
+		t.Fatalf("a call slower than latencyMaxUsec reported %v", got)
+	}
+}
+
+func TestLatencyTrackerInfo(t *testing.T) {
+	tracker := newLatencyTracker()
+	for i := 1; i <= 100; i++ {
+		tracker.Record("GET", time.Duration(i)*time.Microsecond)
+	}
+	tracker.Record("SET", time.Millisecond)
+	if err := tracker.SetPercentiles("50 100"); err != nil {
+		t.Fatal(err)
+	}
+	// Each percentile reports its bucket's upper bound.
+	bound := func(usec float64) float64 { return math.Pow(latencyGrowth, float64(latencyBucket(usec))) }
+	want := "# Latencystats\r\n" +
+		fmt.Sprintf("latency_percentiles_usec_get:p50=%.3f,p100=%.3f\r\n", bound(50), bound(100)) +
+		fmt.Sprintf("latency_percentiles_usec_set:p50=%.3f,p100=%.3f\r\n", bound(1000), bound(1000))
+	if got := tracker.Info(); got != want {
+		t.Fatalf("Info() = %q, want %q", got, want)
+	}
+
+	tracker.Reset()
+	if got := tracker.Info(); got != "# Latencystats\r\n" {
+		t.Fatalf("Info() after a reset = %q", got)
+	}
+	tracker.SetEnabled(false)
+	tracker.Record("GET", time.Microsecond)
+	if got := tracker.Info(); got != "# Latencystats\r\n" {
+		t.Fatalf("a disabled tracker recorded: %q", got)
+	}
+}
+
+// BenchmarkLatencyRecord measures what recording adds to each command: one
+// command from one goroutine, and many commands recorded in parallel.
+func BenchmarkLatencyRecord(b *testing.B) {
+	b.Run("serial", func(b *testing.B) {
+		tracker := newLatencyTracker()
+		for i := 0; i < b.N; i++ {
+			tracker.Record("GET", time.Duration(i%100000)*time.Nanosecond)
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		tracker := newLatencyTracker()
+		names := []string{"GET", "SET", "INCR", "XADD", "XRANGE", "LPUSH", "HSET", "PING"}
+		b.RunParallel(func(pb *testing.PB) {
+			i := 0
+			for pb.Next() {
+				tracker.Record(names[i%len(names)], time.Duration(i%100000)*time.Nanosecond)
+				i++
+			}
+		})
+	})
+}
@@ -0,0 +1,460 @@
+package main
+
+import "errors"
+
+var (
+	// ErrNoSuchKey is returned by LSET when the key does not exist.
+	ErrNoSuchKey = errors.New("ERR no such key")
+	// ErrIndexOutOfRange is returned by LSET for an index past either end.
+	ErrIndexOutOfRange = errors.New("ERR index out of range")
+)
+
+// List holds the elements stored under a single key, head first. They live
+// in buf[head:], and room is kept at the front so that pushes and pops at
+// either end are amortized O(1).
+type List struct {
+	buf  []string
+	head int
+}
+
+// newList returns a list holding elements, which it takes ownership of.
+func newList(elements []string) *List {
+	return &List{buf: elements}
+}
+
+// Len returns the number of elements.
+func (l *List) Len() int {
+	return len(l.buf) - l.head
+}
+
+// Elements returns the elements head first. The slice aliases the list, so
+// callers must copy it before releasing the lock.
+func (l *List) Elements() []string {
+	return l.buf[l.head:]
+}
+
+// pushFront inserts value at the head, reallocating with as much free room
+// at the front as there are elements when none is left.
+func (l *List) pushFront(value string) {
+	if l.head == 0 {
+		n := l.Len()
+		room := max(n, 8)
+		buf := make([]string, room+n, room+cap(l.buf))
+		copy(buf[room:], l.buf)
+		l.buf, l.head = buf, room
+	}
+	l.head--
+	l.buf[l.head] = value
+}
+
+// pushBack appends value at the tail.
+func (l *List) pushBack(value string) {
+	l.buf = append(l.buf, value)
+}
+
+// popFront removes and returns the head element; the list must not be empty.
+// Once more than half the buffer is dead space in front, the live elements
+// are moved down so a queue fed at the tail doesn't grow without bound.
+func (l *List) popFront() string {
+	value := l.buf[l.head]
+	l.buf[l.head] = ""
+	l.head++
+	if l.head >= 32 && l.head > len(l.buf)/2 {
+		n := copy(l.buf, l.buf[l.head:])
+		clear(l.buf[n:])
+		l.buf, l.head = l.buf[:n], 0
+	}
+	return value
+}
+
+// popBack removes and returns the tail element; the list must not be empty.
+func (l *List) popBack() string {
+	last := len(l.buf) - 1
+	value := l.buf[last]
+	l.buf[last] = ""
+	l.buf = l.buf[:last]
+	return value
+}
+
+// replace swaps in a new set of elements, which the list takes ownership of.
+func (l *List) replace(elements []string) {
+	l.buf, l.head = elements, 0
+}
+
+// clone returns a copy that shares nothing with l.
+func (l *List) clone() *List {
+	return newList(append([]string(nil), l.Elements()...))
+}
+
+// listIndex resolves a possibly negative index against a list of length n.
+// It reports false when the index is outside the list.
+func listIndex(index, n int) (int, bool) {
+	if index < 0 {
+		index += n
+	}
+	return index, index >= 0 && index < n
+}
+
+// listRange clamps an inclusive start/stop pair, either of which may count
+// from the end, to a list of length n, as LRANGE and LTRIM do. It reports
+// false when the range is empty.
+func listRange(start, stop, n int) (int, int, bool) {
+	if start < 0 {
+		start = max(start+n, 0)
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start > stop || start >= n {
+		return 0, 0, false
+	}
+	return start, min(stop, n-1), true
+}
+
+// getListLocked returns the list at key; callers must hold at least the read lock.
+func (s *KeyValueStore) getListLocked(key string) (*List, bool, error) {
+	value, exists := s.lookupLocked(key)
+	if !exists {
+		return nil, false, nil
+	}
+	list, ok := value.(*List)
+	if !ok {
+		return nil, false, ErrWrongType
+	}
+	return list, true, nil
+}
+
+// getListForWriteLocked is getListLocked for writers, dropping the key first
+// if it has expired; callers must hold the write lock.
+func (s *KeyValueStore) getListForWriteLocked(key string) (*List, bool, error) {
+	value, exists := s.lookupForWriteLocked(key)
+	if !exists {
+		return nil, false, nil
+	}
+	list, ok := value.(*List)
+	if !ok {
+		return nil, false, ErrWrongType
+	}
+	return list, true, nil
+}
+
+// Push adds values to the head of the list at key, or to its tail when
+// front is false, creating the list if needed, and returns its new length.
+// Values pushed at the head end up in reverse order, as with LPUSH.
+func (s *KeyValueStore) Push(key string, values []string, front bool) (int, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	list, exists, err := s.getListForWriteLocked(key)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		list = newList(nil)
+		s.storeLocked(key, list)
+	}
+	for _, value := range values {
+		if front {
+			list.pushFront(value)
+		} else {
+			list.pushBack(value)
+		}
+		s.growLocked(key, int64(len(value)))
+	}
+	return list.Len(), nil
+}
+
+// Pop removes up to count elements from the head of the list at key, or
+// from its tail when front is false, deleting the key once it is empty. It
+// reports false when the key does not exist.
+func (s *KeyValueStore) Pop(key string, count int, front bool) ([]string, bool, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	list, exists, err := s.getListForWriteLocked(key)
+	if err != nil || !exists {
+		return nil, false, err
+	}
+	return s.popLocked(key, list, count, front), true, nil
+}
+
+// popLocked removes up to count elements from the head of list, stored at
+// key, or from its tail when front is false, deleting the key once it is
+// empty; callers must hold the write lock.
+func (s *KeyValueStore) popLocked(key string, list *List, count int, front bool) []string {
+	popped := make([]string, 0, min(count, list.Len()))
+	for len(popped) < count && list.Len() > 0 {
+		var value string
+		if front {
+			value = list.popFront()
+		} else {
+			value = list.popBack()
+		}
+		s.growLocked(key, -int64(len(value)))
+		popped = append(popped, value)
+	}
+	if list.Len() == 0 {
+		s.deleteLocked(key)
+	}
+	return popped
+}
+
+// LLen returns the length of the list at key, 0 when it does not exist.
+func (s *KeyValueStore) LLen(key string) (int, error) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	list, exists, err := s.getListLocked(key)
+	if err != nil || !exists {
+		return 0, err
+	}
+	return list.Len(), nil
+}
+
+// LRange returns a copy of the elements between start and stop inclusive.
+func (s *KeyValueStore) LRange(key string, start, stop int) ([]string, error) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	list, exists, err := s.getListLocked(key)
+	if err != nil || !exists {
+		return nil, err
+	}
+	start, stop, ok := listRange(start, stop, list.Len())
+	if !ok {
+		return nil, nil
+	}
+	return append([]string(nil), list.Elements()[start:stop+1]...), nil
+}
+
+// LIndex returns the element at index, reporting false when the key is
+// missing or the index is out of range.
+func (s *KeyValueStore) LIndex(key string, index int) (string, bool, error) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	list, exists, err := s.getListLocked(key)
+	if err != nil || !exists {
+		return "", false, err
+	}
+	index, ok := listIndex(index, list.Len())
+	if !ok {
+		return "", false, nil
+	}
+	return list.Elements()[index], true, nil
+}
+
+// LSet replaces the element at index.
+func (s *KeyValueStore) LSet(key string, index int, value string) error {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	list, exists, err := s.getListForWriteLocked(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNoSuchKey
+	}
+	index, ok := listIndex(index, list.Len())
+	if !ok {
+		return ErrIndexOutOfRange
+	}
+	elements := list.Elements()
+	s.growLocked(key, int64(len(value)-len(elements[index])))
+	elements[index] = value
+	return nil
+}
+
+// LInsert inserts value just before the first occurrence of pivot, or just
+// after it when before is false. It returns the new length, -1 when pivot
+// is not in the list and 0 when the key does not exist.
+func (s *KeyValueStore) LInsert(key string, before bool, pivot, value string) (int, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	list, exists, err := s.getListForWriteLocked(key)
+	if err != nil || !exists {
+		return 0, err
+	}
+	elements := list.Elements()
+	at := -1
+	for i, element := range elements {
+		if element == pivot {
+			at = i
+			break
+		}
+	}
+	if at < 0 {
+		return -1, nil
+	}
+	if !before {
+		at++
+	}
+	updated := make([]string, 0, len(elements)+1)
+	updated = append(updated, elements[:at]...)
+	updated = append(updated, value)
+	updated = append(updated, elements[at:]...)
+	list.replace(updated)
+	s.growLocked(key, int64(len(value)))
+	return list.Len(), nil
+}
+
+// LRem removes up to count occurrences of value, scanning from the head
+// when count is positive and from the tail when it is negative; 0 removes
+// them all. It returns how many were removed, deleting the key once the
+// list is empty.
+func (s *KeyValueStore) LRem(key string, count int, value string) (int, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	list, exists, err := s.getListForWriteLocked(key)
+	if err != nil || !exists {
+		return 0, err
+	}
+	elements := list.Elements()
+	limit := count
+	if limit < 0 {
+		limit = -limit
+	}
+	drop := make([]bool, len(elements))
+	removed := 0
+	for i := range elements {
+		if limit > 0 && removed == limit {
+			break
+		}
+		j := i
+		if count < 0 {
+			j = len(elements) - 1 - i
+		}
+		if elements[j] == value {
+			drop[j] = true
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	kept := make([]string, 0, len(elements)-removed)
+	for i, element := range elements {
+		if !drop[i] {
+			kept = append(kept, element)
+		}
+	}
+	list.replace(kept)
+	s.growLocked(key, -int64(removed*len(value)))
+	if list.Len() == 0 {
+		s.deleteLocked(key)
+	}
+	return removed, nil
+}
+
+// LTrim keeps only the elements between start and stop inclusive, deleting
+// the key when that leaves none. It reports whether anything was removed.
+func (s *KeyValueStore) LTrim(key string, start, stop int) (bool, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	list, exists, err := s.getListForWriteLocked(key)
+	if err != nil || !exists {
+		return false, err
+	}
+	n := list.Len()
+	start, stop, ok := listRange(start, stop, n)
+	if !ok {
+		s.deleteLocked(key)
+		return true, nil
+	}
+	if start == 0 && stop == n-1 {
+		return false, nil
+	}
+	elements := list.Elements()
+	var freed int64
+	for _, element := range elements[:start] {
+		freed += int64(len(element))
+	}
+	for _, element := range elements[stop+1:] {
+		freed += int64(len(element))
+	}
+	list.replace(append([]string(nil), elements[start:stop+1]...))
+	s.growLocked(key, -freed)
+	return true, nil
+}
+
+// LPosOptions are the RANK, COUNT and MAXLEN arguments of LPOS.
+type LPosOptions struct {
+	Rank   int // 1-based match to start from; negative scans from the tail
+	Count  int // matches to return; 0 returns them all
+	MaxLen int // elements to compare at most; 0 compares them all
+}
+
+// LPos returns the indexes of the elements equal to value, as LPOS finds
+// them.
+func (s *KeyValueStore) LPos(key, value string, opts LPosOptions) ([]int, error) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	list, exists, err := s.getListLocked(key)
+	if err != nil || !exists {
+		return nil, err
+	}
+	elements := list.Elements()
+	skip := opts.Rank
+	if skip < 0 {
+		skip = -skip
+	}
+	skip--
+	var matches []int
+	for i := range elements {
+		if opts.MaxLen > 0 && i == opts.MaxLen {
+			break
+		}
+		j := i
+		if opts.Rank < 0 {
+			j = len(elements) - 1 - i
+		}
+		if elements[j] != value {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		matches = append(matches, j)
+		if opts.Count > 0 && len(matches) == opts.Count {
+			break
+		}
+	}
+	return matches, nil
+}
+
+// MPop pops up to count elements from the first of keys holding a list, at
+// its head or at its tail when front is false, deleting it once it is
+// empty. It returns the key popped from, or "" when none holds a list. All
+// the keys are locked together, so a push to an earlier key cannot be
+// passed over for a later one.
+func (s *KeyValueStore) MPop(keys []string, count int, front bool) (string, []string, error) {
+	defer s.lockKeys(keys...)()
+
+	for _, key := range keys {
+		list, exists, err := s.getListForWriteLocked(key)
+		if err != nil {
+			return "", nil, err
+		}
+		if !exists {
+			continue
+		}
+		return key, s.popLocked(key, list, count, front), nil
+	}
+	return "", nil, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+)
+
+// Listpacks are the packed element sequences Redis stores stream nodes in.
+// A listpack is a 4-byte total size and a 2-byte element count, both little
+// endian, then the elements and a 0xFF terminator. Each element is an
+// encoding byte with its data, followed by the element's own length
+// written so the list can be walked backwards.
+const (
+	listpackHeaderSize = 6
+	listpackEnd        = 0xFF
+	// listpackUnknownCount is the element count of a listpack too long to
+	// keep one in its header.
+	listpackUnknownCount = math.MaxUint16
+)
+
+// errBadListpack is returned for a listpack that does not decode.
+var errBadListpack = errors.New("malformed listpack")
+
+// listpackBuilder appends elements to a listpack under construction.
+type listpackBuilder struct {
+	buf   []byte
+	count int
+}
+
+// newListpackBuilder returns a builder holding an empty listpack.
+func newListpackBuilder() *listpackBuilder {
+	return &listpackBuilder{buf: make([]byte, listpackHeaderSize, 256)}
+}
+
+// appendString appends s, in integer form when it is the canonical spelling
+// of a 64-bit integer, as Redis stores it.
+func (lp *listpackBuilder) appendString(s string) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && strconv.FormatInt(n, 10) == s {
+		lp.appendInt(n)
+		return
+	}
+	start := len(lp.buf)
+	switch n := len(s); {
+	case n < 1<<6:
+		lp.buf = append(lp.buf, 0x80|byte(n))
+	case n < 1<<12:
+		lp.buf = append(lp.buf, 0xE0|byte(n>>8), byte(n))
+	default:
+		lp.buf = append(lp.buf, 0xF0)
+		lp.buf = binary.LittleEndian.AppendUint32(lp.buf, uint32(n))
+	}
+	lp.buf = append(lp.buf, s...)
+	lp.finishElement(start)
+}
+
+// appendInt appends n with the smallest integer encoding that holds it.
+func (lp *listpackBuilder) appendInt(n int64) {
+	start := len(lp.buf)
+	switch {
+	case n >= 0 && n <= 127:
+		lp.buf = append(lp.buf, byte(n))
+	case n >= -4096 && n <= 4095:
+		u := uint16(n) & 0x1FFF
+		lp.buf = append(lp.buf, 0xC0|byte(u>>8), byte(u))
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		lp.buf = append(lp.buf, 0xF1)
+		lp.buf = binary.LittleEndian.AppendUint16(lp.buf, uint16(n))
+	case n >= -1<<23 && n < 1<<23:
+		u := uint32(n)
+		lp.buf = append(lp.buf, 0xF2, byte(u), byte(u>>8), byte(u>>16))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		lp.buf = append(lp.buf, 0xF3)
+		lp.buf = binary.LittleEndian.AppendUint32(lp.buf, uint32(n))
+	default:
+		lp.buf = append(lp.buf, 0xF4)
+		lp.buf = binary.LittleEndian.AppendUint64(lp.buf, uint64(n))
+	}
+	lp.finishElement(start)
+}
+
+// finishElement appends the back length of the element that starts at start.
+// The back length is big endian in 7-bit groups, every byte after the first
+// flagged with the high bit.
+func (lp *listpackBuilder) finishElement(start int) {
+	size := len(lp.buf) - start
+	n := backLenSize(size)
+	for i := n - 1; i >= 0; i-- {
+		b := byte(size>>(7*i)) & 0x7F
+		if i != n-1 {
+			b |= 0x80
+		}
+		lp.buf = append(lp.buf, b)
+	}
+	lp.count++
+}
+
+// bytes terminates the listpack and fills in its header.
+func (lp *listpackBuilder) bytes() []byte {
+	buf := append(lp.buf, listpackEnd)
+	binary.LittleEndian.PutUint32(buf, uint32(len(buf)))
+	count := uint16(listpackUnknownCount)
+	if lp.count < listpackUnknownCount {
+		count = uint16(lp.count)
+	}
+	binary.LittleEndian.PutUint16(buf[4:], count)
+	return buf
+}
+
+// listpackElements decodes every element of a listpack, writing integers in
+// decimal.
+func listpackElements(lp []byte) ([]string, error) {
+	if len(lp) < listpackHeaderSize+1 || binary.LittleEndian.Uint32(lp) != uint32(len(lp)) {
+		return nil, errBadListpack
+	}
+	var elements []string
+	p := lp[listpackHeaderSize:]
+	for p[0] != listpackEnd {
+		element, size, err := listpackElement(p)
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, element)
+		if size += backLenSize(size); size >= len(p) {
+			return nil, errBadListpack
+		}
+		p = p[size:]
+	}
+	return elements, nil
+}
+
+// listpackElement decodes the element at the start of p, returning it and
+// the size of its encoding and data.
+func listpackElement(p []byte) (string, int, error) {
+	need := func(n int) error {
+		if len(p) < n {
+			return errBadListpack
+		}
+		return nil
+	}
+	b := p[0]
+	switch {
+	case b&0x80 == 0:
+		return strconv.Itoa(int(b)), 1, nil
+	case b&0xC0 == 0x80:
+		n := int(b & 0x3F)
+		if err := need(1 + n); err != nil {
+			return "", 0, err
+		}
+		return string(p[1 : 1+n]), 1 + n, nil
+	case b&0xE0 == 0xC0:
+		if err := need(2); err != nil {
+			return "", 0, err
+		}
+		u := uint16(b&0x1F)<<8 | uint16(p[1])
+		// Sign-extend the 13-bit value.
+		n := int64(int16(u<<3) >> 3)
+		return strconv.FormatInt(n, 10), 2, nil
+	case b&0xF0 == 0xE0:
+		if err := need(2); err != nil {
+			return "", 0, err
+		}
+		n := int(b&0x0F)<<8 | int(p[1])
+		if err := need(2 + n); err != nil {
+			return "", 0, err
+		}
+		return string(p[2 : 2+n]), 2 + n, nil
+	}
+
+	switch b {
+	case 0xF0:
+		if err := need(5); err != nil {
+			return "", 0, err
+		}
+		n := int(binary.LittleEndian.Uint32(p[1:]))
+		if n < 0 || len(p)-5 < n {
+			return "", 0, errBadListpack
+		}
+		return string(p[5 : 5+n]), 5 + n, nil
+	case 0xF1:
+		if err := need(3); err != nil {
+			return "", 0, err
+		}
+		return strconv.FormatInt(int64(int16(binary.LittleEndian.Uint16(p[1:]))), 10), 3, nil
+	case 0xF2:
+		if err := need(4); err != nil {
+			return "", 0, err
+		}
+		u := uint32(p[1]) | uint32(p[2])<<8 | uint32(p[3])<<16
+		return strconv.FormatInt(int64(int32(u<<8)>>8), 10), 4, nil
+	case 0xF3:
+		if err := need(5); err != nil {
+			return "", 0, err
+		}
+		return strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(p[1:]))), 10), 5, nil
+	case 0xF4:
+		if err := need(9); err != nil {
+			return "", 0, err
+		}
+		return strconv.FormatInt(int64(binary.LittleEndian.Uint64(p[1:])), 10), 9, nil
+	}
+	return "", 0, errBadListpack
+}
+
+// backLenSize returns how many bytes the back length of an element of size
+// bytes takes. Redis walks listpacks forwards with these exact bounds, one
+// short of each power of 128 past the first, so they must not be tidied.
+func backLenSize(size int) int {
+	switch {
+	case size <= 127:
+		return 1
+	case size < 16383:
+		return 2
+	case size < 2097151:
+		return 3
+	case size < 268435455:
+		return 4
+	}
+	return 5
+}
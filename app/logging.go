@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Log levels, named after Redis's loglevel values. Messages below the
+// configured level are dropped before their arguments are formatted.
+const (
+	LogDebug   = slog.LevelDebug
+	LogVerbose = slog.Level(-2)
+	LogNotice  = slog.LevelInfo
+	LogWarning = slog.LevelWarn
+)
+
+// logLevelNames maps each level to its loglevel value, in ascending order.
+var logLevelNames = []struct {
+	level slog.Level
+	name  string
+}{
+	{LogDebug, "debug"},
+	{LogVerbose, "verbose"},
+	{LogNotice, "notice"},
+	{LogWarning, "warning"},
+}
+
+var (
+	// logLevel is the minimum level written; CONFIG SET loglevel changes it.
+	logLevel = func() *slog.LevelVar {
+		level := new(slog.LevelVar)
+		level.Set(LogNotice)
+		return level
+	}()
+	// serverLogger is swapped whole when the log file changes, which may
+	// happen while other servers in the process are logging.
+	serverLogger = func() *atomic.Pointer[slog.Logger] {
+		logger := new(atomic.Pointer[slog.Logger])
+		logger.Store(newLogger(os.Stdout))
+		return logger
+	}()
+)
+
+// newLogger returns a logger writing text records to f at logLevel, with
+// levels shown by their loglevel names.
+func newLogger(f *os.File) *slog.Logger {
+	return slog.New(slog.NewTextHandler(f, &slog.HandlerOptions{
+		Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.LevelKey && len(groups) == 0 {
+				a.Value = slog.StringValue(strings.ToUpper(logLevelName(a.Value.Any().(slog.Level))))
+			}
+			return a
+		},
+	}))
+}
+
+// parseLogLevel returns the level a loglevel value names, ignoring case.
+func parseLogLevel(name string) (slog.Level, bool) {
+	for _, l := range logLevelNames {
+		if strings.EqualFold(l.name, name) {
+			return l.level, true
+		}
+	}
+	return 0, false
+}
+
+// logLevelName returns the loglevel value for level, rounding down to the
+// nearest named level.
+func logLevelName(level slog.Level) string {
+	name := logLevelNames[0].name
+	for _, l := range logLevelNames {
+		if level >= l.level {
+			name = l.name
+		}
+	}
+	return name
+}
+
+// setLogFile sends the log to path, appending to it, or to stdout when path
+// is empty.
+func setLogFile(path string) error {
+	if path == "" {
+		serverLogger.Store(newLogger(os.Stdout))
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return errors.New("can't open the log file: " + err.Error())
+	}
+	serverLogger.Store(newLogger(f))
+	return nil
+}
+
+// logDebug logs msg with key-value args at debug level.
+func logDebug(msg string, args ...any) {
+	serverLogger.Load().Log(context.Background(), LogDebug, msg, args...)
+}
+
+// logVerbose logs msg with key-value args at verbose level.
+func logVerbose(msg string, args ...any) {
+	serverLogger.Load().Log(context.Background(), LogVerbose, msg, args...)
+}
+
+// logNotice logs msg with key-value args at notice level.
+func logNotice(msg string, args ...any) {
+	serverLogger.Load().Log(context.Background(), LogNotice, msg, args...)
+}
+
+// logWarning logs msg with key-value args at warning level.
+func logWarning(msg string, args ...any) {
+	serverLogger.Load().Log(context.Background(), LogWarning, msg, args...)
+}
@@ -2,137 +2,432 @@ package main
 
 import (
     "bufio"
+    "bytes"
+    "compress/flate"
+    "context"
+    "errors"
     "flag"
     "fmt"
     "io"
+    "math/rand"
     "net"
     "os"
-    "path/filepath"
     "strconv"
     "strings"
     "sync"
+    "time"
 )
 
 type ClientState struct {
-    InTransaction  bool
-    QueuedCommands []RESP
-    mu             sync.RWMutex
+    ID              int64
+    InTransaction   bool
+    TxAborted       bool
+    Executing       bool
+    QueuedCommands  []RESP
+    IsReplicaLink   bool
+    Subscribed      bool
+    Monitoring      bool
+    Authenticated   bool
+    ReplCompress    bool
+    ReplListeningPort int
+    PropagateAs     []RESP
+    // PropagateNone makes the running write replicate nothing at all; see
+    // suppressPropagation.
+    PropagateNone   bool
+    // ReadyKeys are the keys the running command may have made ready for
+    // blocked clients; see markReady.
+    ReadyKeys       []dbKey
+    Protocol        int
+    DB              int
+    ReadOnly        bool
+    MaxLag          time.Duration
+    Name            string
+    CreatedAt       time.Time
+    LastCmd         string
+    LastActive      time.Time
+    conn            net.Conn
+    reader          *bufio.Reader
+    // closeAfterReply makes handleClient hang up once the current reply is written.
+    closeAfterReply bool
+    mu              sync.RWMutex
+    // outMu serializes writes to conn. handleClient holds it except while
+    // it waits for input, when queued pushes may go out; see queuePush.
+    outMu           sync.Mutex
+    pushMu          sync.Mutex
+    pushes          [][]byte
+    pushScheduled   bool
 }
 
-var (
-    clientStates      = make(map[net.Conn]*ClientState)
-    clientStatesMutex sync.RWMutex
-)
+// Mode returns the connection's current mode for the compatibility matrix.
+func (c *ClientState) Mode() ConnMode {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+
+    if c.IsReplicaLink {
+        return ModeReplicaLink
+    }
+    if c.Monitoring {
+        return ModeMonitor
+    }
+    if c.InTransaction {
+        return ModeMulti
+    }
+    if c.Subscribed {
+        return ModeSubscribed
+    }
+    return ModeNormal
+}
+
+// reset puts the connection's own settings back to those of a new
+// connection, as RESET does: no transaction, database 0, RESP2, read-write,
+// no name, and logged out when a password is required. Subscriptions and
+// monitor mode are also held by their managers, which resetCommand clears.
+func (c *ClientState) reset(config *ServerConfig) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    c.InTransaction = false
+    c.TxAborted = false
+    c.QueuedCommands = nil
+    c.Subscribed = false
+    c.Monitoring = false
+    c.Protocol = 0
+    c.DB = 0
+    c.ReadOnly = false
+    c.MaxLag = 0
+    c.Name = ""
+    c.Authenticated = config.RequirePass == ""
+}
+
+// Proto returns the protocol version the connection negotiated, RESP2 by default.
+func (c *ClientState) Proto() int {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+
+    if c.Protocol == 0 {
+        return RESP2
+    }
+    return c.Protocol
+}
 
-// getClientState returns the per-connection transactional state, creating it if absent.
-func getClientState(conn net.Conn) *ClientState {
-    clientStatesMutex.RLock()
-    state, exists := clientStates[conn]
-    clientStatesMutex.RUnlock()
+// clientState returns the per-connection transactional state, creating it if absent.
+func (s *Server) clientState(conn net.Conn) *ClientState {
+    s.clientStatesMu.RLock()
+    state, exists := s.clientStates[conn]
+    s.clientStatesMu.RUnlock()
 
     if !exists {
-        clientStatesMutex.Lock()
-        state = &ClientState{}
-        clientStates[conn] = state
-        clientStatesMutex.Unlock()
+        s.clientStatesMu.Lock()
+        if state, exists = s.clientStates[conn]; !exists {
+            s.nextClientID++
+            now := time.Now()
+            state = &ClientState{ID: s.nextClientID, CreatedAt: now, LastActive: now, conn: conn}
+            // Connections made while no password is set need no AUTH later.
+            state.Authenticated = s.Config().RequirePass == ""
+            s.clientStates[conn] = state
+        }
+        s.clientStatesMu.Unlock()
     }
 
     return state
 }
 
 // removeClientState removes any stored state associated with a connection.
-func removeClientState(conn net.Conn) {
-    clientStatesMutex.Lock()
-    delete(clientStates, conn)
-    clientStatesMutex.Unlock()
+func (s *Server) removeClientState(conn net.Conn) {
+    failpoint(fpBeforeRemoveClientState)
+    s.clientStatesMu.Lock()
+    delete(s.clientStates, conn)
+    s.clientStatesMu.Unlock()
 }
 
+// main parses flags into ServerOptions and runs a Server. Besides the
+// accept loop, a default server runs only the keyspace expiry sweeper, the
+// save-rule checker when --save is given, the AOF fsync loop with
+// --appendonly, the SIGUSR1 diagnostics watcher and, on a replica, the
+// master link; the leak sampler, replication heartbeat, AOF rewrites,
+// subscriber and replica writers and per-client handlers start on demand.
+// --minimal also drops the diagnostics watcher and latency tracking.
 func main() {
-    dirFlag := flag.String("dir", ".", "Directory where RDB files are stored")
-    dbFilenameFlag := flag.String("dbfilename", "dump.rdb", "Name of the RDB file")
+    opts := DefaultServerOptions()
+    flag.StringVar(&opts.Dir, "dir", opts.Dir, "Directory where RDB files are stored")
+    flag.StringVar(&opts.DBFilename, "dbfilename", opts.DBFilename, "Name of the RDB file")
     portFlag := flag.Int("port", 6379, "Port to listen on")
-    replicaofFlag := flag.String("replicaof", "", "Master host and port (e.g., 'localhost 6379')")
+    flag.StringVar(&opts.ReplicaOf, "replicaof", "", "Master host and port (e.g., 'localhost 6379')")
+    flag.BoolVar(&opts.ReplCompression, "repl-compression", opts.ReplCompression, "Compress the replication stream for replicas that support it")
+    flag.IntVar(&opts.ReplQueueDepth, "repl-queue-depth", opts.ReplQueueDepth, "Writes a replica may fall behind by before it is disconnected")
+    flag.IntVar(&opts.ReplPingPeriod, "repl-ping-replica-period", opts.ReplPingPeriod, "Seconds between PINGs the master sends its replicas")
+    flag.IntVar(&opts.ReplTimeout, "repl-timeout", opts.ReplTimeout, "Seconds an online replica may go without an ACK before it is disconnected")
+    flag.BoolVar(&opts.ReplicaReadOnly, "replica-read-only", opts.ReplicaReadOnly, "Reject writes from clients while running as a replica")
+    flag.IntVar(&opts.ReplBacklogSize, "repl-backlog-size", opts.ReplBacklogSize, "Bytes of replication stream kept for partial resync")
+    flag.BoolVar(&opts.DiagnosticsOnPanic, "diagnostics-on-panic", opts.DiagnosticsOnPanic, "Log a diagnostics snapshot when a command handler panics")
+    flag.IntVar(&opts.Databases, "databases", opts.Databases, "Number of databases SELECT can switch between")
+    flag.StringVar(&opts.Save, "save", opts.Save, "Save rules as 'seconds changes' pairs (e.g. '900 1 300 10'); empty disables automatic saving")
+    flag.BoolVar(&opts.AppendOnly, "appendonly", opts.AppendOnly, "Log every write to an append-only file and load it at startup instead of the RDB file")
+    flag.StringVar(&opts.AppendFilename, "appendfilename", opts.AppendFilename, "Name of the append-only file")
+    flag.StringVar(&opts.AppendFsync, "appendfsync", opts.AppendFsync, "When the append-only file is fsynced: always, everysec or no")
+    flag.StringVar(&opts.MaxMemory, "maxmemory", opts.MaxMemory, "Approximate dataset size limit in bytes, with optional k/kb/m/mb/g/gb suffix; 0 means no limit")
+    flag.StringVar(&opts.MaxMemoryPolicy, "maxmemory-policy", opts.MaxMemoryPolicy, "What to evict at maxmemory: noeviction, allkeys-lru, allkeys-random, volatile-lru, volatile-random or volatile-ttl")
+    flag.StringVar(&opts.NotifyKeyspaceEvents, "notify-keyspace-events", opts.NotifyKeyspaceEvents, "Keyspace notification classes to publish (e.g. 'KEA'); empty disables them")
+    flag.StringVar(&opts.RequirePass, "requirepass", opts.RequirePass, "Password clients must AUTH with; empty disables authentication")
+    flag.StringVar(&opts.MasterAuth, "masterauth", opts.MasterAuth, "Password a replica sends to its master with AUTH")
+    flag.StringVar(&opts.EnableDebugCommand, "enable-debug-command", opts.EnableDebugCommand, "Allow DEBUG: yes, no, or local for loopback connections only")
+    flag.IntVar(&opts.MaxClients, "maxclients", opts.MaxClients, "Connections served at once; more are refused")
+    flag.IntVar(&opts.Timeout, "timeout", opts.Timeout, "Seconds before an idle client is disconnected; 0 disables")
+    flag.StringVar(&opts.ProtoMaxBulkLen, "proto-max-bulk-len", opts.ProtoMaxBulkLen, "Largest bulk string a client may send, with optional k/kb/m/mb/g/gb suffix (at least 1mb)")
+    flag.BoolVar(&opts.Minimal, "minimal", opts.Minimal, "Disable optional subsystems and admin/debug commands (for embedding and tests)")
+    flag.StringVar(&opts.LogLevel, "loglevel", opts.LogLevel, "Least severe messages logged: debug, verbose, notice or warning")
+    flag.StringVar(&opts.LogFile, "logfile", opts.LogFile, "File to append the log to; empty logs to stdout")
+    flag.StringVar(&opts.UnixSocket, "unixsocket", opts.UnixSocket, "Also listen on a Unix domain socket at this path; with --port 0, only there")
+    flag.StringVar(&opts.UnixSocketPerm, "unixsocketperm", opts.UnixSocketPerm, "Octal file mode of the Unix socket (e.g. 700)")
+    tlsPortFlag := flag.Int("tls-port", 0, "Port to accept TLS clients on; 0 disables TLS")
+    flag.StringVar(&opts.TLSCertFile, "tls-cert-file", opts.TLSCertFile, "PEM certificate for TLS clients and, with --tls-replication, the master")
+    flag.StringVar(&opts.TLSKeyFile, "tls-key-file", opts.TLSKeyFile, "PEM private key of --tls-cert-file")
+    flag.StringVar(&opts.TLSCACertFile, "tls-ca-cert-file", opts.TLSCACertFile, "PEM CA certificates peers must present a certificate from")
+    flag.BoolVar(&opts.TLSReplication, "tls-replication", opts.TLSReplication, "Connect to the master over TLS")
     flag.Parse()
 
-	if *portFlag < 1 || *portFlag > 65535 {
-		fmt.Println("Error: Port number must be between 1 and 65535")
+	if *portFlag < 0 || *portFlag > 65535 || (*portFlag == 0 && opts.UnixSocket == "" && *tlsPortFlag == 0) {
+		logWarning("Port number must be between 1 and 65535, or 0 with --unixsocket or --tls-port", "port", *portFlag)
 		os.Exit(1)
 	}
-
-    if err := InitConfig(*dirFlag, *dbFilenameFlag, *replicaofFlag); err != nil {
-        fmt.Printf("Error: %v\n", err)
+	if *tlsPortFlag < 0 || *tlsPortFlag > 65535 {
+		logWarning("TLS port number must be between 0 and 65535", "port", *tlsPortFlag)
+		os.Exit(1)
+	}
+    server, err := NewServer(opts)
+    if err != nil {
+        logWarning("Fatal error", "err", err)
         os.Exit(1)
     }
-
-    config := GetServerConfig()
-    registry := NewRegistry()
-
-    rdbPath := filepath.Join(config.Dir, config.DBFilename)
-    if _, err := os.Stat(rdbPath); err == nil {
-        if err := ParseRDB(rdbPath, GetStore()); err != nil {
-            fmt.Printf("Warning: Failed to load RDB file: %v\n", err)
-        }
+    if !opts.Minimal {
+        server.watchDiagnosticsSignal()
     }
+    server.watchShutdownSignals()
 
-    if config.IsReplica {
-        go func() {
-            if err := connectToMaster(config.MasterHost, config.MasterPort, *portFlag, registry); err != nil {
-                fmt.Printf("Error connecting to master: %v\n", err)
-            }
-        }()
+    var listeners []net.Listener
+    if *portFlag != 0 {
+        l, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", *portFlag))
+        if err != nil {
+            logWarning("Failed to bind", "port", *portFlag, "err", err)
+            os.Exit(1)
+        }
+        listeners = append(listeners, l)
     }
-
-    l, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", *portFlag))
-    if err != nil {
-        fmt.Printf("Failed to bind to port %d: %v\n", *portFlag, err)
-        os.Exit(1)
+    if *tlsPortFlag != 0 {
+        l, err := server.ListenTLS(fmt.Sprintf("0.0.0.0:%d", *tlsPortFlag))
+        if err != nil {
+            logWarning("Failed to bind the TLS port", "port", *tlsPortFlag, "err", err)
+            os.Exit(1)
+        }
+        listeners = append(listeners, l)
     }
-    defer l.Close()
-
-    for {
-        conn, err := l.Accept()
+    if opts.UnixSocket != "" {
+        perm, _ := opts.unixSocketPerm()
+        l, err := ListenUnix(opts.UnixSocket, perm)
         if err != nil {
-            fmt.Println("Error accepting connection:", err.Error())
-            continue
+            logWarning("Failed to open the Unix socket", "path", opts.UnixSocket, "err", err)
+            os.Exit(1)
         }
+        listeners = append(listeners, l)
+    }
+    server.Serve(listeners...)
+}
+
+// writeBufferSize is how many bytes of replies a connection buffers before
+// they are written regardless of pipelined input still waiting.
+const writeBufferSize = 64 * 1024
+
+// flushBeforeCommands may block, or write to the connection outside its
+// reply buffer, so replies already buffered are sent before they run.
+var flushBeforeCommands = map[string]bool{
+    "SUBSCRIBE":    true,
+    "PSUBSCRIBE":   true,
+    "UNSUBSCRIBE":  true,
+    "PUNSUBSCRIBE": true,
+    "MONITOR":      true,
+    "PSYNC":        true,
+    "XREAD":        true,
+    "BLMPOP":       true,
+    "WAIT":         true,
+    "DEBUG":        true,
+    "SHUTDOWN":     true,
+}
 
-        go handleClient(conn, registry)
+// flushingReader flushes buffered replies whenever the connection's reader
+// needs more input. That is exactly when no complete pipelined command is
+// left to run: a pipeline's replies go out in large writes, and a lone
+// request's reply goes out before the server waits for the next one.
+type flushingReader struct {
+    conn   net.Conn
+    writer *bufio.Writer
+    state  *ClientState
+}
+
+// Read flushes pending replies, then reads from the connection, letting
+// queued pushes out while it waits. Whoever reads holds the output lock
+// around the call: handleClient, or BlockManager.watchDisconnect while
+// handleClient is parked in a blocking command.
+func (f flushingReader) Read(p []byte) (int, error) {
+    if f.writer.Buffered() > 0 {
+        if err := f.writer.Flush(); err != nil {
+            return 0, err
+        }
     }
+    f.state.outMu.Unlock()
+    defer f.state.outMu.Lock()
+    return f.conn.Read(p)
 }
 
 // handleClient reads, executes and responds to RESP commands for a connection.
-func handleClient(conn net.Conn, registry *Registry) {
+func (s *Server) handleClient(conn net.Conn) {
     defer conn.Close()
-    defer removeClientState(conn)
-    reader := bufio.NewReader(conn)
+    defer logVerbose("Client closed connection", "addr", clientAddr(conn))
+    defer s.removeClientState(conn)
+    defer s.pubsub.RemoveConn(conn)
+    defer s.blocks.RemoveConn(conn)
+    defer s.watches.RemoveConn(conn)
+    defer s.monitors.RemoveConn(conn)
+    defer s.repl.RemoveReplica(conn)
+    state := s.clientState(conn)
+    defer s.tracking.Disable(state)
+    state.outMu.Lock()
+    defer state.outMu.Unlock()
+    writer := bufio.NewWriterSize(conn, writeBufferSize)
+    defer writer.Flush()
+    reader := bufio.NewReaderSize(flushingReader{conn: conn, writer: writer, state: state}, writeBufferSize)
+    state.mu.Lock()
+    state.reader = reader
+    state.mu.Unlock()
 
-    for {
-        respObj, err := Parse(reader)
+    // Shutdown interrupts the pending read so idle connections close.
+    ctx := s.shutdown.Context()
+    stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+    defer stop()
+
+    idleDeadline := false
+    for ctx.Err() == nil {
+        // The idle timeout only covers waiting for the next command, so a
+        // client blocked in XREAD is never cut off mid-command.
+        if timeout := s.idleTimeout(state); timeout > 0 || idleDeadline {
+            var deadline time.Time
+            if timeout > 0 {
+                deadline = time.Now().Add(timeout)
+            }
+            conn.SetReadDeadline(deadline)
+            idleDeadline = timeout > 0
+            // Shutdown may have cleared its deadline in the meantime.
+            if ctx.Err() != nil {
+                break
+            }
+        }
+        respObj, err := ParseLimit(reader, s.Config().ProtoMaxBulkLen)
         if err != nil {
-            if err != io.EOF {
-                fmt.Println("Error parsing command:", err.Error())
+            var protoErr *ProtocolError
+            if !errors.As(err, &protoErr) {
+                if err != io.EOF && ctx.Err() == nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+                    logVerbose("Error parsing command", "addr", clientAddr(conn), "err", err)
+                }
+                break
             }
-            break
+            // Reply like Redis does, then skip the bad line and keep serving
+            // unless the framing itself is beyond repair.
+            reply := NewError("ERR " + protoErr.Error())
+            if _, err := writer.Write(reply.MarshalBytes()); err != nil || protoErr.Fatal {
+                break
+            }
+            if err := Resync(reader, protoErr); err != nil {
+                break
+            }
+            continue
         }
 
-        response, extraBytes := processCommand(respObj, registry, conn)
+        if writer.Buffered() > 0 && flushBeforeCommands[commandName(respObj)] {
+            if err := writer.Flush(); err != nil {
+                break
+            }
+        }
+
+        s.shutdown.beginCommand()
+        response, extraBytes := s.processCommand(respObj, conn)
 
-        if _, err := conn.Write([]byte(response.Marshal())); err != nil {
-            fmt.Println("Error writing to connection:", err.Error())
+        for _, push := range state.takePushes() {
+            if err == nil {
+                _, err = writer.Write(push)
+            }
+        }
+        if err == nil {
+            _, err = response.WriteToFor(writer, state.Proto())
+        }
+        // Other goroutines write to subscribers, monitors and replicas
+        // too, so their replies go out right away to keep the order.
+        if mode := state.Mode(); err == nil && mode != ModeNormal && mode != ModeMulti {
+            err = writer.Flush()
+        }
+        s.shutdown.endCommand()
+        if err != nil {
+            logVerbose("Error writing to client", "addr", clientAddr(conn), "err", err)
             break
         }
 
         if len(extraBytes) > 0 {
-            if _, err := conn.Write(extraBytes); err != nil {
-                fmt.Println("Error writing extra bytes to connection:", err.Error())
+            if state.Mode() == ModeReplicaLink {
+                failpoint(fpReplicaSendBulk)
+            }
+            _, err := writer.Write(extraBytes)
+            if err == nil {
+                err = writer.Flush()
+            }
+            if err != nil {
+                logVerbose("Error writing to client", "addr", clientAddr(conn), "err", err)
                 break
             }
         }
+        // PSYNC turns the connection into a replica link, after the
+        // snapshot for a full resync or right away for a partial one.
+        if state.Mode() == ModeReplicaLink {
+            s.repl.StartReplicaStream(conn)
+            // From here on the replica only sends ACKs, which never
+            // reach the command dispatcher.
+            s.repl.serveReplicaLink(conn, reader)
+            return
+        }
+
+        state.mu.RLock()
+        closing := state.closeAfterReply
+        state.mu.RUnlock()
+        if closing {
+            break
+        }
     }
 }
 
+// idleTimeout returns how long a client may wait between commands before
+// it is disconnected, or 0 for no limit. Subscribers and monitors are
+// exempt since they mostly listen; replica links never get here.
+func (s *Server) idleTimeout(state *ClientState) time.Duration {
+    seconds := s.Config().Timeout
+    if seconds == 0 {
+        return 0
+    }
+    switch state.Mode() {
+    case ModeSubscribed, ModeMonitor:
+        return 0
+    }
+    return time.Duration(seconds) * time.Second
+}
+
+// commandName returns the upper-cased name of a parsed command, or "" if
+// it is not a well-formed command.
+func commandName(respObj RESP) string {
+    if respObj.Type != Array || len(respObj.Array) == 0 || respObj.Array[0].Type != BulkString {
+        return ""
+    }
+    return strings.ToUpper(respObj.Array[0].String)
+}
+
 // processCommand validates and dispatches a single RESP command.
-func processCommand(respObj RESP, registry *Registry, conn net.Conn) (RESP, []byte) {
+func (s *Server) processCommand(respObj RESP, conn net.Conn) (RESP, []byte) {
+    registry := s.registry
     if respObj.Type != Array {
         return NewError("ERR invalid command format"), nil
     }
@@ -147,13 +442,43 @@ func processCommand(respObj RESP, registry *Registry, conn net.Conn) (RESP, []by
 	}
 
 	cmdName := strings.ToUpper(cmdNameResp.String)
+	s.stats.CommandProcessed()
+
+	state := s.clientState(conn)
+	state.mu.Lock()
+	state.LastCmd = strings.ToLower(cmdName)
+	state.LastActive = time.Now()
+	state.mu.Unlock()
 
-	state := getClientState(conn)
-	state.mu.RLock()
-	InTransaction := state.InTransaction
-	state.mu.RUnlock()
+	if msg := checkAuth(state, s.Config(), cmdName); msg != "" {
+		return NewError(msg), nil
+	}
 
-	if InTransaction && cmdName != "EXEC" && cmdName != "MULTI" && cmdName != "DISCARD" {
+	rule := resolveModeRule(state.Mode(), cmdName)
+	switch rule.action {
+	case actionReject:
+		return NewError(rule.errorFor(cmdName)), nil
+	case actionDrop:
+		return RESP{}, nil
+	case actionQueue:
+		// Like Redis, a command that can never run poisons the whole
+		// transaction so EXEC refuses it instead of running the rest.
+		if _, exists := registry.Get(cmdName); !exists {
+			state.mu.Lock()
+			state.TxAborted = true
+			state.mu.Unlock()
+			return NewError(fmt.Sprintf("ERR unknown command '%s'", cmdName)), nil
+		}
+		msg := registry.CheckArity(cmdName, len(respObj.Array)-1)
+		if msg == "" {
+			msg = s.checkReplicaWrite(cmdName)
+		}
+		if msg != "" {
+			state.mu.Lock()
+			state.TxAborted = true
+			state.mu.Unlock()
+			return NewError(msg), nil
+		}
 		state.mu.Lock()
 		state.QueuedCommands = append(state.QueuedCommands, respObj)
 		state.mu.Unlock()
@@ -164,67 +489,274 @@ func processCommand(respObj RESP, registry *Registry, conn net.Conn) (RESP, []by
 	if !exists {
 		return NewError(fmt.Sprintf("ERR unknown command '%s'", cmdName)), nil
 	}
+	if msg := registry.CheckArity(cmdName, len(respObj.Array)-1); msg != "" {
+		return NewError(msg), nil
+	}
+
+	if weight := admissionWeight(registry, cmdName); weight > 0 {
+		if err := s.admission.Acquire(weight); err != nil {
+			return NewError(err.Error()), nil
+		}
+		defer s.admission.Release(weight)
+	}
+
+	defer s.lockForCommand(cmdName)()
+
+	// EXEC and scripts hold the lock for all the commands they run; the
+	// writes among them go straight to dispatchCommand.
+	if (registry.IsWriteCommand(cmdName) && !blockingWrites[cmdName]) || cmdName == "EXEC" || scriptCommands[cmdName] {
+		s.repl.snapshotMu.RLock()
+		defer s.repl.snapshotMu.RUnlock()
+	}
 
+	return s.dispatchCommand(respObj, cmdName, handler, conn)
+}
+
+// dispatchCommand runs a resolved command with the bookkeeping shared by
+// top-level calls and commands executed by EXEC: replica read and write
+// checks, hot keys, latency, the replication handshake hooks and write
+// propagation.
+func (s *Server) dispatchCommand(respObj RESP, cmdName string, handler Handler, conn net.Conn) (RESP, []byte) {
+	registry := s.registry
+	state := s.clientState(conn)
 	args := respObj.Array[1:]
-	response, extraBytes := handler(args, conn)
+	if msg := s.checkReplicaRead(state, cmdName, args); msg != "" {
+		return NewError(msg), nil
+	}
+	if msg := s.checkReplicaWrite(cmdName); msg != "" {
+		return NewError(msg), nil
+	}
+	if msg := s.checkMaxMemory(cmdName); msg != "" {
+		return NewError(msg), nil
+	}
+	if msg := checkMonitorKeyspace(registry, state, cmdName, args); msg != "" {
+		return NewError(msg), nil
+	}
+
+	s.hotKeys.Record(registry.GetKeys(cmdName, args), registry.IsWriteCommand(cmdName))
+	start := time.Now()
+	response, extraBytes := runHandler(cmdName, handler, s.newCommandContext(conn, args))
+	elapsed := time.Since(start)
+	s.latency.Record(cmdName, elapsed)
+	s.slowLog.Record(respObj.Array, elapsed, state)
+	s.monitors.Feed(state, cmdName, respObj.Array)
 
 	if cmdName == "PSYNC" {
-		AddReplica(conn)
+		// The snapshot is produced synchronously by the PSYNC handler, so by
+		// now it only remains to stream it; handleClient marks the replica
+		// online once the bulk payload is written.
+		s.repl.SetReplicaSyncState(conn, ReplicaSendBulk)
 	}
 
-	if cmdName == "REPLCONF" && len(args) >= 2 &&
-		strings.ToUpper(args[0].String) == "ACK" {
-		offset, err := strconv.ParseInt(args[1].String, 10, 64)
-		if err == nil {
-			UpdateReplicaOffset(conn, offset)
-		}
-	}
+    if registry.IsWriteCommand(cmdName) && response.Type != Error {
+        s.persistence.MarkDirty()
+        state.mu.RLock()
+        db := state.DB
+        state.mu.RUnlock()
+        s.signalModifiedKeys(db, registry.GetKeys(cmdName, args)...)
+    } else if response.Type != Error {
+        s.tracking.Remember(state, registry.GetKeys(cmdName, args))
+    }
 
-    if registry.IsWriteCommand(cmdName) && !GetServerConfig().IsReplica {
-        bytesWritten := int64(len(response.Marshal()))
-        if len(extraBytes) > 0 {
-            bytesWritten += int64(len(extraBytes))
+    if registry.IsWriteCommand(cmdName) && !s.Config().IsReplica {
+        state.mu.RLock()
+        executing := state.Executing
+        state.mu.RUnlock()
+        if executing {
+            failpoint(fpExecBeforePropagate)
+        } else {
+            failpoint(fpAfterStoreSetBeforePropagate)
         }
-        IncrementOffset(bytesWritten)
-        propagateCommand(respObj)
+        s.propagateEffects(state, respObj)
     }
+    s.serveReadyKeys(state)
 
     return response, extraBytes
 }
 
-// propagateCommand forwards a write command to all connected replicas.
-func propagateCommand(cmd RESP) {
-    conns := GetReplicaConnections()
-    if len(conns) == 0 {
+// addReplicaToStream starts streaming writes to a new replica and returns the
+// offset its stream starts at. The replica starts in database 0, so the next
+// write re-announces its database.
+func (s *Server) addReplicaToStream(conn net.Conn, listeningPort int, compress bool) int64 {
+    s.repl.streamMu.Lock()
+    defer s.repl.streamMu.Unlock()
+    s.repl.streamDB = -1
+    return s.repl.AddReplica(conn, listeningPort, compress)
+}
+
+// propagateCommand forwards a write command to the AOF and all connected
+// replicas.
+func (s *Server) propagateCommand(cmd RESP) {
+    b := cmd.MarshalBytes()
+    s.aof.Append(cmd, b)
+    s.repl.sendToReplicas(b)
+}
+
+// selectReplStreamDBLocked sends SELECT db to replicas unless the stream is
+// already there; callers must hold the stream mutex.
+func (s *Server) selectReplStreamDBLocked(db int) {
+    if db != s.repl.streamDB {
+        s.propagateCommand(NewArray([]RESP{NewBulkString("SELECT"), NewBulkString(strconv.Itoa(db))}))
+        s.repl.streamDB = db
+    }
+}
+
+// propagateDel replicates the removal of key from database db, for keys the
+// master drops on its own, such as maxmemory evictions.
+func (s *Server) propagateDel(db int, key string) {
+    s.propagateToDB(db, NewArray([]RESP{NewBulkString("DEL"), NewBulkString(key)}))
+}
+
+// propagateToDB replicates cmd as a write to database db made outside the
+// command that caused it, such as a pop served to a blocked client.
+func (s *Server) propagateToDB(db int, cmd RESP) {
+    if s.Config().IsReplica {
         return
     }
+    s.repl.streamMu.Lock()
+    defer s.repl.streamMu.Unlock()
+    s.selectReplStreamDBLocked(db)
+    s.propagateCommand(cmd)
+}
 
-    cmdBytes := []byte(cmd.Marshal())
+// propagateEffects replicates the rewrite recorded for a client, or original
+// when there is none, selecting the client's database first if the stream is
+// elsewhere. A suppressed command replicates nothing.
+func (s *Server) propagateEffects(state *ClientState, original RESP) {
+    state.mu.Lock()
+    cmds, none := state.PropagateAs, state.PropagateNone
+    state.PropagateAs, state.PropagateNone = nil, false
+    db := state.DB
+    state.mu.Unlock()
+    if none {
+        return
+    }
 
-    var toRemove []net.Conn
-    for _, conn := range conns {
-        _, err := conn.Write(cmdBytes)
-        if err != nil {
-            toRemove = append(toRemove, conn)
-        }
+    s.repl.streamMu.Lock()
+    defer s.repl.streamMu.Unlock()
+    s.selectReplStreamDBLocked(db)
+    if cmds == nil {
+        s.propagateCommand(original)
+        return
+    }
+    for _, cmd := range cmds {
+        s.propagateCommand(cmd)
     }
+}
+
+// loadMasterRDB replaces every database with the snapshot a master sent on
+// full resync. Clients blocked on keys in the snapshot are re-checked, since
+// those keys may now hold data, and every WATCH is invalidated.
+func (s *Server) loadMasterRDB(payload []byte) error {
+	dbs := s.dbs
+	stores, err := readRDB(NewRDBReader(bytes.NewReader(payload)), dbs.Count())
+	if err != nil {
+		return err
+	}
+	dbs.Replace(stores)
+	indexes := make([]int, len(stores))
+	for index := range indexes {
+		indexes[index] = index
+	}
+	s.signalFlushedDBs(indexes...)
+	s.aof.Restart()
+	for index, store := range stores {
+		store.ForEachKey(func(key string) bool {
+			s.blocks.Signal(index, key)
+			return true
+		})
+	}
+	return nil
+}
+
+// receiveFullSync reads the RDB payload that follows +FULLRESYNC and
+// replaces the replica's data with it.
+func (s *Server) receiveFullSync(reader *bufio.Reader) error {
+	b, err := reader.ReadByte()
+	if err != nil {
+		return fmt.Errorf("failed to read RDB marker: %w", err)
+	}
+	if b != '$' {
+		return fmt.Errorf("expected '$', got '%c'", b)
+	}
+
+	sizeStr, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read RDB size: %w", err)
+	}
+	sizeStr = strings.TrimSuffix(sizeStr, "\r\n")
+	size, err := strconv.Atoi(sizeStr)
+	if err != nil {
+		return fmt.Errorf("invalid RDB size: %w", err)
+	}
+
+	rdbBytes := make([]byte, size)
+	if _, err := io.ReadFull(reader, rdbBytes); err != nil {
+		return fmt.Errorf("failed to read RDB file: %w", err)
+	}
+	if err := s.loadMasterRDB(rdbBytes); err != nil {
+		return fmt.Errorf("rejecting RDB from master: %w", err)
+	}
+	failpoint(fpReplicaAfterRDB)
+	return nil
+}
+
+// Delays between attempts to reach the master. Each failed attempt doubles
+// the delay up to the cap; a completed sync resets it.
+const (
+    masterReconnectMinDelay = 500 * time.Millisecond
+    masterReconnectMaxDelay = 30 * time.Second
+)
 
-    for _, conn := range toRemove {
-        RemoveReplica(conn)
-        conn.Close()
+// replicateFromMaster keeps the replica attached to its master until ctx is
+// cancelled. Whenever the link fails or drops it waits and runs the
+// handshake again, which resumes the stream from the backlog or ends in a
+// full resync. The wait grows exponentially and is jittered so replicas of
+// a restarted master don't all reconnect at the same instant.
+func (s *Server) replicateFromMaster(ctx context.Context, masterHost string, masterPort int, replicaPort int) {
+    backoff := masterReconnectMinDelay
+    for {
+        attempt := time.Now()
+        err := s.connectToMaster(ctx, masterHost, masterPort, replicaPort)
+        if ctx.Err() != nil {
+            return
+        }
+        if err != nil {
+            logWarning("Error connecting to master", "err", err)
+        } else {
+            logNotice("Master closed the replication link")
+        }
+        if s.masterLink.LastSync().After(attempt) {
+            backoff = masterReconnectMinDelay
+        }
+        delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+        logNotice("Reconnecting to master", "delay", delay.Round(time.Millisecond))
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(delay):
+        }
+        backoff = min(backoff*2, masterReconnectMaxDelay)
     }
 }
 
-// connectToMaster performs the replica handshake and applies streamed updates.
-func connectToMaster(masterHost string, masterPort int, replicaPort int, registry *Registry) error {
-    conn, err := net.Dial("tcp", net.JoinHostPort(masterHost, fmt.Sprintf("%d", masterPort)))
+// connectToMaster performs the replica handshake and applies streamed
+// updates. Cancelling ctx closes the connection, which ends the link.
+func (s *Server) connectToMaster(ctx context.Context, masterHost string, masterPort int, replicaPort int) error {
+    var dialer net.Dialer
+    conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(masterHost, fmt.Sprintf("%d", masterPort)))
     if err != nil {
         return fmt.Errorf("failed to connect to master: %w", err)
     }
+    if conn, err = s.dialMasterTLS(ctx, conn, masterHost); err != nil {
+        return err
+    }
     defer conn.Close()
+    stop := context.AfterFunc(ctx, func() { conn.Close() })
+    defer stop()
 
 	pingCmd := NewArray([]RESP{NewBulkString("PING")})
-	if _, err := conn.Write([]byte(pingCmd.Marshal())); err != nil {
+	if _, err := conn.Write(pingCmd.MarshalBytes()); err != nil {
 		return fmt.Errorf("failed to send PING to master: %w", err)
 	}
 
@@ -233,16 +765,32 @@ func connectToMaster(masterHost string, masterPort int, replicaPort int, registr
 	if err != nil {
 		return fmt.Errorf("failed to read master response: %w", err)
 	}
-    if respObj.Type != SimpleString || respObj.String != "PONG" {
+    // A master with requirepass answers NOAUTH until the AUTH below.
+    pingOK := respObj.Type == SimpleString && respObj.String == "PONG"
+    if !pingOK && !(respObj.Type == Error && strings.HasPrefix(respObj.String, "NOAUTH")) {
         return fmt.Errorf("unexpected response to PING: %v", respObj)
     }
 
+    if masterAuth := s.Config().MasterAuth; masterAuth != "" {
+        authCmd := NewArray([]RESP{NewBulkString("AUTH"), NewBulkString(masterAuth)})
+        if _, err := conn.Write(authCmd.MarshalBytes()); err != nil {
+            return fmt.Errorf("failed to send AUTH to master: %w", err)
+        }
+        respObj, err = Parse(reader)
+        if err != nil {
+            return fmt.Errorf("failed to read master response to AUTH: %w", err)
+        }
+        if respObj.Type != SimpleString || respObj.String != "OK" {
+            return fmt.Errorf("master rejected AUTH: %v", respObj.String)
+        }
+    }
+
     portCmd := NewArray([]RESP{
         NewBulkString("REPLCONF"),
         NewBulkString("listening-port"),
         NewBulkString(strconv.Itoa(replicaPort)),
     })
-	if _, err := conn.Write([]byte(portCmd.Marshal())); err != nil {
+	if _, err := conn.Write(portCmd.MarshalBytes()); err != nil {
 		return fmt.Errorf("failed to send REPLCONF listening-port to master: %w", err)
 	}
 
@@ -258,8 +806,10 @@ func connectToMaster(masterHost string, masterPort int, replicaPort int, registr
 		NewBulkString("REPLCONF"),
 		NewBulkString("capa"),
 		NewBulkString("psync2"),
+		NewBulkString("capa"),
+		NewBulkString("compress-flate"),
 	})
-	if _, err := conn.Write([]byte(capaCmd.Marshal())); err != nil {
+	if _, err := conn.Write(capaCmd.MarshalBytes()); err != nil {
 		return fmt.Errorf("failed to send REPLCONF capa to master: %w", err)
 	}
 
@@ -271,65 +821,127 @@ func connectToMaster(masterHost string, masterPort int, replicaPort int, registr
 		return fmt.Errorf("unexpected response to REPLCONF capa: %v", respObj)
 	}
 
-	psyncCmd := NewArray([]RESP{
-		NewBulkString("PSYNC"),
-		NewBulkString("?"),
-		NewBulkString("-1"),
+	// Masters that don't know about compression answer with an error, in
+	// which case the stream simply stays uncompressed.
+	compressCmd := NewArray([]RESP{
+		NewBulkString("REPLCONF"),
+		NewBulkString("compress"),
+		NewBulkString("flate"),
 	})
-	if _, err := conn.Write([]byte(psyncCmd.Marshal())); err != nil {
-		return fmt.Errorf("failed to send PSYNC to master: %w", err)
+	if _, err := conn.Write(compressCmd.MarshalBytes()); err != nil {
+		return fmt.Errorf("failed to send REPLCONF compress to master: %w", err)
 	}
 
 	respObj, err = Parse(reader)
 	if err != nil {
-		return fmt.Errorf("failed to read master response to PSYNC: %w", err)
+		return fmt.Errorf("failed to read master response to REPLCONF compress: %w", err)
 	}
-    b, err := reader.ReadByte()
-    if err != nil {
-        return fmt.Errorf("failed to read RDB marker: %w", err)
-    }
+	compressed := respObj.Type == SimpleString && respObj.String == "OK"
 
-	if b != '$' {
-		return fmt.Errorf("expected '$', got '%c'", b)
+	// After a sync, ask to continue from the next byte of the master's
+	// stream; the master falls back to a full resync if it can't.
+	psyncID, psyncOffset := "?", "-1"
+	if !s.masterLink.LastSync().IsZero() {
+		psyncID, _ = s.repl.GetReplID()
+		psyncOffset = strconv.FormatInt(s.repl.GetOffset()+1, 10)
 	}
-
-	sizeStr, err := reader.ReadString('\n')
-	if err != nil {
-		return fmt.Errorf("failed to read RDB size: %w", err)
+	psyncCmd := NewArray([]RESP{
+		NewBulkString("PSYNC"),
+		NewBulkString(psyncID),
+		NewBulkString(psyncOffset),
+	})
+	if _, err := conn.Write(psyncCmd.MarshalBytes()); err != nil {
+		return fmt.Errorf("failed to send PSYNC to master: %w", err)
 	}
 
-	sizeStr = strings.TrimSuffix(sizeStr, "\r\n")
-	size, err := strconv.Atoi(sizeStr)
+	respObj, err = Parse(reader)
 	if err != nil {
-		return fmt.Errorf("invalid RDB size: %w", err)
+		return fmt.Errorf("failed to read master response to PSYNC: %w", err)
 	}
+	if respObj.Type != SimpleString {
+		return fmt.Errorf("unexpected response to PSYNC: %v", respObj)
+	}
+	psyncReply := strings.Fields(respObj.String)
+	switch {
+	case len(psyncReply) == 3 && psyncReply[0] == "FULLRESYNC":
+		startOffset, err := strconv.ParseInt(psyncReply[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid offset in reply to PSYNC: %s", respObj.String)
+		}
+		if err := s.receiveFullSync(reader); err != nil {
+			return err
+		}
+		// The ID and offset only change once the data matching them is
+		// loaded, so a failed sync never leaves a history to continue.
+		s.repl.adoptReplID(psyncReply[1])
+		s.repl.offsetMu.Lock()
+		s.repl.currentOffset = startOffset
+		s.repl.offsetMu.Unlock()
+		s.repl.masterStreamDB = 0
+	case len(psyncReply) >= 1 && psyncReply[0] == "CONTINUE":
+		if len(psyncReply) == 2 {
+			if replID, _ := s.repl.GetReplID(); replID != psyncReply[1] {
+				s.repl.adoptReplID(psyncReply[1])
+			}
+		}
+	default:
+		return fmt.Errorf("unexpected response to PSYNC: %s", respObj.String)
+	}
+	s.masterLink.SetUp(true)
+	defer s.masterLink.SetUp(false)
 
-    rdbBytes := make([]byte, size)
-    if _, err := io.ReadFull(reader, rdbBytes); err != nil {
-        return fmt.Errorf("failed to read RDB file: %w", err)
-    }
+	// The stream picks up in the database it had selected when the last
+	// link dropped, and a partial resync doesn't select it again.
+	state := s.clientState(conn)
+	state.mu.Lock()
+	state.DB = s.repl.masterStreamDB
+	state.mu.Unlock()
+	defer s.removeClientState(conn)
+	defer func() {
+		state.mu.RLock()
+		s.repl.masterStreamDB = state.DB
+		state.mu.RUnlock()
+	}()
 
-    offsetMu.Lock()
-    currentOffset = 0
-    offsetMu.Unlock()
+    // The ACK ticker and GETACK replies share the connection.
+    var writeMu sync.Mutex
+    done := make(chan struct{})
+    defer close(done)
+    go s.sendReplicaAcks(conn, &writeMu, done)
 
-    var commandHistory []int64
+    if compressed {
+        reader = bufio.NewReader(flate.NewReader(reader))
+    }
 
     for {
-        respObj, err := Parse(reader)
+        respObj, err := ParseLimit(reader, s.Config().ProtoMaxBulkLen)
+        // Commands still buffered when the link is cancelled are dropped.
+        if ctx.Err() != nil {
+            return ctx.Err()
+        }
         if err != nil {
             if err == io.EOF {
                 return nil
             }
+            var protoErr *ProtocolError
+            if !errors.As(err, &protoErr) || protoErr.Fatal {
+                return err
+            }
+            if err := Resync(reader, protoErr); err != nil {
+                return err
+            }
             continue
         }
 
+        s.masterLink.Touch()
+
         if respObj.Type != Array || len(respObj.Array) == 0 {
             continue
         }
 
-		commandBytes := respObj.Marshal()
-		bytesCount := int64(len(commandBytes))
+		// Every command counts toward the offset once processed, whether or
+		// not it could be applied, since the master counted it when sending.
+		bytesCount := int64(len(respObj.MarshalBytes()))
 
 		isGetAck := false
 		if len(respObj.Array) >= 3 &&
@@ -339,43 +951,85 @@ func connectToMaster(masterHost string, masterPort int, replicaPort int, registr
 		}
 
 		if !isGetAck {
-			cmdNameResp := respObj.Array[0]
-            if cmdNameResp.Type != BulkString {
-                continue
-            }
-            cmdName := strings.ToUpper(cmdNameResp.String)
-            handler, exists := registry.Get(cmdName)
-            if !exists {
-                continue
-            }
-            args := respObj.Array[1:]
-            handler(args, conn)
+			s.applyFromMaster(respObj, conn)
+			s.repl.offsetMu.Lock()
+			s.repl.currentOffset += bytesCount
+			s.repl.offsetMu.Unlock()
+		} else {
+            // Like Redis, the ACK covers everything before this GETACK.
+            response, _ := replconfGetackCommand(s.newCommandContext(conn, respObj.Array[2:]))
+            s.repl.offsetMu.Lock()
+            s.repl.currentOffset += bytesCount
+            s.repl.offsetMu.Unlock()
 
-            commandHistory = append(commandHistory, bytesCount)
-        } else {
-            var totalBytes int64
-            for _, size := range commandHistory {
-                totalBytes += size
-            }
-
-            commandHistory = append(commandHistory, bytesCount)
-
-            offsetMu.Lock()
-            currentOffset = totalBytes
-            offsetMu.Unlock()
-
-            cmdNameResp := respObj.Array[0]
-            cmdName := strings.ToUpper(cmdNameResp.String)
-            handler, exists := registry.Get(cmdName)
-            if !exists {
-                continue
+            failpoint(fpBeforeReplicaAckSend)
+            writeMu.Lock()
+            if _, err := conn.Write(response.MarshalBytes()); err != nil {
+                _ = err
             }
-            args := respObj.Array[1:]
-            response, _ := handler(args, conn)
+            writeMu.Unlock()
+        }
+    }
+}
 
-            if _, err := conn.Write([]byte(response.Marshal())); err != nil {
-                _ = err
+// sendReplicaAcks reports the processed offset to the master every second
+// until done is closed. Like Redis, the replica ACKs on its own rather than
+// only when asked, so the master sees it is alive while no writes arrive.
+func (s *Server) sendReplicaAcks(conn net.Conn, writeMu *sync.Mutex, done chan struct{}) {
+    ticker := time.NewTicker(time.Second)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-done:
+            return
+        case <-ticker.C:
+            ack := NewArray([]RESP{
+                NewBulkString("REPLCONF"),
+                NewBulkString("ACK"),
+                NewBulkString(strconv.FormatInt(s.repl.GetOffset(), 10)),
+            })
+            writeMu.Lock()
+            _, err := conn.Write(ack.MarshalBytes())
+            writeMu.Unlock()
+            if err != nil {
+                return
             }
         }
     }
 }
+
+// applyFromMaster runs a command received on the replication stream. Unknown
+// commands and bad arities are skipped rather than answered.
+func (s *Server) applyFromMaster(respObj RESP, conn net.Conn) {
+    registry := s.registry
+    cmdNameResp := respObj.Array[0]
+    if cmdNameResp.Type != BulkString {
+        return
+    }
+    cmdName := strings.ToUpper(cmdNameResp.String)
+    handler, exists := registry.Get(cmdName)
+    if !exists || registry.CheckArity(cmdName, len(respObj.Array)-1) != "" {
+        return
+    }
+    args := respObj.Array[1:]
+    failpoint(fpReplicaBeforeApply)
+    state := s.clientState(conn)
+    // Like a write on a master, the command is applied and logged to the
+    // AOF without a rewrite snapshot in between.
+    s.repl.snapshotMu.RLock()
+    defer s.repl.snapshotMu.RUnlock()
+    response, _ := handler(s.newCommandContext(conn, args))
+    isWrite := registry.IsWriteCommand(cmdName) && response.Type != Error
+    if isWrite || cmdName == "SELECT" || cmdName == "MULTI" || cmdName == "EXEC" {
+        s.aof.Append(respObj, respObj.MarshalBytes())
+    }
+    if isWrite {
+        s.persistence.MarkDirty()
+        state.mu.RLock()
+        db := state.DB
+        state.mu.RUnlock()
+        s.signalModifiedKeys(db, registry.GetKeys(cmdName, args)...)
+    }
+    s.monitors.Feed(state, cmdName, respObj.Array)
+    s.serveReadyKeys(state)
+}
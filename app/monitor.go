@@ -0,0 +1,191 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// monitorQueueSize bounds how many lines a monitor may fall behind by before
+// it is disconnected, as subscriberQueueSize does for pub/sub.
+const monitorQueueSize = 1024
+
+// errMonitorKeyspace is returned for keyspace commands sent by a monitor.
+const errMonitorKeyspace = "ERR Replica can't interact with the keyspace"
+
+// monitorSkip lists commands MONITOR never shows besides admin commands:
+// ones that may carry credentials.
+var monitorSkip = map[string]bool{
+	"AUTH":  true,
+	"HELLO": true,
+}
+
+// Monitor owns the outbound queue of a connection that issued MONITOR.
+type Monitor struct {
+	conn net.Conn
+	out  chan []byte
+	done chan struct{} // closed once writeLoop has returned
+}
+
+// MonitorManager fans processed commands out to monitor connections.
+type MonitorManager struct {
+	mu       sync.RWMutex
+	monitors map[net.Conn]*Monitor
+	// count lets Feed skip formatting without taking the lock when nobody
+	// is monitoring.
+	count atomic.Int32
+}
+
+// Add turns conn into a monitor. The +OK reply goes through the monitor's
+// queue so it is written before the first fed command.
+func (mm *MonitorManager) Add(conn net.Conn) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if _, exists := mm.monitors[conn]; exists {
+		return
+	}
+	m := &Monitor{conn: conn, out: make(chan []byte, monitorQueueSize), done: make(chan struct{})}
+	ok := NewSimpleString("OK")
+	m.out <- ok.MarshalBytes()
+	mm.monitors[conn] = m
+	mm.count.Add(1)
+	go m.writeLoop()
+}
+
+// RemoveConn drops conn's monitor, if any, and stops its writer.
+func (mm *MonitorManager) RemoveConn(conn net.Conn) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if m, exists := mm.monitors[conn]; exists {
+		delete(mm.monitors, conn)
+		mm.count.Add(-1)
+		close(m.out)
+	}
+}
+
+// Reset turns conn back into a normal connection, as RESET does, waiting
+// until the lines already queued for it have been written so they reach the
+// client ahead of RESET's reply.
+func (mm *MonitorManager) Reset(conn net.Conn) {
+	mm.mu.RLock()
+	m, exists := mm.monitors[conn]
+	mm.mu.RUnlock()
+	if !exists {
+		return
+	}
+	mm.RemoveConn(conn)
+	<-m.done
+}
+
+// writeLoop delivers queued lines until the queue is closed.
+func (m *Monitor) writeLoop() {
+	defer close(m.done)
+	for b := range m.out {
+		if _, err := m.conn.Write(b); err != nil {
+			m.conn.Close()
+			for range m.out {
+			}
+			return
+		}
+	}
+}
+
+// Feed shows a command that just ran to every monitor, without blocking:
+// a monitor whose queue is full is disconnected. Admin commands and those
+// in monitorSkip are left out, as Redis does.
+func (mm *MonitorManager) Feed(state *ClientState, cmdName string, argv []RESP) {
+	if mm.count.Load() == 0 || adminCommands[cmdName] || monitorSkip[cmdName] {
+		return
+	}
+	state.mu.RLock()
+	db, conn := state.DB, state.conn
+	state.mu.RUnlock()
+	reply := NewSimpleString(formatMonitorLine(time.Now(), db, conn.RemoteAddr().String(), argv))
+	line := reply.MarshalBytes()
+
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+	for _, m := range mm.monitors {
+		select {
+		case m.out <- line:
+		default:
+			m.conn.Close()
+		}
+	}
+}
+
+// formatMonitorLine renders a command the way MONITOR shows it:
+// 1339518083.107412 [0 127.0.0.1:60866] "keys" "*"
+func formatMonitorLine(now time.Time, db int, addr string, argv []RESP) string {
+	var builder strings.Builder
+	builder.WriteString(strconv.FormatInt(now.Unix(), 10))
+	builder.WriteByte('.')
+	micros := strconv.Itoa(now.Nanosecond() / 1000)
+	builder.WriteString(strings.Repeat("0", 6-len(micros)) + micros)
+	builder.WriteString(" [" + strconv.Itoa(db) + " " + addr + "]")
+	for _, arg := range argv {
+		builder.WriteByte(' ')
+		writeQuoted(&builder, arg.String)
+	}
+	return builder.String()
+}
+
+// writeQuoted writes s double-quoted with C-style escapes for quotes,
+// backslashes and unprintable bytes.
+func writeQuoted(builder *strings.Builder, s string) {
+	builder.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '\\', '"':
+			builder.WriteByte('\\')
+			builder.WriteByte(c)
+		case '\n':
+			builder.WriteString(`\n`)
+		case '\r':
+			builder.WriteString(`\r`)
+		case '\t':
+			builder.WriteString(`\t`)
+		case '\a':
+			builder.WriteString(`\a`)
+		case '\b':
+			builder.WriteString(`\b`)
+		default:
+			if c < 0x20 || c > 0x7e {
+				builder.WriteString(`\x`)
+				builder.WriteString(strconv.FormatUint(uint64(c)>>4, 16))
+				builder.WriteString(strconv.FormatUint(uint64(c)&0xf, 16))
+			} else {
+				builder.WriteByte(c)
+			}
+		}
+	}
+	builder.WriteByte('"')
+}
+
+// monitorCommand implements MONITOR. The connection stays a monitor until
+// it disconnects.
+func monitorCommand(ctx *CommandContext) (RESP, []byte) {
+	state := ctx.Client
+	state.mu.Lock()
+	state.Monitoring = true
+	state.mu.Unlock()
+	ctx.Server.monitors.Add(ctx.Conn)
+	// The +OK is already queued ahead of the monitor lines.
+	return RESP{}, nil
+}
+
+// checkMonitorKeyspace returns the error a monitor gets for a command that
+// reads or writes keys, or "" when the command may run.
+func checkMonitorKeyspace(registry *Registry, state *ClientState, cmdName string, args []RESP) string {
+	if state.Mode() != ModeMonitor {
+		return ""
+	}
+	if registry.IsWriteCommand(cmdName) || isDataRead(registry, cmdName, args) {
+		return errMonitorKeyspace
+	}
+	return ""
+}
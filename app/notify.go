@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Keyspace notification classes, one per notify-keyspace-events flag.
+const (
+	notifyKeyspace = 1 << iota // K: publish to __keyspace@<db>__:<key>
+	notifyKeyevent             // E: publish to __keyevent@<db>__:<event>
+	notifyGeneric              // g: DEL, EXPIRE and other type-independent events
+	notifyString               // $
+	notifyList                 // l
+	notifySet                  // s
+	notifyHash                 // h
+	notifyZset                 // z
+	notifyExpired              // x: a key expired
+	notifyEvicted              // e: a key was evicted for maxmemory
+	notifyStream               // t
+	notifyKeyMiss              // m
+	notifyNew                  // n
+
+	// notifyAll is what the A flag stands for.
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash | notifyZset | notifyExpired | notifyEvicted | notifyStream
+)
+
+// notifyFlagChars maps each class flag to its character, in the order
+// CONFIG GET reports them after any A.
+var notifyFlagChars = []struct {
+	flag int
+	char byte
+}{
+	{notifyGeneric, 'g'}, {notifyString, '$'}, {notifyList, 'l'}, {notifySet, 's'},
+	{notifyHash, 'h'}, {notifyZset, 'z'}, {notifyExpired, 'x'}, {notifyEvicted, 'e'},
+	{notifyStream, 't'}, {notifyKeyspace, 'K'}, {notifyKeyevent, 'E'},
+	{notifyKeyMiss, 'm'}, {notifyNew, 'n'},
+}
+
+// parseNotifyFlags parses a notify-keyspace-events value such as "KEA" or "Ex".
+func parseNotifyFlags(value string) (int, error) {
+	flags := 0
+outer:
+	for i := 0; i < len(value); i++ {
+		if value[i] == 'A' {
+			flags |= notifyAll
+			continue
+		}
+		for _, fc := range notifyFlagChars {
+			if fc.char == value[i] {
+				flags |= fc.flag
+				continue outer
+			}
+		}
+		return 0, fmt.Errorf("unknown notify-keyspace-events flag %q", value[i])
+	}
+	return flags, nil
+}
+
+// formatNotifyFlags renders flags the way CONFIG GET reports them, folding
+// the type classes into A when all of them are set.
+func formatNotifyFlags(flags int) string {
+	var builder strings.Builder
+	if flags&notifyAll == notifyAll {
+		builder.WriteByte('A')
+		flags &^= notifyAll
+	}
+	for _, fc := range notifyFlagChars {
+		if flags&fc.flag != 0 {
+			builder.WriteByte(fc.char)
+		}
+	}
+	return builder.String()
+}
+
+// keyspaceEvent is one notification waiting to be published.
+type keyspaceEvent struct {
+	db    *KeyValueStore
+	flags int
+	event string
+	key   string
+}
+
+// keyspaceNotifier publishes keyspace events from a single goroutine, in
+// the order they were raised. Events are raised while the store lock is
+// held, so raising one only appends to a queue; publishing, which takes
+// the pub/sub and databases locks, happens after the lock is released.
+type keyspaceNotifier struct {
+	server  *Server
+	once    sync.Once
+	mu      sync.Mutex
+	pending []keyspaceEvent
+	wake    chan struct{}
+}
+
+// notifyKeyspaceEvent raises event for key in db if the class is enabled
+// by the notify-keyspace-events of the server db belongs to. It is safe to
+// call with the store lock held.
+func notifyKeyspaceEvent(db *KeyValueStore, class int, event, key string) {
+	if db.server == nil {
+		return
+	}
+	flags := db.server.Config().NotifyKeyspaceEvents
+	if flags&class == 0 || flags&(notifyKeyspace|notifyKeyevent) == 0 {
+		return
+	}
+	notifier := db.server.notifier
+	notifier.once.Do(func() { go notifier.run() })
+	notifier.mu.Lock()
+	notifier.pending = append(notifier.pending, keyspaceEvent{db: db, flags: flags, event: event, key: key})
+	notifier.mu.Unlock()
+	select {
+	case notifier.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run publishes queued events. The database index is resolved here rather
+// than when the event is raised, since looking it up takes the databases
+// lock, which is ordered before store locks.
+func (n *keyspaceNotifier) run() {
+	pubsub := n.server.pubsub
+	for range n.wake {
+		n.mu.Lock()
+		events := n.pending
+		n.pending = nil
+		n.mu.Unlock()
+
+		for _, ev := range events {
+			index := n.server.dbs.IndexOf(ev.db)
+			if index < 0 {
+				continue
+			}
+			db := strconv.Itoa(index)
+			if ev.flags&notifyKeyspace != 0 {
+				pubsub.Publish("__keyspace@"+db+"__:"+ev.key, ev.event)
+			}
+			if ev.flags&notifyKeyevent != 0 {
+				pubsub.Publish("__keyevent@"+db+"__:"+ev.event, ev.key)
+			}
+		}
+	}
+}
+
+// notifyIfDeleted raises del for a key that a write just emptied, as
+// removing the last hash field or set member deletes the key.
+func notifyIfDeleted(db *KeyValueStore, key string) {
+	if !db.Exists(key) {
+		notifyKeyspaceEvent(db, notifyGeneric, "del", key)
+	}
+}
+
+// setStoreEvents names the event each set-algebra store command raises.
+var setStoreEvents = map[setOp]string{
+	setInter: "sinterstore",
+	setUnion: "sunionstore",
+	setDiff:  "sdiffstore",
+}
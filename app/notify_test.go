@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// message is the push a subscriber gets for a publish to channel.
+func message(channel, payload string) RESP {
+	return NewArray([]RESP{NewBulkString("message"), NewBulkString(channel), NewBulkString(payload)})
+}
+
+// TestExpiredNotification checks both ways a key expires: found by the
+// expiry cycle, and found by a command that looks it up first.
+func TestExpiredNotification(t *testing.T) {
+	s := startServer(t, nil)
+	c, sub := dial(t, s), dial(t, s)
+	expectReply(t, c.do("CONFIG", "SET", "notify-keyspace-events", "KEx"), NewSimpleString("OK"))
+	sub.send("SUBSCRIBE", "__keyevent@0__:expired", "__keyspace@0__:lazy")
+	sub.read()
+	sub.read()
+
+	expectReply(t, c.do("SET", "active", "v", "PX", "50"), NewSimpleString("OK"))
+	expectReply(t, sub.read(), message("__keyevent@0__:expired", "active"))
+
+	// A GET polling the key usually finds it lapsed before the cycle
+	// does; whichever does, the expiry is announced once.
+	expectReply(t, c.do("SET", "lazy", "v", "PX", "1"), NewSimpleString("OK"))
+	eventually(t, "lazy to expire", func() bool { return sameReply(c.do("GET", "lazy"), NewNullBulkString()) })
+	expectReply(t, sub.read(), message("__keyspace@0__:lazy", "expired"))
+	expectReply(t, sub.read(), message("__keyevent@0__:expired", "lazy"))
+
+	// Without x the expiry is silent.
+	expectReply(t, c.do("CONFIG", "SET", "notify-keyspace-events", "KE$"), NewSimpleString("OK"))
+	expectReply(t, c.do("SET", "quiet", "v", "PX", "10"), NewSimpleString("OK"))
+	eventually(t, "quiet to expire", func() bool { return sameReply(c.do("EXISTS", "quiet"), NewInteger(0)) })
+	sub.expectNoReply(100 * time.Millisecond)
+}
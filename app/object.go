@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Size limits below which Redis keeps small values in compact encodings.
+const (
+	embstrMaxLen        = 44
+	listpackMaxEntries  = 128
+	listpackMaxValueLen = 64
+	intsetMaxEntries    = 512
+)
+
+// objectEncoding returns the encoding Redis would report for a value, so
+// clients and tools that inspect OBJECT ENCODING see familiar names.
+func objectEncoding(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		if len(v) <= 20 {
+			if _, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return "int"
+			}
+		}
+		if len(v) <= embstrMaxLen {
+			return "embstr"
+		}
+		return "raw"
+	case *Stream:
+		return "stream"
+	case Hash:
+		if len(v) > listpackMaxEntries {
+			return "hashtable"
+		}
+		for field, val := range v {
+			if len(field) > listpackMaxValueLen || len(val) > listpackMaxValueLen {
+				return "hashtable"
+			}
+		}
+		return "listpack"
+	case Set:
+		return setEncoding(v)
+	case *List:
+		if v.Len() > listpackMaxEntries {
+			return "quicklist"
+		}
+		for _, element := range v.Elements() {
+			if len(element) > listpackMaxValueLen {
+				return "quicklist"
+			}
+		}
+		return "listpack"
+	case *ZSet:
+		if v.Len() > listpackMaxEntries {
+			return "skiplist"
+		}
+		for _, m := range v.Members() {
+			if len(m.Member) > listpackMaxValueLen {
+				return "skiplist"
+			}
+		}
+		return "listpack"
+	default:
+		return "unknown"
+	}
+}
+
+// setEncoding picks intset for small all-integer sets, listpack for other
+// small sets and hashtable otherwise.
+func setEncoding(set Set) string {
+	allInts, short := true, true
+	for member := range set {
+		if _, err := strconv.ParseInt(member, 10, 64); err != nil {
+			allInts = false
+		}
+		if len(member) > listpackMaxValueLen {
+			short = false
+		}
+	}
+	switch {
+	case allInts && len(set) <= intsetMaxEntries:
+		return "intset"
+	case short && len(set) <= listpackMaxEntries:
+		return "listpack"
+	default:
+		return "hashtable"
+	}
+}
+
+// objectCommand implements OBJECT ENCODING, REFCOUNT, IDLETIME and FREQ.
+// Inspecting a key does not count as accessing it.
+func objectCommand(ctx *CommandContext) (RESP, []byte) {
+	db, args := ctx.DB, ctx.Args
+	sub := strings.ToUpper(args[0].String)
+	switch sub {
+	case "HELP":
+		return NewArray([]RESP{
+			NewSimpleString("OBJECT <subcommand> [<arg> ...]. Subcommands are:"),
+			NewSimpleString("ENCODING <key>"),
+			NewSimpleString("    Return the kind of internal representation used to store the value at <key>."),
+			NewSimpleString("FREQ <key>"),
+			NewSimpleString("    Return the access frequency index of <key> (needs an LFU maxmemory-policy)."),
+			NewSimpleString("IDLETIME <key>"),
+			NewSimpleString("    Return the idle time of <key>, in seconds."),
+			NewSimpleString("REFCOUNT <key>"),
+			NewSimpleString("    Return the reference count of the value at <key>."),
+		}), nil
+	case "ENCODING", "REFCOUNT", "IDLETIME", "FREQ":
+	default:
+		return unknownSubcommand("OBJECT", args[0].String), nil
+	}
+	if len(args) != 2 {
+		return NewError("ERR wrong number of arguments for 'object|" + strings.ToLower(sub) + "' command"), nil
+	}
+
+	encoding, idle, ok := db.Object(args[1].String)
+	if !ok {
+		return NewNullBulkString(), nil
+	}
+	switch sub {
+	case "ENCODING":
+		return NewBulkString(encoding), nil
+	case "REFCOUNT":
+		return NewInteger(1), nil
+	case "IDLETIME":
+		return NewInteger(int(idle.Seconds())), nil
+	default:
+		return NewError("ERR An LFU maxmemory policy is not selected, access frequency not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust."), nil
+	}
+}
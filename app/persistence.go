@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errSaveInProgress is returned when a save is requested while another is still writing.
+var errSaveInProgress = errors.New("ERR Background save already in progress")
+
+// saveRetryDelay is how long save rules wait after a failed background save before trying again.
+const saveRetryDelay = 5 * time.Second
+
+// SaveRule triggers a background save once Changes writes have accumulated
+// and Seconds have passed since the last successful save.
+type SaveRule struct {
+	Seconds int64
+	Changes int64
+}
+
+// Persistence serializes snapshot writes: one SAVE or BGSAVE runs at a time,
+// and LASTSAVE reports when the last one succeeded. It also counts writes
+// since that save and, while save rules are configured, runs the goroutine
+// that turns them into background saves.
+type Persistence struct {
+	server      *Server
+	mu          sync.Mutex
+	saving      bool
+	lastSave    time.Time
+	lastAttempt time.Time
+	lastFailed  bool
+	rules       []SaveRule
+	stop        chan struct{}
+	dirty       atomic.Int64
+}
+
+// rdbPath returns the configured dump file path.
+func (s *Server) rdbPath() string {
+	cfg := s.Config()
+	return filepath.Join(cfg.Dir, cfg.DBFilename)
+}
+
+// begin claims the single save slot.
+func (p *Persistence) begin() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.saving {
+		return errSaveInProgress
+	}
+	p.saving = true
+	return nil
+}
+
+// finish releases the save slot and records the outcome. On success the
+// writes the snapshot covered no longer count as dirty.
+func (p *Persistence) finish(err error, covered int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.saving = false
+	p.lastAttempt = time.Now()
+	p.lastFailed = err != nil
+	if err == nil {
+		p.lastSave = p.lastAttempt
+		p.dirty.Add(-covered)
+	}
+}
+
+// Save snapshots every database and writes the dump before returning.
+func (p *Persistence) Save() error {
+	if err := p.begin(); err != nil {
+		return err
+	}
+	covered := p.dirty.Load()
+	err := writeSnapshot(p.server.rdbPath(), p.server.dbs.Snapshot())
+	p.finish(err, covered)
+	return err
+}
+
+// BackgroundSave snapshots every database now and writes the dump in a
+// goroutine, so writes that arrive after it returns are not included.
+func (p *Persistence) BackgroundSave() error {
+	if err := p.begin(); err != nil {
+		return err
+	}
+	covered := p.dirty.Load()
+	path, snapshot := p.server.rdbPath(), p.server.dbs.Snapshot()
+	go func() {
+		err := writeSnapshot(path, snapshot)
+		if err != nil {
+			logWarning("Background saving error", "err", err)
+		}
+		p.finish(err, covered)
+	}()
+	return nil
+}
+
+// MarkDirty counts a successful write toward the save rules.
+func (p *Persistence) MarkDirty() {
+	p.dirty.Add(1)
+}
+
+// Dirty returns the number of writes since the last successful save.
+func (p *Persistence) Dirty() int64 {
+	return p.dirty.Load()
+}
+
+// Rules returns the configured save rules.
+func (p *Persistence) Rules() []SaveRule {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rules
+}
+
+// SetRules replaces the save rules. The checking goroutine only runs while
+// there is at least one rule.
+func (p *Persistence) SetRules(rules []SaveRule) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rules = rules
+	if len(rules) == 0 {
+		if p.stop != nil {
+			close(p.stop)
+			p.stop = nil
+		}
+		return
+	}
+	if p.stop == nil {
+		p.stop = make(chan struct{})
+		go p.run(p.stop)
+	}
+}
+
+// run checks the save rules every second until stop is closed.
+func (p *Persistence) run(stop chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if p.ruleDue(now) {
+				// Losing a race with SAVE or BGSAVE is fine: that save resets the count.
+				p.BackgroundSave()
+			}
+		}
+	}
+}
+
+// ruleDue reports whether any save rule is met at now. After a failed save
+// it waits saveRetryDelay so a full disk is not hammered every second.
+func (p *Persistence) ruleDue(now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.saving || (p.lastFailed && now.Sub(p.lastAttempt) < saveRetryDelay) {
+		return false
+	}
+	dirty := p.dirty.Load()
+	elapsed := now.Sub(p.lastSave)
+	for _, rule := range p.rules {
+		if dirty >= rule.Changes && elapsed >= time.Duration(rule.Seconds)*time.Second {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSaveRules parses "seconds changes [seconds changes ...]" as given to
+// --save and CONFIG SET save. An empty string means no rules.
+func ParseSaveRules(spec string) ([]SaveRule, error) {
+	fields := strings.Fields(spec)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("save rules need seconds and changes pairs")
+	}
+	rules := make([]SaveRule, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil || seconds < 1 {
+			return nil, fmt.Errorf("invalid save seconds %q", fields[i])
+		}
+		changes, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil || changes < 0 {
+			return nil, fmt.Errorf("invalid save changes %q", fields[i+1])
+		}
+		rules = append(rules, SaveRule{Seconds: seconds, Changes: changes})
+	}
+	return rules, nil
+}
+
+// formatSaveRules renders rules the way CONFIG GET save reports them.
+func formatSaveRules(rules []SaveRule) string {
+	parts := make([]string, 0, len(rules)*2)
+	for _, rule := range rules {
+		parts = append(parts, strconv.FormatInt(rule.Seconds, 10), strconv.FormatInt(rule.Changes, 10))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Status reports whether a save is running and whether the last one failed.
+func (p *Persistence) Status() (saving, lastFailed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.saving, p.lastFailed
+}
+
+// LastSave returns when the last save succeeded, or the start time if none has.
+func (p *Persistence) LastSave() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastSave
+}
+
+// writeSnapshot writes dbs to a temporary file next to path and renames it
+// over path, so a failed write never leaves a truncated dump.
+func writeSnapshot(path string, dbs [][]SnapshotEntry) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "temp-*.rdb")
+	if err != nil {
+		return fmt.Errorf("failed to create temp RDB file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	err = WriteRDB(writer, dbs, time.Now())
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		// CreateTemp makes the file owner-only; dumps are normally world-readable.
+		err = tmp.Chmod(0o644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write RDB file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to rename RDB file: %w", err)
+	}
+	return nil
+}
+
+// saveCommand writes a snapshot synchronously.
+func saveCommand(ctx *CommandContext) (RESP, []byte) {
+	if err := ctx.Server.persistence.Save(); err != nil {
+		if errors.Is(err, errSaveInProgress) {
+			return NewError(err.Error()), nil
+		}
+		return NewError("ERR " + err.Error()), nil
+	}
+	return NewSimpleString("OK"), nil
+}
+
+// bgsaveCommand starts a background snapshot.
+func bgsaveCommand(ctx *CommandContext) (RESP, []byte) {
+	if err := ctx.Server.persistence.BackgroundSave(); err != nil {
+		return NewError(err.Error()), nil
+	}
+	return NewSimpleString("Background saving started"), nil
+}
+
+// lastsaveCommand returns the Unix time of the last successful save.
+func lastsaveCommand(ctx *CommandContext) (RESP, []byte) {
+	return NewInteger(int(ctx.Server.persistence.LastSave().Unix())), nil
+}
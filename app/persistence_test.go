@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSaveRules(t *testing.T) {
+	tests := []struct {
+		spec string
+		want []SaveRule
+		ok   bool
+	}{
+		{"", []SaveRule{}, true},
+		{"900 1", []SaveRule{{900, 1}}, true},
+		{"900 1 300 10 60 10000", []SaveRule{{900, 1}, {300, 10}, {60, 10000}}, true},
+		{"  60   0 ", []SaveRule{{60, 0}}, true},
+		{"900", nil, false},
+		{"0 1", nil, false},
+		{"x 1", nil, false},
+		{"60 -1", nil, false},
+	}
+	for _, tt := range tests {
+		rules, err := ParseSaveRules(tt.spec)
+		if (err == nil) != tt.ok || tt.ok && !reflect.DeepEqual(rules, tt.want) {
+			t.Fatalf("ParseSaveRules(%q) = %v, %v", tt.spec, rules, err)
+		}
+		if tt.ok && formatSaveRules(rules) != formatSaveRules(tt.want) {
+			t.Fatalf("%q formats as %q", tt.spec, formatSaveRules(rules))
+		}
+	}
+}
+
+func TestSaveRules(t *testing.T) {
+	s := startServer(t, func(o *ServerOptions) { o.Save = "1 3" })
+	c := dial(t, s)
+	expectReply(t, c.do("CONFIG", "GET", "save"), NewArray([]RESP{NewBulkString("save"), NewBulkString("1 3")}))
+	dumped := func() bool {
+		_, err := os.Stat(s.rdbPath())
+		return err == nil
+	}
+
+	// Two writes fall short of the rule however long they wait.
+	c.do("SET", "a", "1")
+	c.do("SET", "b", "2")
+	time.Sleep(1500 * time.Millisecond)
+	if dumped() {
+		t.Fatal("saved after 2 changes with the rule at 3")
+	}
+
+	c.do("SET", "c", "3")
+	eventually(t, "the rule to save", dumped)
+	eventually(t, "the change count to reset", func() bool { return s.persistence.Dirty() == 0 })
+	loaded := newServer(1)
+	if err := ParseRDB(s.rdbPath(), loaded.dbs); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"a": "1", "b": "2", "c": "3"} {
+		if got, _ := loaded.dbs.DB(0).Get(key); got != want {
+			t.Fatalf("the dump holds %s = %q, want %q", key, got, want)
+		}
+	}
+
+	// With the rules cleared nothing saves.
+	expectReply(t, c.do("CONFIG", "SET", "save", ""), NewSimpleString("OK"))
+	if err := os.Remove(s.rdbPath()); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"d", "e", "f", "g"} {
+		c.do("SET", key, "v")
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if dumped() {
+		t.Fatal("saved with no rules configured")
+	}
+}
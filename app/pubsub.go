@@ -0,0 +1,337 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"sync"
+)
+
+// subscriberQueueSize bounds how many undelivered messages a subscriber may
+// accumulate before it is considered too slow and disconnected.
+const subscriberQueueSize = 1024
+
+// Subscriber owns the outbound queue of a connection in subscriber mode.
+type Subscriber struct {
+	conn     net.Conn
+	out      chan []byte
+	done     chan struct{} // closed once writeLoop has returned
+	channels map[string]struct{}
+	patterns map[string]struct{}
+}
+
+// PubSubManager tracks channel and pattern subscriptions and fans out published messages.
+type PubSubManager struct {
+	channels    map[string]map[net.Conn]*Subscriber
+	patterns    map[string]map[net.Conn]*Subscriber
+	subscribers map[net.Conn]*Subscriber
+	mu          sync.RWMutex
+}
+
+// newPubSubManager returns a manager with no subscriptions.
+func newPubSubManager() *PubSubManager {
+	return &PubSubManager{
+		channels:    make(map[string]map[net.Conn]*Subscriber),
+		patterns:    make(map[string]map[net.Conn]*Subscriber),
+		subscribers: make(map[net.Conn]*Subscriber),
+	}
+}
+
+// subscriberLocked returns the connection's subscriber, creating it and its writer if needed.
+func (pm *PubSubManager) subscriberLocked(conn net.Conn) *Subscriber {
+	sub, exists := pm.subscribers[conn]
+	if !exists {
+		sub = &Subscriber{
+			conn:     conn,
+			out:      make(chan []byte, subscriberQueueSize),
+			done:     make(chan struct{}),
+			channels: make(map[string]struct{}),
+			patterns: make(map[string]struct{}),
+		}
+		pm.subscribers[conn] = sub
+		go sub.writeLoop()
+	}
+	return sub
+}
+
+// writeLoop delivers queued messages until the queue is closed.
+func (sub *Subscriber) writeLoop() {
+	defer close(sub.done)
+	for b := range sub.out {
+		if _, err := sub.conn.Write(b); err != nil {
+			sub.conn.Close()
+			for range sub.out {
+			}
+			return
+		}
+	}
+}
+
+// enqueueLocked queues b without blocking, disconnecting a subscriber that has fallen too far behind.
+func (sub *Subscriber) enqueueLocked(b []byte) bool {
+	select {
+	case sub.out <- b:
+		return true
+	default:
+		sub.conn.Close()
+		return false
+	}
+}
+
+// releaseLocked stops the writer once the connection has no subscriptions left.
+func (pm *PubSubManager) releaseLocked(sub *Subscriber) {
+	if sub.count() == 0 {
+		delete(pm.subscribers, sub.conn)
+		close(sub.out)
+	}
+}
+
+// count returns the number of active channel and pattern subscriptions.
+func (sub *Subscriber) count() int {
+	return len(sub.channels) + len(sub.patterns)
+}
+
+// subscriptionKind selects between exact channel and pattern subscriptions.
+type subscriptionKind struct {
+	subscribeReply   string
+	unsubscribeReply string
+	isPattern        bool
+}
+
+var (
+	channelKind = subscriptionKind{subscribeReply: "subscribe", unsubscribeReply: "unsubscribe"}
+	patternKind = subscriptionKind{subscribeReply: "psubscribe", unsubscribeReply: "punsubscribe", isPattern: true}
+)
+
+// indexes returns the manager-wide and per-subscriber maps for a kind.
+func (pm *PubSubManager) indexes(sub *Subscriber, kind subscriptionKind) (map[string]map[net.Conn]*Subscriber, map[string]struct{}) {
+	if kind.isPattern {
+		return pm.patterns, sub.patterns
+	}
+	return pm.channels, sub.channels
+}
+
+// Subscribe adds channels for conn, queueing a confirmation for each.
+func (pm *PubSubManager) Subscribe(conn net.Conn, channels []string) {
+	pm.subscribe(conn, channels, channelKind)
+}
+
+// PSubscribe adds patterns for conn, queueing a confirmation for each.
+func (pm *PubSubManager) PSubscribe(conn net.Conn, patterns []string) {
+	pm.subscribe(conn, patterns, patternKind)
+}
+
+func (pm *PubSubManager) subscribe(conn net.Conn, names []string, kind subscriptionKind) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	sub := pm.subscriberLocked(conn)
+	index, own := pm.indexes(sub, kind)
+	for _, name := range names {
+		if _, ok := own[name]; !ok {
+			own[name] = struct{}{}
+			if index[name] == nil {
+				index[name] = make(map[net.Conn]*Subscriber)
+			}
+			index[name][conn] = sub
+		}
+		reply := NewArray([]RESP{NewBulkString(kind.subscribeReply), NewBulkString(name), NewInteger(sub.count())})
+		sub.enqueueLocked(reply.MarshalBytes())
+	}
+}
+
+// Unsubscribe removes channels for conn (all of them when none are given).
+// When conn was not subscribed at all, the confirmation is returned for the
+// caller to write; otherwise confirmations go through the subscriber queue.
+func (pm *PubSubManager) Unsubscribe(conn net.Conn, channels []string) (RESP, bool) {
+	return pm.unsubscribe(conn, channels, channelKind)
+}
+
+// PUnsubscribe removes patterns for conn, with the same reply rules as Unsubscribe.
+func (pm *PubSubManager) PUnsubscribe(conn net.Conn, patterns []string) (RESP, bool) {
+	return pm.unsubscribe(conn, patterns, patternKind)
+}
+
+func (pm *PubSubManager) unsubscribe(conn net.Conn, names []string, kind subscriptionKind) (RESP, bool) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	sub, exists := pm.subscribers[conn]
+	if !exists {
+		var name RESP = NewNullBulkString()
+		if len(names) > 0 {
+			name = NewBulkString(names[0])
+		}
+		return NewArray([]RESP{NewBulkString(kind.unsubscribeReply), name, NewInteger(0)}), false
+	}
+
+	index, own := pm.indexes(sub, kind)
+	if len(names) == 0 {
+		if len(own) == 0 {
+			reply := NewArray([]RESP{NewBulkString(kind.unsubscribeReply), NewNullBulkString(), NewInteger(sub.count())})
+			sub.enqueueLocked(reply.MarshalBytes())
+			return RESP{}, true
+		}
+		for name := range own {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	for _, name := range names {
+		removeSubscriptionLocked(index, own, sub.conn, name)
+		reply := NewArray([]RESP{NewBulkString(kind.unsubscribeReply), NewBulkString(name), NewInteger(sub.count())})
+		sub.enqueueLocked(reply.MarshalBytes())
+	}
+	pm.releaseLocked(sub)
+	return RESP{}, true
+}
+
+// removeSubscriptionLocked drops one channel or pattern subscription.
+func removeSubscriptionLocked(index map[string]map[net.Conn]*Subscriber, own map[string]struct{}, conn net.Conn, name string) {
+	delete(own, name)
+	if subs, ok := index[name]; ok {
+		delete(subs, conn)
+		if len(subs) == 0 {
+			delete(index, name)
+		}
+	}
+}
+
+// Publish delivers a message to every subscriber of channel and every
+// subscriber with a matching pattern, returning the number of deliveries. A
+// connection matching both ways receives the message once per match.
+func (pm *PubSubManager) Publish(channel, message string) int {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	receivers := 0
+	if subs := pm.channels[channel]; len(subs) > 0 {
+		msg := NewArray([]RESP{NewBulkString("message"), NewBulkString(channel), NewBulkString(message)})
+		b := msg.MarshalBytes()
+		for _, sub := range subs {
+			if sub.enqueueLocked(b) {
+				receivers++
+			}
+		}
+	}
+
+	for pattern, subs := range pm.patterns {
+		if !matchGlob(pattern, channel) {
+			continue
+		}
+		msg := NewArray([]RESP{NewBulkString("pmessage"), NewBulkString(pattern), NewBulkString(channel), NewBulkString(message)})
+		b := msg.MarshalBytes()
+		for _, sub := range subs {
+			if sub.enqueueLocked(b) {
+				receivers++
+			}
+		}
+	}
+	return receivers
+}
+
+// SendTo delivers payload as a message on channel to conn alone, if it is
+// subscribed to that channel, and reports whether it was queued.
+func (pm *PubSubManager) SendTo(conn net.Conn, channel string, payload RESP) bool {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	sub, ok := pm.channels[channel][conn]
+	if !ok {
+		return false
+	}
+	msg := NewArray([]RESP{NewBulkString("message"), NewBulkString(channel), payload})
+	return sub.enqueueLocked(msg.MarshalBytes())
+}
+
+// ActiveChannels returns channels with at least one subscriber, optionally filtered by a glob pattern.
+func (pm *PubSubManager) ActiveChannels(pattern string) []string {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	var channels []string
+	for channel := range pm.channels {
+		if pattern == "" || matchGlob(pattern, channel) {
+			channels = append(channels, channel)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// NumSub returns the number of exact subscribers of a channel.
+func (pm *PubSubManager) NumSub(channel string) int {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	return len(pm.channels[channel])
+}
+
+// NumPat returns the number of distinct subscribed patterns.
+func (pm *PubSubManager) NumPat() int {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	return len(pm.patterns)
+}
+
+// QueueStats returns the number of subscribers and the messages waiting in their outbound queues.
+func (pm *PubSubManager) QueueStats() (int, int) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	queued := 0
+	for _, sub := range pm.subscribers {
+		queued += len(sub.out)
+	}
+	return len(pm.subscribers), queued
+}
+
+// SubscriptionCount returns how many subscriptions conn holds.
+func (pm *PubSubManager) SubscriptionCount(conn net.Conn) int {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	if sub, ok := pm.subscribers[conn]; ok {
+		return sub.count()
+	}
+	return 0
+}
+
+// Counts returns how many channels and patterns conn is subscribed to.
+func (pm *PubSubManager) Counts(conn net.Conn) (int, int) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	if sub, ok := pm.subscribers[conn]; ok {
+		return len(sub.channels), len(sub.patterns)
+	}
+	return 0, 0
+}
+
+// RemoveConn drops every subscription held by a disconnected connection.
+func (pm *PubSubManager) RemoveConn(conn net.Conn) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	sub, exists := pm.subscribers[conn]
+	if !exists {
+		return
+	}
+	for channel := range sub.channels {
+		removeSubscriptionLocked(pm.channels, sub.channels, conn, channel)
+	}
+	for pattern := range sub.patterns {
+		removeSubscriptionLocked(pm.patterns, sub.patterns, conn, pattern)
+	}
+	pm.releaseLocked(sub)
+}
+
+// Reset drops every subscription held by conn without confirmations, as
+// RESET does, and waits until the messages already queued for it have been
+// written, so they reach the client ahead of RESET's reply.
+func (pm *PubSubManager) Reset(conn net.Conn) {
+	pm.mu.RLock()
+	sub, exists := pm.subscribers[conn]
+	pm.mu.RUnlock()
+	if !exists {
+		return
+	}
+	pm.RemoveConn(conn)
+	<-sub.done
+}
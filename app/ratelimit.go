@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+// Rate limiter state is stored as a packed string so it round-trips through
+// anything that copies string values (replication, RDB). Every encoding
+// starts with a kind byte and a version byte; bump the version when a layout
+// changes so older state is rejected rather than misread.
+const (
+	rateLimitVersion    = 1
+	rateLimitKindBucket = 'T'
+	rateLimitKindWindow = 'S'
+
+	// slidingWindowSlots is the number of sub-window counters in the ring.
+	slidingWindowSlots = 10
+
+	tokenBucketSize   = 2 + 8 + 8
+	slidingWindowSize = 2 + 8 + 8 + 4*slidingWindowSlots
+)
+
+// ErrRateLimitState is returned when a key holds a string that is not limiter state.
+var ErrRateLimitState = errors.New("ERR key does not hold valid rate limiter state")
+
+// RateLimitResult is the outcome of one limiter call and the state to replicate.
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int64
+	RetryAfter int64 // milliseconds; 0 when allowed, -1 when the request can never succeed
+	State      string
+	TTL        time.Duration
+}
+
+// tokenBucket is the decoded RL.LIMIT state.
+type tokenBucket struct {
+	tokens float64
+	lastMs int64
+}
+
+func (b tokenBucket) encode() string {
+	buf := make([]byte, tokenBucketSize)
+	buf[0], buf[1] = rateLimitKindBucket, rateLimitVersion
+	binary.BigEndian.PutUint64(buf[2:], math.Float64bits(b.tokens))
+	binary.BigEndian.PutUint64(buf[10:], uint64(b.lastMs))
+	return string(buf)
+}
+
+func decodeTokenBucket(s string) (tokenBucket, error) {
+	if len(s) != tokenBucketSize || s[0] != rateLimitKindBucket || s[1] != rateLimitVersion {
+		return tokenBucket{}, ErrRateLimitState
+	}
+	return tokenBucket{
+		tokens: math.Float64frombits(binary.BigEndian.Uint64([]byte(s[2:10]))),
+		lastMs: int64(binary.BigEndian.Uint64([]byte(s[10:18]))),
+	}, nil
+}
+
+// slidingWindow is the decoded RL.SLIDING state: a ring of per-slot event
+// counts where head is the index of the newest slot (now / slot width).
+type slidingWindow struct {
+	windowMs int64
+	head     int64
+	counts   [slidingWindowSlots]uint32
+}
+
+func (w slidingWindow) encode() string {
+	buf := make([]byte, slidingWindowSize)
+	buf[0], buf[1] = rateLimitKindWindow, rateLimitVersion
+	binary.BigEndian.PutUint64(buf[2:], uint64(w.windowMs))
+	binary.BigEndian.PutUint64(buf[10:], uint64(w.head))
+	for i, c := range w.counts {
+		binary.BigEndian.PutUint32(buf[18+4*i:], c)
+	}
+	return string(buf)
+}
+
+func decodeSlidingWindow(s string) (slidingWindow, error) {
+	if len(s) != slidingWindowSize || s[0] != rateLimitKindWindow || s[1] != rateLimitVersion {
+		return slidingWindow{}, ErrRateLimitState
+	}
+	b := []byte(s)
+	w := slidingWindow{
+		windowMs: int64(binary.BigEndian.Uint64(b[2:10])),
+		head:     int64(binary.BigEndian.Uint64(b[10:18])),
+	}
+	for i := range w.counts {
+		w.counts[i] = binary.BigEndian.Uint32(b[18+4*i:])
+	}
+	return w, nil
+}
+
+// getLimiterStateLocked returns the packed state at key, or "" when the key is missing.
+func (s *KeyValueStore) getLimiterStateLocked(key string) (string, error) {
+	value, exists := s.lookupForWriteLocked(key)
+	if !exists {
+		return "", nil
+	}
+	str, ok := value.(string)
+	if !ok {
+		return "", ErrWrongType
+	}
+	return str, nil
+}
+
+// storeLimiterStateLocked writes packed state with the TTL after which it is indistinguishable from a fresh limiter.
+func (s *KeyValueStore) storeLimiterStateLocked(key string, now time.Time, result *RateLimitResult) {
+	if result.TTL < time.Millisecond {
+		result.TTL = time.Millisecond
+	}
+	s.storeLocked(key, result.State)
+	s.shard(key).expiryMap[key] = now.Add(result.TTL)
+}
+
+// TokenBucket spends cost tokens from the bucket at key, refilling at refillPerSec up to maxTokens.
+func (s *KeyValueStore) TokenBucket(key string, maxTokens int64, refillPerSec float64, cost int64, now time.Time) (RateLimitResult, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	raw, err := s.getLimiterStateLocked(key)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+
+	nowMs := now.UnixMilli()
+	bucket := tokenBucket{tokens: float64(maxTokens), lastMs: nowMs}
+	if raw != "" {
+		if bucket, err = decodeTokenBucket(raw); err != nil {
+			return RateLimitResult{}, err
+		}
+		if elapsed := nowMs - bucket.lastMs; elapsed > 0 {
+			bucket.tokens += float64(elapsed) / 1000 * refillPerSec
+		}
+		bucket.tokens = math.Min(bucket.tokens, float64(maxTokens))
+		bucket.lastMs = nowMs
+	}
+
+	var result RateLimitResult
+	switch {
+	case float64(cost) <= bucket.tokens:
+		bucket.tokens -= float64(cost)
+		result.Allowed = true
+	case cost > maxTokens:
+		result.RetryAfter = -1
+	default:
+		result.RetryAfter = int64(math.Ceil((float64(cost) - bucket.tokens) / refillPerSec * 1000))
+	}
+	result.Remaining = int64(math.Floor(bucket.tokens))
+	result.State = bucket.encode()
+	result.TTL = time.Duration(math.Ceil((float64(maxTokens)-bucket.tokens)/refillPerSec*1000)) * time.Millisecond
+
+	s.storeLimiterStateLocked(key, now, &result)
+	return result, nil
+}
+
+// SlidingWindow records one event at key if fewer than maxEvents happened in the last windowMs.
+func (s *KeyValueStore) SlidingWindow(key string, windowMs, maxEvents int64, now time.Time) (RateLimitResult, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	raw, err := s.getLimiterStateLocked(key)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+
+	slotMs := (windowMs + slidingWindowSlots - 1) / slidingWindowSlots
+	current := now.UnixMilli() / slotMs
+
+	window := slidingWindow{windowMs: windowMs, head: current}
+	if raw != "" {
+		decoded, err := decodeSlidingWindow(raw)
+		if err != nil {
+			return RateLimitResult{}, err
+		}
+		// A different window length makes the old slots meaningless.
+		if decoded.windowMs == windowMs {
+			window = decoded
+		}
+	}
+
+	if current < window.head {
+		current = window.head
+	}
+	if current > window.head {
+		for slot := window.head + 1; slot <= current && slot <= window.head+slidingWindowSlots; slot++ {
+			window.counts[slot%slidingWindowSlots] = 0
+		}
+		window.head = current
+	}
+
+	var total int64
+	for _, c := range window.counts {
+		total += int64(c)
+	}
+
+	var result RateLimitResult
+	switch {
+	case total < maxEvents:
+		window.counts[current%slidingWindowSlots]++
+		total++
+		result.Allowed = true
+	default:
+		// Wait until the oldest occupied slot slides out of the window.
+		for slot := window.head - slidingWindowSlots + 1; slot <= window.head; slot++ {
+			if window.counts[slot%slidingWindowSlots] > 0 {
+				result.RetryAfter = (slot+slidingWindowSlots)*slotMs - now.UnixMilli()
+				break
+			}
+		}
+	}
+	result.Remaining = maxEvents - total
+	result.State = window.encode()
+	result.TTL = time.Duration((window.head+slidingWindowSlots)*slotMs-now.UnixMilli()) * time.Millisecond
+
+	s.storeLimiterStateLocked(key, now, &result)
+	return result, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeStart returns the whole second after now, the zero of a test's fake
+// clock. Limiter state expires on the real clock, so the fake one must not
+// run behind it, and starting on a second keeps sliding-window slots aligned.
+func fakeStart() time.Time {
+	return time.Now().Truncate(time.Second).Add(time.Second)
+}
+
+func TestTokenBucket(t *testing.T) {
+	db := NewKeyValueStore()
+	start := fakeStart()
+	spend := func(at time.Duration, cost int64) RateLimitResult {
+		t.Helper()
+		result, err := db.TokenBucket("k", 5, 2, cost, start.Add(at))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	// A full bucket allows a burst of five, then refills two a second.
+	for i := int64(0); i < 5; i++ {
+		if r := spend(0, 1); !r.Allowed || r.Remaining != 4-i {
+			t.Fatalf("burst call %d: %+v", i, r)
+		}
+	}
+	if r := spend(0, 1); r.Allowed || r.RetryAfter != 500 {
+		t.Fatalf("call on an empty bucket: %+v, want a retry after 500ms", r)
+	}
+	if r := spend(400*time.Millisecond, 1); r.Allowed || r.RetryAfter != 100 {
+		t.Fatalf("call 100ms early: %+v", r)
+	}
+	if r := spend(500*time.Millisecond, 1); !r.Allowed || r.Remaining != 0 {
+		t.Fatalf("call after refilling one token: %+v", r)
+	}
+	if r := spend(time.Hour, 1); !r.Allowed || r.Remaining != 4 {
+		t.Fatalf("call after an idle hour: %+v, want the bucket capped at five", r)
+	}
+	if r := spend(time.Hour, 6); r.Allowed || r.RetryAfter != -1 {
+		t.Fatalf("cost above capacity: %+v, want a retry of -1", r)
+	}
+
+	// The key expires once the bucket would be full again.
+	if r := spend(time.Hour, 0); r.TTL != 500*time.Millisecond {
+		t.Fatalf("TTL with one token missing = %v, want 500ms", r.TTL)
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	db := NewKeyValueStore()
+	start := fakeStart()
+	event := func(at time.Duration) RateLimitResult {
+		t.Helper()
+		result, err := db.SlidingWindow("k", 1000, 3, start.Add(at))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	event(0)
+	event(250 * time.Millisecond)
+	if r := event(500 * time.Millisecond); !r.Allowed || r.Remaining != 0 {
+		t.Fatalf("third event: %+v", r)
+	}
+	// The first event's slot leaves the window a second after it began.
+	if r := event(600 * time.Millisecond); r.Allowed || r.RetryAfter != 400 {
+		t.Fatalf("fourth event: %+v, want a retry after 400ms", r)
+	}
+	if r := event(time.Second); !r.Allowed || r.Remaining != 0 {
+		t.Fatalf("event once the first slid out: %+v", r)
+	}
+	if r := event(time.Hour); !r.Allowed || r.Remaining != 2 {
+		t.Fatalf("event after an idle hour: %+v", r)
+	}
+
+	db.SetValue("str", "not a limiter")
+	if _, err := db.SlidingWindow("str", 1000, 3, start); err != ErrRateLimitState {
+		t.Fatalf("limiting a plain string: %v", err)
+	}
+	if _, err := db.TokenBucket("k", 5, 1, 1, start); err != ErrRateLimitState {
+		t.Fatalf("a token bucket over sliding-window state: %v", err)
+	}
+}
+
+func TestTokenBucketConcurrent(t *testing.T) {
+	db := NewKeyValueStore()
+	now := time.Now()
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if r, _ := db.TokenBucket("k", 100, 1, 1, now); r.Allowed {
+					allowed.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if got := allowed.Load(); got != 100 {
+		t.Fatalf("%d calls allowed from a bucket of 100", got)
+	}
+}
+
+// TestRateLimitReplication checks that a replica and a reloaded dump end
+// up with the master's exact state, which depends on the master's clock.
+func TestRateLimitReplication(t *testing.T) {
+	master := startServer(t, nil)
+	replica := startReplica(t, master)
+	mc, rc := dial(t, master), dial(t, replica)
+	for i := 0; i < 3; i++ {
+		mc.do("RL.LIMIT", "bucket", "10", "1", "2")
+		mc.do("RL.SLIDING", "window", "60000", "10")
+	}
+	for _, key := range []string{"bucket", "window"} {
+		want := mc.do("GET", key)
+		eventually(t, "the replica to apply "+key, func() bool { return sameReply(rc.do("GET", key), want) })
+	}
+	expectReply(t, mc.do("RL.LIMIT", "bucket", "10", "0.001", "4"), NewArray([]RESP{NewInteger(1), NewInteger(0), NewInteger(0)}))
+
+	expectReply(t, mc.do("SAVE"), NewSimpleString("OK"))
+	loaded := newServer(1)
+	if err := ParseRDB(master.rdbPath(), loaded.dbs); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"bucket", "window"} {
+		got, _ := loaded.dbs.DB(0).Get(key)
+		if want, _ := master.dbs.DB(0).Get(key); got != want {
+			t.Fatalf("%s reloaded as %x, want %x", key, got, want)
+		}
+	}
+	if r, _ := loaded.dbs.DB(0).TokenBucket("bucket", 10, 0.001, 1, time.Now()); r.Allowed {
+		t.Fatalf("the reloaded bucket still had tokens: %+v", r)
+	}
+}
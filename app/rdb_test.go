@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// roundTrip writes db to an RDB and reads it back as database 0.
+func roundTrip(t *testing.T, db *KeyValueStore) *KeyValueStore {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := WriteRDB(&buf, [][]SnapshotEntry{db.Snapshot()}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	stores, err := readRDB(NewRDBReader(&buf), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stores[0]
+}
+
+func TestRDBStreamRoundTrip(t *testing.T) {
+	db := NewKeyValueStore()
+	// Enough entries for several listpacks, with IDs past 32 bits, field
+	// sets that change between entries and values that look like integers.
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli()
+	for i := 0; i < 250; i++ {
+		entry := Entry{ID: fmt.Sprintf("%d-%d", base+int64(i/3), i%3)}
+		entry.Fields = []FieldValue{{"n", strconv.Itoa(i * 1000)}, {"name", "entry " + strconv.Itoa(i)}}
+		if i%7 == 0 {
+			entry.Fields = append(entry.Fields, FieldValue{"extra", "-5000"})
+		}
+		if i%11 == 0 {
+			entry.Fields = []FieldValue{{"other", strconv.FormatInt(math.MinInt64, 10)}}
+		}
+		if _, err := db.AppendToStream("s", entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.XTrim("s", 240); err != nil {
+		t.Fatal(err)
+	}
+	db.SetValue("empty", &Stream{Entries: []Entry{}, LastID: "5-3"})
+	db.SetWithExpiry("expiring", &Stream{Entries: []Entry{{ID: "1-1", Fields: []FieldValue{{"f", "v"}}, ms: 1, seq: 1}}, LastID: "1-1"}, time.Hour)
+
+	loaded := roundTrip(t, db)
+	for _, key := range []string{"s", "empty", "expiring"} {
+		want, _ := db.GetStream(key)
+		got, ok := loaded.GetStream(key)
+		if !ok {
+			t.Fatalf("stream %s was not loaded", key)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("stream %s loaded as %+v, want %+v", key, got, want)
+		}
+	}
+	if _, ttl, _ := loaded.Object("expiring"); ttl <= 0 || ttl > time.Hour {
+		t.Fatalf("expiring stream loaded with TTL %v", ttl)
+	}
+	if got := loaded.Count(); got != 3 {
+		t.Fatalf("loaded %d keys, want 3", got)
+	}
+}
+
+func TestRDBUnknownTypeFails(t *testing.T) {
+	entries := []SnapshotEntry{{Key: "k", Value: 42}}
+	var buf bytes.Buffer
+	if err := WriteRDB(&buf, [][]SnapshotEntry{entries}, time.Now()); err == nil {
+		t.Fatal("writing a value without an RDB encoding succeeded")
+	}
+}
+
+func TestListpackRoundTrip(t *testing.T) {
+	values := []string{
+		"", "a", "0", "127", "128", "-1", "4095", "4096", "-4096", "-4097",
+		"32767", "-32768", "32768", "8388607", "-8388608", "8388608",
+		"2147483647", "-2147483648", "2147483648",
+		strconv.FormatInt(math.MaxInt64, 10), strconv.FormatInt(math.MinInt64, 10),
+		"9223372036854775808", "007", "+1", "1.5",
+		string(bytes.Repeat([]byte("x"), 63)), string(bytes.Repeat([]byte("x"), 64)),
+		string(bytes.Repeat([]byte("x"), 4095)), string(bytes.Repeat([]byte("x"), 4096)),
+		string(bytes.Repeat([]byte("x"), 16377)), string(bytes.Repeat([]byte("x"), 16378)),
+		string(bytes.Repeat([]byte("x"), 20000)),
+	}
+	lp := newListpackBuilder()
+	for _, v := range values {
+		lp.appendString(v)
+	}
+	got, err := listpackElements(lp.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, values) {
+		t.Fatalf("listpack decoded as %q, want %q", got, values)
+	}
+}
+
+// redisDump assembles a dump the way Redis 7.2 lays one out: header, aux
+// fields, database 0 and the given key/value records, then the EOF opcode
+// and the CRC64 of everything before it.
+func redisDump(records ...string) []byte {
+	dump := "REDIS0011" +
+		"\xfa\x09redis-ver\x057.2.0" +
+		"\xfa\x0aredis-bits\xc0\x40" +
+		"\xfe\x00\xfb" + string(byte(len(records))) + "\x00" +
+		strings.Join(records, "") + "\xff"
+	return binary.LittleEndian.AppendUint64([]byte(dump), crc64Jones(0, []byte(dump)))
+}
+
+// TestRDBRedisEncodings loads records in the encodings Redis writes for
+// lists, sets and hashes. The plain encodings load; the compact ones are
+// skipped without failing the rest of the file.
+func TestRDBRedisEncodings(t *testing.T) {
+	dump := redisDump(
+		"\x00\x03str\x05value",
+		"\x00\x03int\xc0\x7b",
+		"\x01\x04list\x03\x01a\x01b\x01c",
+		"\x02\x03set\x02\x01x\x01y",
+		"\x04\x04hash\x02\x01f\x01v\x02f2\x02v2",
+		"\xfc\x01\x00\x00\x00\x00\x00\x00\x00\x01\x07expired\x01\x01a",
+		// An intset of 1 and 2, a listpack hash and a one-node quicklist.
+		"\x0b\x06intset\x0c\x02\x00\x00\x00\x02\x00\x00\x00\x01\x00\x02\x00",
+		"\x10\x06lphash\x0d\x0d\x00\x00\x00\x02\x00\x81f\x02\x81v\x02\xff",
+		"\x12\x09quicklist\x01\x02\x0a\x0a\x00\x00\x00\x01\x00\x81a\x02\xff",
+	)
+	stores, err := readRDB(NewRDBReader(bytes.NewReader(dump)), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := stores[0]
+	ctx := func(args ...string) *CommandContext { return testContext(db, args...) }
+
+	if value, _ := db.Get("str"); value != "value" {
+		t.Fatalf("str = %q", value)
+	}
+	if value, _ := db.Get("int"); value != "123" {
+		t.Fatalf("int = %q", value)
+	}
+	reply, _ := lrangeCommand(ctx("list", "0", "-1"))
+	expectReply(t, reply, NewArray([]RESP{NewBulkString("a"), NewBulkString("b"), NewBulkString("c")}))
+	reply, _ = smembersCommand(ctx("set"))
+	if len(reply.Array) != 2 {
+		t.Fatalf("set holds %q", reply.Marshal())
+	}
+	for field, want := range map[string]string{"f": "v", "f2": "v2"} {
+		reply, _ = hgetCommand(ctx("hash", field))
+		expectReply(t, reply, NewBulkString(want))
+	}
+	// The key that lapsed 1ms into 1970 does not count.
+	if got := db.Count(); got != 5 {
+		t.Fatalf("loaded %d keys, want the 5 in plain encodings", got)
+	}
+}
+
+// fixtureRDB returns a dump of a few keys of several types, one with a TTL.
+func fixtureRDB(t *testing.T) []byte {
+	t.Helper()
+	db := NewKeyValueStore()
+	db.SetValue("str", "value")
+	db.SetWithExpiry("ttl", "value", time.Hour)
+	db.Push("list", []string{"a", "b", "c"}, false)
+	db.SAdd("set", []string{"x", "y"})
+	db.HSet("hash", []string{"f", "v"})
+	db.AppendToStream("stream", Entry{ID: "1-1", Fields: []FieldValue{{"f", "v"}}})
+	var buf bytes.Buffer
+	if err := WriteRDB(&buf, [][]SnapshotEntry{db.Snapshot()}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRDBCorruptFixtures(t *testing.T) {
+	valid := fixtureRDB(t)
+	if _, err := readRDB(NewRDBReader(bytes.NewReader(valid)), 1); err != nil {
+		t.Fatalf("the valid fixture fails to load: %v", err)
+	}
+
+	// Every truncation fails, whether it cuts a header, a key, a value or
+	// the checksum.
+	for n := 0; n < len(valid); n++ {
+		if _, err := readRDB(NewRDBReader(bytes.NewReader(valid[:n])), 1); err == nil {
+			t.Fatalf("a dump truncated to %d of %d bytes loaded", n, len(valid))
+		}
+	}
+
+	// Flipping any bit of the body breaks the checksum if not the parse.
+	for i := 9; i < len(valid)-8; i++ {
+		corrupt := bytes.Clone(valid)
+		corrupt[i] ^= 0x20
+		if _, err := readRDB(NewRDBReader(bytes.NewReader(corrupt)), 1); err == nil {
+			t.Fatalf("a dump with byte %d flipped loaded", i)
+		}
+	}
+
+	badSum := bytes.Clone(valid)
+	badSum[len(badSum)-1] ^= 0xff
+	_, err := readRDB(NewRDBReader(bytes.NewReader(badSum)), 1)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("a bad checksum loaded with error %v, want a checksum mismatch", err)
+	}
+
+	// A string length promising gigabytes fails on the missing bytes
+	// without allocating them first.
+	huge := append([]byte("REDIS0011"), RDB_TYPE_STRING, 1, 'k', 0x80, 0xff, 0xff, 0xff, 0xff, 'v')
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = readRDB(NewRDBReader(bytes.NewReader(huge)), 1)
+	runtime.ReadMemStats(&after)
+	if err == nil {
+		t.Fatal("a string longer than the dump loaded")
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > maxHeaderAlloc {
+		t.Fatalf("a 4GB string header allocated %d bytes", allocated)
+	}
+
+	// A zero checksum means the writer had checksums disabled.
+	noSum := bytes.Clone(valid)
+	clear(noSum[len(noSum)-8:])
+	if _, err := readRDB(NewRDBReader(bytes.NewReader(noSum)), 1); err != nil {
+		t.Fatalf("a dump without a checksum failed to load: %v", err)
+	}
+}
+
+// TestSyncPayload checks the snapshot a master sends on full resync: it
+// carries the running server's version and a current ctime, its checksum
+// covers every byte, and a replica loads it.
+func TestSyncPayload(t *testing.T) {
+	master := startServer(t, nil)
+	mc := dial(t, master)
+	expectReply(t, mc.do("SET", "k", "v"), NewSimpleString("OK"))
+	expectReply(t, mc.do("RPUSH", "list", "a", "b"), NewInteger(2))
+	payload := fullSync(t, dial(t, master))
+
+	if want := fmt.Sprintf("REDIS%04d", rdbVersion); string(payload[:9]) != want {
+		t.Fatalf("payload starts %q, want %q", payload[:9], want)
+	}
+	aux := make(map[string]string)
+	reader := NewRDBReader(bytes.NewReader(payload[9:]))
+	for {
+		if next, err := reader.Peek(1); err != nil || next[0] != RDB_OPCODE_AUX {
+			break
+		}
+		reader.ReadByte()
+		key, err := readString(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := readString(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aux[key] = value
+	}
+	if aux["redis-ver"] != ServerVersion {
+		t.Fatalf("redis-ver is %q, want %q", aux["redis-ver"], ServerVersion)
+	}
+	ctime, err := strconv.ParseInt(aux["ctime"], 10, 64)
+	if err != nil || time.Since(time.Unix(ctime, 0)) > time.Minute {
+		t.Fatalf("ctime is %q, want about now", aux["ctime"])
+	}
+
+	body := payload[:len(payload)-8]
+	if sum := binary.LittleEndian.Uint64(payload[len(body):]); sum != crc64Jones(0, body) {
+		t.Fatalf("checksum %016x, want %016x", sum, crc64Jones(0, body))
+	}
+	corrupt := slices.Clone(payload)
+	corrupt[len(body)/2] ^= 0x20
+	if _, err := readRDB(NewRDBReader(bytes.NewReader(corrupt)), 16); err == nil {
+		t.Fatal("a corrupted payload loaded")
+	}
+
+	replica := startServer(t, nil)
+	if err := replica.loadMasterRDB(payload); err != nil {
+		t.Fatal(err)
+	}
+	rc := dial(t, replica)
+	expectReply(t, rc.do("GET", "k"), NewBulkString("v"))
+	expectReply(t, rc.do("LRANGE", "list", "0", "-1"), NewArray([]RESP{NewBulkString("a"), NewBulkString("b")}))
+}
+
+func TestParseRDBCorruptLeavesData(t *testing.T) {
+	valid := fixtureRDB(t)
+	dir := t.TempDir()
+	for name, data := range map[string][]byte{
+		"truncated.rdb":    valid[:len(valid)/2],
+		"bad-checksum.rdb": append(bytes.Clone(valid[:len(valid)-8]), 1, 2, 3, 4, 5, 6, 7, 8),
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			s := newServer(1)
+			s.dbs.DB(0).SetValue("existing", "kept")
+			if err := ParseRDB(path, s.dbs); err == nil {
+				t.Fatal("the corrupt dump loaded")
+			}
+			if got := s.dbs.DB(0).Count(); got != 1 {
+				t.Fatalf("database holds %d keys after a failed load, want only the existing one", got)
+			}
+			if value, _ := s.dbs.DB(0).Get("existing"); value != "kept" {
+				t.Fatalf("existing = %q after a failed load", value)
+			}
+		})
+	}
+}
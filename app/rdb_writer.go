@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"math"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// rdbVersion is the RDB format version this server writes.
+const rdbVersion = 11
+
+// crc64JonesTable is the reflected CRC-64/Jones table Redis uses for the RDB trailer.
+var crc64JonesTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// crc64Jones extends crc over p. Redis runs the CRC with no initial or final
+// inversion, so the inversions hash/crc64 applies are undone on both sides.
+func crc64Jones(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, crc64JonesTable, p)
+}
+
+// RDBWriter encodes an RDB stream and keeps the running checksum that the
+// EOF trailer carries. The first write error sticks and is returned by End.
+type RDBWriter struct {
+	w   io.Writer
+	crc uint64
+	err error
+}
+
+// NewRDBWriter creates a writer that encodes onto w.
+func NewRDBWriter(w io.Writer) *RDBWriter {
+	return &RDBWriter{w: w}
+}
+
+// write emits raw bytes and folds them into the checksum.
+func (rw *RDBWriter) write(p []byte) {
+	if rw.err != nil {
+		return
+	}
+	rw.crc = crc64Jones(rw.crc, p)
+	_, rw.err = rw.w.Write(p)
+}
+
+// WriteHeader writes the magic string and format version.
+func (rw *RDBWriter) WriteHeader() {
+	rw.write([]byte(fmt.Sprintf("REDIS%04d", rdbVersion)))
+}
+
+// WriteAux writes an auxiliary metadata field.
+func (rw *RDBWriter) WriteAux(key, value string) {
+	rw.write([]byte{RDB_OPCODE_AUX})
+	rw.writeString(key)
+	rw.writeString(value)
+}
+
+// WriteAuxInt writes an auxiliary field whose value is an integer.
+func (rw *RDBWriter) WriteAuxInt(key string, value int64) {
+	rw.write([]byte{RDB_OPCODE_AUX})
+	rw.writeString(key)
+	rw.writeIntString(value)
+}
+
+// WriteSelectDB starts the section for a database.
+func (rw *RDBWriter) WriteSelectDB(index int) {
+	rw.write([]byte{RDB_OPCODE_SELECTDB})
+	rw.writeLength(uint64(index))
+}
+
+// WriteResizeDB writes the key and expiry counts that let a loader presize its tables.
+func (rw *RDBWriter) WriteResizeDB(keys, expires int) {
+	rw.write([]byte{RDB_OPCODE_RESIZEDB})
+	rw.writeLength(uint64(keys))
+	rw.writeLength(uint64(expires))
+}
+
+// Stream item flags, as Redis stores them in a stream listpack entry.
+const (
+	streamItemDeleted    = 1
+	streamItemSameFields = 2
+)
+
+// streamNodeEntries is how many entries a stream listpack holds at most,
+// Redis's default stream-node-max-entries.
+const streamNodeEntries = 100
+
+// WriteKey writes one key, preceded by its expiry when it has one. Sets,
+// hashes, lists and sorted sets use the plain encodings and streams
+// RDB_TYPE_STREAM_LISTPACKS. A value of any other type has no encoding; it
+// fails the write, so a dump never silently loses keys.
+func (rw *RDBWriter) WriteKey(entry SnapshotEntry) {
+	switch entry.Value.(type) {
+	case string, Set, Hash, *List, *ZSet, *Stream:
+	default:
+		if rw.err == nil {
+			rw.err = fmt.Errorf("no RDB encoding for key %q of type %T", entry.Key, entry.Value)
+		}
+		return
+	}
+	if !entry.Expiry.IsZero() {
+		buf := make([]byte, 9)
+		buf[0] = RDB_OPCODE_EXPIRETIMEMS
+		binary.LittleEndian.PutUint64(buf[1:], uint64(entry.Expiry.UnixMilli()))
+		rw.write(buf)
+	}
+
+	switch entry.Value.(type) {
+	case string:
+		rw.write([]byte{RDB_TYPE_STRING})
+	case Set:
+		rw.write([]byte{RDB_TYPE_SET})
+	case Hash:
+		rw.write([]byte{RDB_TYPE_HASH})
+	case *List:
+		rw.write([]byte{RDB_TYPE_LIST})
+	case *ZSet:
+		rw.write([]byte{RDB_TYPE_ZSET_2})
+	case *Stream:
+		rw.write([]byte{RDB_TYPE_STREAM_LISTPACKS})
+	}
+	rw.writeString(entry.Key)
+	rw.writeValue(entry.Value)
+}
+
+// writeValue writes the body of a string, set, hash, list, sorted set or
+// stream, after its type byte and key. Scores are binary doubles, as in
+// RDB_TYPE_ZSET_2.
+func (rw *RDBWriter) writeValue(value interface{}) {
+	switch v := value.(type) {
+	case string:
+		rw.writeString(v)
+	case Set:
+		rw.writeLength(uint64(len(v)))
+		for member := range v {
+			rw.writeString(member)
+		}
+	case Hash:
+		rw.writeLength(uint64(len(v)))
+		for field, val := range v {
+			rw.writeString(field)
+			rw.writeString(val)
+		}
+	case *List:
+		rw.writeLength(uint64(v.Len()))
+		for _, element := range v.Elements() {
+			rw.writeString(element)
+		}
+	case *ZSet:
+		rw.writeLength(uint64(v.Len()))
+		score := make([]byte, 8)
+		for _, m := range v.Members() {
+			rw.writeString(m.Member)
+			binary.LittleEndian.PutUint64(score, math.Float64bits(m.Score))
+			rw.write(score)
+		}
+	case *Stream:
+		rw.writeStream(v)
+	}
+}
+
+// writeStream writes the body of a stream as RDB_TYPE_STREAM_LISTPACKS: its
+// entries in listpacks of up to streamNodeEntries, each keyed by the ID of
+// its first entry, then the entry count, the last ID and no consumer groups.
+func (rw *RDBWriter) writeStream(stream *Stream) {
+	entries := stream.Entries
+	rw.writeLength(uint64((len(entries) + streamNodeEntries - 1) / streamNodeEntries))
+	for start := 0; start < len(entries); start += streamNodeEntries {
+		node := entries[start:min(start+streamNodeEntries, len(entries))]
+		key := make([]byte, 16)
+		binary.BigEndian.PutUint64(key, uint64(node[0].ms))
+		binary.BigEndian.PutUint64(key[8:], uint64(node[0].seq))
+		rw.writeString(string(key))
+		rw.writeString(string(streamListpack(node)))
+	}
+
+	rw.writeLength(uint64(len(entries)))
+	lastID := stream.LastID
+	if lastID == "" && len(entries) > 0 {
+		lastID = entries[len(entries)-1].ID
+	}
+	lastMs, lastSeq, err := splitStreamID(lastID)
+	if err != nil {
+		lastMs, lastSeq = 0, 0
+	}
+	rw.writeLength(uint64(lastMs))
+	rw.writeLength(uint64(lastSeq))
+	rw.writeLength(0)
+}
+
+// streamListpack encodes one node of stream entries the way Redis lays out
+// a stream listpack; see appendStreamNode. The first entry's fields are the
+// master fields, and entries with the same field names store values only.
+func streamListpack(node []Entry) []byte {
+	master := node[0]
+	lp := newListpackBuilder()
+	lp.appendInt(int64(len(node)))
+	lp.appendInt(0)
+	lp.appendInt(int64(len(master.Fields)))
+	for _, fv := range master.Fields {
+		lp.appendString(fv.Field)
+	}
+	lp.appendInt(0)
+
+	for _, entry := range node {
+		same := sameFieldNames(entry.Fields, master.Fields)
+		flags := int64(0)
+		if same {
+			flags = streamItemSameFields
+		}
+		lp.appendInt(flags)
+		lp.appendInt(entry.ms - master.ms)
+		lp.appendInt(entry.seq - master.seq)
+		count := int64(3 + len(entry.Fields))
+		if same {
+			for _, fv := range entry.Fields {
+				lp.appendString(fv.Value)
+			}
+		} else {
+			lp.appendInt(int64(len(entry.Fields)))
+			for _, fv := range entry.Fields {
+				lp.appendString(fv.Field)
+				lp.appendString(fv.Value)
+			}
+			count += int64(len(entry.Fields)) + 1
+		}
+		lp.appendInt(count)
+	}
+	return lp.bytes()
+}
+
+// sameFieldNames reports whether a and b name the same fields in the same order.
+func sameFieldNames(a, b []FieldValue) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Field != b[i].Field {
+			return false
+		}
+	}
+	return true
+}
+
+// serializedLength returns how many bytes value takes in a dump, not counting
+// its key, as DEBUG OBJECT reports.
+func serializedLength(value interface{}) int {
+	var counter byteCounter
+	rw := NewRDBWriter(&counter)
+	rw.writeValue(value)
+	return int(counter)
+}
+
+// byteCounter is an io.Writer that only counts what is written to it.
+type byteCounter int
+
+// Write counts p.
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// End writes the EOF opcode and the checksum of everything before it.
+func (rw *RDBWriter) End() error {
+	rw.write([]byte{RDB_OPCODE_EOF})
+	trailer := make([]byte, 8)
+	binary.LittleEndian.PutUint64(trailer, rw.crc)
+	rw.write(trailer)
+	return rw.err
+}
+
+// writeLength writes a length using the 6, 14, 32 or 64 bit encodings readLength understands.
+func (rw *RDBWriter) writeLength(n uint64) {
+	switch {
+	case n < 1<<6:
+		rw.write([]byte{byte(n)})
+	case n < 1<<14:
+		rw.write([]byte{0x40 | byte(n>>8), byte(n)})
+	case n <= math.MaxUint32:
+		buf := make([]byte, 5)
+		buf[0] = 0x80
+		binary.BigEndian.PutUint32(buf[1:], uint32(n))
+		rw.write(buf)
+	default:
+		buf := make([]byte, 9)
+		buf[0] = 0x81
+		binary.BigEndian.PutUint64(buf[1:], n)
+		rw.write(buf)
+	}
+}
+
+// writeString writes a length-prefixed string.
+func (rw *RDBWriter) writeString(s string) {
+	rw.writeLength(uint64(len(s)))
+	rw.write([]byte(s))
+}
+
+// writeIntString writes value with the compact integer string encoding, or as
+// plain text when it does not fit in 32 bits.
+func (rw *RDBWriter) writeIntString(value int64) {
+	switch {
+	case value >= math.MinInt8 && value <= math.MaxInt8:
+		rw.write([]byte{0xc0, byte(int8(value))})
+	case value >= math.MinInt16 && value <= math.MaxInt16:
+		buf := []byte{0xc1, 0, 0}
+		binary.LittleEndian.PutUint16(buf[1:], uint16(int16(value)))
+		rw.write(buf)
+	case value >= math.MinInt32 && value <= math.MaxInt32:
+		buf := []byte{0xc2, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(buf[1:], uint32(int32(value)))
+		rw.write(buf)
+	default:
+		rw.writeString(strconv.FormatInt(value, 10))
+	}
+}
+
+// WriteRDB writes a snapshot of dbs, indexed by database, with the server's
+// aux fields.
+func WriteRDB(w io.Writer, dbs [][]SnapshotEntry, now time.Time) error {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	rw := NewRDBWriter(w)
+	rw.WriteHeader()
+	rw.WriteAux("redis-ver", ServerVersion)
+	rw.WriteAuxInt("redis-bits", strconv.IntSize)
+	rw.WriteAuxInt("ctime", now.Unix())
+	rw.WriteAuxInt("used-mem", int64(mem.HeapAlloc))
+	rw.WriteAuxInt("aof-base", 0)
+
+	for index, entries := range dbs {
+		if len(entries) == 0 {
+			continue
+		}
+		expires := 0
+		for _, entry := range entries {
+			if !entry.Expiry.IsZero() {
+				expires++
+			}
+		}
+		rw.WriteSelectDB(index)
+		rw.WriteResizeDB(len(entries), expires)
+		for _, entry := range entries {
+			rw.WriteKey(entry)
+		}
+	}
+	return rw.End()
+}
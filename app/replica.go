@@ -1,33 +1,267 @@
 package main
 
 import (
+    "bufio"
+    "compress/flate"
+    "errors"
+    "io"
     "math/rand"
     "net"
     "slices"
+    "strconv"
+    "strings"
     "sync"
+    "sync/atomic"
     "time"
 )
 
-// ReplicaState tracks replication progress for a connected replica.
+// ReplicaSyncState is where a replica is in its initial synchronization.
+type ReplicaSyncState int
+
+const (
+    // ReplicaWaitBgsave: PSYNC accepted, the snapshot is being produced.
+    ReplicaWaitBgsave ReplicaSyncState = iota
+    // ReplicaSendBulk: the snapshot is being streamed to the replica.
+    ReplicaSendBulk
+    // ReplicaOnline: the snapshot is loaded; the replica gets the live stream and ACKs it.
+    ReplicaOnline
+)
+
+// String returns the state name used by INFO, matching Redis.
+func (s ReplicaSyncState) String() string {
+    switch s {
+    case ReplicaWaitBgsave:
+        return "wait_bgsave"
+    case ReplicaSendBulk:
+        return "send_bulk"
+    case ReplicaOnline:
+        return "online"
+    default:
+        return "unknown"
+    }
+}
+
+// defaultReplQueueDepth bounds how many propagated writes may wait for a
+// replica's writer before the replica is considered too far behind.
+const defaultReplQueueDepth = 10000
+
+// defaultReplPingPeriod is how often, in seconds, the master PINGs its
+// replicas over the replication stream.
+const defaultReplPingPeriod = 10
+
+// defaultReplTimeout is how long, in seconds, an online replica may go
+// without acknowledging before the master disconnects it.
+const defaultReplTimeout = 60
+
+// ReplicaState tracks replication progress for a connected replica. Writes
+// are queued on out and put on the wire by the replica's own writeLoop, so
+// a slow replica never blocks the command that propagated them.
 type ReplicaState struct {
-    Conn        net.Conn
-    Offset      int64
-    LastAckTime time.Time
+    repl          *replication
+    Conn          net.Conn
+    ListeningPort int
+    Offset        int64
+    LastAckTime   time.Time
+    SyncState     ReplicaSyncState
+
+    out        chan []byte
+    started    bool
+    dropped    atomic.Bool
+    compressor *flate.Writer
+    wire       *bufio.Writer // batches stream writes into few syscalls
+    rawBytes   atomic.Int64
+    wireBytes  atomic.Int64
+}
+
+// countingWriter counts the bytes written through it to the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
 }
 
-var (
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// enqueueLocked queues stream bytes without blocking, disconnecting a
+// replica whose queue is full. Callers must hold replicaMu, which keeps
+// RemoveReplica from closing the queue underneath them.
+func (r *ReplicaState) enqueueLocked(b []byte) {
+	select {
+	case r.out <- b:
+	default:
+		if r.dropped.CompareAndSwap(false, true) {
+			logWarning("Disconnecting replica: replication queue full", "replica", r.Conn.RemoteAddr().String(), "writes", cap(r.out))
+			r.Conn.Close()
+		}
+	}
+}
+
+// writeLoop puts queued stream bytes on the wire until the queue is closed.
+// It only starts once the snapshot has been written, so writes propagated
+// during the initial sync wait in the queue and follow the snapshot.
+func (r *ReplicaState) writeLoop() {
+	for b := range r.out {
+		err := r.write(b)
+		// Write whatever else is already queued before flushing, so a
+		// batch goes out in as few writes as possible.
+		for err == nil && len(r.out) > 0 {
+			next, ok := <-r.out
+			if !ok {
+				break
+			}
+			err = r.write(next)
+		}
+		if err == nil && r.compressor != nil {
+			// Flushing keeps the replica able to decode each command as
+			// soon as it arrives instead of waiting for a full block.
+			err = r.compressor.Flush()
+		}
+		if err == nil {
+			err = r.wire.Flush()
+		}
+		if err != nil {
+			r.Conn.Close()
+			for range r.out {
+			}
+			return
+		}
+	}
+}
+
+// write sends stream bytes to the replica, compressing them when negotiated.
+func (r *ReplicaState) write(b []byte) error {
+	r.rawBytes.Add(int64(len(b)))
+	if r.compressor == nil {
+		_, err := r.wire.Write(b)
+		return err
+	}
+	_, err := r.compressor.Write(b)
+	return err
+}
+
+// AckLag returns how long ago the replica last acknowledged the stream.
+func (r *ReplicaState) AckLag(now time.Time) time.Duration {
+	r.repl.replicaMu.RLock()
+	defer r.repl.replicaMu.RUnlock()
+	return now.Sub(r.LastAckTime)
+}
+
+// Compressed reports whether the stream to this replica is compressed.
+func (r *ReplicaState) Compressed() bool {
+	return r.compressor != nil
+}
+
+// Queued returns how many writes are waiting for the replica's writer.
+func (r *ReplicaState) Queued() int {
+	return len(r.out)
+}
+
+// CompressionRatio returns raw stream bytes divided by bytes put on the wire.
+func (r *ReplicaState) CompressionRatio() float64 {
+	wire := r.wireBytes.Load()
+	if wire == 0 {
+		return 1
+	}
+	return float64(r.rawBytes.Load()) / float64(wire)
+}
+
+// replication is a server's replication state: its replicas, stream
+// offsets and backlog, and the replication IDs.
+type replication struct {
+    server *Server
+
     replicas      []*ReplicaState
     replicaMu     sync.RWMutex
+    heartbeatOnce sync.Once
     currentOffset int64
     offsetMu      sync.RWMutex
-)
+    // ackSignal is closed and replaced, under replicaMu, whenever a replica
+    // acknowledges an offset.
+    ackSignal chan struct{}
+    // backlog is created with the first replica and guarded by offsetMu,
+    // since every byte appended to it advances the offset.
+    backlog          *ReplBacklog
+    masterReplOffset int64
+
+    // streamMu keeps a SELECT next to the write it prefixes in the replication stream.
+    streamMu sync.Mutex
+    // streamDB is the database the replication stream last selected; -1
+    // makes the next write select one.
+    streamDB int
+    // snapshotMu orders writes against full-resync snapshots. Writes hold
+    // it shared from execution through propagation, and PSYNC holds it while
+    // it snapshots and registers the replica.
+    snapshotMu sync.RWMutex
+    // masterStreamDB is the database the master's replication stream had
+    // selected when the last link dropped. Only the replication goroutine uses it.
+    masterStreamDB int
+
+    idMu sync.RWMutex
+    id   string
+    id2  string
+}
+
+// newReplication returns the replication state of a server that has never
+// had a replica, under a fresh replication ID.
+func newReplication(server *Server) *replication {
+    return &replication{
+        server:    server,
+        ackSignal: make(chan struct{}),
+        streamDB:  -1,
+        id:        generateReplID(),
+        id2:       emptyReplID,
+    }
+}
+
+// emptyReplID is the placeholder secondary ID used when there is no previous history.
+const emptyReplID = "0000000000000000000000000000000000000000"
 
-var masterReplID string
-var masterReplOffset int64 = 0
+// The replication ID names a history of the dataset. Replicas may only
+// partially resync against a master whose ID (or secondary ID) matches the
+// one they last synced with, so the ID must change whenever the history
+// becomes discontinuous. Following Redis:
+//   - startup: a fresh random ID, since a dataset loaded from disk on a
+//     master has no replication stream behind it;
+//   - full resync on a replica: the replica adopts its master's ID, so its
+//     own sub-replicas share the master's history;
+//   - promotion to master: the old ID becomes the secondary ID (so former
+//     siblings can still continue) and a new ID is minted;
+//   - DEBUG CHANGE-REPL-ID: a new ID and no secondary ID, which forces every
+//     replica into a full resync;
+//   - FLUSHALL does not change the ID; the flush is part of the stream.
 
-func init() {
-    masterReplID = generateReplID()
-    _ = masterReplID
+// GetReplID returns the current primary and secondary replication IDs.
+func (rp *replication) GetReplID() (string, string) {
+    rp.idMu.RLock()
+    defer rp.idMu.RUnlock()
+    return rp.id, rp.id2
+}
+
+// adoptReplID takes over the master's replication ID after a full resync.
+func (rp *replication) adoptReplID(id string) {
+    rp.idMu.Lock()
+    defer rp.idMu.Unlock()
+    rp.id = id
+    rp.id2 = emptyReplID
+}
+
+// shiftReplID keeps the current ID as the secondary one and mints a new primary ID.
+func (rp *replication) shiftReplID() {
+    rp.idMu.Lock()
+    defer rp.idMu.Unlock()
+    rp.id2 = rp.id
+    rp.id = generateReplID()
+}
+
+// resetReplID mints a new primary ID and forgets the secondary one.
+func (rp *replication) resetReplID() {
+    rp.idMu.Lock()
+    defer rp.idMu.Unlock()
+    rp.id = generateReplID()
+    rp.id2 = emptyReplID
 }
 
 // generateReplID returns a random 40-character replication ID.
@@ -40,118 +274,386 @@ func generateReplID() string {
     return string(b)
 }
 
-// AddReplica registers a new replica connection.
-func AddReplica(conn net.Conn) {
-    replicaMu.Lock()
-    defer replicaMu.Unlock()
+// AddReplica registers a new replica connection, compressing its stream if
+// requested, and returns the master offset its stream starts at. Its queue
+// collects writes right away; its writer starts with StartReplicaStream.
+// The first replica also starts the replication heartbeat.
+func (rp *replication) AddReplica(conn net.Conn, listeningPort int, compress bool) int64 {
+    rp.heartbeatOnce.Do(func() { go rp.runReplicationHeartbeat() })
+    rp.replicaMu.Lock()
+    defer rp.replicaMu.Unlock()
 
-    for _, r := range replicas {
+    offset := rp.ensureReplBacklog()
+    for _, r := range rp.replicas {
         if r.Conn == conn {
-            return
+            return offset
         }
     }
+    rp.replicas = append(rp.replicas, rp.newReplicaState(conn, listeningPort, compress))
+    return offset
+}
+
+// ResumeReplica registers a replica that asked to continue the stream from
+// offset, queueing the bytes it missed ahead of any new writes. It reports
+// false, registering nothing, when the backlog no longer covers offset.
+func (rp *replication) ResumeReplica(conn net.Conn, listeningPort int, compress bool, offset int64) bool {
+    rp.heartbeatOnce.Do(func() { go rp.runReplicationHeartbeat() })
+    rp.replicaMu.Lock()
+    defer rp.replicaMu.Unlock()
+
+    rp.ensureReplBacklog()
+    rp.offsetMu.RLock()
+    missing, ok := rp.backlog.Since(offset)
+    rp.offsetMu.RUnlock()
+    if !ok {
+        return false
+    }
+    replica := rp.newReplicaState(conn, listeningPort, compress)
+    replica.Offset = offset - 1
+    if len(missing) > 0 {
+        replica.out <- missing
+    }
+    rp.replicas = append(rp.replicas, replica)
+    return true
+}
+
+// ensureReplBacklog creates the backlog if this is the first replica and
+// returns the master offset.
+func (rp *replication) ensureReplBacklog() int64 {
+    rp.offsetMu.Lock()
+    defer rp.offsetMu.Unlock()
+    if rp.backlog == nil {
+        rp.backlog = NewReplBacklog(rp.server.Config().ReplBacklogSize, rp.masterReplOffset)
+    }
+    return rp.masterReplOffset
+}
 
-    replicas = append(replicas, &ReplicaState{
-        Conn:        conn,
-        Offset:      0,
-        LastAckTime: time.Now(),
-    })
+// ResizeReplBacklog changes the backlog size, keeping the most recent history.
+func (rp *replication) ResizeReplBacklog(size int) {
+    rp.offsetMu.Lock()
+    defer rp.offsetMu.Unlock()
+    if rp.backlog != nil {
+        rp.backlog = rp.backlog.Resize(size)
+    }
+}
+
+// ReplBacklogInfo returns the backlog's size, the offset of its oldest byte
+// and how many bytes it holds. The bool is false until a replica has
+// attached and the backlog exists.
+func (rp *replication) ReplBacklogInfo() (int, int64, int, bool) {
+    rp.offsetMu.RLock()
+    defer rp.offsetMu.RUnlock()
+    if rp.backlog == nil {
+        return 0, 0, 0, false
+    }
+    return rp.backlog.Size(), rp.backlog.FirstOffset(), rp.backlog.HistLen(), true
+}
+
+// newReplicaState builds the state for a replica connection.
+func (rp *replication) newReplicaState(conn net.Conn, listeningPort int, compress bool) *ReplicaState {
+    depth := rp.server.Config().ReplQueueDepth
+    if depth < 1 {
+        depth = defaultReplQueueDepth
+    }
+    replica := &ReplicaState{
+        repl:          rp,
+        Conn:          conn,
+        ListeningPort: listeningPort,
+        Offset:        0,
+        LastAckTime:   time.Now(),
+        out:           make(chan []byte, depth),
+    }
+    replica.wire = bufio.NewWriterSize(countingWriter{w: conn, n: &replica.wireBytes}, writeBufferSize)
+    if compress {
+        replica.compressor, _ = flate.NewWriter(replica.wire, flate.BestSpeed)
+    }
+    return replica
 }
 
 // RemoveReplica removes a replica connection.
-func RemoveReplica(conn net.Conn) {
-    replicaMu.Lock()
-    defer replicaMu.Unlock()
-    for i, r := range replicas {
+func (rp *replication) RemoveReplica(conn net.Conn) {
+    failpoint(fpBeforeRemoveReplica)
+    rp.replicaMu.Lock()
+    defer rp.replicaMu.Unlock()
+    for i, r := range rp.replicas {
         if r.Conn == conn {
-            replicas = slices.Delete(replicas, i, i+1)
+            rp.replicas = slices.Delete(rp.replicas, i, i+1)
+            close(r.out)
             break
         }
     }
 }
 
-// UpdateReplicaOffset records the latest acknowledged offset for a replica.
-func UpdateReplicaOffset(conn net.Conn, offset int64) {
-    replicaMu.Lock()
-    defer replicaMu.Unlock()
-    for _, r := range replicas {
+// UpdateReplicaOffset records the latest acknowledged offset for a replica
+// and wakes every WAIT.
+func (rp *replication) UpdateReplicaOffset(conn net.Conn, offset int64) {
+    rp.replicaMu.Lock()
+    defer rp.replicaMu.Unlock()
+    for _, r := range rp.replicas {
         if r.Conn == conn {
             r.Offset = offset
             r.LastAckTime = time.Now()
+            close(rp.ackSignal)
+            rp.ackSignal = make(chan struct{})
             break
         }
     }
 }
 
+// serveReplicaLink reads a replica's connection once its initial sync is
+// done. The replica only sends REPLCONF ACK <offset> there, so everything
+// else is skipped, and nothing is ever written back on this path.
+func (rp *replication) serveReplicaLink(conn net.Conn, reader *bufio.Reader) {
+    for {
+        respObj, err := ParseLimit(reader, rp.server.Config().ProtoMaxBulkLen)
+        if err != nil {
+            var protoErr *ProtocolError
+            if !errors.As(err, &protoErr) || protoErr.Fatal || Resync(reader, protoErr) != nil {
+                return
+            }
+            continue
+        }
+
+        args := respObj.Array
+        if respObj.Type != Array || len(args) < 3 ||
+            !strings.EqualFold(args[0].String, "REPLCONF") || !strings.EqualFold(args[1].String, "ACK") {
+            continue
+        }
+        offset, err := strconv.ParseInt(args[2].String, 10, 64)
+        if err != nil {
+            continue
+        }
+        rp.UpdateReplicaOffset(conn, offset)
+    }
+}
+
+// DisconnectReplicas closes every replica connection. Each one is
+// unregistered by its handler as the connection ends.
+func (rp *replication) DisconnectReplicas() {
+    rp.replicaMu.RLock()
+    defer rp.replicaMu.RUnlock()
+    for _, r := range rp.replicas {
+        r.Conn.Close()
+    }
+}
+
+// promoteToMaster makes a former replica's stream position its master
+// offset and moves to a new replication ID, keeping the old one as the
+// secondary ID. The backlog from any earlier time as master no longer
+// matches the offset, so it is dropped and recreated with the next replica.
+func (rp *replication) promoteToMaster() {
+    rp.shiftReplID()
+    rp.offsetMu.Lock()
+    defer rp.offsetMu.Unlock()
+    rp.masterReplOffset = rp.currentOffset
+    rp.backlog = nil
+}
+
 // GetReplicaCount returns the number of connected replicas.
-func GetReplicaCount() int {
-    replicaMu.RLock()
-    defer replicaMu.RUnlock()
-    return len(replicas)
+func (rp *replication) GetReplicaCount() int {
+    rp.replicaMu.RLock()
+    defer rp.replicaMu.RUnlock()
+    return len(rp.replicas)
+}
+
+// SetReplicaSyncState moves a replica to the given synchronization state.
+func (rp *replication) SetReplicaSyncState(conn net.Conn, state ReplicaSyncState) {
+    rp.replicaMu.Lock()
+    defer rp.replicaMu.Unlock()
+    for _, r := range rp.replicas {
+        if r.Conn == conn {
+            r.SyncState = state
+            break
+        }
+    }
+}
+
+// StartReplicaStream marks a replica online once its snapshot has been
+// written and starts its writer, which first sends the writes propagated in
+// the meantime.
+func (rp *replication) StartReplicaStream(conn net.Conn) {
+    rp.replicaMu.Lock()
+    defer rp.replicaMu.Unlock()
+    for _, r := range rp.replicas {
+        if r.Conn == conn {
+            r.SyncState = ReplicaOnline
+            // The timeout counts from the end of the initial sync, however
+            // long the snapshot took to transfer.
+            r.LastAckTime = time.Now()
+            if !r.started {
+                r.started = true
+                go r.writeLoop()
+            }
+            return
+        }
+    }
+}
+
+// sendToReplicas queues replication stream bytes for every replica and
+// advances the master offset by their size. Both happen under replicaMu, so
+// a replica registering concurrently either gets the bytes or starts at an
+// offset that excludes them, and a resuming replica gets each byte exactly
+// once, from the backlog or from its queue.
+func (rp *replication) sendToReplicas(b []byte) {
+    failpoint(fpBeforeReplicaSend)
+    rp.replicaMu.RLock()
+    defer rp.replicaMu.RUnlock()
+    rp.appendToStream(b)
+    for _, r := range rp.replicas {
+        r.enqueueLocked(b)
+    }
+}
+
+// runReplicationHeartbeat PINGs the replicas over the replication stream
+// every repl-ping-replica-period seconds and disconnects online replicas
+// that have not acknowledged within repl-timeout seconds. The PINGs count
+// toward the master offset like any other stream bytes, and give replicas
+// traffic to measure the link by while no writes arrive. It stops when the
+// server shuts down.
+func (rp *replication) runReplicationHeartbeat() {
+    pingCmd := NewArray([]RESP{NewBulkString("PING")})
+    ping := pingCmd.MarshalBytes()
+    ticker := time.NewTicker(time.Second)
+    defer ticker.Stop()
+    done := rp.server.shutdown.Context().Done()
+    // Counting ticks rather than comparing times keeps ticker jitter from
+    // skipping a PING.
+    sinceLastPing := 0
+    for {
+        var now time.Time
+        select {
+        case now = <-ticker.C:
+        case <-done:
+            return
+        }
+        if rp.GetReplicaCount() == 0 {
+            continue
+        }
+        cfg := rp.server.Config()
+        sinceLastPing++
+        if sinceLastPing >= cfg.ReplPingPeriod {
+            sinceLastPing = 0
+            rp.sendToReplicas(ping)
+        }
+        rp.dropStaleReplicas(now, time.Duration(cfg.ReplTimeout)*time.Second)
+    }
+}
+
+// dropStaleReplicas closes the connection of every online replica whose
+// last ACK is older than timeout. Its handler then unregisters it.
+func (rp *replication) dropStaleReplicas(now time.Time, timeout time.Duration) {
+    rp.replicaMu.RLock()
+    defer rp.replicaMu.RUnlock()
+    for _, r := range rp.replicas {
+        if r.SyncState != ReplicaOnline || now.Sub(r.LastAckTime) <= timeout {
+            continue
+        }
+        if r.dropped.CompareAndSwap(false, true) {
+            logWarning("Disconnecting replica: no ACK", "replica", r.Conn.RemoteAddr().String(), "for", now.Sub(r.LastAckTime).Truncate(time.Second))
+            r.Conn.Close()
+        }
+    }
+}
+
+// GetReplicaSyncStateCounts returns how many replicas are in each synchronization state.
+func (rp *replication) GetReplicaSyncStateCounts() map[ReplicaSyncState]int {
+    rp.replicaMu.RLock()
+    defer rp.replicaMu.RUnlock()
+    counts := make(map[ReplicaSyncState]int)
+    for _, r := range rp.replicas {
+        counts[r.SyncState]++
+    }
+    return counts
+}
+
+// GetOnlineReplicaCount returns the number of replicas that finished their
+// initial sync. Only these can acknowledge live writes, so WAIT counts them.
+func (rp *replication) GetOnlineReplicaCount() int {
+    return rp.GetReplicaSyncStateCounts()[ReplicaOnline]
 }
 
 // GetReplicaConnections returns a snapshot of active replica connections.
-func GetReplicaConnections() []net.Conn {
-    replicaMu.RLock()
-    defer replicaMu.RUnlock()
-    conns := make([]net.Conn, len(replicas))
-    for i, r := range replicas {
+func (rp *replication) GetReplicaConnections() []net.Conn {
+    rp.replicaMu.RLock()
+    defer rp.replicaMu.RUnlock()
+    conns := make([]net.Conn, len(rp.replicas))
+    for i, r := range rp.replicas {
         conns[i] = r.Conn
     }
     return conns
 }
 
-// IncrementMasterOffset advances the master replication offset.
-func IncrementMasterOffset(bytesCount int64) {
-    offsetMu.Lock()
-    defer offsetMu.Unlock()
-    currentOffset += bytesCount
-    masterReplOffset += bytesCount
+// GetReplicas returns a snapshot of the registered replicas.
+func (rp *replication) GetReplicas() []*ReplicaState {
+    rp.replicaMu.RLock()
+    defer rp.replicaMu.RUnlock()
+    return slices.Clone(rp.replicas)
+}
+
+// appendToStream advances the master replication offset by the size of b
+// and records b in the backlog.
+func (rp *replication) appendToStream(b []byte) {
+    rp.offsetMu.Lock()
+    defer rp.offsetMu.Unlock()
+    rp.currentOffset += int64(len(b))
+    rp.masterReplOffset += int64(len(b))
+    if rp.backlog != nil {
+        rp.backlog.Append(b)
+    }
 }
 
 // GetOffset returns the current local offset.
-func GetOffset() int64 {
-    offsetMu.RLock()
-    defer offsetMu.RUnlock()
-    return currentOffset
+func (rp *replication) GetOffset() int64 {
+    rp.offsetMu.RLock()
+    defer rp.offsetMu.RUnlock()
+    return rp.currentOffset
 }
 
 // GetMasterOffset returns the current master offset.
-func GetMasterOffset() int64 {
-    offsetMu.RLock()
-    defer offsetMu.RUnlock()
-    return currentOffset
+func (rp *replication) GetMasterOffset() int64 {
+    rp.offsetMu.RLock()
+    defer rp.offsetMu.RUnlock()
+    return rp.currentOffset
 }
 
-// WaitForReplicas waits until the specified number of replicas ack the target offset or timeout.
-func WaitForReplicas(count int, timeoutMs int) int {
-    if count <= 0 || GetReplicaCount() == 0 {
-        return 0
+// WaitForReplicas blocks until count online replicas have acknowledged
+// targetOffset or timeout passes, and returns how many have. A zero timeout
+// waits forever. It wakes on each ACK rather than polling.
+func (rp *replication) WaitForReplicas(count int, targetOffset int64, timeout time.Duration) int {
+    var deadline <-chan time.Time
+    if timeout > 0 {
+        timer := time.NewTimer(timeout)
+        defer timer.Stop()
+        deadline = timer.C
     }
-
-    targetOffset := GetMasterOffset()
-    timeout := time.Duration(timeoutMs) * time.Millisecond
-    endTime := time.Now().Add(timeout)
-
-    for time.Now().Before(endTime) {
-        ackCount := GetAcknowledgedReplicaCount(targetOffset)
-        if ackCount >= count {
-            return ackCount
+    for {
+        rp.replicaMu.RLock()
+        acked := rp.acknowledgedCountLocked(targetOffset)
+        signal := rp.ackSignal
+        rp.replicaMu.RUnlock()
+        if acked >= count {
+            return acked
+        }
+        select {
+        case <-signal:
+        case <-deadline:
+            return rp.GetAcknowledgedReplicaCount(targetOffset)
         }
-        time.Sleep(10 * time.Millisecond)
     }
-
-    return GetAcknowledgedReplicaCount(targetOffset)
 }
 
-// GetAcknowledgedReplicaCount returns the number of replicas that have reached the given offset.
-func GetAcknowledgedReplicaCount(targetOffset int64) int {
-    replicaMu.RLock()
-    defer replicaMu.RUnlock()
+// GetAcknowledgedReplicaCount returns the number of online replicas that have reached the given offset.
+func (rp *replication) GetAcknowledgedReplicaCount(targetOffset int64) int {
+    rp.replicaMu.RLock()
+    defer rp.replicaMu.RUnlock()
+    return rp.acknowledgedCountLocked(targetOffset)
+}
 
+// acknowledgedCountLocked is GetAcknowledgedReplicaCount for callers holding replicaMu.
+func (rp *replication) acknowledgedCountLocked(targetOffset int64) int {
     count := 0
-    for _, r := range replicas {
-        if r.Offset >= targetOffset {
+    for _, r := range rp.replicas {
+        if r.SyncState == ReplicaOnline && r.Offset >= targetOffset {
             count++
         }
     }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errReplicaRead is returned by a replica in replica-require-readonly mode to
+// connections that read data without first sending READONLY.
+const errReplicaRead = "REPLICAREAD send READONLY to read from a replica"
+
+// MasterLink tracks a replica's connection to its master, which is what the
+// READONLY MAXLAG bound is measured against.
+type MasterLink struct {
+	mu        sync.Mutex
+	up        bool
+	lastIO    time.Time
+	lastSync  time.Time
+	downSince time.Time
+}
+
+// SetUp records whether the replica has a synced link to its master. Going
+// up marks a completed sync.
+func (m *MasterLink) SetUp(up bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.up = up
+	if up {
+		m.lastIO = time.Now()
+		m.lastSync = m.lastIO
+	} else {
+		m.downSince = time.Now()
+	}
+}
+
+// LastSync returns when the replica last completed a sync with its master,
+// or the zero time if it never has.
+func (m *MasterLink) LastSync() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastSync
+}
+
+// Touch records that data just arrived from the master.
+func (m *MasterLink) Touch() {
+	m.mu.Lock()
+	m.lastIO = time.Now()
+	m.mu.Unlock()
+}
+
+// Lag estimates how far behind the master the replica is as the time since
+// the master last sent anything. The bool is false when the link is down and
+// the lag is unknown. An idle master also looks like lag, so the estimate
+// errs on the side of refusing reads.
+func (m *MasterLink) Lag() (time.Duration, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.up {
+		return 0, false
+	}
+	return time.Since(m.lastIO), true
+}
+
+// Info renders the link fields of a replica's INFO replication section.
+// master_last_sync_time is the Unix time of the last completed sync, 0 if
+// none has completed, and master_link_down_since_seconds is -1 until the
+// link has been up once.
+func (m *MasterLink) Info() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lastSync := int64(0)
+	if !m.lastSync.IsZero() {
+		lastSync = m.lastSync.Unix()
+	}
+	if m.up {
+		return fmt.Sprintf("master_link_status:up\r\nmaster_last_io_seconds_ago:%d\r\nmaster_last_sync_time:%d",
+			int64(time.Since(m.lastIO).Seconds()), lastSync)
+	}
+	downSince := int64(-1)
+	if !m.downSince.IsZero() {
+		downSince = int64(time.Since(m.downSince).Seconds())
+	}
+	return fmt.Sprintf("master_link_status:down\r\nmaster_last_io_seconds_ago:-1\r\nmaster_last_sync_time:%d\r\nmaster_link_down_since_seconds:%d",
+		lastSync, downSince)
+}
+
+// keylessReads are the commands that read the keyspace without naming keys.
+var keylessReads = map[string]bool{
+	"KEYS":      true,
+	"DBSIZE":    true,
+	"DBSTATS":   true,
+	"RANDOMKEY": true,
+}
+
+// isDataRead reports whether a command reads keyspace data.
+func isDataRead(registry *Registry, cmdName string, args []RESP) bool {
+	if registry.IsWriteCommand(cmdName) {
+		return false
+	}
+	return keylessReads[cmdName] || len(registry.GetKeys(cmdName, args)) > 0
+}
+
+// checkReplicaRead returns the error a replica gives a data read from a
+// client, or "" when the read may go ahead.
+func (s *Server) checkReplicaRead(state *ClientState, cmdName string, args []RESP) string {
+	cfg := s.Config()
+	if !cfg.IsReplica || !isDataRead(s.registry, cmdName, args) {
+		return ""
+	}
+
+	state.mu.RLock()
+	readOnly, maxLag := state.ReadOnly, state.MaxLag
+	state.mu.RUnlock()
+
+	if !readOnly {
+		if cfg.ReplicaRequireReadonly {
+			return errReplicaRead
+		}
+		return ""
+	}
+	if maxLag <= 0 {
+		return ""
+	}
+
+	lag, linked := s.masterLink.Lag()
+	if !linked {
+		return "REPLICALAG replica has no link to the master"
+	}
+	if lag > maxLag {
+		return fmt.Sprintf("REPLICALAG replica is %dms behind the master, above MAXLAG %dms", lag.Milliseconds(), maxLag.Milliseconds())
+	}
+	return ""
+}
+
+// errReplicaWrite is returned by a read-only replica to writes from its clients.
+const errReplicaWrite = "READONLY You can't write against a read only replica."
+
+// checkReplicaWrite returns the error a read-only replica gives a write from
+// one of its clients, or "" when the write may go ahead. Writes from the
+// master are applied by the replication loop and never come through here.
+func (s *Server) checkReplicaWrite(cmdName string) string {
+	cfg := s.Config()
+	if cfg.IsReplica && cfg.ReplicaReadOnly && s.registry.IsWriteCommand(cmdName) {
+		return errReplicaWrite
+	}
+	return ""
+}
+
+// readonlyCommand opts the connection into replica reads, optionally bounded by MAXLAG ms.
+func readonlyCommand(ctx *CommandContext) (RESP, []byte) {
+	var maxLag time.Duration
+	switch len(ctx.Args) {
+	case 0:
+	case 2:
+		if strings.ToUpper(ctx.Args[0].String) != "MAXLAG" {
+			return NewError("ERR syntax error"), nil
+		}
+		ms, err := strconv.ParseInt(ctx.Args[1].String, 10, 64)
+		if err != nil || ms < 0 {
+			return NewError("ERR MAXLAG must be a non-negative integer number of milliseconds"), nil
+		}
+		maxLag = time.Duration(ms) * time.Millisecond
+	default:
+		return NewError("ERR wrong number of arguments for 'readonly' command"), nil
+	}
+
+	state := ctx.Client
+	state.mu.Lock()
+	state.ReadOnly = true
+	state.MaxLag = maxLag
+	state.mu.Unlock()
+	return NewSimpleString("OK"), nil
+}
+
+// readwriteCommand clears READONLY and any MAXLAG bound.
+func readwriteCommand(ctx *CommandContext) (RESP, []byte) {
+	state := ctx.Client
+	state.mu.Lock()
+	state.ReadOnly = false
+	state.MaxLag = 0
+	state.mu.Unlock()
+	return NewSimpleString("OK"), nil
+}
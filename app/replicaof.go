@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ReplicationLink owns the goroutine that keeps a replica attached to its
+// master, so the role can change at runtime without leaking old links.
+type ReplicationLink struct {
+	server *Server
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Start replaces any running link with one to host:port.
+func (l *ReplicationLink) Start(host string, port int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stopLocked()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	l.cancel, l.done = cancel, done
+	go func() {
+		defer close(done)
+		l.server.replicateFromMaster(ctx, host, port, l.server.announcedPort())
+	}()
+}
+
+// Stop cancels the running link, if any, and waits until it has applied
+// its last command and closed the connection.
+func (l *ReplicationLink) Stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stopLocked()
+}
+
+// stopLocked is Stop for callers holding l.mu.
+func (l *ReplicationLink) stopLocked() {
+	if l.cancel == nil {
+		return
+	}
+	l.cancel()
+	<-l.done
+	l.cancel, l.done = nil, nil
+}
+
+// replicaofCommand implements REPLICAOF host port and REPLICAOF NO ONE
+// (also registered as SLAVEOF).
+func replicaofCommand(ctx *CommandContext) (RESP, []byte) {
+	server := ctx.Server
+	cfg := server.Config()
+	if strings.EqualFold(ctx.Args[0].String, "NO") && strings.EqualFold(ctx.Args[1].String, "ONE") {
+		if !cfg.IsReplica {
+			return NewSimpleString("OK"), nil
+		}
+		server.replLink.Stop()
+		server.UpdateConfig(func(c *ServerConfig) {
+			c.IsReplica = false
+			c.MasterHost, c.MasterPort = "", 0
+		})
+		server.repl.promoteToMaster()
+		// The AOF followed the old master's SELECTs, which the stream's
+		// own record of its database knows nothing of.
+		server.repl.streamMu.Lock()
+		server.repl.streamDB = -1
+		server.repl.streamMu.Unlock()
+		logNotice("Promoted to master")
+		return NewSimpleString("OK"), nil
+	}
+
+	host := ctx.Args[0].String
+	port, err := strconv.Atoi(ctx.Args[1].String)
+	if err != nil || port < 1 || port > 65535 {
+		return NewError("ERR Invalid master port"), nil
+	}
+	if cfg.IsReplica && cfg.MasterHost == host && cfg.MasterPort == port {
+		return NewSimpleString("OK Already connected to specified master"), nil
+	}
+
+	// Replicas of this server would get no stream once it is a replica
+	// itself, so they are dropped and reconnect to resync.
+	server.repl.DisconnectReplicas()
+	server.UpdateConfig(func(c *ServerConfig) {
+		c.IsReplica = true
+		c.MasterHost, c.MasterPort = host, port
+	})
+	server.replLink.Start(host, port)
+	logNotice("Replicating from master", "master", net.JoinHostPort(host, ctx.Args[1].String))
+	return NewSimpleString("OK"), nil
+}
@@ -2,9 +2,10 @@ package main
 
 import (
     "bufio"
-    "errors"
+    "bytes"
     "fmt"
     "io"
+    "math"
     "strconv"
     "strings"
 )
@@ -15,13 +16,75 @@ const (
     Integer      = ':'
     BulkString   = '$'
     Array        = '*'
+
+    // RESP3 types, only sent to connections that negotiated protocol 3 with HELLO.
+    Map       = '%'
+    SetType   = '~' // Set is taken by the stored set type
+    Double    = ','
+    Boolean   = '#'
+    BigNumber = '('
+    Null      = '_'
+    Push      = '>' // out-of-band data, such as tracking invalidations, between replies
+)
+
+const (
+    // RESP2 and RESP3 are the protocol versions a client can negotiate with HELLO.
+    RESP2 = 2
+    RESP3 = 3
 )
 
 const (
     CRLF = "\r\n"
 )
 
+// defaultMaxBulkLength and maxArrayLength bound what a single request may
+// make the server allocate; larger lengths are treated as an unrecoverable
+// stream. The bulk limit is proto-max-bulk-len, which ParseLimit takes.
+const (
+    defaultMaxBulkLength = 512 * 1024 * 1024
+    minMaxBulkLength     = 1024 * 1024
+    maxArrayLength       = 1024 * 1024
+    // maxInlineLength caps an inline command line, as in Redis.
+    maxInlineLength = 64 * 1024
+    // preallocLimit and preallocItems are the most a length header alone
+    // makes the parser reserve; bigger values grow only as their data
+    // actually arrives.
+    preallocLimit = 64 * 1024
+    preallocItems = 1024
+)
+
+// ProtocolError reports malformed input. A recoverable error leaves the
+// stream usable once the rest of the offending line is skipped with Resync;
+// a fatal one means the peer's framing can no longer be trusted.
+type ProtocolError struct {
+    Msg   string
+    Fatal bool
+    // midLine is set when the rest of the offending line has not been read yet.
+    midLine bool
+}
+
+// Error implements the error interface.
+func (e *ProtocolError) Error() string {
+    return "Protocol error: " + e.Msg
+}
+
+// Resync discards input up to and including the next line ending after a
+// recoverable protocol error, so the next Parse starts at a fresh line.
+func Resync(reader *bufio.Reader, err *ProtocolError) error {
+    if !err.midLine {
+        return nil
+    }
+    for {
+        _, readErr := reader.ReadSlice('\n')
+        if readErr != bufio.ErrBufferFull {
+            return readErr
+        }
+    }
+}
+
 // RESP represents a value encoded using the Redis Serialization Protocol.
+// Maps keep their keys and values interleaved in Array; doubles and big
+// numbers keep their text in String; booleans are a 0 or 1 Number.
 type RESP struct {
     Type   byte
     String string
@@ -29,36 +92,192 @@ type RESP struct {
     Array  []RESP
 }
 
-// Marshal converts a RESP value to its wire-format string.
+// Marshal converts a RESP value to its wire-format string. RESP2 types use
+// their RESP2 encoding and RESP3 types their RESP3 one; replies to clients go
+// through MarshalBytesFor so they match the negotiated protocol.
 func (r *RESP) Marshal() string {
+    return string(r.appendTo(nil, 0))
+}
+
+// MarshalBytes is Marshal for writing to a connection. Lengths are byte
+// counts, so values holding NULs, CRLF or invalid UTF-8 round-trip intact.
+func (r *RESP) MarshalBytes() []byte {
+    return r.appendTo(nil, 0)
+}
+
+// MarshalBytesFor encodes r for a client speaking proto. Under RESP2 the RESP3
+// types are downgraded the way Redis does (maps flatten to arrays, doubles
+// and big numbers become bulk strings, booleans integers); under RESP3 nulls
+// use the null type.
+func (r *RESP) MarshalBytesFor(proto int) []byte {
+    return r.appendTo(nil, proto)
+}
+
+// appendTo appends the encoding of r for proto, where 0 means no conversion.
+func (r *RESP) appendTo(buf []byte, proto int) []byte {
     switch r.Type {
-    case SimpleString:
-        return fmt.Sprintf("+%s\r\n", r.String)
-    case Error:
-        return fmt.Sprintf("-%s\r\n", r.String)
+    case SimpleString, Error:
+        buf = append(buf, r.Type)
+        buf = append(buf, r.String...)
+        return append(buf, CRLF...)
     case Integer:
-        return fmt.Sprintf(":%d\r\n", r.Number)
+        buf = append(buf, Integer)
+        buf = strconv.AppendInt(buf, int64(r.Number), 10)
+        return append(buf, CRLF...)
     case BulkString:
         if r.String == "" && r.Number == -1 {
-            return "$-1\r\n"
+            return appendNull(buf, proto)
         }
-        return fmt.Sprintf("$%d\r\n%s\r\n", len(r.String), r.String)
-    case Array:
+        return appendBulk(buf, r.String)
+    case Array, SetType, Map, Push:
         if r.Array == nil && r.Number == -1 {
-            return "*-1\r\n"
+            return appendNullArray(buf, proto)
         }
 
-        var builder strings.Builder
-        builder.WriteString(fmt.Sprintf("*%d\r\n", len(r.Array)))
-
-        for _, item := range r.Array {
-            builder.WriteString(item.Marshal())
+        buf = r.appendHeader(buf, proto)
+        for i := range r.Array {
+            buf = r.Array[i].appendTo(buf, proto)
+        }
+        return buf
+    case Double, BigNumber:
+        if proto == RESP2 {
+            return appendBulk(buf, r.String)
+        }
+        buf = append(buf, r.Type)
+        buf = append(buf, r.String...)
+        return append(buf, CRLF...)
+    case Boolean:
+        if proto == RESP2 {
+            buf = append(buf, Integer)
+            buf = strconv.AppendInt(buf, int64(r.Number), 10)
+            return append(buf, CRLF...)
+        }
+        if r.Number != 0 {
+            return append(buf, "#t"+CRLF...)
         }
+        return append(buf, "#f"+CRLF...)
+    case Null:
+        return appendNull(buf, proto)
+    }
+    return buf
+}
+
+// appendHeader appends the type and element count line of an aggregate.
+func (r *RESP) appendHeader(buf []byte, proto int) []byte {
+    prefix, count := r.Type, len(r.Array)
+    if r.Type == Map {
+        count /= 2
+    }
+    if proto == RESP2 && r.Type != Array {
+        prefix, count = Array, len(r.Array)
+    }
+    buf = append(buf, prefix)
+    buf = strconv.AppendInt(buf, int64(count), 10)
+    return append(buf, CRLF...)
+}
 
-        return builder.String()
+// WriteTo streams the encoding of r to w, producing the same bytes as
+// MarshalBytes without building the whole reply in memory first. When w is
+// a *bufio.Writer the caller flushes it; otherwise WriteTo buffers and
+// flushes on its own.
+func (r *RESP) WriteTo(w io.Writer) (int64, error) {
+    return r.WriteToFor(w, 0)
+}
+
+// WriteToFor is WriteTo with the protocol conversion of MarshalBytesFor.
+func (r *RESP) WriteToFor(w io.Writer, proto int) (int64, error) {
+    bw, buffered := w.(*bufio.Writer)
+    if !buffered {
+        bw = bufio.NewWriter(w)
+    }
+    enc := respEncoder{w: bw, proto: proto}
+    if err := enc.encode(r); err != nil {
+        return enc.n, err
+    }
+    if !buffered {
+        return enc.n, bw.Flush()
+    }
+    return enc.n, nil
+}
+
+// respEncoder streams RESP values to a bufio.Writer, counting the bytes
+// written. Scalars are encoded into a reused scratch buffer; bulk payloads
+// are copied straight from the value.
+type respEncoder struct {
+    w       *bufio.Writer
+    proto   int
+    n       int64
+    scratch []byte
+}
+
+// encode writes r and, recursively, its elements.
+func (e *respEncoder) encode(r *RESP) error {
+    switch {
+    case r.Type == BulkString && !(r.String == "" && r.Number == -1):
+        e.scratch = append(e.scratch[:0], BulkString)
+        e.scratch = strconv.AppendInt(e.scratch, int64(len(r.String)), 10)
+        e.scratch = append(e.scratch, CRLF...)
+        if err := e.write(e.scratch); err != nil {
+            return err
+        }
+        if err := e.writeString(r.String); err != nil {
+            return err
+        }
+        return e.writeString(CRLF)
+    case (r.Type == Array || r.Type == SetType || r.Type == Map || r.Type == Push) && !(r.Array == nil && r.Number == -1):
+        e.scratch = r.appendHeader(e.scratch[:0], e.proto)
+        if err := e.write(e.scratch); err != nil {
+            return err
+        }
+        for i := range r.Array {
+            if err := e.encode(&r.Array[i]); err != nil {
+                return err
+            }
+        }
+        return nil
     default:
-        return ""
+        e.scratch = r.appendTo(e.scratch[:0], e.proto)
+        return e.write(e.scratch)
+    }
+}
+
+// write writes p and counts it.
+func (e *respEncoder) write(p []byte) error {
+    n, err := e.w.Write(p)
+    e.n += int64(n)
+    return err
+}
+
+// writeString writes s and counts it.
+func (e *respEncoder) writeString(s string) error {
+    n, err := e.w.WriteString(s)
+    e.n += int64(n)
+    return err
+}
+
+// appendBulk appends s as a bulk string.
+func appendBulk(buf []byte, s string) []byte {
+    buf = append(buf, BulkString)
+    buf = strconv.AppendInt(buf, int64(len(s)), 10)
+    buf = append(buf, CRLF...)
+    buf = append(buf, s...)
+    return append(buf, CRLF...)
+}
+
+// appendNull appends a null bulk string, or the RESP3 null under RESP3.
+func appendNull(buf []byte, proto int) []byte {
+    if proto == RESP3 {
+        return append(buf, "_"+CRLF...)
+    }
+    return append(buf, "$-1"+CRLF...)
+}
+
+// appendNullArray appends a null array, or the RESP3 null under RESP3.
+func appendNullArray(buf []byte, proto int) []byte {
+    if proto == RESP3 {
+        return append(buf, "_"+CRLF...)
     }
+    return append(buf, "*-1"+CRLF...)
 }
 
 // NewSimpleString creates a RESP simple string.
@@ -96,8 +315,96 @@ func NewNullArray() RESP {
     return RESP{Type: Array, Number: -1}
 }
 
-// Parse reads a RESP value from a buffered reader.
+// NewMap creates a RESP3 map from interleaved keys and values.
+func NewMap(pairs []RESP) RESP {
+    return RESP{Type: Map, Array: pairs}
+}
+
+// NewSet creates a RESP3 set.
+func NewSet(items []RESP) RESP {
+    return RESP{Type: SetType, Array: items}
+}
+
+// NewPush creates a RESP3 push, sent as an array under RESP2.
+func NewPush(items []RESP) RESP {
+    return RESP{Type: Push, Array: items}
+}
+
+// NewDouble creates a RESP3 double.
+func NewDouble(f float64) RESP {
+    return RESP{Type: Double, String: formatDouble(f)}
+}
+
+// NewBoolean creates a RESP3 boolean.
+func NewBoolean(b bool) RESP {
+    if b {
+        return RESP{Type: Boolean, Number: 1}
+    }
+    return RESP{Type: Boolean}
+}
+
+// NewBigNumber creates a RESP3 big number from its decimal text.
+func NewBigNumber(digits string) RESP {
+    return RESP{Type: BigNumber, String: digits}
+}
+
+// NewNull creates the RESP3 null.
+func NewNull() RESP {
+    return RESP{Type: Null}
+}
+
+// formatDouble renders f the way RESP3 spells doubles, including inf and nan.
+func formatDouble(f float64) string {
+    switch {
+    case math.IsInf(f, 1):
+        return "inf"
+    case math.IsInf(f, -1):
+        return "-inf"
+    case math.IsNaN(f):
+        return "nan"
+    }
+    return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Parse reads a RESP value from a buffered reader, accepting bulk strings
+// up to the default proto-max-bulk-len. A line that does not start with a
+// RESP type byte is an inline command (as typed into telnet) and comes back
+// as an array of bulk strings; blank inline lines are skipped.
 func Parse(reader *bufio.Reader) (RESP, error) {
+    return ParseLimit(reader, defaultMaxBulkLength)
+}
+
+// ParseLimit is Parse with a bulk string limit of maxBulk bytes.
+func ParseLimit(reader *bufio.Reader, maxBulk int64) (RESP, error) {
+    for {
+        prefix, err := reader.Peek(1)
+        if err != nil {
+            return RESP{}, err
+        }
+
+        switch prefix[0] {
+        case SimpleString, Error, Integer, BulkString, Array, Map, SetType, Double, Boolean, BigNumber, Null, Push:
+            return parseValue(reader, maxBulk)
+        }
+
+        args, err := parseInline(reader)
+        if err != nil {
+            return RESP{}, err
+        }
+        if len(args) == 0 {
+            continue
+        }
+
+        items := make([]RESP, len(args))
+        for i, arg := range args {
+            items[i] = NewBulkString(arg)
+        }
+        return NewArray(items), nil
+    }
+}
+
+// parseValue reads a single typed RESP value.
+func parseValue(reader *bufio.Reader, maxBulk int64) (RESP, error) {
     prefix, err := reader.ReadByte()
     if err != nil {
         return RESP{}, err
@@ -111,11 +418,25 @@ func Parse(reader *bufio.Reader) (RESP, error) {
     case Integer:
         return parseInteger(reader)
     case BulkString:
-        return parseBulkString(reader)
+        return parseBulkString(reader, maxBulk)
     case Array:
-        return parseArray(reader)
+        return parseArray(reader, maxBulk)
+    case Map:
+        return parseAggregate(reader, Map, 2, maxBulk)
+    case SetType:
+        return parseAggregate(reader, SetType, 1, maxBulk)
+    case Push:
+        return parseAggregate(reader, Push, 1, maxBulk)
+    case Double:
+        return parseDouble(reader)
+    case Boolean:
+        return parseBoolean(reader)
+    case BigNumber:
+        return parseBigNumber(reader)
+    case Null:
+        return parseNull(reader)
     default:
-        return RESP{}, fmt.Errorf("unknown RESP type: %c", prefix)
+        return RESP{}, &ProtocolError{Msg: fmt.Sprintf("unknown RESP type '%c'", prefix), midLine: prefix != '\n'}
     }
 }
 
@@ -146,65 +467,102 @@ func parseInteger(reader *bufio.Reader) (RESP, error) {
 
     num, err := strconv.Atoi(line)
     if err != nil {
-        return RESP{}, err
+        return RESP{}, &ProtocolError{Msg: "invalid integer"}
     }
 
     return NewInteger(num), nil
 }
 
 // parseBulkString reads a bulk string value.
-func parseBulkString(reader *bufio.Reader) (RESP, error) {
+func parseBulkString(reader *bufio.Reader, maxBulk int64) (RESP, error) {
     line, err := readLine(reader)
     if err != nil {
         return RESP{}, err
     }
 
     length, err := strconv.Atoi(line)
-    if err != nil {
-        return RESP{}, err
+    if err != nil || length < -1 {
+        return RESP{}, &ProtocolError{Msg: "invalid bulk length"}
+    }
+    if int64(length) > maxBulk {
+        return RESP{}, &ProtocolError{Msg: "invalid bulk length", Fatal: true}
     }
 
     if length == -1 {
         return NewNullBulkString(), nil
     }
 
-    data := make([]byte, length)
-    _, err = io.ReadFull(reader, data)
+    data, err := readBulkData(reader, length)
     if err != nil {
         return RESP{}, err
     }
 
-    _, err = reader.ReadByte()
+    cr, err := reader.ReadByte()
     if err != nil {
         return RESP{}, err
     }
-    _, err = reader.ReadByte()
+    lf, err := reader.ReadByte()
     if err != nil {
         return RESP{}, err
     }
+    if cr != '\r' || lf != '\n' {
+        return RESP{}, &ProtocolError{Msg: "expected CRLF after bulk data", midLine: lf != '\n'}
+    }
 
     return NewBulkString(string(data)), nil
 }
 
+// readBulkData reads exactly length bytes. Small values are read in one
+// allocation; larger ones grow with the data received, so a length header
+// with nothing behind it costs no more than preallocLimit.
+func readBulkData(reader *bufio.Reader, length int) ([]byte, error) {
+    if length <= preallocLimit {
+        data := make([]byte, length)
+        if _, err := io.ReadFull(reader, data); err != nil {
+            return nil, err
+        }
+        return data, nil
+    }
+    var buf bytes.Buffer
+    buf.Grow(preallocLimit)
+    n, err := io.CopyN(&buf, reader, int64(length))
+    if err != nil {
+        if err == io.EOF && n > 0 {
+            err = io.ErrUnexpectedEOF
+        }
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+// aggregateCapacity is the initial capacity for an aggregate of n items,
+// capped so the header alone cannot reserve a huge slice.
+func aggregateCapacity(n int) int {
+    return min(n, preallocItems)
+}
+
 // parseArray reads an array value.
-func parseArray(reader *bufio.Reader) (RESP, error) {
+func parseArray(reader *bufio.Reader, maxBulk int64) (RESP, error) {
     line, err := readLine(reader)
     if err != nil {
         return RESP{}, err
     }
 
     count, err := strconv.Atoi(line)
-    if err != nil {
-        return RESP{}, err
+    if err != nil || count < -1 {
+        return RESP{}, &ProtocolError{Msg: "invalid multibulk length"}
+    }
+    if count > maxArrayLength {
+        return RESP{}, &ProtocolError{Msg: "invalid multibulk length", Fatal: true}
     }
 
     if count == -1 {
         return NewNullArray(), nil
     }
 
-    items := make([]RESP, 0, count)
+    items := make([]RESP, 0, aggregateCapacity(count))
     for range count {
-        item, err := Parse(reader)
+        item, err := parseValue(reader, maxBulk)
         if err != nil {
             return RESP{}, err
         }
@@ -214,6 +572,205 @@ func parseArray(reader *bufio.Reader) (RESP, error) {
     return NewArray(items), nil
 }
 
+// parseAggregate reads a RESP3 map or set whose header counts entries of width items each.
+func parseAggregate(reader *bufio.Reader, kind byte, width int, maxBulk int64) (RESP, error) {
+    line, err := readLine(reader)
+    if err != nil {
+        return RESP{}, err
+    }
+
+    count, err := strconv.Atoi(line)
+    if err != nil || count < 0 {
+        return RESP{}, &ProtocolError{Msg: "invalid multibulk length"}
+    }
+    if count > maxArrayLength {
+        return RESP{}, &ProtocolError{Msg: "invalid multibulk length", Fatal: true}
+    }
+
+    items := make([]RESP, 0, aggregateCapacity(count*width))
+    for range count * width {
+        item, err := parseValue(reader, maxBulk)
+        if err != nil {
+            return RESP{}, err
+        }
+        items = append(items, item)
+    }
+
+    return RESP{Type: kind, Array: items}, nil
+}
+
+// parseDouble reads a RESP3 double.
+func parseDouble(reader *bufio.Reader) (RESP, error) {
+    line, err := readLine(reader)
+    if err != nil {
+        return RESP{}, err
+    }
+
+    f, err := strconv.ParseFloat(line, 64)
+    if err != nil {
+        return RESP{}, &ProtocolError{Msg: "invalid double"}
+    }
+    return NewDouble(f), nil
+}
+
+// parseBoolean reads a RESP3 boolean.
+func parseBoolean(reader *bufio.Reader) (RESP, error) {
+    line, err := readLine(reader)
+    if err != nil {
+        return RESP{}, err
+    }
+
+    switch line {
+    case "t":
+        return NewBoolean(true), nil
+    case "f":
+        return NewBoolean(false), nil
+    }
+    return RESP{}, &ProtocolError{Msg: "invalid boolean"}
+}
+
+// parseBigNumber reads a RESP3 big number.
+func parseBigNumber(reader *bufio.Reader) (RESP, error) {
+    line, err := readLine(reader)
+    if err != nil {
+        return RESP{}, err
+    }
+
+    digits := strings.TrimPrefix(line, "-")
+    if digits == "" || strings.TrimLeft(digits, "0123456789") != "" {
+        return RESP{}, &ProtocolError{Msg: "invalid big number"}
+    }
+    return NewBigNumber(line), nil
+}
+
+// parseNull reads the RESP3 null.
+func parseNull(reader *bufio.Reader) (RESP, error) {
+    line, err := readLine(reader)
+    if err != nil {
+        return RESP{}, err
+    }
+    if line != "" {
+        return RESP{}, &ProtocolError{Msg: "invalid null"}
+    }
+    return NewNull(), nil
+}
+
+// parseInline reads one inline command line and splits it into arguments.
+func parseInline(reader *bufio.Reader) ([]string, error) {
+    var line []byte
+    for {
+        chunk, err := reader.ReadSlice('\n')
+        line = append(line, chunk...)
+        if len(line) > maxInlineLength {
+            return nil, &ProtocolError{Msg: "too big inline request", Fatal: true}
+        }
+        if err == nil {
+            break
+        }
+        if err != bufio.ErrBufferFull {
+            return nil, err
+        }
+    }
+
+    line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+    args, ok := splitArgs(string(line))
+    if !ok {
+        return nil, &ProtocolError{Msg: "unbalanced quotes in request"}
+    }
+    return args, nil
+}
+
+// splitArgs splits an inline command on whitespace the way redis-cli does:
+// double quotes allow \n, \r, \t, \b, \a, \\, \" and \xHH escapes, single
+// quotes only \', and a closing quote must end the argument. It reports
+// false for unbalanced quotes.
+func splitArgs(line string) ([]string, bool) {
+    var args []string
+    i := 0
+    for {
+        for i < len(line) && isInlineSpace(line[i]) {
+            i++
+        }
+        if i == len(line) {
+            return args, true
+        }
+
+        var current []byte
+        inDouble, inSingle := false, false
+    arg:
+        for ; i < len(line); i++ {
+            c := line[i]
+            switch {
+            case inDouble:
+                switch {
+                case c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHexDigit(line[i+2]) && isHexDigit(line[i+3]):
+                    value, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+                    current = append(current, byte(value))
+                    i += 3
+                case c == '\\' && i+1 < len(line):
+                    i++
+                    switch line[i] {
+                    case 'n':
+                        current = append(current, '\n')
+                    case 'r':
+                        current = append(current, '\r')
+                    case 't':
+                        current = append(current, '\t')
+                    case 'b':
+                        current = append(current, '\b')
+                    case 'a':
+                        current = append(current, '\a')
+                    default:
+                        current = append(current, line[i])
+                    }
+                case c == '"':
+                    if i+1 < len(line) && !isInlineSpace(line[i+1]) {
+                        return nil, false
+                    }
+                    inDouble = false
+                default:
+                    current = append(current, c)
+                }
+            case inSingle:
+                switch {
+                case c == '\\' && i+1 < len(line) && line[i+1] == '\'':
+                    current = append(current, '\'')
+                    i++
+                case c == '\'':
+                    if i+1 < len(line) && !isInlineSpace(line[i+1]) {
+                        return nil, false
+                    }
+                    inSingle = false
+                default:
+                    current = append(current, c)
+                }
+            case isInlineSpace(c):
+                break arg
+            case c == '"':
+                inDouble = true
+            case c == '\'':
+                inSingle = true
+            default:
+                current = append(current, c)
+            }
+        }
+        if inDouble || inSingle {
+            return nil, false
+        }
+        args = append(args, string(current))
+    }
+}
+
+// isInlineSpace reports whether c separates inline arguments.
+func isInlineSpace(c byte) bool {
+    return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+// isHexDigit reports whether c is a hexadecimal digit.
+func isHexDigit(c byte) bool {
+    return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
 // readLine reads a single line terminated by CRLF.
 func readLine(reader *bufio.Reader) (string, error) {
     var line []byte
@@ -229,7 +786,7 @@ func readLine(reader *bufio.Reader) (string, error) {
                 return "", err
             }
             if b != '\n' {
-                return "", errors.New("protocol error: expected \\n after \\r")
+                return "", &ProtocolError{Msg: "expected '\\n' after '\\r'", midLine: true}
             }
             break
         }
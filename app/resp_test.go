@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+// FuzzParse feeds arbitrary bytes to the parser. It must never panic, and
+// whatever it parses must encode to something that parses back the same.
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{
+		"*2\r\n$3\r\nGET\r\n$1\r\nk\r\n",
+		"PING\r\n",
+		"SET k \"a b\" 'c'\r\n",
+		"+OK\r\n-ERR x\r\n:42\r\n$-1\r\n*-1\r\n",
+		"%1\r\n+k\r\n:1\r\n~2\r\n,1.5\r\n#t\r\n(123\r\n_\r\n",
+		">2\r\n$10\r\ninvalidate\r\n*1\r\n$1\r\nk\r\n",
+		"$9999999999\r\n",
+		"*2147483647\r\n",
+		"$-2\r\n",
+		"*1\r\n*1\r\n*1\r\n$0\r\n\r\n",
+		"$3\r\nabcXY",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reader := bufio.NewReader(bytes.NewReader(data))
+		for {
+			value, err := ParseLimit(reader, minMaxBulkLength)
+			if err != nil {
+				var protoErr *ProtocolError
+				if !errors.As(err, &protoErr) || protoErr.Fatal || Resync(reader, protoErr) != nil {
+					return
+				}
+				continue
+			}
+			encoded := value.Marshal()
+			again, err := Parse(bufio.NewReader(bytes.NewReader([]byte(encoded))))
+			if err != nil {
+				t.Fatalf("%q re-encoded as %q, which does not parse: %v", data, encoded, err)
+			}
+			if again.Marshal() != encoded {
+				t.Fatalf("%q re-encoded as %q, which parses back as %q", data, encoded, again.Marshal())
+			}
+		}
+	})
+}
+
+// binaryValues returns values a text-minded encoder would get wrong: NUL
+// bytes, CRLF inside the data, invalid UTF-8 and 1MB random blobs.
+func binaryValues() []string {
+	blob := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(blob)
+	crlfs := bytes.Repeat([]byte("\r\n"), 1<<19)
+	return []string{"", "\x00", "a\x00b", "\r\n", "$3\r\nabc\r\n", "\xff\xfe\xc3\x28", string(blob), string(crlfs)}
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	for _, value := range binaryValues() {
+		cmd := NewArray([]RESP{NewBulkString("SET"), NewBulkString("k"), NewBulkString(value)})
+		encoded := cmd.MarshalBytes()
+		want := fmt.Sprintf("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$%d\r\n%s\r\n", len(value), value)
+		if string(encoded) != want {
+			t.Fatalf("%d-byte value encoded wrongly", len(value))
+		}
+		if cmd.Marshal() != want {
+			t.Fatalf("Marshal and MarshalBytes differ for a %d-byte value", len(value))
+		}
+		parsed, err := Parse(bufio.NewReader(bytes.NewReader(encoded)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(parsed.Array) != 3 || parsed.Array[2].String != value {
+			t.Fatalf("%d-byte value did not parse back the same", len(value))
+		}
+	}
+}
+
+// largeArray is the 100k-element reply of a big KEYS or XRANGE.
+func largeArray() RESP {
+	items := make([]RESP, 100000)
+	for i := range items {
+		items[i] = NewArray([]RESP{NewBulkString("key:" + strconv.Itoa(i)), NewInteger(i)})
+	}
+	return NewArray(items)
+}
+
+func TestWriteToMatchesMarshal(t *testing.T) {
+	values := []RESP{
+		NewSimpleString("OK"), NewError("ERR x"), NewInteger(-7), NewNullBulkString(), NewNullArray(), NewArray(nil),
+		NewMap([]RESP{NewBulkString("k"), NewDouble(1.5)}), NewSet([]RESP{NewBoolean(true), NewNull()}),
+		NewBigNumber("123456789012345678901234567890"), NewPush([]RESP{NewBulkString("invalidate"), NewNull()}), largeArray(),
+	}
+	for _, value := range binaryValues() {
+		values = append(values, NewBulkString(value))
+	}
+	for _, value := range values {
+		for _, proto := range []int{0, 2, 3} {
+			var buf bytes.Buffer
+			n, err := value.WriteToFor(&buf, proto)
+			want := value.MarshalBytesFor(proto)
+			if err != nil || n != int64(buf.Len()) || !bytes.Equal(buf.Bytes(), want) {
+				t.Fatalf("WriteToFor(%d) wrote %d bytes (%v), want the %d bytes of MarshalBytesFor", proto, n, err, len(want))
+			}
+		}
+	}
+}
+
+// BenchmarkLargeReply writes a 100k-element array to a buffered
+// connection by encoding it whole first, as Marshal does, and by
+// streaming it with WriteTo.
+func BenchmarkLargeReply(b *testing.B) {
+	reply := largeArray()
+	b.Run("marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		w := bufio.NewWriter(io.Discard)
+		for i := 0; i < b.N; i++ {
+			w.Write(reply.MarshalBytes())
+			w.Flush()
+		}
+	})
+	b.Run("writeto", func(b *testing.B) {
+		b.ReportAllocs()
+		w := bufio.NewWriter(io.Discard)
+		for i := 0; i < b.N; i++ {
+			reply.WriteTo(w)
+			w.Flush()
+		}
+	})
+}
+
+// maxHeaderAlloc is well above what a length header alone may make the
+// parser reserve (preallocLimit bytes or preallocItems values) and far
+// below what any large declared length would take if it were trusted.
+const maxHeaderAlloc = 1 << 20
+
+// FuzzParseLength sends a length header with little or nothing behind it.
+// Lengths past the limits must be refused as fatal, negative ones other
+// than -1 as recoverable, and no header may allocate more than
+// maxHeaderAlloc.
+func FuzzParseLength(f *testing.F) {
+	for _, prefix := range []byte{BulkString, Array, Map, SetType} {
+		for _, n := range []int64{-2, -1, 0, 3, preallocLimit + 1, maxArrayLength + 1, defaultMaxBulkLength + 1, 9999999999, 2147483647} {
+			f.Add(prefix, n, []byte("ab"))
+		}
+	}
+	f.Fuzz(func(t *testing.T, prefix byte, n int64, body []byte) {
+		limit := int64(maxArrayLength)
+		switch prefix {
+		case BulkString:
+			limit = minMaxBulkLength
+		case Array, Map, SetType:
+		default:
+			return
+		}
+		input := append([]byte(fmt.Sprintf("%c%d\r\n", prefix, n)), body...)
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := ParseLimit(bufio.NewReader(bytes.NewReader(input)), minMaxBulkLength)
+		runtime.ReadMemStats(&after)
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > maxHeaderAlloc {
+			t.Fatalf("%q allocated %d bytes", input, allocated)
+		}
+
+		var protoErr *ProtocolError
+		isProto := errors.As(err, &protoErr)
+		minimum := int64(-1)
+		if prefix == Map || prefix == SetType {
+			minimum = 0
+		}
+		switch {
+		case n > limit:
+			if !isProto || !protoErr.Fatal {
+				t.Fatalf("%q: got %v, want a fatal protocol error", input, err)
+			}
+		case n < minimum:
+			if !isProto || protoErr.Fatal {
+				t.Fatalf("%q: got %v, want a recoverable protocol error", input, err)
+			}
+		case err != nil && !isProto && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF):
+			t.Fatalf("%q: unexpected error %v", input, err)
+		}
+	})
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// leakSampleInterval is how often the leak detector samples the gauges.
+	leakSampleInterval = 10 * time.Second
+	// leakWindows is how many consecutive increases make a gauge suspicious.
+	leakWindows = 6
+)
+
+// gauge is one named resource measurement.
+type gauge struct {
+	name  string
+	value int64
+}
+
+// resourceGauges samples the package's own resource usage. Each of these
+// should return to its baseline once the clients that caused it go away, so
+// they double as leak indicators.
+func (s *Server) resourceGauges() []gauge {
+	modes := make(map[ConnMode]int64)
+	s.clientStatesMu.RLock()
+	connected := int64(len(s.clientStates))
+	for _, state := range s.clientStates {
+		modes[state.Mode()]++
+	}
+	s.clientStatesMu.RUnlock()
+
+	subscribers, queued := s.pubsub.QueueStats()
+	_, admissionQueued := s.admission.Queued()
+
+	return []gauge{
+		{"connected_clients", connected},
+		{"clients_multi", modes[ModeMulti]},
+		{"clients_subscribed", modes[ModeSubscribed]},
+		{"clients_replica_link", modes[ModeReplicaLink]},
+		{"clients_monitor", modes[ModeMonitor]},
+		{"blocked_clients", int64(len(s.blocks.Blocked()))},
+		{"connected_replicas", int64(s.repl.GetReplicaCount())},
+		{"pubsub_subscribers", int64(subscribers)},
+		{"pubsub_queued_messages", int64(queued)},
+		{"admission_queued", admissionQueued},
+		{"goroutines", int64(runtime.NumGoroutine())},
+	}
+}
+
+// openFileDescriptors counts the process's open descriptors, or -1 where that is not observable.
+func openFileDescriptors() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(entries)
+}
+
+// runtimeInfo renders the Go runtime and resource gauges for INFO runtime.
+func (s *Server) runtimeInfo() string {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	var lastPause uint64
+	if mem.NumGC > 0 {
+		lastPause = mem.PauseNs[(mem.NumGC+255)%256]
+	}
+
+	var builder strings.Builder
+	builder.WriteString("# Runtime\r\n")
+	builder.WriteString(fmt.Sprintf("go_version:%s\r\n", runtime.Version()))
+	builder.WriteString(fmt.Sprintf("go_threads:%d\r\n", pprof.Lookup("threadcreate").Count()))
+	builder.WriteString(fmt.Sprintf("go_gc_count:%d\r\n", mem.NumGC))
+	builder.WriteString(fmt.Sprintf("go_gc_pause_total_usec:%d\r\n", mem.PauseTotalNs/1000))
+	builder.WriteString(fmt.Sprintf("go_gc_last_pause_usec:%d\r\n", lastPause/1000))
+	builder.WriteString(fmt.Sprintf("go_heap_inuse_bytes:%d\r\n", mem.HeapInuse))
+	builder.WriteString(fmt.Sprintf("go_heap_sys_bytes:%d\r\n", mem.HeapSys))
+	builder.WriteString(fmt.Sprintf("go_sys_bytes:%d\r\n", mem.Sys))
+	builder.WriteString(fmt.Sprintf("open_fds:%d\r\n", openFileDescriptors()))
+	for _, g := range s.resourceGauges() {
+		builder.WriteString(fmt.Sprintf("%s:%d\r\n", g.name, g.value))
+	}
+	enabled := 0
+	if s.leaks.Enabled() {
+		enabled = 1
+	}
+	builder.WriteString(fmt.Sprintf("leak_detection:%d\r\n", enabled))
+	return builder.String()
+}
+
+// LeakDetector periodically samples the resource gauges and warns when one
+// keeps growing while the number of connected clients stays the same, the
+// usual signature of goroutines or registrations that are never released.
+type LeakDetector struct {
+	enabled atomic.Bool
+	stop    chan struct{}
+	mu      sync.Mutex
+	history map[string][]int64
+	clients []int64
+	sample  func() []gauge
+	warn    func(string)
+}
+
+// newLeakDetector returns a disabled detector that samples gauges from sample.
+func newLeakDetector(sample func() []gauge) *LeakDetector {
+	return &LeakDetector{
+		history: make(map[string][]int64),
+		sample:  sample,
+		warn:    func(msg string) { logWarning(msg) },
+	}
+}
+
+// Enabled reports whether leak detection is on.
+func (d *LeakDetector) Enabled() bool {
+	return d.enabled.Load()
+}
+
+// SetEnabled turns leak detection on or off. The sampler goroutine only runs
+// while detection is on, and its history is discarded when it stops.
+func (d *LeakDetector) SetEnabled(enabled bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.enabled.Store(enabled)
+	if !enabled {
+		if d.stop != nil {
+			close(d.stop)
+			d.stop = nil
+		}
+		d.history = make(map[string][]int64)
+		d.clients = nil
+		return
+	}
+	if d.stop == nil {
+		d.stop = make(chan struct{})
+		go d.run(d.stop)
+	}
+}
+
+// run samples every leakSampleInterval until stop is closed.
+func (d *LeakDetector) run(stop chan struct{}) {
+	ticker := time.NewTicker(leakSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if d.Enabled() {
+				d.Sample()
+			}
+		}
+	}
+}
+
+// Sample takes one measurement of every gauge and warns about any that grew
+// in each of the last leakWindows windows while connected_clients was flat.
+func (d *LeakDetector) Sample() {
+	gauges := d.sample()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var clients int64
+	for _, g := range gauges {
+		if g.name == "connected_clients" {
+			clients = g.value
+		}
+	}
+	d.clients = appendWindow(d.clients, clients)
+	flat := len(d.clients) == leakWindows+1
+	for _, c := range d.clients {
+		flat = flat && c == clients
+	}
+
+	for _, g := range gauges {
+		if g.name == "connected_clients" {
+			continue
+		}
+		samples := appendWindow(d.history[g.name], g.value)
+		d.history[g.name] = samples
+		if !flat || !strictlyIncreasing(samples) {
+			continue
+		}
+		growth := samples[len(samples)-1] - samples[0]
+		rate := float64(growth) / (leakSampleInterval * leakWindows).Seconds()
+		d.warn(fmt.Sprintf("Possible leak: %s grew from %d to %d over %d windows (%.2f/s) while connected_clients stayed at %d",
+			g.name, samples[0], samples[len(samples)-1], leakWindows, rate, clients))
+		// Start over so a persistent leak warns once per leakWindows rather than every sample.
+		d.history[g.name] = nil
+	}
+}
+
+// appendWindow appends v, keeping only the most recent leakWindows+1 samples.
+func appendWindow(samples []int64, v int64) []int64 {
+	samples = append(samples, v)
+	if len(samples) > leakWindows+1 {
+		samples = samples[len(samples)-leakWindows-1:]
+	}
+	return samples
+}
+
+// strictlyIncreasing reports whether a full window of samples rose at every step.
+func strictlyIncreasing(samples []int64) bool {
+	if len(samples) < leakWindows+1 {
+		return false
+	}
+	for i := 1; i < len(samples); i++ {
+		if samples[i] <= samples[i-1] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"maps"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// leakingGauges stands in for resourceGauges with a deliberate leak: every
+// sample has one more goroutine than the last while the clients stay put.
+// grow controls whether connected_clients rises along with it.
+func leakingGauges(grow bool) func() []gauge {
+	var n int64
+	return func() []gauge {
+		n++
+		clients := int64(3)
+		if grow {
+			clients += n
+		}
+		return []gauge{{"connected_clients", clients}, {"goroutines", 100 + n}, {"blocked_clients", n % 2}}
+	}
+}
+
+func TestLeakDetector(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		grow  bool
+		warns int
+	}{
+		{"leak", false, 2},
+		// Growth that follows the clients is load, not a leak.
+		{"load", true, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newLeakDetector(leakingGauges(tt.grow))
+			var warnings []string
+			d.warn = func(msg string) { warnings = append(warnings, msg) }
+
+			// A full window is leakWindows+1 samples; the history starts
+			// over after a warning, so a second takes as many again.
+			for i := 0; i < 2*(leakWindows+1); i++ {
+				d.Sample()
+				if i == leakWindows-1 && len(warnings) != 0 {
+					t.Fatalf("warned before a full window: %q", warnings)
+				}
+			}
+			if len(warnings) != tt.warns {
+				t.Fatalf("got %d warnings %q, want %d", len(warnings), warnings, tt.warns)
+			}
+			for _, msg := range warnings {
+				if !strings.Contains(msg, "goroutines grew from") {
+					t.Fatalf("warning %q does not name the leaking gauge", msg)
+				}
+			}
+		})
+	}
+}
+
+// TestResourceGaugesReturnToBaseline churns clients through every mode the
+// gauges count, checks each gauge saw them, and waits for all of them to
+// settle back where they started once the clients are gone.
+func TestResourceGaugesReturnToBaseline(t *testing.T) {
+	s := startServer(t, nil)
+	values := func() map[string]int64 {
+		m := make(map[string]int64)
+		for _, g := range s.resourceGauges() {
+			m[g.name] = g.value
+		}
+		return m
+	}
+	baseline := values()
+
+	const rounds = 20
+	for round := 0; round < rounds; round++ {
+		multi, subscriber, blocked, monitor := dial(t, s), dial(t, s), dial(t, s), dial(t, s)
+		multi.do("MULTI")
+		multi.do("SET", "k", "v")
+		subscriber.do("SUBSCRIBE", "ch")
+		blocked.send("BLMPOP", "0", "1", "list", "LEFT")
+		monitor.do("MONITOR")
+		waitBlocked(t, s, 1)
+
+		during := values()
+		for name, want := range map[string]int64{
+			"connected_clients":  4,
+			"clients_multi":      1,
+			"clients_subscribed": 1,
+			"clients_monitor":    1,
+			"blocked_clients":    1,
+			"pubsub_subscribers": 1,
+		} {
+			if got := during[name] - baseline[name]; got != want {
+				t.Fatalf("round %d: %s rose by %d, want %d", round, name, got, want)
+			}
+		}
+
+		for _, c := range []*testClient{multi, subscriber, blocked, monitor} {
+			c.conn.Close()
+		}
+		eventually(t, "the gauges to return to baseline", func() bool {
+			now := values()
+			for name, base := range baseline {
+				// Goroutines from earlier tests may still be winding down,
+				// so the count can end below where it started.
+				if name == "goroutines" && now[name] <= base {
+					continue
+				}
+				if now[name] != base {
+					return false
+				}
+			}
+			return true
+		})
+	}
+}
+
+// goroutineStacks returns the stack of every running goroutine, each
+// starting with its "goroutine N [state]:" header.
+func goroutineStacks() []string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return strings.Split(string(buf[:n]), "\n\n")
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// goroutineID returns the N of a stack's "goroutine N [state]:" header.
+func goroutineID(stack string) string {
+	id, _, _ := strings.Cut(strings.TrimPrefix(stack, "goroutine "), " ")
+	return id
+}
+
+// runningGoroutines returns the IDs of every goroutine running now.
+func runningGoroutines() map[string]bool {
+	ids := make(map[string]bool)
+	for _, stack := range goroutineStacks() {
+		ids[goroutineID(stack)] = true
+	}
+	return ids
+}
+
+// goroutineInventory counts the running goroutines that are not in skip by
+// the package function each was started in, such as "(*Server).Serve.func3".
+// Goroutines the tests start themselves are left out.
+func goroutineInventory(skip map[string]bool) map[string]int {
+	pkg := runtime.FuncForPC(reflect.ValueOf(NewServer).Pointer()).Name()
+	pkg = strings.TrimSuffix(pkg, "NewServer")
+
+	inventory := make(map[string]int)
+	for _, stack := range goroutineStacks() {
+		if skip[goroutineID(stack)] {
+			continue
+		}
+		// The entry frame is the one just above "created by", each frame
+		// taking a function line and a file line.
+		lines := strings.Split(stack, "\n")
+		for i, line := range lines {
+			if !strings.HasPrefix(line, "created by ") || i < 2 || i+1 == len(lines) {
+				continue
+			}
+			entry := lines[i-2]
+			if strings.HasPrefix(entry, pkg) && !strings.Contains(lines[i+1], "_test.go:") {
+				entry = strings.TrimPrefix(entry, pkg)
+				inventory[entry[:strings.LastIndex(entry, "(")]]++
+			}
+			break
+		}
+	}
+	return inventory
+}
+
+// expectGoroutines waits for the server goroutines started since before
+// to be exactly want, and fails naming them if they never are.
+func expectGoroutines(t *testing.T, before map[string]bool, want map[string]int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := goroutineInventory(before)
+		if maps.Equal(got, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server goroutines = %v, want %v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestGoroutineInventory pins the goroutines an idle default server runs:
+// the expiry cycle and one accept loop per listener. A new unconditional
+// goroutine fails it; optional subsystems start theirs only while enabled
+// and stop them when disabled, however often they are toggled.
+func TestGoroutineInventory(t *testing.T) {
+	idle := map[string]int{
+		"(*Databases).expireCycle": 1,
+		"(*Server).Serve.func3":    1,
+	}
+	for _, minimal := range []bool{false, true} {
+		t.Run("minimal="+strconv.FormatBool(minimal), func(t *testing.T) {
+			before := runningGoroutines()
+			s := startServer(t, func(o *ServerOptions) { o.Minimal = minimal })
+			expectGoroutines(t, before, idle)
+
+			c := dial(t, s)
+			c.do("PING")
+			withClient := maps.Clone(idle)
+			withClient["(*Server).acceptLoop.func1"] = 1
+			expectGoroutines(t, before, withClient)
+			if minimal {
+				return
+			}
+
+			for _, tt := range []struct {
+				param, on, off, goroutine string
+			}{
+				{"leak-detection", "yes", "no", "(*LeakDetector).run"},
+				{"save", "3600 1", "", "(*Persistence).run"},
+				{"appendonly", "yes", "no", "(*AOF).run"},
+				{"hotkeys-tracking", "yes", "no", ""},
+				{"latency-tracking", "yes", "no", ""},
+			} {
+				for range 3 {
+					expectReply(t, c.do("CONFIG", "SET", tt.param, tt.on), NewSimpleString("OK"))
+					enabled := maps.Clone(withClient)
+					if tt.goroutine != "" {
+						enabled[tt.goroutine] = 1
+					}
+					expectGoroutines(t, before, enabled)
+					expectReply(t, c.do("CONFIG", "SET", tt.param, tt.off), NewSimpleString("OK"))
+					expectGoroutines(t, before, withClient)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	errNoScript        = "NOSCRIPT No matching script. Please use EVAL."
+	errScriptForbidden = "ERR This Redis command is not allowed from script"
+	errScriptArgs      = "ERR Lua redis lib command arguments must be strings or integers"
+)
+
+// scriptCommands run Lua scripts. They hold scriptMu exclusively.
+var scriptCommands = map[string]bool{
+	"EVAL":    true,
+	"EVALSHA": true,
+}
+
+// scriptForbidden lists commands redis.call refuses: ones that change the
+// connection's mode, block, or would run a script from inside a script.
+var scriptForbidden = map[string]bool{
+	"EVAL":         true,
+	"EVALSHA":      true,
+	"SCRIPT":       true,
+	"MULTI":        true,
+	"EXEC":         true,
+	"DISCARD":      true,
+	"WATCH":        true,
+	"UNWATCH":      true,
+	"SUBSCRIBE":    true,
+	"UNSUBSCRIBE":  true,
+	"PSUBSCRIBE":   true,
+	"PUNSUBSCRIBE": true,
+	"MONITOR":      true,
+	"RESET":        true,
+	"QUIT":         true,
+	"HELLO":        true,
+	"AUTH":         true,
+	"PSYNC":        true,
+	"REPLCONF":     true,
+	"WAIT":         true,
+	"SHUTDOWN":     true,
+}
+
+// scriptLockFree are commands that never take scriptMu: they may wait on
+// other clients, and holding it while they do would keep scripts, and every
+// command queued behind a script, waiting too.
+var scriptLockFree = map[string]bool{
+	"XREAD":    true,
+	"WAIT":     true,
+	"SHUTDOWN": true,
+	"BLMPOP":   true,
+}
+
+// lockForCommand takes the server's scriptMu the way cmdName needs it and
+// returns the matching unlock. scriptMu makes scripts atomic: a script holds
+// it exclusively from start to finish and every other command holds it
+// shared while it runs, so nothing interleaves with the commands a script
+// issues.
+func (s *Server) lockForCommand(cmdName string) func() {
+	switch {
+	case scriptCommands[cmdName]:
+		s.scriptMu.Lock()
+		return s.scriptMu.Unlock
+	case scriptLockFree[cmdName]:
+		return func() {}
+	}
+	s.scriptMu.RLock()
+	return s.scriptMu.RUnlock
+}
+
+// ScriptEngine owns the Lua interpreter and the scripts it has compiled,
+// keyed by the SHA1 of their source.
+type ScriptEngine struct {
+	mu      sync.Mutex
+	state   *lua.LState
+	scripts map[string]*lua.LFunction
+
+	// The script being run, for redis.call.
+	ctx     *CommandContext
+	wrapped bool // whether a MULTI has been propagated for its writes
+	inExec  bool // whether it runs inside EXEC, which propagates its own MULTI
+}
+
+// newScriptEngine returns an engine with a fresh interpreter and no scripts.
+func newScriptEngine() *ScriptEngine {
+	e := &ScriptEngine{scripts: make(map[string]*lua.LFunction)}
+	e.state = e.newState()
+	return e
+}
+
+// newState builds an interpreter with the base, table, string and math
+// libraries, minus the file loaders, and the redis table scripts call into.
+func (e *ScriptEngine) newState() *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	redis := L.NewTable()
+	L.SetField(redis, "call", L.NewFunction(func(L *lua.LState) int { return e.call(L, true) }))
+	L.SetField(redis, "pcall", L.NewFunction(func(L *lua.LState) int { return e.call(L, false) }))
+	L.SetField(redis, "status_reply", L.NewFunction(func(L *lua.LState) int {
+		L.Push(replyTable(L, "ok", L.CheckString(1)))
+		return 1
+	}))
+	L.SetField(redis, "error_reply", L.NewFunction(func(L *lua.LState) int {
+		L.Push(replyTable(L, "err", L.CheckString(1)))
+		return 1
+	}))
+	L.SetGlobal("redis", redis)
+	return L
+}
+
+// replyTable returns {field = msg}, the form status and error replies take
+// in Lua.
+func replyTable(L *lua.LState, field, msg string) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString(field, lua.LString(msg))
+	return t
+}
+
+// scriptSHA returns the hex SHA1 that EVALSHA names body by.
+func scriptSHA(body string) string {
+	sum := sha1.Sum([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// Load compiles body and caches it, returning its SHA1.
+func (e *ScriptEngine) Load(body string) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.loadLocked(body)
+}
+
+// loadLocked is Load for callers holding e.mu.
+func (e *ScriptEngine) loadLocked(body string) (string, error) {
+	sha := scriptSHA(body)
+	if _, ok := e.scripts[sha]; ok {
+		return sha, nil
+	}
+	fn, err := e.state.Load(strings.NewReader(body), "@user_script")
+	if err != nil {
+		return "", fmt.Errorf("ERR Error compiling script (new function): %s", oneLine(err.Error()))
+	}
+	e.scripts[sha] = fn
+	return sha, nil
+}
+
+// Exists reports which of shas are cached.
+func (e *ScriptEngine) Exists(shas []string) []bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	found := make([]bool, len(shas))
+	for i, sha := range shas {
+		_, found[i] = e.scripts[strings.ToLower(sha)]
+	}
+	return found
+}
+
+// Flush drops every cached script along with the interpreter, so globals
+// scripts left behind go too.
+func (e *ScriptEngine) Flush() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.state.Close()
+	e.state = e.newState()
+	e.scripts = make(map[string]*lua.LFunction)
+}
+
+// Run executes the cached script sha for conn with KEYS and ARGV set, and
+// converts what it returns into a reply.
+func (e *ScriptEngine) Run(ctx *CommandContext, sha string, keys, argv []string) RESP {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	fn, ok := e.scripts[strings.ToLower(sha)]
+	if !ok {
+		return NewError(errNoScript)
+	}
+	return e.runLocked(ctx, sha, fn, keys, argv)
+}
+
+// Eval compiles body if needed and runs it as Run does.
+func (e *ScriptEngine) Eval(ctx *CommandContext, body string, keys, argv []string) RESP {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	sha, err := e.loadLocked(body)
+	if err != nil {
+		return NewError(err.Error())
+	}
+	return e.runLocked(ctx, sha, e.scripts[sha], keys, argv)
+}
+
+// runLocked runs fn, which callers looked up under e.mu. Like EXEC, it
+// marks the client as executing so blocking commands return at once, and
+// wraps the writes it makes in MULTI/EXEC for replicas. A SELECT in the
+// script does not outlast it.
+func (e *ScriptEngine) runLocked(ctx *CommandContext, sha string, fn *lua.LFunction, keys, argv []string) RESP {
+	state := ctx.Client
+	state.mu.Lock()
+	db, executing := state.DB, state.Executing
+	state.Executing = true
+	state.mu.Unlock()
+	e.ctx, e.wrapped, e.inExec = ctx, false, executing
+	defer func() {
+		if e.wrapped {
+			ctx.Server.propagateCommand(NewArray([]RESP{NewBulkString("EXEC")}))
+		}
+		e.ctx = nil
+		state.mu.Lock()
+		state.DB, state.Executing = db, executing
+		state.mu.Unlock()
+	}()
+
+	L := e.state
+	L.SetTop(0)
+	L.SetGlobal("KEYS", stringsTable(L, keys))
+	L.SetGlobal("ARGV", stringsTable(L, argv))
+	L.Push(fn)
+	if err := L.PCall(0, 1, nil); err != nil {
+		return scriptError(sha, err)
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	return luaToRESP(ret)
+}
+
+// stringsTable returns values as a Lua array.
+func stringsTable(L *lua.LState, values []string) *lua.LTable {
+	t := L.CreateTable(len(values), 0)
+	for _, value := range values {
+		t.Append(lua.LString(value))
+	}
+	return t
+}
+
+// scriptError turns a failed script into its reply. An error raised by
+// redis.call, or a {err = ...} table passed to error(), is returned as is.
+func scriptError(sha string, err error) RESP {
+	var apiErr *lua.ApiError
+	if !errors.As(err, &apiErr) {
+		return NewError(fmt.Sprintf("ERR Error running script (call to f_%s): %s", sha, oneLine(err.Error())))
+	}
+	if t, ok := apiErr.Object.(*lua.LTable); ok {
+		if msg, ok := t.RawGetString("err").(lua.LString); ok {
+			return NewError(oneLine(string(msg)))
+		}
+	}
+	return NewError(fmt.Sprintf("ERR Error running script (call to f_%s): %s", sha, oneLine(apiErr.Object.String())))
+}
+
+// oneLine makes msg safe to send as a status or error reply, which cannot
+// span lines.
+func oneLine(msg string) string {
+	return strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ").Replace(strings.TrimSpace(msg))
+}
+
+// call implements redis.call, which raises Redis errors, and redis.pcall,
+// which returns them as {err = ...} tables.
+func (e *ScriptEngine) call(L *lua.LState, raise bool) int {
+	argv := make([]RESP, L.GetTop())
+	for i := range argv {
+		switch v := L.Get(i + 1).(type) {
+		case lua.LString:
+			argv[i] = NewBulkString(string(v))
+		case lua.LNumber:
+			argv[i] = NewBulkString(formatLuaNumber(v))
+		default:
+			return e.fail(L, raise, errScriptArgs)
+		}
+	}
+	if len(argv) == 0 {
+		return e.fail(L, raise, "ERR Please specify at least one argument for this redis lib call")
+	}
+
+	reply := e.dispatch(argv)
+	if reply.Type == Error {
+		return e.fail(L, raise, reply.String)
+	}
+	L.Push(respToLua(L, reply))
+	return 1
+}
+
+// fail raises msg from redis.call, or returns it from redis.pcall.
+func (e *ScriptEngine) fail(L *lua.LState, raise bool, msg string) int {
+	if raise {
+		L.Error(replyTable(L, "err", msg), 0)
+		return 0
+	}
+	L.Push(replyTable(L, "err", msg))
+	return 1
+}
+
+// dispatch runs one command for the script through the same path as EXEC.
+func (e *ScriptEngine) dispatch(argv []RESP) RESP {
+	cmdName := strings.ToUpper(argv[0].String)
+	registry, server := e.ctx.Registry, e.ctx.Server
+	handler, exists := registry.Get(cmdName)
+	if !exists {
+		return NewError("ERR Unknown Redis command called from script")
+	}
+	if scriptForbidden[cmdName] {
+		return NewError(errScriptForbidden)
+	}
+	if registry.CheckArity(cmdName, len(argv)-1) != "" {
+		return NewError("ERR Wrong number of args calling Redis command from script")
+	}
+	if !e.wrapped && !e.inExec && registry.IsWriteCommand(cmdName) && !server.Config().IsReplica {
+		server.propagateCommand(NewArray([]RESP{NewBulkString("MULTI")}))
+		e.wrapped = true
+	}
+	reply, _ := server.dispatchCommand(NewArray(argv), cmdName, handler, e.ctx.Conn)
+	return reply
+}
+
+// formatLuaNumber renders a number passed to redis.call: integers without a
+// decimal point, anything else with up to 17 significant digits.
+func formatLuaNumber(n lua.LNumber) string {
+	f := float64(n)
+	if f == float64(int64(f)) {
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return strconv.FormatFloat(f, 'g', 17, 64)
+}
+
+// respToLua converts a reply for a script: integers become numbers, bulk
+// strings strings, nulls false, arrays tables, and status and error replies
+// {ok = ...} and {err = ...} tables.
+func respToLua(L *lua.LState, r RESP) lua.LValue {
+	switch r.Type {
+	case Integer, Boolean:
+		return lua.LNumber(r.Number)
+	case BulkString:
+		if r.Number == -1 {
+			return lua.LFalse
+		}
+		return lua.LString(r.String)
+	case SimpleString:
+		return replyTable(L, "ok", r.String)
+	case Error:
+		return replyTable(L, "err", r.String)
+	case Double, BigNumber:
+		return lua.LString(r.String)
+	case Array, Map, SetType:
+		if r.Array == nil && r.Number == -1 {
+			return lua.LFalse
+		}
+		t := L.CreateTable(len(r.Array), 0)
+		for _, item := range r.Array {
+			t.Append(respToLua(L, item))
+		}
+		return t
+	}
+	return lua.LFalse
+}
+
+// luaToRESP converts what a script returns: numbers become integers
+// (truncated), strings bulk strings, true 1 and false or nil a null, and
+// tables arrays up to their first nil, unless they carry an ok or err field.
+func luaToRESP(v lua.LValue) RESP {
+	switch v := v.(type) {
+	case lua.LNumber:
+		return NewInteger(int(v))
+	case lua.LString:
+		return NewBulkString(string(v))
+	case lua.LBool:
+		if v {
+			return NewInteger(1)
+		}
+		return NewNullBulkString()
+	case *lua.LTable:
+		if msg, ok := v.RawGetString("err").(lua.LString); ok {
+			return NewError(oneLine(string(msg)))
+		}
+		if msg, ok := v.RawGetString("ok").(lua.LString); ok {
+			return NewSimpleString(oneLine(string(msg)))
+		}
+		var items []RESP
+		for i := 1; ; i++ {
+			item := v.RawGetInt(i)
+			if item == lua.LNil {
+				break
+			}
+			items = append(items, luaToRESP(item))
+		}
+		return NewArray(items)
+	}
+	return NewNullBulkString()
+}
+
+// parseNumKeys splits EVAL and EVALSHA arguments after the script into keys
+// and the remaining arguments.
+func parseNumKeys(args []RESP) ([]string, []string, string) {
+	numKeys, err := strconv.Atoi(args[0].String)
+	if err != nil {
+		return nil, nil, "ERR value is not an integer or out of range"
+	}
+	if numKeys < 0 {
+		return nil, nil, "ERR Number of keys can't be negative"
+	}
+	if numKeys > len(args)-1 {
+		return nil, nil, "ERR Number of keys can't be greater than number of args"
+	}
+	return argStrings(args[1 : 1+numKeys]), argStrings(args[1+numKeys:]), ""
+}
+
+// evalKeys returns the keys an EVAL or EVALSHA call declares.
+func evalKeys(args []RESP) []string {
+	if len(args) < 2 {
+		return nil
+	}
+	keys, _, msg := parseNumKeys(args[1:])
+	if msg != "" {
+		return nil
+	}
+	return keys
+}
+
+// evalCommand implements EVAL script numkeys [key ...] [arg ...].
+func evalCommand(ctx *CommandContext) (RESP, []byte) {
+	keys, argv, msg := parseNumKeys(ctx.Args[1:])
+	if msg != "" {
+		return NewError(msg), nil
+	}
+	return ctx.Server.scripts.Eval(ctx, ctx.Args[0].String, keys, argv), nil
+}
+
+// evalshaCommand implements EVALSHA sha1 numkeys [key ...] [arg ...].
+func evalshaCommand(ctx *CommandContext) (RESP, []byte) {
+	keys, argv, msg := parseNumKeys(ctx.Args[1:])
+	if msg != "" {
+		return NewError(msg), nil
+	}
+	return ctx.Server.scripts.Run(ctx, ctx.Args[0].String, keys, argv), nil
+}
+
+// scriptCommand implements SCRIPT LOAD, EXISTS and FLUSH.
+func scriptCommand(ctx *CommandContext) (RESP, []byte) {
+	args := ctx.Args
+	sub := strings.ToUpper(args[0].String)
+	switch sub {
+	case "LOAD":
+		if len(args) != 2 {
+			return NewError("ERR wrong number of arguments for 'script|load' command"), nil
+		}
+		sha, err := ctx.Server.scripts.Load(args[1].String)
+		if err != nil {
+			return NewError(err.Error()), nil
+		}
+		return NewBulkString(sha), nil
+	case "EXISTS":
+		if len(args) < 2 {
+			return NewError("ERR wrong number of arguments for 'script|exists' command"), nil
+		}
+		found := ctx.Server.scripts.Exists(argStrings(args[1:]))
+		items := make([]RESP, len(found))
+		for i, ok := range found {
+			items[i] = NewInteger(0)
+			if ok {
+				items[i] = NewInteger(1)
+			}
+		}
+		return NewArray(items), nil
+	case "FLUSH":
+		if len(args) > 2 || (len(args) == 2 && !strings.EqualFold(args[1].String, "ASYNC") && !strings.EqualFold(args[1].String, "SYNC")) {
+			return NewError("ERR syntax error"), nil
+		}
+		ctx.Server.scripts.Flush()
+		return NewSimpleString("OK"), nil
+	}
+	return NewError("ERR unknown subcommand '" + sub + "'. Try SCRIPT LOAD, EXISTS or FLUSH"), nil
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrServerClosed is returned by ListenAndServe once Shutdown, SHUTDOWN or a
+// signal has stopped the server.
+var ErrServerClosed = errors.New("server closed")
+
+const (
+	// defaultMaxClients is how many connections are served at once before
+	// new ones are turned away.
+	defaultMaxClients = 10000
+	// errMaxClients is written to a connection turned away at maxclients.
+	errMaxClients = "ERR max number of clients reached"
+)
+
+// ServerOptions holds the startup settings that the command-line flags set.
+// Start from DefaultServerOptions; the zero value is not usable.
+type ServerOptions struct {
+	Dir                  string
+	DBFilename           string
+	ReplicaOf            string // "host port", or empty for a master
+	Databases            int
+	Save                 string // save rules as given to --save
+	AppendOnly           bool
+	AppendFilename       string // name of the AOF in Dir
+	AppendFsync          string // always, everysec or no
+	ReplCompression      bool
+	ReplQueueDepth       int
+	ReplPingPeriod       int
+	ReplTimeout          int
+	ReplBacklogSize      int
+	ReplicaReadOnly      bool
+	DiagnosticsOnPanic   bool
+	MaxMemory            string
+	MaxMemoryPolicy      string
+	NotifyKeyspaceEvents string
+	RequirePass          string
+	MasterAuth           string
+	EnableDebugCommand   string
+	Minimal              bool
+	MaxClients           int
+	Timeout              int    // idle seconds before a normal client is closed; 0 disables
+	ProtoMaxBulkLen      string // largest bulk string a client may send, with optional unit
+	LogLevel             string // debug, verbose, notice or warning
+	LogFile              string // file the log is appended to; empty logs to stdout
+	UnixSocket           string // path of a Unix domain socket to listen on; empty for none
+	UnixSocketPerm       string // octal mode of the socket file, e.g. "700"; empty keeps the umask's
+	TLSCertFile          string // certificate TLS clients and a TLS master are shown
+	TLSKeyFile           string
+	TLSCACertFile        string // CA peers' certificates must chain to; empty skips client verification
+	TLSReplication       bool   // dial the master over TLS
+}
+
+// DefaultServerOptions returns the options a server started without flags
+// uses.
+func DefaultServerOptions() ServerOptions {
+	return ServerOptions{
+		Dir:                ".",
+		DBFilename:         "dump.rdb",
+		AppendFilename:     "appendonly.aof",
+		AppendFsync:        "everysec",
+		Databases:          defaultDatabases,
+		ReplQueueDepth:     defaultReplQueueDepth,
+		ReplPingPeriod:     defaultReplPingPeriod,
+		ReplTimeout:        defaultReplTimeout,
+		ReplBacklogSize:    defaultReplBacklogSize,
+		ReplicaReadOnly:    true,
+		MaxMemory:          "0",
+		MaxMemoryPolicy:    "noeviction",
+		EnableDebugCommand: "yes",
+		MaxClients:         defaultMaxClients,
+		ProtoMaxBulkLen:    "512mb",
+		LogLevel:           "notice",
+	}
+}
+
+// validate checks the options that have no CONFIG SET parser of their own.
+func (o ServerOptions) validate() error {
+	switch {
+	case o.ReplQueueDepth < 1:
+		return errors.New("repl-queue-depth must be at least 1")
+	case o.ReplPingPeriod < 1 || o.ReplTimeout < 1:
+		return errors.New("repl-ping-replica-period and repl-timeout must be at least 1")
+	case o.ReplBacklogSize < 1:
+		return errors.New("repl-backlog-size must be at least 1")
+	case o.EnableDebugCommand != "yes" && o.EnableDebugCommand != "no" && o.EnableDebugCommand != "local":
+		return errors.New("enable-debug-command must be yes, no or local")
+	case o.Databases < 1:
+		return errors.New("databases must be at least 1")
+	case o.MaxClients < 1:
+		return errors.New("maxclients must be at least 1")
+	case o.Timeout < 0:
+		return errors.New("timeout must not be negative")
+	case o.AppendFilename == "" || strings.ContainsRune(o.AppendFilename, os.PathSeparator):
+		return errors.New("appendfilename must be a file name without a directory")
+	}
+	if _, ok := parseLogLevel(o.LogLevel); !ok {
+		return errors.New("loglevel must be debug, verbose, notice or warning")
+	}
+	if _, err := o.unixSocketPerm(); err != nil {
+		return err
+	}
+	if (o.TLSCertFile == "") != (o.TLSKeyFile == "") {
+		return errors.New("tls-cert-file and tls-key-file must be given together")
+	}
+	if (o.TLSReplication || o.TLSCACertFile != "") && o.TLSCertFile == "" {
+		return errors.New("tls-replication and tls-ca-cert-file need tls-cert-file and tls-key-file")
+	}
+	return nil
+}
+
+// unixSocketPerm parses UnixSocketPerm, returning 0 when it is empty.
+func (o ServerOptions) unixSocketPerm() (os.FileMode, error) {
+	if o.UnixSocketPerm == "" {
+		return 0, nil
+	}
+	perm, err := strconv.ParseUint(o.UnixSocketPerm, 8, 32)
+	if err != nil || perm > 0o777 {
+		return 0, errors.New("unixsocketperm must be an octal file mode such as 700")
+	}
+	return os.FileMode(perm), nil
+}
+
+// Server is a running instance: it owns the listeners, the command
+// registry, the dataset, the configuration, the connected clients and the
+// subsystems commands run against, so several servers can share a process.
+// Only logging and failpoints are process-wide.
+type Server struct {
+	registry  *Registry
+	clients   atomic.Int64 // connections being served, for maxclients
+	tlsConfig *tls.Config  // for ListenTLS; nil without a certificate
+	// replTLSConfig is what a replica dials its master with when
+	// tls-replication is on, or nil for plaintext.
+	replTLSConfig *tls.Config
+
+	// configMu serializes configuration updates; reads just load the pointer.
+	configMu sync.Mutex
+	config   atomic.Pointer[ServerConfig]
+
+	clientStatesMu sync.RWMutex
+	clientStates   map[net.Conn]*ClientState
+	nextClientID   int64
+
+	dbs         *Databases
+	blocks      *BlockManager
+	streams     *StreamManager
+	watches     *WatchManager
+	pubsub      *PubSubManager
+	tracking    *TrackingManager
+	monitors    *MonitorManager
+	persistence *Persistence
+	aof         *AOF
+	shutdown    *Shutdown
+	masterLink  *MasterLink
+	replLink    *ReplicationLink
+	repl        *replication
+	scripts     *ScriptEngine
+	// scriptMu makes scripts atomic; see lockForCommand.
+	scriptMu  sync.RWMutex
+	notifier  *keyspaceNotifier
+	stats     *ServerStats
+	latency   *LatencyTracker
+	slowLog   *SlowLog
+	hotKeys   *HotKeyTracker
+	admission *AdmissionController
+	leaks     *LeakDetector
+}
+
+// newServer returns a server with the default configuration and n empty
+// databases. Nothing runs until the databases' sweeper is started.
+func newServer(n int) *Server {
+	s := &Server{clientStates: make(map[net.Conn]*ClientState)}
+	s.config.Store(&ServerConfig{
+		Dir:                "./",
+		DBFilename:         "dump.rdb",
+		ReplQueueDepth:     defaultReplQueueDepth,
+		ReplPingPeriod:     defaultReplPingPeriod,
+		ReplTimeout:        defaultReplTimeout,
+		ReplBacklogSize:    defaultReplBacklogSize,
+		ReplicaReadOnly:    true,
+		MaxMemoryPolicy:    "noeviction",
+		EnableDebugCommand: "yes",
+		MaxClients:         defaultMaxClients,
+		ProtoMaxBulkLen:    defaultMaxBulkLength,
+	})
+	s.dbs = newDatabases(s, n)
+	s.blocks = newBlockManager()
+	s.streams = &StreamManager{blocks: s.blocks}
+	s.watches = newWatchManager()
+	s.pubsub = newPubSubManager()
+	s.tracking = newTrackingManager(s)
+	s.monitors = &MonitorManager{monitors: make(map[net.Conn]*Monitor)}
+	s.persistence = &Persistence{server: s, lastSave: time.Now()}
+	s.aof = newAOF(s)
+	s.shutdown = newShutdown(s)
+	s.masterLink = &MasterLink{}
+	s.replLink = &ReplicationLink{server: s}
+	s.repl = newReplication(s)
+	s.scripts = newScriptEngine()
+	s.notifier = &keyspaceNotifier{server: s, wake: make(chan struct{}, 1)}
+	s.stats = &ServerStats{startTime: time.Now()}
+	s.latency = newLatencyTracker()
+	s.slowLog = newSlowLog()
+	s.hotKeys = NewHotKeyTracker(hotKeysCapacity)
+	s.admission = NewAdmissionController(int64(4*runtime.NumCPU()), defaultAdmissionQueueDepth)
+	s.leaks = newLeakDetector(s.resourceGauges)
+	return s
+}
+
+// NewServer applies opts, loads the AOF or RDB file if there is one and
+// returns a server ready to ListenAndServe. A replica starts syncing once it
+// listens, so it can tell the master its port.
+func NewServer(opts ServerOptions) (*Server, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	saveRules, err := ParseSaveRules(opts.Save)
+	if err != nil {
+		return nil, fmt.Errorf("save: %w", err)
+	}
+	notifyFlags, err := parseNotifyFlags(opts.NotifyKeyspaceEvents)
+	if err != nil {
+		return nil, fmt.Errorf("notify-keyspace-events: %w", err)
+	}
+	var tlsServer, tlsClient *tls.Config
+	if opts.TLSCertFile != "" {
+		if tlsServer, tlsClient, err = loadTLSConfigs(opts.TLSCertFile, opts.TLSKeyFile, opts.TLSCACertFile); err != nil {
+			return nil, err
+		}
+	}
+	if err := setLogFile(opts.LogFile); err != nil {
+		return nil, err
+	}
+	level, _ := parseLogLevel(opts.LogLevel)
+	logLevel.Set(level)
+
+	s := newServer(opts.Databases)
+	s.registry, s.tlsConfig = NewRegistry(opts.Minimal), tlsServer
+	s.UpdateConfig(func(c *ServerConfig) {
+		c.LogFile = opts.LogFile
+		c.UnixSocket, c.UnixSocketPerm = opts.UnixSocket, opts.UnixSocketPerm
+		c.TLSCertFile, c.TLSKeyFile, c.TLSCACertFile = opts.TLSCertFile, opts.TLSKeyFile, opts.TLSCACertFile
+		c.TLSReplication = opts.TLSReplication
+	})
+	if opts.TLSReplication {
+		s.replTLSConfig = tlsClient
+	}
+
+	if err := s.initConfig(opts.Dir, opts.DBFilename, opts.ReplicaOf); err != nil {
+		return nil, err
+	}
+	s.UpdateConfig(func(c *ServerConfig) {
+		c.ReplCompression = opts.ReplCompression
+		c.ReplQueueDepth = opts.ReplQueueDepth
+		c.ReplPingPeriod = opts.ReplPingPeriod
+		c.ReplTimeout = opts.ReplTimeout
+		c.ReplBacklogSize = opts.ReplBacklogSize
+		c.ReplicaReadOnly = opts.ReplicaReadOnly
+		c.DiagnosticsOnPanic = opts.DiagnosticsOnPanic
+		c.Minimal = opts.Minimal
+		c.NotifyKeyspaceEvents = notifyFlags
+		c.EnableDebugCommand = opts.EnableDebugCommand
+		c.MaxClients = opts.MaxClients
+		c.Timeout = opts.Timeout
+	})
+	for name, value := range map[string]string{
+		"maxmemory":          opts.MaxMemory,
+		"maxmemory-policy":   opts.MaxMemoryPolicy,
+		"requirepass":        opts.RequirePass,
+		"masterauth":         opts.MasterAuth,
+		"proto-max-bulk-len": opts.ProtoMaxBulkLen,
+		"appendfsync":        opts.AppendFsync,
+	} {
+		if err := s.setConfigParam(name, value); err != nil {
+			return nil, fmt.Errorf("%s: invalid value '%s'", name, value)
+		}
+	}
+	if opts.Minimal {
+		s.latency.SetEnabled(false)
+	}
+
+	role := "master"
+	if s.Config().IsReplica {
+		role = "replica"
+	}
+	logNotice("Server starting", "version", ServerVersion, "pid", os.Getpid(), "role", role, "databases", opts.Databases)
+
+	// With appendonly on the AOF is the more complete record, so the RDB
+	// is only loaded when there is no AOF yet.
+	s.aof.filename = opts.AppendFilename
+	aofExists := false
+	if opts.AppendOnly {
+		_, err := os.Stat(s.aof.path())
+		aofExists = err == nil
+	}
+	if aofExists {
+		if err := s.aof.Load(s.aof.path()); err != nil {
+			return nil, fmt.Errorf("failed to load AOF: %w", err)
+		}
+	} else if _, err := os.Stat(s.rdbPath()); err == nil {
+		if err := ParseRDB(s.rdbPath(), s.dbs); err != nil {
+			logWarning("Failed to load RDB file", "err", err)
+		}
+	}
+	go s.dbs.expireCycle(s.shutdown.Context())
+	s.persistence.SetRules(saveRules)
+	if opts.AppendOnly {
+		if err := s.aof.start(aofExists); err != nil {
+			return nil, fmt.Errorf("failed to open AOF: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// ListenAndServe listens on the TCP address addr and serves clients until
+// the server shuts down, when it returns ErrServerClosed. With port 0 the
+// system picks one, which CONFIG and INFO then report.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// ListenUnix listens on a Unix domain socket at path, first removing a
+// socket file a previous run left behind. A perm other than 0 becomes the
+// socket file's mode. Closing the listener removes the file.
+func ListenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if perm != 0 {
+		if err := os.Chmod(path, perm); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Serve accepts clients on every listener until the server shuts down,
+// when it returns ErrServerClosed. The first plaintext TCP listener's port
+// is the port CONFIG and INFO report and a replica announces to its master,
+// and the first TLS listener's is the tls-port.
+func (s *Server) Serve(listeners ...net.Listener) error {
+	for _, l := range listeners {
+		defer l.Close()
+		s.shutdown.AddListener(l)
+	}
+	if s.shutdown.Context().Err() != nil {
+		return ErrServerClosed
+	}
+	// Walking backwards leaves the first listener of each kind recorded.
+	for i := len(listeners) - 1; i >= 0; i-- {
+		addr, ok := listeners[i].Addr().(*net.TCPAddr)
+		if !ok {
+			continue
+		}
+		if _, isTLS := listeners[i].(tlsListener); isTLS {
+			s.UpdateConfig(func(c *ServerConfig) { c.TLSPort = addr.Port })
+		} else {
+			s.UpdateConfig(func(c *ServerConfig) { c.Port = addr.Port })
+		}
+	}
+
+	config := s.Config()
+	if config.IsReplica {
+		s.replLink.Start(config.MasterHost, config.MasterPort)
+	}
+
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		network := l.Addr().Network()
+		if _, isTLS := l.(tlsListener); isTLS {
+			network = "tls"
+		}
+		logNotice("Ready to accept connections", "network", network, "addr", l.Addr().String())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.acceptLoop(l)
+		}()
+	}
+	wg.Wait()
+	return ErrServerClosed
+}
+
+// acceptLoop serves the clients connecting to l until l is closed.
+func (s *Server) acceptLoop(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			// Shutdown closes the listeners once it is ready to exit.
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logWarning("Error accepting connection", "err", err)
+			continue
+		}
+
+		s.stats.ConnectionReceived()
+		if s.clients.Load() >= int64(s.Config().MaxClients) {
+			s.stats.ConnectionRejected()
+			go rejectClient(conn)
+			continue
+		}
+		logVerbose("Accepted", "addr", clientAddr(conn))
+		s.clients.Add(1)
+		go func() {
+			defer s.clients.Add(-1)
+			if s.handshakeTLS(conn) {
+				s.handleClient(conn)
+			}
+		}()
+	}
+}
+
+// rejectClient tells a connection over maxclients why it is being dropped.
+func rejectClient(conn net.Conn) {
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte("-" + errMaxClients + "\r\n"))
+}
+
+// Shutdown stops the server as SHUTDOWN does, saving first when save rules
+// are set. It returns ctx's error if ctx ends first, in which case the
+// shutdown carries on in the background.
+func (s *Server) Shutdown(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- s.shutdown.Run(saveIfConfigured, 0)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,938 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startServer runs a server on a free loopback port with its dump in a
+// temporary directory, after letting configure adjust the options. The
+// server is shut down when the test ends.
+func startServer(t testing.TB, configure func(*ServerOptions)) *Server {
+	t.Helper()
+	return startServerWith(t, configure, nil)
+}
+
+// startServerWith is startServer for a server that also serves on the
+// listeners listen opens for it, such as a TLS port or a Unix socket.
+func startServerWith(t testing.TB, configure func(*ServerOptions), listen func(s *Server) []net.Listener) *Server {
+	t.Helper()
+	opts := DefaultServerOptions()
+	opts.Dir = t.TempDir()
+	opts.LogLevel = "warning"
+	if configure != nil {
+		configure(&opts)
+	}
+	s, err := NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners := []net.Listener{l}
+	if listen != nil {
+		listeners = append(listeners, listen(s)...)
+	}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		s.Serve(listeners...)
+	}()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+		<-served
+	})
+	// Serve records the ports before it starts accepting, the plaintext
+	// one last.
+	for s.Config().Port == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	return s
+}
+
+// startReplica runs a server replicating master and waits until the master
+// counts it as online.
+func startReplica(t testing.TB, master *Server) *Server {
+	t.Helper()
+	replica := startServer(t, func(o *ServerOptions) {
+		o.ReplicaOf = fmt.Sprintf("127.0.0.1 %d", master.Config().Port)
+	})
+	eventually(t, "the replica to come online", func() bool { return master.repl.GetOnlineReplicaCount() == 1 })
+	return replica
+}
+
+// psyncLink connects to s as a replica would, by PSYNC, reads the snapshot
+// and waits until s counts the link as online.
+func psyncLink(t testing.TB, s *Server) *testClient {
+	t.Helper()
+	c := dial(t, s)
+	fullSync(t, c)
+	eventually(t, "the link to come online", func() bool { return s.repl.GetOnlineReplicaCount() == 1 })
+	return c
+}
+
+// fullSync sends PSYNC on c and returns the snapshot the full resync carries.
+func fullSync(t testing.TB, c *testClient) []byte {
+	t.Helper()
+	c.send("PSYNC", "?", "-1")
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := c.reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "+FULLRESYNC") {
+		t.Fatalf("PSYNC replied %q, %v", line, err)
+	}
+	line, err = c.reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "$") {
+		t.Fatalf("snapshot header %q, %v", line, err)
+	}
+	size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+// addr returns the loopback address the server listens on.
+func (s *Server) addr() string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(s.Config().Port))
+}
+
+// testClient is a RESP2 connection to a test server.
+type testClient struct {
+	t      testing.TB
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dial connects to s; the connection is closed when the test ends.
+func dial(t testing.TB, s *Server) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestClient(t, conn)
+}
+
+// newTestClient speaks RESP2 over conn, which is closed when the test ends.
+func newTestClient(t testing.TB, conn net.Conn) *testClient {
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// send writes a command without waiting for its reply.
+func (c *testClient) send(args ...string) {
+	c.t.Helper()
+	cmd := make([]RESP, len(args))
+	for i, arg := range args {
+		cmd[i] = NewBulkString(arg)
+	}
+	req := NewArray(cmd)
+	if _, err := c.conn.Write(req.MarshalBytes()); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// read returns the next reply, failing the test if none arrives in time.
+func (c *testClient) read() RESP {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := Parse(c.reader)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return reply
+}
+
+// do sends a command and returns its reply.
+func (c *testClient) do(args ...string) RESP {
+	c.t.Helper()
+	c.send(args...)
+	return c.read()
+}
+
+// expectNoReply fails the test if a reply arrives within d.
+func (c *testClient) expectNoReply(d time.Duration) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(d))
+	if _, err := c.reader.Peek(1); err == nil {
+		c.t.Fatalf("got a reply within %v, want none", d)
+	}
+}
+
+// sameReply reports whether got encodes the same as want.
+func sameReply(got, want RESP) bool {
+	return got.Marshal() == want.Marshal()
+}
+
+// eventually retries check until it passes or a few seconds go by.
+func eventually(t testing.TB, what string, check func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServersAreIndependent(t *testing.T) {
+	a, b := startServer(t, nil), startServer(t, nil)
+	ca, cb := dial(t, a), dial(t, b)
+
+	expectReply(t, ca.do("SET", "k", "a"), NewSimpleString("OK"))
+	expectReply(t, cb.do("SET", "k", "b"), NewSimpleString("OK"))
+	expectReply(t, ca.do("GET", "k"), NewBulkString("a"))
+	expectReply(t, cb.do("GET", "k"), NewBulkString("b"))
+
+	expectReply(t, ca.do("CONFIG", "SET", "maxclients", "7"), NewSimpleString("OK"))
+	if got := b.Config().MaxClients; got == 7 {
+		t.Fatal("CONFIG SET on one server changed the other")
+	}
+}
+
+func TestMasterReplica(t *testing.T) {
+	master := startServer(t, nil)
+	replica := startServer(t, func(o *ServerOptions) {
+		o.ReplicaOf = fmt.Sprintf("127.0.0.1 %d", master.Config().Port)
+	})
+	mc, rc := dial(t, master), dial(t, replica)
+
+	expectReply(t, mc.do("SET", "k", "v"), NewSimpleString("OK"))
+	expectReply(t, mc.do("SELECT", "3"), NewSimpleString("OK"))
+	expectReply(t, mc.do("RPUSH", "list", "a", "b"), NewInteger(2))
+
+	eventually(t, "the replica to apply the writes", func() bool {
+		rc.do("SELECT", "3")
+		if !sameReply(rc.do("LLEN", "list"), NewInteger(2)) {
+			return false
+		}
+		rc.do("SELECT", "0")
+		return sameReply(rc.do("GET", "k"), NewBulkString("v"))
+	})
+
+	reply := rc.do("SET", "k", "local")
+	if reply.Type != Error || reply.String != errReplicaWrite {
+		t.Fatalf("write on the replica replied %v", reply)
+	}
+	if master.repl.GetReplicaCount() != 1 || replica.repl.GetReplicaCount() != 0 {
+		t.Fatalf("replica counts: master %d, replica %d", master.repl.GetReplicaCount(), replica.repl.GetReplicaCount())
+	}
+	masterID, _ := master.repl.GetReplID()
+	if replicaID, _ := replica.repl.GetReplID(); replicaID != masterID {
+		t.Fatalf("replica replication ID = %s, want the master's %s", replicaID, masterID)
+	}
+
+	expectReply(t, mc.do("DEL", "list"), NewInteger(1))
+	eventually(t, "the replica to apply the DEL", func() bool {
+		rc.do("SELECT", "3")
+		return sameReply(rc.do("EXISTS", "list"), NewInteger(0))
+	})
+}
+
+// writeSelfSignedCert writes a self-signed certificate for 127.0.0.1 and its
+// key into dir, returning their paths and a pool that trusts the certificate.
+func writeSelfSignedCert(t *testing.T, dir string) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "rego test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	pool = x509.NewCertPool()
+	pool.AppendCertsFromPEM(certPEM)
+	return certFile, keyFile, pool
+}
+
+func TestTLS(t *testing.T) {
+	certFile, keyFile, pool := writeSelfSignedCert(t, t.TempDir())
+	s := startServerWith(t, func(o *ServerOptions) {
+		o.TLSCertFile, o.TLSKeyFile = certFile, keyFile
+	}, func(s *Server) []net.Listener {
+		l, err := s.ListenTLS("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []net.Listener{l}
+	})
+	tlsAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(s.Config().TLSPort))
+
+	// A plaintext client on the TLS port fails the handshake and is dropped
+	// without disturbing anyone else.
+	plain, err := net.Dial("tcp", tlsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	plain.Write([]byte("PING\r\n"))
+	plain.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if reply, err := bufio.NewReader(plain).ReadString('\n'); err == nil && reply == "+PONG\r\n" {
+		t.Fatal("a plaintext client was served on the TLS port")
+	}
+
+	conn, err := tls.Dial("tcp", tlsAddr, &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := conn.ConnectionState(); !state.HandshakeComplete || len(state.PeerCertificates) != 1 {
+		t.Fatalf("handshake state: complete %v, %d peer certificates", state.HandshakeComplete, len(state.PeerCertificates))
+	}
+	c := newTestClient(t, conn)
+	expectReply(t, c.do("PING"), NewSimpleString("PONG"))
+	expectReply(t, c.do("SET", "k", "over tls"), NewSimpleString("OK"))
+
+	// Both listeners serve the same data.
+	expectReply(t, dial(t, s).do("GET", "k"), NewBulkString("over tls"))
+	expectReply(t, c.do("CONFIG", "GET", "tls-port"), NewArray([]RESP{
+		NewBulkString("tls-port"), NewBulkString(strconv.Itoa(s.Config().TLSPort)),
+	}))
+}
+
+func TestUnixSocket(t *testing.T) {
+	// Socket paths are limited to about a hundred bytes, which a test's
+	// own temporary directory can exceed.
+	dir, err := os.MkdirTemp("", "rego")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rego.sock")
+
+	// A socket file a previous run left behind is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	s := startServerWith(t, func(o *ServerOptions) {
+		o.UnixSocket, o.UnixSocketPerm = path, "700"
+	}, func(s *Server) []net.Listener {
+		l, err := ListenUnix(path, 0o700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []net.Listener{l}
+	})
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0o700 {
+		t.Fatalf("socket file mode = %v, want a socket with mode 0700", info.Mode())
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, conn)
+	expectReply(t, c.do("PING"), NewSimpleString("PONG"))
+	expectReply(t, c.do("SET", "k", "over unix"), NewSimpleString("OK"))
+	expectReply(t, dial(t, s).do("GET", "k"), NewBulkString("over unix"))
+	expectReply(t, c.do("CONFIG", "GET", "unixsocketperm"), NewArray([]RESP{NewBulkString("unixsocketperm"), NewBulkString("700")}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.Shutdown(ctx)
+	eventually(t, "the socket file to be removed", func() bool {
+		_, err := os.Stat(path)
+		return os.IsNotExist(err)
+	})
+}
+
+func TestReplicaLoadsSeededData(t *testing.T) {
+	master := startServer(t, nil)
+	mc := dial(t, master)
+	seed := [][]string{
+		{"SET", "str", "v"},
+		{"SET", "ttl", "v", "EX", "1000"},
+		{"RPUSH", "list", "a", "b", "c"},
+		{"SADD", "set", "x", "y"},
+		{"HSET", "hash", "f", "v"},
+		{"ZADD", "zset", "1", "a", "2.5", "b"},
+		{"XADD", "stream", "1-1", "f", "v"},
+		{"SELECT", "3"},
+		{"SET", "other-db", "v"},
+	}
+	for _, cmd := range seed {
+		if reply := mc.do(cmd...); reply.Type == Error {
+			t.Fatalf("%v replied %q", cmd, reply.String)
+		}
+	}
+
+	// Nothing is written after the replica attaches, so it can only have
+	// the keys from the snapshot it loaded.
+	replica := startReplica(t, master)
+	rc := dial(t, replica)
+	eventually(t, "the replica to load the snapshot", func() bool {
+		return sameReply(rc.do("GET", "str"), NewBulkString("v"))
+	})
+	checks := []struct {
+		cmd  []string
+		want RESP
+	}{
+		{[]string{"LRANGE", "list", "0", "-1"}, NewArray([]RESP{NewBulkString("a"), NewBulkString("b"), NewBulkString("c")})},
+		{[]string{"SCARD", "set"}, NewInteger(2)},
+		{[]string{"HGET", "hash", "f"}, NewBulkString("v")},
+		{[]string{"ZSCORE", "zset", "b"}, NewBulkString("2.5")},
+		{[]string{"TYPE", "stream"}, NewSimpleString("stream")},
+		{[]string{"GET", "ttl"}, NewBulkString("v")},
+		{[]string{"SELECT", "3"}, NewSimpleString("OK")},
+		{[]string{"GET", "other-db"}, NewBulkString("v")},
+	}
+	for _, c := range checks {
+		expectReply(t, rc.do(c.cmd...), c.want)
+	}
+	if info, _ := replica.dbs.DB(0).DebugObject("ttl"); info.ttl <= 0 || info.ttl > 1000*time.Second {
+		t.Fatalf("the replica's copy has TTL %v, want the master's", info.ttl)
+	}
+}
+
+func TestReplicaSnapshotUnderWrites(t *testing.T) {
+	master := startServer(t, nil)
+	mc := dial(t, master)
+	expectReply(t, mc.do("SET", "n", "0"), NewSimpleString("OK"))
+
+	// INCR and RPUSH are not idempotent: a write both in the snapshot and
+	// streamed after it, or in neither, leaves the replica off by one.
+	stop := make(chan struct{})
+	done := make(chan int)
+	go func() {
+		writes := 0
+		for {
+			select {
+			case <-stop:
+				done <- writes
+				return
+			default:
+			}
+			mc.send("INCR", "n")
+			mc.send("RPUSH", "list", "x")
+			mc.read()
+			mc.read()
+			writes++
+		}
+	}()
+	replica := startReplica(t, master)
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	writes := <-done
+
+	want := strconv.Itoa(writes)
+	rc := dial(t, replica)
+	eventually(t, "the replica to catch up", func() bool {
+		return sameReply(rc.do("GET", "n"), NewBulkString(want))
+	})
+	expectReply(t, rc.do("LLEN", "list"), NewInteger(writes))
+	expectReply(t, mc.do("GET", "n"), NewBulkString(want))
+}
+
+func TestReplicaAckMatchesMasterOffset(t *testing.T) {
+	master := startServer(t, nil)
+	replica := startReplica(t, master)
+	mc := dial(t, master)
+	for i := 0; i < 20; i++ {
+		expectReply(t, mc.do("SET", "k"+strconv.Itoa(i), strings.Repeat("v", i)), NewSimpleString("OK"))
+	}
+
+	// Replicas ACK once a second, so the last ACK covers every SET.
+	offset := master.repl.GetMasterOffset()
+	acked := func() int64 {
+		master.repl.replicaMu.RLock()
+		defer master.repl.replicaMu.RUnlock()
+		return master.repl.replicas[0].Offset
+	}
+	eventually(t, "the replica to ACK the writes", func() bool { return acked() >= offset })
+	if got := acked(); got != offset {
+		t.Fatalf("replica ACKed offset %d, want the master's %d", got, offset)
+	}
+	if got := replica.repl.GetOffset(); got != offset {
+		t.Fatalf("replica offset = %d, want the master's %d", got, offset)
+	}
+}
+
+// fakeMaster starts a replica of a master the test plays by hand. It runs
+// the master's side of the handshake, ending in a full resync to an empty
+// dataset at offset 0, and returns the replica and its link, on which the
+// test writes the replication stream.
+func fakeMaster(t *testing.T) (*Server, *testClient) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	replica := startServer(t, func(o *ServerOptions) {
+		o.ReplicaOf = fmt.Sprintf("127.0.0.1 %d", l.Addr().(*net.TCPAddr).Port)
+	})
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := newTestClient(t, conn)
+
+	var rdb bytes.Buffer
+	if err := WriteRDB(&rdb, nil, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	for _, reply := range []string{"+PONG\r\n", "+OK\r\n", "+OK\r\n", "-ERR no compression\r\n"} {
+		link.read()
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link.read()
+	fmt.Fprintf(conn, "+FULLRESYNC %s 0\r\n$%d\r\n%s", strings.Repeat("a", 40), rdb.Len(), rdb.Bytes())
+	eventually(t, "the replica to load the snapshot", func() bool { return !replica.masterLink.LastSync().IsZero() })
+	return replica, link
+}
+
+// TestReplicaGetAck checks the offset a replica reports for each GETACK:
+// every command before it, applied or not, and not the GETACK itself,
+// which counts once it has been answered. SET k v is 27 bytes, the GETACK
+// 37, PING 14, SELECT 1 23 and BOGUS 15.
+func TestReplicaGetAck(t *testing.T) {
+	getack := []string{"REPLCONF", "GETACK", "*"}
+	tests := []struct {
+		name   string
+		stream [][]string
+		acks   []int64
+		total  int64
+	}{
+		{"first", [][]string{getack}, []int64{0}, 37},
+		{"after writes", [][]string{{"SET", "k", "v"}, {"SET", "k", "v"}, getack}, []int64{54}, 91},
+		{"back to back", [][]string{getack, getack}, []int64{0, 37}, 74},
+		{"interleaved", [][]string{{"SET", "k", "v"}, getack, {"SET", "k", "v"}, {"PING"}, getack}, []int64{27, 105}, 142},
+		{"not applied", [][]string{{"SELECT", "1"}, {"BOGUS"}, getack}, []int64{38}, 75},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replica, link := fakeMaster(t)
+			for _, cmd := range tt.stream {
+				link.send(cmd...)
+			}
+			for _, want := range tt.acks {
+				// The replica also ACKs once a second on its own, so an
+				// ACK other than the one wanted may arrive first.
+				var got []string
+				deadline := time.Now().Add(3 * time.Second)
+				for time.Now().Before(deadline) {
+					link.conn.SetReadDeadline(deadline)
+					reply, err := Parse(link.reader)
+					if err != nil {
+						break
+					}
+					if len(reply.Array) != 3 || reply.Array[1].String != "ACK" {
+						t.Fatalf("replica sent %q, want an ACK", reply.Marshal())
+					}
+					if got = append(got, reply.Array[2].String); reply.Array[2].String == strconv.FormatInt(want, 10) {
+						break
+					}
+				}
+				if len(got) == 0 || got[len(got)-1] != strconv.FormatInt(want, 10) {
+					t.Fatalf("replica ACKed %v, want %d", got, want)
+				}
+			}
+			eventually(t, "the replica to count the whole stream", func() bool { return replica.repl.GetOffset() == tt.total })
+		})
+	}
+}
+
+func TestUnreadReplicaDoesNotStallWrites(t *testing.T) {
+	master := startServer(t, func(o *ServerOptions) { o.ReplQueueDepth = 64 })
+	// The link is never read again. Once its socket buffers fill, its
+	// writer blocks, its queue fills behind it, and the master drops it.
+	psyncLink(t, master)
+	mc := dial(t, master)
+
+	value := strings.Repeat("v", 64<<10)
+	var slowest time.Duration
+	for i := 0; i < 500; i++ {
+		start := time.Now()
+		expectReply(t, mc.do("SET", "k"+strconv.Itoa(i), value), NewSimpleString("OK"))
+		slowest = max(slowest, time.Since(start))
+	}
+	if slowest > 250*time.Millisecond {
+		t.Fatalf("slowest SET took %v with an unread replica", slowest)
+	}
+	eventually(t, "the master to drop the replica", func() bool { return master.repl.GetReplicaCount() == 0 })
+}
+
+func TestReplicaReconnectsAfterMasterRestart(t *testing.T) {
+	master := startServer(t, nil)
+	addr := master.addr()
+	replica := startReplica(t, master)
+	rc := dial(t, replica)
+	expectReply(t, dial(t, master).do("SET", "before", "v"), NewSimpleString("OK"))
+	eventually(t, "the replica to apply the write", func() bool {
+		return sameReply(rc.do("GET", "before"), NewBulkString("v"))
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	master.Shutdown(ctx)
+	eventually(t, "the replica to see the link drop", func() bool {
+		return strings.Contains(rc.do("INFO", "replication").String, "master_link_status:down")
+	})
+
+	// The new master answers on the old address, empty and with a new
+	// replication ID, so the replica must resync from scratch.
+	restarted := startServerWith(t, nil, func(*Server) []net.Listener {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []net.Listener{l}
+	})
+	expectReply(t, dial(t, restarted).do("SET", "after", "v"), NewSimpleString("OK"))
+	eventually(t, "the replica to resync with the restarted master", func() bool {
+		return sameReply(rc.do("GET", "after"), NewBulkString("v"))
+	})
+	expectReply(t, rc.do("EXISTS", "before"), NewInteger(0))
+	if info := rc.do("INFO", "replication").String; !strings.Contains(info, "master_link_status:up") {
+		t.Fatalf("INFO replication after the resync:\n%s", info)
+	}
+	masterID, _ := restarted.repl.GetReplID()
+	if replicaID, _ := replica.repl.GetReplID(); replicaID != masterID {
+		t.Fatalf("replica replication ID = %s, want the restarted master's %s", replicaID, masterID)
+	}
+}
+
+// expiryOf returns when key expires in db, or the zero time if it doesn't.
+func expiryOf(db *KeyValueStore, key string) time.Time {
+	sh := db.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	return sh.expiryMap[key]
+}
+
+// TestReplicaAppliesEffects checks that writes whose outcome depends on
+// when or where they run reach the replica as their effect: the same
+// absolute expiry, the same stream IDs and the same float.
+func TestReplicaAppliesEffects(t *testing.T) {
+	master := startServer(t, nil)
+	replica := startReplica(t, master)
+	mc := dial(t, master)
+	// The replica applies the writes a while after the master ran them,
+	// so a command replicated as itself would come out differently.
+	l := latch(t, fpReplicaBeforeApply)
+
+	expectReply(t, mc.do("SET", "ex", "v", "EX", "100"), NewSimpleString("OK"))
+	expectReply(t, mc.do("SET", "px", "v", "PX", "100000"), NewSimpleString("OK"))
+	expectReply(t, mc.do("SET", "getex", "v"), NewSimpleString("OK"))
+	expectReply(t, mc.do("GETEX", "getex", "EX", "100"), NewBulkString("v"))
+	expectReply(t, mc.do("SET", "expire", "v"), NewSimpleString("OK"))
+	expectReply(t, mc.do("EXPIRE", "expire", "100"), NewInteger(1))
+	var ids []string
+	for i := 0; i < 3; i++ {
+		ids = append(ids, mc.do("XADD", "s", "*", "i", strconv.Itoa(i)).String)
+	}
+	expectReply(t, mc.do("INCRBYFLOAT", "f", "0.1"), NewBulkString("0.1"))
+	expectReply(t, mc.do("INCRBYFLOAT", "f", "3.0e2"), NewBulkString("300.1"))
+	reach(t, l)
+	time.Sleep(20 * time.Millisecond)
+	l.Release()
+
+	rc := dial(t, replica)
+	eventually(t, "the replica to apply the writes", func() bool {
+		return sameReply(rc.do("EXISTS", "f"), NewInteger(1))
+	})
+	for _, key := range []string{"ex", "px", "getex", "expire"} {
+		want := expiryOf(master.dbs.DB(0), key)
+		if want.IsZero() {
+			t.Fatalf("%s has no expiry on the master", key)
+		}
+		if got := expiryOf(replica.dbs.DB(0), key); got.UnixMilli() != want.UnixMilli() {
+			t.Fatalf("%s expires at %v on the replica, %v on the master", key, got, want)
+		}
+	}
+	reply := rc.do("XRANGE", "s", "-", "+")
+	if len(reply.Array) != len(ids) {
+		t.Fatalf("replica XRANGE replied %q", reply.Marshal())
+	}
+	for i, entry := range reply.Array {
+		if entry.Array[0].String != ids[i] {
+			t.Fatalf("replica entry %d has ID %s, the master gave %s", i, entry.Array[0].String, ids[i])
+		}
+	}
+	expectReply(t, rc.do("GET", "f"), NewBulkString("300.1"))
+}
+
+func TestReplicaReadOnly(t *testing.T) {
+	for _, readOnly := range []bool{true, false} {
+		t.Run(fmt.Sprintf("replica-read-only=%v", readOnly), func(t *testing.T) {
+			master := startServer(t, nil)
+			replica := startServer(t, func(o *ServerOptions) {
+				o.ReplicaOf = fmt.Sprintf("127.0.0.1 %d", master.Config().Port)
+				o.ReplicaReadOnly = readOnly
+			})
+			eventually(t, "the replica to come online", func() bool { return master.repl.GetOnlineReplicaCount() == 1 })
+			mc, rc := dial(t, master), dial(t, replica)
+			// READONLY opts into reads; it never makes writes acceptable.
+			expectReply(t, rc.do("READONLY"), NewSimpleString("OK"))
+
+			writes := [][]string{{"SET", "local", "v"}, {"INCR", "n"}, {"XADD", "s", "*", "f", "v"}}
+			for _, cmd := range writes {
+				reply := rc.do(cmd...)
+				if rejected := reply.Type == Error && reply.String == errReplicaWrite; rejected != readOnly {
+					t.Fatalf("%v on the replica replied %q", cmd, reply.Marshal())
+				}
+			}
+			want := NewBulkString("v")
+			if readOnly {
+				want = NewNullBulkString()
+			}
+			expectReply(t, rc.do("GET", "local"), want)
+
+			// Writes from the master are applied either way.
+			expectReply(t, mc.do("SET", "k", "from master"), NewSimpleString("OK"))
+			eventually(t, "the replica to apply the master's write", func() bool {
+				return sameReply(rc.do("GET", "k"), NewBulkString("from master"))
+			})
+		})
+	}
+}
+
+// TestProtocolErrorRecovery pipes a malformed command and a PING on one
+// connection. Recoverable errors are answered and the PING still gets its
+// PONG; a length too large to skip closes the connection.
+func TestProtocolErrorRecovery(t *testing.T) {
+	s := startServer(t, nil)
+	tests := []struct {
+		name  string
+		input string
+		reply string
+		alive bool
+	}{
+		{"bad multibulk length", "*x\r\n", "ERR Protocol error: invalid multibulk length", true},
+		{"negative multibulk length", "*-5\r\n", "ERR Protocol error: invalid multibulk length", true},
+		{"bad bulk length", "*1\r\n$x\r\n", "ERR Protocol error: invalid bulk length", true},
+		{"negative bulk length", "*1\r\n$-5\r\n", "ERR Protocol error: invalid bulk length", true},
+		{"missing CRLF", "*1\r\n$3\r\nabcXY\r\n", "ERR Protocol error: expected CRLF after bulk data", true},
+		{"non-bulk argument", "*1\r\n+PING\r\n", "ERR command must be a bulk string", true},
+		{"oversized bulk length", "$9999999999\r\n", "ERR Protocol error: invalid bulk length", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := dial(t, s)
+			if _, err := c.conn.Write([]byte(tt.input + "*1\r\n$4\r\nPING\r\n")); err != nil {
+				t.Fatal(err)
+			}
+			expectReply(t, c.read(), NewError(tt.reply))
+			if !tt.alive {
+				c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if _, err := Parse(c.reader); err == nil {
+					t.Fatal("connection still open after an oversized length")
+				}
+				return
+			}
+			expectReply(t, c.read(), NewSimpleString("PONG"))
+		})
+	}
+}
+
+// TestBinaryValuesEndToEnd sends binaryValues through SET and GET and
+// through the replication stream.
+func TestBinaryValuesEndToEnd(t *testing.T) {
+	master := startServer(t, nil)
+	replica := startReplica(t, master)
+	mc, rc := dial(t, master), dial(t, replica)
+	values := binaryValues()
+	for i, value := range values {
+		expectReply(t, mc.do("SET", "k"+strconv.Itoa(i), value), NewSimpleString("OK"))
+	}
+	for i, value := range values {
+		key := "k" + strconv.Itoa(i)
+		if got := mc.do("GET", key); !sameReply(got, NewBulkString(value)) {
+			t.Fatalf("GET %s returned %d bytes, want the %d stored", key, len(got.String), len(value))
+		}
+		eventually(t, "the replica to apply "+key, func() bool { return sameReply(rc.do("GET", key), NewBulkString(value)) })
+	}
+	// A stream off by one byte would have failed to parse or skewed the offset.
+	offset := master.repl.GetMasterOffset()
+	eventually(t, "the replica to reach the master's offset", func() bool { return replica.repl.GetOffset() == offset })
+}
+
+// TestReplicationCompression runs a compressible workload to a master with
+// one replica that negotiates compression and one link that doesn't.
+func TestReplicationCompression(t *testing.T) {
+	master := startServer(t, func(o *ServerOptions) { o.ReplCompression = true })
+	replica := startReplica(t, master)
+	plain := dial(t, master)
+	fullSync(t, plain)
+	eventually(t, "both links to come online", func() bool { return master.repl.GetOnlineReplicaCount() == 2 })
+	before := master.repl.GetMasterOffset()
+
+	mc := dial(t, master)
+	const keys = 200
+	for i := 0; i < keys; i++ {
+		expectReply(t, mc.do("SET", "k"+strconv.Itoa(i), strings.Repeat("value "+strconv.Itoa(i%10)+" ", 100)), NewSimpleString("OK"))
+	}
+	offset := master.repl.GetMasterOffset()
+
+	// Offsets count uncompressed bytes on both sides.
+	eventually(t, "the replica to reach the master's offset", func() bool { return replica.repl.GetOffset() == offset })
+	rc := dial(t, replica)
+	for i := 0; i < keys; i++ {
+		key := "k" + strconv.Itoa(i)
+		expectReply(t, rc.do("GET", key), mc.do("GET", key))
+	}
+	eventually(t, "the replica to ACK the master's offset", func() bool {
+		return master.repl.GetAcknowledgedReplicaCount(offset) == 1
+	})
+
+	var sent int64
+	for sent < offset-before {
+		cmd := plain.read()
+		sent += int64(len(cmd.MarshalBytes()))
+	}
+	if sent != offset-before {
+		t.Fatalf("plain link got %d bytes, master offset moved %d", sent, offset-before)
+	}
+
+	for _, r := range master.repl.GetReplicas() {
+		compressed := r.Conn.RemoteAddr().String() != plain.conn.LocalAddr().String()
+		if r.Compressed() != compressed {
+			t.Fatalf("link from %s compressed = %v, want %v", r.Conn.RemoteAddr(), r.Compressed(), compressed)
+		}
+		if ratio := r.CompressionRatio(); compressed && ratio < 5 || !compressed && ratio != 1 {
+			t.Fatalf("link from %s (compressed %v) has compression ratio %.2f", r.Conn.RemoteAddr(), compressed, ratio)
+		}
+	}
+	if info := mc.do("INFO", "replication").String; !strings.Contains(info, "compression=flate") || !strings.Contains(info, "compression=none") {
+		t.Fatalf("INFO replication does not list one compressed and one plain replica:\n%s", info)
+	}
+}
+
+// countingListener counts the writes made to the connections it accepts.
+type countingListener struct {
+	net.Listener
+	writes *atomic.Int64
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{conn, l.writes}, nil
+}
+
+// countingConn is a connection that counts its writes.
+type countingConn struct {
+	net.Conn
+	writes *atomic.Int64
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(p)
+}
+
+// BenchmarkPipelinedPing sends 50k PINGs per iteration, pipelined in one
+// write or one at a time, and reports how many writes the server made to
+// answer them. Buffered replies let a pipeline go out in a few large
+// writes where writing each reply would take 50k.
+func BenchmarkPipelinedPing(b *testing.B) {
+	const pings = 50000
+	var writes atomic.Int64
+	var counted net.Listener
+	startServerWith(b, nil, func(*Server) []net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			b.Fatal(err)
+		}
+		counted = l
+		return []net.Listener{countingListener{l, &writes}}
+	})
+	conn, err := net.Dial("tcp", counted.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	c := newTestClient(b, conn)
+	ping := NewArray([]RESP{NewBulkString("PING")})
+	batch := bytes.Repeat(ping.MarshalBytes(), pings)
+	pong := NewSimpleString("PONG")
+	reply := pong.MarshalBytes()
+
+	b.Run("pipelined", func(b *testing.B) {
+		writes.Store(0)
+		for i := 0; i < b.N; i++ {
+			if _, err := conn.Write(batch); err != nil {
+				b.Fatal(err)
+			}
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			if _, err := io.CopyN(io.Discard, c.reader, int64(pings*len(reply))); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(writes.Load())/float64(b.N), "writes/op")
+	})
+	b.Run("serial", func(b *testing.B) {
+		writes.Store(0)
+		for i := 0; i < b.N; i++ {
+			for range pings {
+				if got := c.do("PING"); got.String != "PONG" {
+					b.Fatalf("PING replied %q", got.Marshal())
+				}
+			}
+		}
+		b.ReportMetric(float64(writes.Load())/float64(b.N), "writes/op")
+	})
+}
@@ -0,0 +1,254 @@
+package main
+
+// Set holds the unique members stored under a single key.
+type Set map[string]struct{}
+
+// getSetLocked returns the set at key; callers must hold at least the read lock.
+func (s *KeyValueStore) getSetLocked(key string) (Set, bool, error) {
+	value, exists := s.lookupLocked(key)
+	if !exists {
+		return nil, false, nil
+	}
+	set, ok := value.(Set)
+	if !ok {
+		return nil, false, ErrWrongType
+	}
+	return set, true, nil
+}
+
+// SAdd adds members to the set at key, creating it if needed, and returns the number newly added.
+func (s *KeyValueStore) SAdd(key string, members []string) (int, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	var set Set
+	value, exists := s.lookupForWriteLocked(key)
+	if exists {
+		existing, ok := value.(Set)
+		if !ok {
+			return 0, ErrWrongType
+		}
+		set = existing
+	} else {
+		set = make(Set)
+		s.storeLocked(key, set)
+	}
+
+	added := 0
+	for _, member := range members {
+		if _, ok := set[member]; !ok {
+			s.growLocked(key, int64(len(member)))
+			set[member] = struct{}{}
+			added++
+		}
+	}
+	return added, nil
+}
+
+// SRem removes members from the set at key and returns how many were removed.
+func (s *KeyValueStore) SRem(key string, members []string) (int, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	value, exists := s.lookupForWriteLocked(key)
+	if !exists {
+		return 0, nil
+	}
+	set, ok := value.(Set)
+	if !ok {
+		return 0, ErrWrongType
+	}
+
+	removed := 0
+	for _, member := range members {
+		if _, ok := set[member]; ok {
+			s.growLocked(key, -int64(len(member)))
+			delete(set, member)
+			removed++
+		}
+	}
+	if len(set) == 0 {
+		s.deleteLocked(key)
+	}
+	return removed, nil
+}
+
+// SMembers returns every member of the set at key in no particular order.
+func (s *KeyValueStore) SMembers(key string) ([]string, error) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	set, exists, err := s.getSetLocked(key)
+	if err != nil || !exists {
+		return nil, err
+	}
+	members := make([]string, 0, len(set))
+	for member := range set {
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+// SIsMember reports whether member belongs to the set at key.
+func (s *KeyValueStore) SIsMember(key, member string) (bool, error) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	set, exists, err := s.getSetLocked(key)
+	if err != nil || !exists {
+		return false, err
+	}
+	_, ok := set[member]
+	return ok, nil
+}
+
+// SCard returns the number of members in the set at key.
+func (s *KeyValueStore) SCard(key string) (int, error) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	set, _, err := s.getSetLocked(key)
+	if err != nil {
+		return 0, err
+	}
+	return len(set), nil
+}
+
+// setOp identifies a multi-set algebra operation.
+type setOp int
+
+const (
+	setInter setOp = iota
+	setUnion
+	setDiff
+)
+
+// combineSetsLocked computes op over the sets at keys; missing keys are empty sets.
+// Callers must hold at least the read lock.
+func (s *KeyValueStore) combineSetsLocked(op setOp, keys []string) (Set, error) {
+	sets := make([]Set, len(keys))
+	for i, key := range keys {
+		set, _, err := s.getSetLocked(key)
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = set
+	}
+
+	result := make(Set)
+	switch op {
+	case setUnion:
+		for _, set := range sets {
+			for member := range set {
+				result[member] = struct{}{}
+			}
+		}
+	case setInter:
+		for member := range sets[0] {
+			inAll := true
+			for _, other := range sets[1:] {
+				if _, ok := other[member]; !ok {
+					inAll = false
+					break
+				}
+			}
+			if inAll {
+				result[member] = struct{}{}
+			}
+		}
+	case setDiff:
+		for member := range sets[0] {
+			inOther := false
+			for _, other := range sets[1:] {
+				if _, ok := other[member]; ok {
+					inOther = true
+					break
+				}
+			}
+			if !inOther {
+				result[member] = struct{}{}
+			}
+		}
+	}
+	return result, nil
+}
+
+// SCombine returns the members of the intersection, union or difference of the sets at keys.
+func (s *KeyValueStore) SCombine(op setOp, keys []string) ([]string, error) {
+	defer s.rlockKeys(keys...)()
+
+	result, err := s.combineSetsLocked(op, keys)
+	if err != nil {
+		return nil, err
+	}
+	members := make([]string, 0, len(result))
+	for member := range result {
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+// SInterCard returns the size of the intersection of the sets at keys,
+// stopping once it reaches limit when limit is positive. It walks the
+// smallest set, so the intersection is never built.
+func (s *KeyValueStore) SInterCard(keys []string, limit int) (int, error) {
+	defer s.rlockKeys(keys...)()
+
+	sets := make([]Set, len(keys))
+	for i, key := range keys {
+		set, _, err := s.getSetLocked(key)
+		if err != nil {
+			return 0, err
+		}
+		if len(set) == 0 {
+			return 0, nil
+		}
+		sets[i] = set
+	}
+	smallest := 0
+	for i, set := range sets {
+		if len(set) < len(sets[smallest]) {
+			smallest = i
+		}
+	}
+
+	count := 0
+	for member := range sets[smallest] {
+		inAll := true
+		for i, other := range sets {
+			if i == smallest {
+				continue
+			}
+			if _, ok := other[member]; !ok {
+				inAll = false
+				break
+			}
+		}
+		if !inAll {
+			continue
+		}
+		count++
+		if count == limit {
+			break
+		}
+	}
+	return count, nil
+}
+
+// SCombineStore stores the intersection, union or difference of the sets at keys
+// into dest and returns the resulting cardinality and whether dest existed before.
+func (s *KeyValueStore) SCombineStore(op setOp, dest string, keys []string) (int, bool, error) {
+	defer s.lockKeys(append([]string{dest}, keys...)...)()
+
+	result, err := s.combineSetsLocked(op, keys)
+	if err != nil {
+		return 0, false, err
+	}
+	existed := s.storeDestinationLocked(dest, result, len(result) == 0)
+	return len(result), existed, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// shutdownGracePeriod bounds how long shutdown waits for in-flight commands,
+// such as blocked XREADs, before going ahead without them.
+const shutdownGracePeriod = 3 * time.Second
+
+// saveMode says whether shutdown writes a final dump.
+type saveMode int
+
+const (
+	// saveIfConfigured saves when automatic save rules are set, as a bare
+	// SHUTDOWN or SIGTERM does.
+	saveIfConfigured saveMode = iota
+	saveAlways
+	saveNever
+)
+
+// Shutdown coordinates stopping the server. Commands run between
+// beginCommand and endCommand; once shutdown starts, new ones wait until
+// the server either exits or, if the final save fails, carries on.
+type Shutdown struct {
+	server    *Server
+	mu        sync.Mutex
+	cond      *sync.Cond
+	active    int
+	stopping  bool
+	listeners []net.Listener
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// newShutdown returns a controller for server whose context is live until exit.
+func newShutdown(server *Server) *Shutdown {
+	s := &Shutdown{server: server}
+	s.cond = sync.NewCond(&s.mu)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+// Context is cancelled once the server has committed to exiting; client
+// loops watch it to stop reading.
+func (s *Shutdown) Context() context.Context {
+	return s.ctx
+}
+
+// AddListener records a listener shutdown closes last, which ends its
+// accept loop.
+func (s *Shutdown) AddListener(l net.Listener) {
+	s.mu.Lock()
+	s.listeners = append(s.listeners, l)
+	s.mu.Unlock()
+}
+
+// beginCommand waits out a shutdown in progress and counts a command as in
+// flight.
+func (s *Shutdown) beginCommand() {
+	s.mu.Lock()
+	for s.stopping {
+		s.cond.Wait()
+	}
+	s.active++
+	s.mu.Unlock()
+}
+
+// endCommand marks a command as finished.
+func (s *Shutdown) endCommand() {
+	s.mu.Lock()
+	s.active--
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// Run stops the server: it holds back new commands and waits up to the
+// grace period for running ones. self is how many of those belong to the
+// caller (1 for SHUTDOWN, 0 for a signal). It then optionally saves, closes
+// the AOF, replica links and the listeners, and lets the client loops wind
+// down.
+// If the save fails, it returns the error and the server keeps running.
+func (s *Shutdown) Run(mode saveMode, self int) error {
+	s.mu.Lock()
+	if s.stopping {
+		s.mu.Unlock()
+		return errors.New("ERR shutdown already in progress")
+	}
+	s.stopping = true
+	timer := time.AfterFunc(shutdownGracePeriod, func() {
+		s.mu.Lock()
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	})
+	deadline := time.Now().Add(shutdownGracePeriod)
+	for s.active > self && time.Now().Before(deadline) {
+		s.cond.Wait()
+	}
+	timer.Stop()
+	if s.active > self {
+		logWarning("Shutting down with commands still running", "commands", s.active-self)
+	}
+	s.mu.Unlock()
+
+	if mode == saveAlways || (mode == saveIfConfigured && len(s.server.persistence.Rules()) > 0) {
+		logNotice("Saving the final RDB snapshot before exiting.")
+		if err := saveForShutdown(s.server.persistence); err != nil {
+			logWarning("Error trying to save the DB, can't exit", "err", err)
+			s.mu.Lock()
+			s.stopping = false
+			s.cond.Broadcast()
+			s.mu.Unlock()
+			return errors.New("ERR Errors trying to SHUTDOWN. Check logs.")
+		}
+	}
+
+	s.server.aof.Close()
+	s.cancel()
+	s.server.replLink.Stop()
+	s.server.repl.DisconnectReplicas()
+	logNotice("Server is now ready to exit, bye bye...")
+	s.mu.Lock()
+	listeners := s.listeners
+	s.mu.Unlock()
+	for _, l := range listeners {
+		l.Close()
+	}
+	return nil
+}
+
+// saveForShutdown writes the dump, first waiting for any background save to
+// finish since its snapshot may predate the latest writes.
+func saveForShutdown(p *Persistence) error {
+	for {
+		err := p.Save()
+		if !errors.Is(err, errSaveInProgress) {
+			return err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// shutdownCommand implements SHUTDOWN [NOSAVE|SAVE]. On success the server
+// exits without replying.
+func shutdownCommand(ctx *CommandContext) (RESP, []byte) {
+	args := ctx.Args
+	mode := saveIfConfigured
+	if len(args) == 1 {
+		switch strings.ToUpper(args[0].String) {
+		case "NOSAVE":
+			mode = saveNever
+		case "SAVE":
+			mode = saveAlways
+		default:
+			return NewError("ERR syntax error"), nil
+		}
+	}
+	if err := ctx.Server.shutdown.Run(mode, 1); err != nil {
+		return NewError(err.Error()), nil
+	}
+	// The listeners are closed and main is returning; there is no reply.
+	select {}
+}
+
+// watchShutdownSignals runs shutdown on SIGTERM or SIGINT.
+func (s *Server) watchShutdownSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		for sig := range signals {
+			logWarning("Received signal, scheduling shutdown...", "signal", sig.String())
+			if err := s.shutdown.Run(saveIfConfigured, 0); err != nil {
+				logWarning("Signal received but errors trying to shut down the server, check the logs for more information", "signal", sig.String())
+			}
+		}
+	}()
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultSlowlogSlowerThan is the slowlog threshold in microseconds.
+	defaultSlowlogSlowerThan = 10000
+	// defaultSlowlogMaxLen is how many entries the slowlog keeps.
+	defaultSlowlogMaxLen = 128
+	// slowlogMaxArgs and slowlogMaxArgLen bound what an entry keeps of its
+	// command line, as in Redis.
+	slowlogMaxArgs   = 32
+	slowlogMaxArgLen = 128
+)
+
+// slowlogEntry is one logged command.
+type slowlogEntry struct {
+	id         int64
+	timestamp  int64
+	duration   time.Duration
+	args       []string
+	clientAddr string
+	clientName string
+}
+
+// SlowLog keeps the most recent commands that ran longer than the threshold
+// in a ring buffer. It has its own lock, so recording never waits on a store.
+type SlowLog struct {
+	slowerThan atomic.Int64 // microseconds; negative disables logging
+
+	mu      sync.Mutex
+	entries []slowlogEntry // ring buffer of up to maxLen entries
+	next    int            // slot the next entry goes in once the buffer is full
+	maxLen  int
+	nextID  int64
+}
+
+func newSlowLog() *SlowLog {
+	l := &SlowLog{maxLen: defaultSlowlogMaxLen}
+	l.slowerThan.Store(defaultSlowlogSlowerThan)
+	return l
+}
+
+// SlowerThan returns the threshold in microseconds.
+func (l *SlowLog) SlowerThan() int64 {
+	return l.slowerThan.Load()
+}
+
+// SetSlowerThan sets the threshold in microseconds; negative disables logging.
+func (l *SlowLog) SetSlowerThan(usec int64) {
+	l.slowerThan.Store(usec)
+}
+
+// MaxLen returns how many entries the slowlog keeps.
+func (l *SlowLog) MaxLen() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.maxLen
+}
+
+// SetMaxLen resizes the slowlog, keeping the newest entries that fit.
+func (l *SlowLog) SetMaxLen(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	newest := l.newestLocked(n)
+	l.entries = make([]slowlogEntry, 0, len(newest))
+	for i := len(newest) - 1; i >= 0; i-- {
+		l.entries = append(l.entries, newest[i])
+	}
+	l.next = 0
+	l.maxLen = n
+}
+
+// Record logs a command that took d if it crossed the threshold. args is
+// the command line including its name; client is whoever sent it.
+func (l *SlowLog) Record(args []RESP, d time.Duration, client *ClientState) {
+	threshold := l.slowerThan.Load()
+	if threshold < 0 || d.Microseconds() < threshold {
+		return
+	}
+	entry := slowlogEntry{
+		timestamp: time.Now().Unix(),
+		duration:  d,
+		args:      slowlogArgs(redactArgs(args)),
+	}
+	if client.conn != nil {
+		entry.clientAddr = client.conn.RemoteAddr().String()
+	}
+	client.mu.RLock()
+	entry.clientName = client.Name
+	client.mu.RUnlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxLen == 0 {
+		return
+	}
+	entry.id = l.nextID
+	l.nextID++
+	if len(l.entries) < l.maxLen {
+		l.entries = append(l.entries, entry)
+		return
+	}
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % l.maxLen
+}
+
+// slowlogArgs copies a command line, keeping at most slowlogMaxArgs
+// arguments and slowlogMaxArgLen bytes of each.
+func slowlogArgs(args []RESP) []string {
+	n := len(args)
+	if n > slowlogMaxArgs {
+		n = slowlogMaxArgs
+	}
+	out := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		if i == slowlogMaxArgs-1 && len(args) > slowlogMaxArgs {
+			out = append(out, "... ("+strconv.Itoa(len(args)-slowlogMaxArgs+1)+" more arguments)")
+			break
+		}
+		arg := args[i].String
+		if len(arg) > slowlogMaxArgLen {
+			arg = arg[:slowlogMaxArgLen] + "... (" + strconv.Itoa(len(arg)-slowlogMaxArgLen) + " more bytes)"
+		}
+		out = append(out, arg)
+	}
+	return out
+}
+
+// newestLocked returns up to n entries, newest first.
+func (l *SlowLog) newestLocked(n int) []slowlogEntry {
+	if n > len(l.entries) {
+		n = len(l.entries)
+	}
+	out := make([]slowlogEntry, 0, n)
+	// Once the buffer is full, the newest entry sits just before next.
+	last := len(l.entries) - 1
+	if len(l.entries) == l.maxLen {
+		last = (l.next - 1 + len(l.entries)) % len(l.entries)
+	}
+	for i := 0; i < n; i++ {
+		out = append(out, l.entries[(last-i+len(l.entries))%len(l.entries)])
+	}
+	return out
+}
+
+// Get returns up to n entries, newest first; n < 0 returns them all.
+func (l *SlowLog) Get(n int) []slowlogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n < 0 {
+		n = len(l.entries)
+	}
+	return l.newestLocked(n)
+}
+
+// Len returns the number of entries held.
+func (l *SlowLog) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.entries)
+}
+
+// Reset drops every entry. IDs keep counting up.
+func (l *SlowLog) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = l.entries[:0]
+	l.next = 0
+}
+
+// slowlogCommand implements SLOWLOG GET [count], LEN, RESET and HELP.
+func slowlogCommand(ctx *CommandContext) (RESP, []byte) {
+	args := ctx.Args
+	sub := strings.ToUpper(args[0].String)
+	switch sub {
+	case "GET":
+		count := 10
+		if len(args) == 2 {
+			n, err := strconv.Atoi(args[1].String)
+			if err != nil || n < -1 {
+				return NewError("ERR count should be greater than or equal to -1"), nil
+			}
+			count = n
+		}
+		entries := ctx.Server.slowLog.Get(count)
+		reply := make([]RESP, 0, len(entries))
+		for _, e := range entries {
+			argv := make([]RESP, len(e.args))
+			for i, arg := range e.args {
+				argv[i] = NewBulkString(arg)
+			}
+			reply = append(reply, NewArray([]RESP{
+				NewInteger(int(e.id)),
+				NewInteger(int(e.timestamp)),
+				NewInteger(int(e.duration.Microseconds())),
+				NewArray(argv),
+				NewBulkString(e.clientAddr),
+				NewBulkString(e.clientName),
+			}))
+		}
+		return NewArray(reply), nil
+	case "LEN", "RESET":
+		if len(args) != 1 {
+			return NewError("ERR wrong number of arguments for 'slowlog|" + strings.ToLower(sub) + "' command"), nil
+		}
+		if sub == "LEN" {
+			return NewInteger(ctx.Server.slowLog.Len()), nil
+		}
+		ctx.Server.slowLog.Reset()
+		return NewSimpleString("OK"), nil
+	case "HELP":
+		return NewArray([]RESP{
+			NewSimpleString("SLOWLOG <subcommand> [<arg> [value] [opt] ...]. Subcommands are:"),
+			NewSimpleString("GET [<count>]"),
+			NewSimpleString("    Return top <count> entries from the slowlog (default: 10, -1 mean all)."),
+			NewSimpleString("    Entries are made of:"),
+			NewSimpleString("    id, timestamp, time in microseconds, arguments array, client IP and port,"),
+			NewSimpleString("    client name"),
+			NewSimpleString("LEN"),
+			NewSimpleString("    Return the length of the slowlog."),
+			NewSimpleString("RESET"),
+			NewSimpleString("    Reset the slowlog."),
+		}), nil
+	}
+	return unknownSubcommand("SLOWLOG", args[0].String), nil
+}
@@ -1,12 +1,197 @@
 package main
 
-// Entry represents a single stream entry.
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// FieldValue is one field/value pair of a stream entry.
+type FieldValue struct {
+    Field string
+    Value string
+}
+
+// Entry represents a single stream entry. Fields keep the order they were
+// given to XADD in, as Redis returns them.
 type Entry struct {
     ID     string
-    Fields map[string]string
+    Fields []FieldValue
+    // ms and seq are ID parsed once when the entry is stored, so range
+    // queries can binary search the stream without re-parsing IDs.
+    ms, seq int64
 }
 
-// Stream holds an ordered list of entries.
+// Stream holds an ordered list of entries. LastID survives trimming so new
+// IDs keep increasing even after the newest entries were evicted. Entries
+// are sorted by ID, since XADD only accepts increasing IDs.
 type Stream struct {
     Entries []Entry
+    LastID  string
+}
+
+// clone returns a copy that shares nothing with stream. Copies of a key
+// need it even though streams are replaced rather than mutated: two Streams
+// over one backing array would both append into the same spare slot.
+func (stream *Stream) clone() *Stream {
+	entries := make([]Entry, len(stream.Entries))
+	for i, entry := range stream.Entries {
+		entry.Fields = append([]FieldValue(nil), entry.Fields...)
+		entries[i] = entry
+	}
+	return &Stream{Entries: entries, LastID: stream.LastID}
+}
+
+var (
+	// ErrStreamIDZero is returned when XADD is given the reserved 0-0 ID.
+	ErrStreamIDZero = errors.New("ERR The ID specified in XADD must be greater than 0-0")
+	// ErrStreamIDTooSmall is returned when an XADD ID does not exceed the stream's last ID.
+	ErrStreamIDTooSmall = errors.New("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	// ErrStreamIDExists is returned when an XADD ID is already present in the stream.
+	ErrStreamIDExists = errors.New("ERR The ID specified in XADD already exists in the target stream")
+	// ErrInvalidStreamID is returned when a stream ID cannot be parsed.
+	ErrInvalidStreamID = errors.New("ERR invalid stream ID specified as stream command argument")
+)
+
+// nextEntryID resolves an XADD ID argument (explicit, "ms-*" or "*") against
+// the stream, returning the ID along with its parsed parts.
+func (stream *Stream) nextEntryID(id string) (string, int64, int64, error) {
+	lastID := stream.LastID
+	if lastID == "" && len(stream.Entries) > 0 {
+		lastID = stream.Entries[len(stream.Entries)-1].ID
+	}
+
+	ms, seq, autoSeq, err := parseStreamID(id, lastID)
+	if err != nil {
+		switch err.Error() {
+		case "ID must be greater than 0-0":
+			return "", 0, 0, ErrStreamIDZero
+		case "ID is not greater than last entry":
+			return "", 0, 0, ErrStreamIDTooSmall
+		}
+		return "", 0, 0, ErrInvalidStreamID
+	}
+
+	if autoSeq {
+		if id == "*" {
+			// Never go backwards: a fully automatic ID reuses the last
+			// millisecond, bumping the sequence, when the clock has not
+			// advanced past it (same-millisecond writers or clock skew).
+			if lastMs, lastSeq, err := splitStreamID(lastID); lastID != "" && err == nil && ms <= lastMs {
+				ms, seq = lastMs, lastSeq+1
+			}
+		} else if strings.HasSuffix(id, "-*") {
+			if lastMs, lastSeq, err := splitStreamID(lastID); lastID != "" && err == nil {
+				if ms < lastMs {
+					return "", 0, 0, ErrStreamIDTooSmall
+				}
+				if ms == lastMs {
+					seq = lastSeq + 1
+				}
+			}
+		}
+
+		id = fmt.Sprintf("%d-%d", ms, seq)
+	}
+
+	if i := stream.search(ms, seq, true); i < len(stream.Entries) && stream.Entries[i].ID == id {
+		return "", 0, 0, ErrStreamIDExists
+	}
+	return id, ms, seq, nil
+}
+
+// search returns the index of the first entry whose ID is after ms-seq, or
+// at it when inclusive is set; len(Entries) when there is none. Entries are
+// sorted, so this is a binary search.
+func (stream *Stream) search(ms, seq int64, inclusive bool) int {
+	return sort.Search(len(stream.Entries), func(i int) bool {
+		c := compareStreamIDs(stream.Entries[i].ms, stream.Entries[i].seq, ms, seq)
+		return c > 0 || (inclusive && c == 0)
+	})
+}
+
+// trimmed returns the entries left after dropping the oldest ones beyond maxLen.
+func (stream *Stream) trimmed(maxLen int) ([]Entry, int) {
+	if maxLen < 0 || len(stream.Entries) <= maxLen {
+		return stream.Entries, 0
+	}
+	evicted := len(stream.Entries) - maxLen
+	return stream.Entries[evicted:], evicted
+}
+
+// getStreamForWriteLocked returns the stream at key, or an empty one when the key is missing.
+func (s *KeyValueStore) getStreamForWriteLocked(key string) (*Stream, error) {
+	value, exists := s.lookupForWriteLocked(key)
+	if !exists {
+		return &Stream{Entries: []Entry{}}, nil
+	}
+	stream, ok := value.(*Stream)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return stream, nil
+}
+
+// AppendToStream validates or generates entry.ID ("*", "ms-*" or explicit)
+// and appends the entry to the stream at key, all under the write lock so
+// concurrent writers never reuse an ID or lose an append. It returns the
+// resolved entry ID.
+func (s *KeyValueStore) AppendToStream(key string, entry Entry) (string, error) {
+	return s.AppendToStreamMaxLen(key, entry, -1)
+}
+
+// AppendToStreamMaxLen is AppendToStream that also trims the oldest entries
+// beyond maxLen under the same lock; a negative maxLen disables trimming. The
+// stored *Stream is replaced rather than mutated so readers holding the old
+// one see a consistent snapshot. The new entry may be appended into spare
+// capacity of the shared backing array: that slot lies past the end of every
+// older Stream's Entries, so no reader can see it change.
+func (s *KeyValueStore) AppendToStreamMaxLen(key string, entry Entry, maxLen int) (string, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	stream, err := s.getStreamForWriteLocked(key)
+	if err != nil {
+		return "", err
+	}
+
+	id, ms, seq, err := stream.nextEntryID(entry.ID)
+	if err != nil {
+		return "", err
+	}
+
+	entry.ID, entry.ms, entry.seq = id, ms, seq
+	updated := &Stream{Entries: append(stream.Entries, entry), LastID: id}
+	size := s.sizeLocked(key) + entrySize(entry)
+	kept, evicted := updated.trimmed(maxLen)
+	size -= entriesSize(updated.Entries[:evicted])
+	updated.Entries = kept
+	s.storeSizedLocked(key, updated, size)
+	return id, nil
+}
+
+// XTrim drops the oldest entries of the stream at key beyond maxLen and
+// returns how many were removed. A missing key trims nothing.
+func (s *KeyValueStore) XTrim(key string, maxLen int) (int, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	value, exists := s.lookupForWriteLocked(key)
+	if !exists {
+		return 0, nil
+	}
+	stream, ok := value.(*Stream)
+	if !ok {
+		return 0, ErrWrongType
+	}
+
+	entries, evicted := stream.trimmed(maxLen)
+	if evicted > 0 {
+		size := s.sizeLocked(key) - entriesSize(stream.Entries[:evicted])
+		s.storeSizedLocked(key, &Stream{Entries: entries, LastID: stream.LastID}, size)
+	}
+	return evicted, nil
 }
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestXAddConcurrent(t *testing.T) {
+	const writers, adds = 50, 200
+	// "*" races on the clock and the sequence both; a fixed millisecond
+	// makes every writer race on the sequence alone.
+	for _, id := range []string{"*", "9999999999999-*"} {
+		t.Run(id, func(t *testing.T) {
+			db := NewKeyValueStore()
+			// Building a server per call would swamp the contention, so
+			// the calls share one.
+			base := testContext(db)
+			xadd := func(args ...string) RESP {
+				ctx := *base
+				ctx.Client = &ClientState{}
+				for _, arg := range args {
+					ctx.Args = append(ctx.Args, NewBulkString(arg))
+				}
+				reply, _ := xaddCommand(&ctx)
+				return reply
+			}
+			replies := make([][]string, writers)
+			var wg sync.WaitGroup
+			for w := 0; w < writers; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < adds; i++ {
+						reply := xadd("s", id, "w", strconv.Itoa(w))
+						if reply.Type != BulkString {
+							t.Errorf("XADD replied %q", reply.Marshal())
+							return
+						}
+						replies[w] = append(replies[w], reply.String)
+					}
+				}()
+			}
+			wg.Wait()
+
+			added := map[string]bool{}
+			for _, ids := range replies {
+				for _, id := range ids {
+					if added[id] {
+						t.Fatalf("ID %s was handed out twice", id)
+					}
+					added[id] = true
+				}
+			}
+			stream, _ := db.GetStream("s")
+			if len(stream.Entries) != writers*adds {
+				t.Fatalf("stream has %d entries, want %d", len(stream.Entries), writers*adds)
+			}
+			for i, entry := range stream.Entries {
+				if !added[entry.ID] {
+					t.Fatalf("entry %s was never returned by XADD", entry.ID)
+				}
+				if i == 0 {
+					continue
+				}
+				prev := stream.Entries[i-1]
+				if entry.ms < prev.ms || entry.ms == prev.ms && entry.seq <= prev.seq {
+					t.Fatalf("entry %s follows %s", entry.ID, prev.ID)
+				}
+			}
+			if last := stream.Entries[len(stream.Entries)-1].ID; stream.LastID != last {
+				t.Fatalf("last ID = %s, want %s", stream.LastID, last)
+			}
+
+			// Each writer's own IDs increase too: its XADDs were ordered.
+			for _, ids := range replies {
+				for i := 1; i < len(ids); i++ {
+					ms1, seq1, _ := splitStreamID(ids[i-1])
+					ms2, seq2, _ := splitStreamID(ids[i])
+					if compareStreamIDs(ms1, seq1, ms2, seq2) >= 0 {
+						t.Fatalf("a writer got %s after %s", ids[i], ids[i-1])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestXReadBlockRacesXAdd(t *testing.T) {
+	const pairs, rounds = 20, 100
+	s := startServer(t, nil)
+
+	// Each writer adds an entry as soon as its reader has the previous one,
+	// so the reader's next XREAD BLOCK and the XADD race every round. A
+	// lost wake-up leaves the reader blocked until read gives up.
+	var wg sync.WaitGroup
+	for p := 0; p < pairs; p++ {
+		key := "s" + strconv.Itoa(p)
+		reader, writer := dial(t, s), dial(t, s)
+		// Buffered and closed by the reader, so neither side hangs if
+		// the other stops early.
+		got := make(chan struct{}, rounds)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				<-got
+				if reply := writer.do("XADD", key, "*", "i", strconv.Itoa(i)); reply.Type != BulkString {
+					t.Errorf("XADD replied %q", reply.Marshal())
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			defer close(got)
+			last := "0-0"
+			for i := 0; i < rounds; i++ {
+				got <- struct{}{}
+				reply := reader.do("XREAD", "BLOCK", "0", "STREAMS", key, last)
+				if reply.Type != Array || len(reply.Array) != 1 {
+					t.Errorf("XREAD replied %q", reply.Marshal())
+					return
+				}
+				entries := reply.Array[0].Array[1].Array
+				if len(entries) != 1 || entries[0].Array[1].Array[1].String != strconv.Itoa(i) {
+					t.Errorf("round %d read %q", i, reply.Marshal())
+					return
+				}
+				last = entries[0].Array[0].String
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestXTrim(t *testing.T) {
+	s := startServer(t, nil)
+	c := dial(t, s)
+	for i := 1; i <= 5; i++ {
+		c.do("XADD", "s", strconv.Itoa(i)+"-0", "i", strconv.Itoa(i))
+	}
+	ids := func() []string {
+		var got []string
+		for _, entry := range c.do("XRANGE", "s", "-", "+").Array {
+			got = append(got, entry.Array[0].String)
+		}
+		return got
+	}
+
+	expectReply(t, c.do("XTRIM", "s", "MAXLEN", "10"), NewInteger(0))
+	expectReply(t, c.do("XTRIM", "s", "MAXLEN", "5"), NewInteger(0))
+	expectReply(t, c.do("XTRIM", "s", "MAXLEN", "~", "3"), NewInteger(2))
+	if got := ids(); !slices.Equal(got, []string{"3-0", "4-0", "5-0"}) {
+		t.Fatalf("after MAXLEN 3 the stream holds %v", got)
+	}
+	expectReply(t, c.do("XADD", "s", "MAXLEN", "3", "6-0", "i", "6"), NewBulkString("6-0"))
+	if got := ids(); !slices.Equal(got, []string{"4-0", "5-0", "6-0"}) {
+		t.Fatalf("after XADD MAXLEN 3 the stream holds %v", got)
+	}
+
+	// Trimming to zero empties the stream but keeps it, and its last ID.
+	expectReply(t, c.do("XTRIM", "s", "MAXLEN", "0"), NewInteger(3))
+	expectReply(t, c.do("TYPE", "s"), NewSimpleString("stream"))
+	expectReply(t, c.do("XRANGE", "s", "-", "+"), NewArray([]RESP{}))
+	reply := c.do("XADD", "s", "6-0", "i", "again")
+	if reply.Type != Error {
+		t.Fatalf("XADD of an ID at the emptied stream's last ID replied %q", reply.Marshal())
+	}
+
+	expectReply(t, c.do("XTRIM", "missing", "MAXLEN", "0"), NewInteger(0))
+	expectReply(t, c.do("XTRIM", "s", "MAXLEN", "-1"), NewError("ERR The MAXLEN argument must be >= 0."))
+}
+
+// TestXReadFromTrimmedID blocks a reader on an ID that has been trimmed
+// away; it gets only what is added after.
+func TestXReadFromTrimmedID(t *testing.T) {
+	s := startServer(t, nil)
+	reader, writer := dial(t, s), dial(t, s)
+	for i := 1; i <= 3; i++ {
+		writer.do("XADD", "s", strconv.Itoa(i)+"-0", "i", strconv.Itoa(i))
+	}
+	expectReply(t, writer.do("XTRIM", "s", "MAXLEN", "0"), NewInteger(3))
+
+	reader.send("XREAD", "BLOCK", "0", "STREAMS", "s", "1-0")
+	waitBlocked(t, s, 1)
+	expectReply(t, writer.do("XADD", "s", "MAXLEN", "1", "4-0", "i", "4"), NewBulkString("4-0"))
+	want := NewArray([]RESP{NewArray([]RESP{
+		NewBulkString("s"),
+		NewArray([]RESP{NewArray([]RESP{NewBulkString("4-0"), NewArray([]RESP{NewBulkString("i"), NewBulkString("4")})})}),
+	})})
+	expectReply(t, reader.read(), want)
+}
+
+func TestStreamRange(t *testing.T) {
+	db := NewKeyValueStore()
+	for _, id := range []string{"1-0", "2-0", "2-1", "3-0", "5-0"} {
+		entry := Entry{ID: id, Fields: []FieldValue{{"z", id}, {"a", "1"}, {"m", "2"}}}
+		if _, err := db.AppendToStream("s", entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"XRANGE", "s", "-", "+"}, []string{"1-0", "2-0", "2-1", "3-0", "5-0"}},
+		{[]string{"XREVRANGE", "s", "+", "-"}, []string{"5-0", "3-0", "2-1", "2-0", "1-0"}},
+		// A bare millisecond covers every sequence in it.
+		{[]string{"XRANGE", "s", "2", "2"}, []string{"2-0", "2-1"}},
+		{[]string{"XREVRANGE", "s", "3", "2"}, []string{"3-0", "2-1", "2-0"}},
+		{[]string{"XRANGE", "s", "2-1", "3-0"}, []string{"2-1", "3-0"}},
+		{[]string{"XRANGE", "s", "(2-0", "(5-0"}, []string{"2-1", "3-0"}},
+		{[]string{"XREVRANGE", "s", "(5-0", "(2-0"}, []string{"3-0", "2-1"}},
+		{[]string{"XRANGE", "s", "4", "4"}, nil},
+		{[]string{"XRANGE", "s", "3", "2"}, nil},
+		{[]string{"XREVRANGE", "s", "2", "3"}, nil},
+		{[]string{"XRANGE", "s", "-", "+", "COUNT", "2"}, []string{"1-0", "2-0"}},
+		{[]string{"XREVRANGE", "s", "+", "-", "COUNT", "2"}, []string{"5-0", "3-0"}},
+		{[]string{"XRANGE", "s", "-", "+", "COUNT", "0"}, nil},
+		{[]string{"XRANGE", "missing", "-", "+"}, nil},
+	}
+	for _, tt := range tests {
+		ctx := testContext(db, tt.args[1:]...)
+		run := xrangeCommand
+		if tt.args[0] == "XREVRANGE" {
+			run = xrevrangeCommand
+		}
+		reply, _ := run(ctx)
+		var got []string
+		for _, entry := range reply.Array {
+			got = append(got, entry.Array[0].String)
+			want := NewArray([]RESP{NewBulkString("z"), NewBulkString(entry.Array[0].String), NewBulkString("a"), NewBulkString("1"), NewBulkString("m"), NewBulkString("2")})
+			if !sameReply(entry.Array[1], want) {
+				t.Fatalf("%v: entry %s has fields %q, want them in insertion order", tt.args, entry.Array[0].String, entry.Array[1].Marshal())
+			}
+		}
+		if reply.Type != Array || !slices.Equal(got, tt.want) {
+			t.Fatalf("%v = %q, want IDs %v", tt.args, reply.Marshal(), tt.want)
+		}
+	}
+}
+
+// TestXReadBlockingShape checks that a blocked XREAD woken by writes to
+// several streams returns every one of them, in the same shape as the
+// non-blocking form reading from the same IDs.
+func TestXReadBlockingShape(t *testing.T) {
+	s := startServer(t, nil)
+	reader, writer := dial(t, s), dial(t, s)
+	writer.do("XADD", "a", "1-0", "f", "old")
+	writer.do("XADD", "b", "1-0", "f", "old")
+
+	reader.send("XREAD", "BLOCK", "0", "STREAMS", "a", "missing", "b", "$", "$", "$")
+	waitBlocked(t, s, 1)
+	// Both writes land before the reader is served.
+	writer.do("MULTI")
+	writer.do("XADD", "b", "2-0", "f", "b2")
+	writer.do("XADD", "a", "2-0", "f", "a2", "g", "x")
+	writer.do("XADD", "a", "3-0", "f", "a3")
+	writer.do("EXEC")
+	blocking := reader.read()
+
+	nonBlocking := writer.do("XREAD", "STREAMS", "a", "missing", "b", "1-0", "0-0", "1-0")
+	want := NewArray([]RESP{
+		NewArray([]RESP{NewBulkString("a"), NewArray([]RESP{
+			NewArray([]RESP{NewBulkString("2-0"), NewArray([]RESP{NewBulkString("f"), NewBulkString("a2"), NewBulkString("g"), NewBulkString("x")})}),
+			NewArray([]RESP{NewBulkString("3-0"), NewArray([]RESP{NewBulkString("f"), NewBulkString("a3")})}),
+		})}),
+		NewArray([]RESP{NewBulkString("b"), NewArray([]RESP{
+			NewArray([]RESP{NewBulkString("2-0"), NewArray([]RESP{NewBulkString("f"), NewBulkString("b2")})}),
+		})}),
+	})
+	expectReply(t, nonBlocking, want)
+	expectReply(t, blocking, want)
+}
+
+// benchmarkStream is a million-entry stream with IDs 1-0 through 1000000-0,
+// built once for the range benchmarks.
+var benchmarkStream = sync.OnceValue(func() *KeyValueStore {
+	db := NewKeyValueStore()
+	for i := 1; i <= 1000000; i++ {
+		id := strconv.Itoa(i) + "-0"
+		if _, err := db.AppendToStream("s", Entry{ID: id, Fields: []FieldValue{{"i", id}}}); err != nil {
+			panic(err)
+		}
+	}
+	return db
+})
+
+// BenchmarkStreamRange reads ten entries from a million-entry stream at its
+// start, middle and end, with XRANGE and, at the end, with XREAD. The
+// "scan" cases find the same range the way ranges were found before
+// entries kept their parsed IDs, by walking the stream and parsing each ID,
+// for comparison.
+func BenchmarkStreamRange(b *testing.B) {
+	db := benchmarkStream()
+	stream, _ := db.GetStream("s")
+	// Building a server per call would swamp the read, so the calls share one.
+	base := testContext(db)
+	run := func(b *testing.B, command func(*CommandContext) (RESP, []byte), args ...string) {
+		ctx := *base
+		for _, arg := range args {
+			ctx.Args = append(ctx.Args, NewBulkString(arg))
+		}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if reply, _ := command(&ctx); reply.Type != Array || len(reply.Array) == 0 {
+				b.Fatalf("%v replied %q", args, reply.Marshal())
+			}
+		}
+	}
+	for _, start := range []int{1, 500000, 999990} {
+		from, to := strconv.Itoa(start)+"-0", strconv.Itoa(start+9)+"-0"
+		b.Run("xrange/start="+strconv.Itoa(start), func(b *testing.B) {
+			run(b, xrangeCommand, "s", from, to)
+		})
+		b.Run("scan/start="+strconv.Itoa(start), func(b *testing.B) {
+			b.ReportAllocs()
+			fromMs, fromSeq, _ := splitStreamID(from)
+			toMs, toSeq, _ := splitStreamID(to)
+			for i := 0; i < b.N; i++ {
+				var found []Entry
+				for _, entry := range stream.Entries {
+					ms, seq, _ := splitStreamID(entry.ID)
+					if compareStreamIDs(ms, seq, fromMs, fromSeq) >= 0 && compareStreamIDs(ms, seq, toMs, toSeq) <= 0 {
+						found = append(found, entry)
+					}
+				}
+				if len(found) != 10 {
+					b.Fatalf("scan found %d entries", len(found))
+				}
+			}
+		})
+	}
+	b.Run("xread/newest", func(b *testing.B) {
+		run(b, xreadCommand, "STREAMS", "s", "999990-0")
+	})
+}
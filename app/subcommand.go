@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Subcommand is one subcommand of a command such as CONFIG, dispatched on
+// the command's first argument.
+type Subcommand struct {
+	Name string
+	// Handler runs with Args holding the arguments after the subcommand name.
+	Handler Handler
+	// MinArgs and MaxArgs bound those arguments; MaxArgs -1 means variadic.
+	MinArgs int
+	MaxArgs int
+	// Usage follows the name on its HELP line, e.g. "<pattern> [<pattern> ...]".
+	Usage string
+	// Help holds the lines describing the subcommand under it in HELP.
+	Help []string
+}
+
+// helpSubcommand is the HELP every command with subcommands answers.
+var helpSubcommand = Subcommand{Name: "HELP", Help: []string{"Print this help."}}
+
+// RegisterSubcommands registers name as a command dispatching to subs. Calls
+// naming no subcommand in subs, or giving one the wrong number of arguments,
+// get the same errors for every such command, and a HELP subcommand listing
+// subs is added.
+func (r *Registry) RegisterSubcommands(name string, isWrite bool, subs []Subcommand) {
+	name = strings.ToUpper(name)
+	r.subcommands[name] = subs
+	r.Register(name, r.dispatchSubcommand(name), isWrite, 1, -1)
+}
+
+// dispatchSubcommand returns the handler of a command registered with
+// RegisterSubcommands.
+func (r *Registry) dispatchSubcommand(name string) Handler {
+	return func(ctx *CommandContext) (RESP, []byte) {
+		subName, args := ctx.Args[0].String, ctx.Args[1:]
+		if strings.EqualFold(subName, helpSubcommand.Name) && len(args) == 0 {
+			return r.subcommandHelp(name), nil
+		}
+		sub, ok := r.subcommand(name, subName)
+		if !ok {
+			return unknownSubcommand(name, subName), nil
+		}
+		if len(args) < sub.MinArgs || (sub.MaxArgs >= 0 && len(args) > sub.MaxArgs) {
+			return NewError(fmt.Sprintf("ERR Unknown subcommand or wrong number of arguments for '%s'. Try %s HELP.", subName, name)), nil
+		}
+		subCtx := *ctx
+		subCtx.Args = args
+		return sub.Handler(&subCtx)
+	}
+}
+
+// unknownSubcommand is the error for calling name with subName, which is
+// not one of its subcommands.
+func unknownSubcommand(name, subName string) RESP {
+	return NewError(fmt.Sprintf("ERR unknown subcommand '%s'. Try %s HELP.", subName, name))
+}
+
+// subcommand looks up a subcommand of name, ignoring case.
+func (r *Registry) subcommand(name, subName string) (Subcommand, bool) {
+	for _, sub := range r.subcommands[name] {
+		if strings.EqualFold(sub.Name, subName) {
+			return sub, true
+		}
+	}
+	return Subcommand{}, false
+}
+
+// subcommandHelp renders HELP for name as Redis does: a header, then each
+// subcommand's usage line followed by its indented description.
+func (r *Registry) subcommandHelp(name string) RESP {
+	lines := []RESP{NewSimpleString(name + " <subcommand> [<arg> [value] [opt] ...]. Subcommands are:")}
+	subs := r.subcommands[name]
+	// The full slice expression makes append copy rather than write into
+	// spare capacity shared with concurrent HELP calls.
+	for _, sub := range append(subs[:len(subs):len(subs)], helpSubcommand) {
+		usage := sub.Name
+		if sub.Usage != "" {
+			usage += " " + sub.Usage
+		}
+		lines = append(lines, NewSimpleString(usage))
+		for _, help := range sub.Help {
+			lines = append(lines, NewSimpleString("    "+help))
+		}
+	}
+	return NewArray(lines)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds how long a client may take over the TLS
+// handshake before its connection is dropped.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// loadTLSConfigs builds the config TLS clients are served with and the one a
+// replica dials its master with. Both present the same certificate. With a
+// CA file, clients must present a certificate it signed, and the master's
+// certificate is verified against it instead of the system roots.
+func loadTLSConfigs(certFile, keyFile, caFile string) (server, client *tls.Config, err error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("tls-cert-file/tls-key-file: %w", err)
+	}
+	server = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	client = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("tls-ca-cert-file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, errors.New("tls-ca-cert-file: no certificates found")
+		}
+		server.ClientCAs, server.ClientAuth = pool, tls.RequireAndVerifyClientCert
+		client.RootCAs = pool
+	}
+	return server, client, nil
+}
+
+// tlsListener wraps accepted connections in TLS. The handshake is left to
+// the client's goroutine (see handshakeTLS) so a slow or broken client never
+// holds up the accept loop.
+type tlsListener struct {
+	net.Listener
+	config *tls.Config
+}
+
+// Accept returns the next connection as the server side of a TLS session.
+func (l tlsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Server(conn, l.config), nil
+}
+
+// ListenTLS listens on the TCP address addr for TLS clients, using the
+// certificate given in the server's options.
+func (s *Server) ListenTLS(addr string) (net.Listener, error) {
+	if s.tlsConfig == nil {
+		return nil, errors.New("TLS needs tls-cert-file and tls-key-file")
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return tlsListener{Listener: l, config: s.tlsConfig}, nil
+}
+
+// handshakeTLS completes the handshake of a TLS client, closing conn and
+// reporting false if it fails. Other connections pass straight through.
+func (s *Server) handshakeTLS(conn net.Conn) bool {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(s.shutdown.Context(), tlsHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		logVerbose("TLS handshake failed", "addr", conn.RemoteAddr().String(), "err", err)
+		conn.Close()
+		return false
+	}
+	return true
+}
+
+// dialMasterTLS starts TLS on a replica's connection to host when
+// tls-replication is on, verifying the master's certificate against host.
+// It returns conn unchanged otherwise, and closes it if the handshake fails.
+func (s *Server) dialMasterTLS(ctx context.Context, conn net.Conn, host string) (net.Conn, error) {
+	config := s.replTLSConfig
+	if config == nil {
+		return conn, nil
+	}
+	config = config.Clone()
+	config.ServerName = host
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with master failed: %w", err)
+	}
+	return tlsConn, nil
+}
+
+// announcedPort is the port a replica tells its master it listens on: its
+// TLS port when it replicates over TLS and has one, else its plain port.
+func (s *Server) announcedPort() int {
+	config := s.Config()
+	if config.TLSReplication && config.TLSPort != 0 {
+		return config.TLSPort
+	}
+	return config.Port
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// trackingChannel is the channel RESP2 clients subscribe to on the
+// connection they redirect invalidations to.
+const trackingChannel = "__redis__:invalidate"
+
+// trackingClient is one connection with CLIENT TRACKING on, and the ID of
+// the connection its invalidations go to, or 0 for itself.
+type trackingClient struct {
+	state    *ClientState
+	redirect int64
+}
+
+// TrackingManager implements the default mode of server-assisted client
+// side caching. It remembers which tracking clients read each key, and the
+// first time such a key changes it tells them once and forgets them until
+// they read it again. Key names are shared by every database, as in Redis.
+type TrackingManager struct {
+	server  *Server
+	mu      sync.Mutex
+	keys    map[string]map[int64]struct{}
+	clients map[int64]*trackingClient
+	// active mirrors len(clients) so the write path skips the lock while
+	// nobody tracks.
+	active atomic.Int64
+}
+
+// newTrackingManager returns a manager with tracking off everywhere.
+func newTrackingManager(s *Server) *TrackingManager {
+	return &TrackingManager{
+		server:  s,
+		keys:    make(map[string]map[int64]struct{}),
+		clients: make(map[int64]*trackingClient),
+	}
+}
+
+// Enable turns tracking on for state, sending its invalidations to the
+// client with ID redirect, or to itself when redirect is 0.
+func (tm *TrackingManager) Enable(state *ClientState, redirect int64) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.clients[state.ID] = &trackingClient{state: state, redirect: redirect}
+	tm.active.Store(int64(len(tm.clients)))
+}
+
+// Disable turns tracking off for state. Keys it read stay in the table
+// until they change, but nothing is sent to it for them.
+func (tm *TrackingManager) Disable(state *ClientState) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	delete(tm.clients, state.ID)
+	tm.active.Store(int64(len(tm.clients)))
+	if len(tm.clients) == 0 {
+		tm.keys = make(map[string]map[int64]struct{})
+	}
+}
+
+// Redirect returns the ID state's invalidations go to: 0 for itself, or
+// -1 when it does not track.
+func (tm *TrackingManager) Redirect(state *ClientState) int64 {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tc, ok := tm.clients[state.ID]
+	if !ok {
+		return -1
+	}
+	return tc.redirect
+}
+
+// Remember records that state read keys, if it tracks.
+func (tm *TrackingManager) Remember(state *ClientState, keys []string) {
+	if tm.active.Load() == 0 || len(keys) == 0 {
+		return
+	}
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if _, ok := tm.clients[state.ID]; !ok {
+		return
+	}
+	for _, key := range keys {
+		readers := tm.keys[key]
+		if readers == nil {
+			readers = make(map[int64]struct{})
+			tm.keys[key] = readers
+		}
+		readers[state.ID] = struct{}{}
+	}
+}
+
+// Invalidate tells every tracking client that read one of keys that it
+// changed. It is called with store locks held, so delivery only queues.
+func (tm *TrackingManager) Invalidate(keys ...string) {
+	if tm.active.Load() == 0 {
+		return
+	}
+	tm.mu.Lock()
+	changed := make(map[*trackingClient][]string)
+	for _, key := range keys {
+		for id := range tm.keys[key] {
+			if tc, ok := tm.clients[id]; ok {
+				changed[tc] = append(changed[tc], key)
+			}
+		}
+		delete(tm.keys, key)
+	}
+	tm.mu.Unlock()
+
+	for tc, keys := range changed {
+		tm.send(tc, keys)
+	}
+}
+
+// InvalidateAll tells every tracking client to drop its whole cache, as
+// after a flush or a full resync from the master.
+func (tm *TrackingManager) InvalidateAll() {
+	if tm.active.Load() == 0 {
+		return
+	}
+	tm.mu.Lock()
+	tm.keys = make(map[string]map[int64]struct{})
+	clients := make([]*trackingClient, 0, len(tm.clients))
+	for _, tc := range tm.clients {
+		clients = append(clients, tc)
+	}
+	tm.mu.Unlock()
+
+	for _, tc := range clients {
+		tm.send(tc, nil)
+	}
+}
+
+// send delivers one invalidation for keys, or for everything when keys is
+// nil. RESP3 connections get an invalidate push; a RESP2 connection can
+// only take one through the tracking channel, so it must be a redirect
+// target subscribed to it, and otherwise the message is dropped.
+func (tm *TrackingManager) send(tc *trackingClient, keys []string) {
+	target := tc.state
+	if tc.redirect != 0 {
+		if target = tm.server.clientByID(tc.redirect); target == nil {
+			return
+		}
+	}
+	payload := NewNullArray()
+	if keys != nil {
+		items := make([]RESP, len(keys))
+		for i, key := range keys {
+			items[i] = NewBulkString(key)
+		}
+		payload = NewArray(items)
+	}
+
+	if target.Proto() == RESP3 {
+		push := NewPush([]RESP{NewBulkString("invalidate"), payload})
+		target.queuePush(push.MarshalBytesFor(RESP3))
+		return
+	}
+	if tc.redirect != 0 {
+		tm.server.pubsub.SendTo(target.conn, trackingChannel, payload)
+	}
+}
+
+// queuePush queues an out-of-band reply for the connection. handleClient
+// writes queued pushes ahead of its next reply, and a goroutine writes them
+// while the connection waits for input, so a push never lands inside a
+// reply. A connection that stops reading is closed once
+// subscriberQueueSize pushes are waiting.
+func (c *ClientState) queuePush(b []byte) {
+	c.pushMu.Lock()
+	defer c.pushMu.Unlock()
+	if len(c.pushes) >= subscriberQueueSize {
+		c.conn.Close()
+		return
+	}
+	c.pushes = append(c.pushes, b)
+	if !c.pushScheduled {
+		c.pushScheduled = true
+		go c.deliverPushes()
+	}
+}
+
+// takePushes returns and clears the queued pushes; callers must hold outMu.
+func (c *ClientState) takePushes() [][]byte {
+	c.pushMu.Lock()
+	defer c.pushMu.Unlock()
+	pushes := c.pushes
+	c.pushes = nil
+	c.pushScheduled = false
+	return pushes
+}
+
+// deliverPushes writes the queued pushes as soon as handleClient lets go of
+// the connection's output.
+func (c *ClientState) deliverPushes() {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	for _, b := range c.takePushes() {
+		if _, err := c.conn.Write(b); err != nil {
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// signalModifiedKeys tells what watches or caches keys of database db that
+// they changed: WATCH dirties its transactions, and tracking invalidates
+// the keys for the clients that read them.
+func (s *Server) signalModifiedKeys(db int, keys ...string) {
+	s.watches.Touch(db, keys...)
+	s.tracking.Invalidate(keys...)
+}
+
+// signalFlushedDBs is signalModifiedKeys for databases whose every key was
+// replaced at once.
+func (s *Server) signalFlushedDBs(dbs ...int) {
+	for _, db := range dbs {
+		s.watches.TouchDB(db)
+	}
+	s.tracking.InvalidateAll()
+}
+
+// clientTrackingCommand implements CLIENT TRACKING ON|OFF [REDIRECT id].
+// Only the default mode is supported; BCAST, PREFIX, OPTIN, OPTOUT and
+// NOLOOP are refused.
+func clientTrackingCommand(ctx *CommandContext) (RESP, []byte) {
+	args := ctx.Args
+	var redirect int64
+	for i := 1; i < len(args); i++ {
+		switch option := strings.ToUpper(args[i].String); option {
+		case "REDIRECT":
+			if i+1 == len(args) {
+				return NewError("ERR syntax error"), nil
+			}
+			i++
+			id, err := strconv.ParseInt(args[i].String, 10, 64)
+			if err != nil {
+				return NewError("ERR value is not an integer or out of range"), nil
+			}
+			redirect = id
+		case "BCAST", "PREFIX", "OPTIN", "OPTOUT", "NOLOOP":
+			return NewError("ERR CLIENT TRACKING " + option + " is not supported"), nil
+		default:
+			return NewError("ERR syntax error"), nil
+		}
+	}
+
+	tracking := ctx.Server.tracking
+	switch strings.ToUpper(args[0].String) {
+	case "ON":
+		if redirect == ctx.Client.ID {
+			redirect = 0
+		}
+		if redirect != 0 && ctx.Server.clientByID(redirect) == nil {
+			return NewError("ERR The client ID you want redirect to does not exist"), nil
+		}
+		tracking.Enable(ctx.Client, redirect)
+	case "OFF":
+		tracking.Disable(ctx.Client)
+	default:
+		return NewError("ERR syntax error"), nil
+	}
+	return NewSimpleString("OK"), nil
+}
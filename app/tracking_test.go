@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// invalidation is the push a RESP3 tracking client gets when keys change,
+// or when everything does if keys is empty.
+func invalidation(keys ...string) RESP {
+	payload := NewNull()
+	if len(keys) > 0 {
+		items := make([]RESP, len(keys))
+		for i, key := range keys {
+			items[i] = NewBulkString(key)
+		}
+		payload = NewArray(items)
+	}
+	return NewPush([]RESP{NewBulkString("invalidate"), payload})
+}
+
+// trackingClient3 dials s and turns on RESP3 and CLIENT TRACKING.
+func trackingClient3(t *testing.T, s *Server) *testClient {
+	t.Helper()
+	c := dial(t, s)
+	c.do("HELLO", "3")
+	expectReply(t, c.do("CLIENT", "TRACKING", "ON"), NewSimpleString("OK"))
+	return c
+}
+
+func TestClientTracking(t *testing.T) {
+	s := startServer(t, nil)
+	c, w := trackingClient3(t, s), dial(t, s)
+
+	w.do("SET", "a", "1")
+	w.do("SET", "b", "2")
+	c.do("GET", "a")
+	c.do("EXISTS", "b", "unread")
+	expectReply(t, w.do("DEL", "a", "b", "c"), NewInteger(2))
+	expectReply(t, c.read(), invalidation("a", "b"))
+	// Each read is invalidated once; the next write needs a new read.
+	expectReply(t, w.do("SET", "a", "2"), NewSimpleString("OK"))
+	c.expectNoReply(100 * time.Millisecond)
+
+	// The client's own write is invalidated too, ahead of its reply.
+	c.do("GET", "a")
+	c.send("INCR", "a")
+	expectReply(t, c.read(), invalidation("a"))
+	expectReply(t, c.read(), NewInteger(3))
+
+	// So is a key the expiry cycle removes.
+	expectReply(t, w.do("SET", "e", "v", "PX", "50"), NewSimpleString("OK"))
+	expectReply(t, c.do("GET", "e"), NewBulkString("v"))
+	expectReply(t, c.read(), invalidation("e"))
+
+	expectReply(t, w.do("FLUSHALL"), NewSimpleString("OK"))
+	expectReply(t, c.read(), invalidation())
+
+	// A blocked client still gets its invalidations.
+	c.do("GET", "k")
+	c.send("BLMPOP", "0", "1", "list", "LEFT")
+	waitBlocked(t, s, 1)
+	expectReply(t, w.do("SET", "k", "v"), NewSimpleString("OK"))
+	expectReply(t, c.read(), invalidation("k"))
+	expectReply(t, w.do("RPUSH", "list", "x"), NewInteger(1))
+	expectReply(t, c.read(), NewArray([]RESP{NewBulkString("list"), NewArray([]RESP{NewBulkString("x")})}))
+
+	expectReply(t, c.do("CLIENT", "GETREDIR"), NewInteger(0))
+	expectReply(t, c.do("CLIENT", "TRACKING", "OFF"), NewSimpleString("OK"))
+	expectReply(t, c.do("CLIENT", "GETREDIR"), NewInteger(-1))
+	c.do("GET", "k")
+	expectReply(t, w.do("SET", "k", "v"), NewSimpleString("OK"))
+	c.expectNoReply(100 * time.Millisecond)
+}
+
+// TestClientTrackingRedirect sends a RESP2 client's invalidations to
+// another connection subscribed to the tracking channel.
+func TestClientTrackingRedirect(t *testing.T) {
+	s := startServer(t, nil)
+	target, c, w := dial(t, s), dial(t, s), dial(t, s)
+	id := target.do("CLIENT", "ID")
+	target.do("SUBSCRIBE", trackingChannel)
+
+	expectReply(t, c.do("CLIENT", "TRACKING", "ON", "REDIRECT", strconv.Itoa(id.Number)), NewSimpleString("OK"))
+	expectReply(t, c.do("CLIENT", "GETREDIR"), id)
+	c.do("GET", "k")
+	expectReply(t, w.do("SET", "k", "v"), NewSimpleString("OK"))
+	expectReply(t, target.read(), NewArray([]RESP{
+		NewBulkString("message"), NewBulkString(trackingChannel), NewArray([]RESP{NewBulkString("k")}),
+	}))
+	// Without a redirect a RESP2 client has nowhere to get them.
+	expectReply(t, c.do("CLIENT", "TRACKING", "ON"), NewSimpleString("OK"))
+	c.do("GET", "k")
+	expectReply(t, w.do("SET", "k", "v"), NewSimpleString("OK"))
+	c.expectNoReply(100 * time.Millisecond)
+	target.expectNoReply(100 * time.Millisecond)
+
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"ON", "REDIRECT", "999999"}, "ERR The client ID you want redirect to does not exist"},
+		{[]string{"ON", "REDIRECT"}, "ERR syntax error"},
+		{[]string{"ON", "BCAST"}, "ERR CLIENT TRACKING BCAST is not supported"},
+		{[]string{"MAYBE"}, "ERR syntax error"},
+	} {
+		expectReply(t, c.do(append([]string{"CLIENT", "TRACKING"}, tt.args...)...), NewError(tt.want))
+	}
+}
+
+// TestClientTrackingOnReplica checks the keys a client reads from a
+// replica are invalidated as the master's writes are applied, and that a
+// full resync invalidates everything.
+func TestClientTrackingOnReplica(t *testing.T) {
+	master, other := startServer(t, nil), startServer(t, nil)
+	replica := startReplica(t, master)
+	c, rc, mc := trackingClient3(t, replica), dial(t, replica), dial(t, master)
+
+	expectReply(t, mc.do("SET", "k", "v1"), NewSimpleString("OK"))
+	eventually(t, "the replica to apply the write", func() bool {
+		return sameReply(rc.do("GET", "k"), NewBulkString("v1"))
+	})
+	expectReply(t, c.do("GET", "k"), NewBulkString("v1"))
+	expectReply(t, mc.do("SET", "k", "v2"), NewSimpleString("OK"))
+	expectReply(t, c.read(), invalidation("k"))
+
+	expectReply(t, c.do("GET", "k"), NewBulkString("v2"))
+	expectReply(t, rc.do("REPLICAOF", "127.0.0.1", strconv.Itoa(other.Config().Port)), NewSimpleString("OK"))
+	expectReply(t, c.read(), invalidation())
+}
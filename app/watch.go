@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// connWatch is the set of keys one connection watches, and whether any of
+// them has been touched since it started watching.
+type connWatch struct {
+	keys  []dbKey
+	dirty bool
+}
+
+// WatchManager tracks the keys connections WATCH for an optimistic
+// transaction. A write to a watched key marks every connection watching it
+// dirty, and EXEC on a dirty connection runs nothing.
+type WatchManager struct {
+	mu       sync.Mutex
+	watchers map[dbKey]map[net.Conn]struct{}
+	byConn   map[net.Conn]*connWatch
+}
+
+// newWatchManager returns a manager with nothing watched.
+func newWatchManager() *WatchManager {
+	return &WatchManager{
+		watchers: make(map[dbKey]map[net.Conn]struct{}),
+		byConn:   make(map[net.Conn]*connWatch),
+	}
+}
+
+// Watch adds keys of database db to the keys conn watches.
+func (wm *WatchManager) Watch(conn net.Conn, db int, keys []string) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+
+	cw := wm.byConn[conn]
+	if cw == nil {
+		cw = &connWatch{}
+		wm.byConn[conn] = cw
+	}
+	for _, key := range keys {
+		dk := dbKey{db, key}
+		conns := wm.watchers[dk]
+		if conns == nil {
+			conns = make(map[net.Conn]struct{})
+			wm.watchers[dk] = conns
+		}
+		if _, ok := conns[conn]; ok {
+			continue
+		}
+		conns[conn] = struct{}{}
+		cw.keys = append(cw.keys, dk)
+	}
+}
+
+// Unwatch forgets every key conn watches and reports whether any of them
+// was touched meanwhile.
+func (wm *WatchManager) Unwatch(conn net.Conn) bool {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+
+	cw := wm.byConn[conn]
+	if cw == nil {
+		return false
+	}
+	delete(wm.byConn, conn)
+	for _, dk := range cw.keys {
+		conns := wm.watchers[dk]
+		delete(conns, conn)
+		if len(conns) == 0 {
+			delete(wm.watchers, dk)
+		}
+	}
+	return cw.dirty
+}
+
+// RemoveConn drops the watches of a disconnected connection.
+func (wm *WatchManager) RemoveConn(conn net.Conn) {
+	wm.Unwatch(conn)
+}
+
+// Touch marks the connections watching keys of database db dirty.
+func (wm *WatchManager) Touch(db int, keys ...string) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+
+	for _, key := range keys {
+		for conn := range wm.watchers[dbKey{db, key}] {
+			wm.byConn[conn].dirty = true
+		}
+	}
+}
+
+// TouchDB marks every connection watching a key of database db dirty, for
+// commands that replace a whole database, such as FLUSHDB and SWAPDB. Like
+// Redis it does not check whether the key's value actually changed.
+func (wm *WatchManager) TouchDB(db int) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+
+	for dk, conns := range wm.watchers {
+		if dk.db != db {
+			continue
+		}
+		for conn := range conns {
+			wm.byConn[conn].dirty = true
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestWatch(t *testing.T) {
+	s := startServer(t, nil)
+	c, other := dial(t, s), dial(t, s)
+
+	// An untouched watch lets the transaction run.
+	expectReply(t, c.do("WATCH", "k"), NewSimpleString("OK"))
+	expectReply(t, other.do("SET", "unrelated", "v"), NewSimpleString("OK"))
+	expectReply(t, c.do("MULTI"), NewSimpleString("OK"))
+	expectReply(t, c.do("SET", "k", "mine"), NewSimpleString("QUEUED"))
+	expectReply(t, c.do("EXEC"), NewArray([]RESP{NewSimpleString("OK")}))
+
+	// A write to the watched key by another client aborts it.
+	expectReply(t, c.do("WATCH", "k"), NewSimpleString("OK"))
+	expectReply(t, other.do("SET", "k", "theirs"), NewSimpleString("OK"))
+	expectReply(t, c.do("MULTI"), NewSimpleString("OK"))
+	expectReply(t, c.do("SET", "k", "mine"), NewSimpleString("QUEUED"))
+	expectReply(t, c.do("EXEC"), NewNullArray())
+	expectReply(t, c.do("GET", "k"), NewBulkString("theirs"))
+
+	// EXEC forgot the watch, so the next transaction runs.
+	expectReply(t, other.do("SET", "k", "again"), NewSimpleString("OK"))
+	expectReply(t, c.do("MULTI"), NewSimpleString("OK"))
+	expectReply(t, c.do("GET", "k"), NewSimpleString("QUEUED"))
+	expectReply(t, c.do("EXEC"), NewArray([]RESP{NewBulkString("again")}))
+
+	// So does UNWATCH.
+	expectReply(t, c.do("WATCH", "k"), NewSimpleString("OK"))
+	expectReply(t, c.do("UNWATCH"), NewSimpleString("OK"))
+	expectReply(t, other.do("DEL", "k"), NewInteger(1))
+	expectReply(t, c.do("MULTI"), NewSimpleString("OK"))
+	expectReply(t, c.do("EXISTS", "k"), NewSimpleString("QUEUED"))
+	expectReply(t, c.do("EXEC"), NewArray([]RESP{NewInteger(0)}))
+
+	// The same key name in another database is a different key.
+	expectReply(t, c.do("WATCH", "k"), NewSimpleString("OK"))
+	expectReply(t, other.do("SELECT", "1"), NewSimpleString("OK"))
+	expectReply(t, other.do("SET", "k", "v"), NewSimpleString("OK"))
+	expectReply(t, c.do("MULTI"), NewSimpleString("OK"))
+	expectReply(t, c.do("PING"), NewSimpleString("QUEUED"))
+	expectReply(t, c.do("EXEC"), NewArray([]RESP{NewSimpleString("PONG")}))
+}
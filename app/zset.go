@@ -0,0 +1,367 @@
+package main
+
+import (
+	"maps"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// zsetEntrySize is what a member costs in the memory accounting besides
+// its name: the score.
+const zsetEntrySize = 8
+
+// ZMember is a member of a sorted set with its score.
+type ZMember struct {
+	Member string
+	Score  float64
+}
+
+// zmemberLess orders sorted set members by score, breaking ties by member.
+func zmemberLess(a, b ZMember) bool {
+	if a.Score != b.Score {
+		return a.Score < b.Score
+	}
+	return a.Member < b.Member
+}
+
+// ZSet holds the members stored under a single key. scores answers ZSCORE
+// in O(1) and sorted keeps the members in ZRANGE order, so range reads are
+// a binary search; inserts and removals shift the slice, which is cheap at
+// the sizes sorted sets are used for here.
+type ZSet struct {
+	scores map[string]float64
+	sorted []ZMember
+}
+
+// newZSet returns an empty sorted set.
+func newZSet() *ZSet {
+	return &ZSet{scores: make(map[string]float64)}
+}
+
+// Len returns the number of members.
+func (z *ZSet) Len() int {
+	return len(z.sorted)
+}
+
+// Members returns the members in ascending order. The slice aliases the set,
+// so callers must copy it before releasing the lock.
+func (z *ZSet) Members() []ZMember {
+	return z.sorted
+}
+
+// Score returns the score of member.
+func (z *ZSet) Score(member string) (float64, bool) {
+	score, ok := z.scores[member]
+	return score, ok
+}
+
+// position returns where m sits, or would be inserted, in sorted.
+func (z *ZSet) position(m ZMember) int {
+	return sort.Search(len(z.sorted), func(i int) bool {
+		return !zmemberLess(z.sorted[i], m)
+	})
+}
+
+// set adds member or moves it to score, reporting whether it is new.
+func (z *ZSet) set(member string, score float64) bool {
+	old, exists := z.scores[member]
+	if exists {
+		if old == score {
+			return false
+		}
+		z.removeAt(z.position(ZMember{member, old}))
+	}
+	z.scores[member] = score
+	m := ZMember{member, score}
+	i := z.position(m)
+	z.sorted = append(z.sorted, ZMember{})
+	copy(z.sorted[i+1:], z.sorted[i:])
+	z.sorted[i] = m
+	return !exists
+}
+
+// remove deletes member, reporting whether it was present.
+func (z *ZSet) remove(member string) bool {
+	score, exists := z.scores[member]
+	if !exists {
+		return false
+	}
+	delete(z.scores, member)
+	z.removeAt(z.position(ZMember{member, score}))
+	return true
+}
+
+// removeAt drops the entry at index i of sorted.
+func (z *ZSet) removeAt(i int) {
+	copy(z.sorted[i:], z.sorted[i+1:])
+	z.sorted[len(z.sorted)-1] = ZMember{}
+	z.sorted = z.sorted[:len(z.sorted)-1]
+}
+
+// clone returns a copy that shares nothing with z.
+func (z *ZSet) clone() *ZSet {
+	return &ZSet{
+		scores: maps.Clone(z.scores),
+		sorted: append([]ZMember(nil), z.sorted...),
+	}
+}
+
+// ScoreBound is one end of a score range: a score, -inf or +inf, inclusive
+// unless written with a leading "(".
+type ScoreBound struct {
+	Score     float64
+	Exclusive bool
+}
+
+// parseScoreBound parses a ZRANGEBYSCORE min or max.
+func parseScoreBound(s string) (ScoreBound, bool) {
+	var bound ScoreBound
+	if strings.HasPrefix(s, "(") {
+		bound.Exclusive = true
+		s = s[1:]
+	}
+	score, ok := parseScore(s)
+	bound.Score = score
+	return bound, ok
+}
+
+// parseScore parses a score as ZADD takes it, rejecting NaN.
+func parseScore(s string) (float64, bool) {
+	score, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, false
+	}
+	return score, true
+}
+
+// scoreRange returns the slice bounds of the members scored between lower
+// and upper.
+func (z *ZSet) scoreRange(lower, upper ScoreBound) (int, int) {
+	lo := sort.Search(len(z.sorted), func(i int) bool {
+		score := z.sorted[i].Score
+		return score > lower.Score || (!lower.Exclusive && score == lower.Score)
+	})
+	hi := sort.Search(len(z.sorted), func(i int) bool {
+		score := z.sorted[i].Score
+		return score > upper.Score || (upper.Exclusive && score == upper.Score)
+	})
+	return lo, max(lo, hi)
+}
+
+// getZSetLocked returns the sorted set at key; callers must hold at least
+// the read lock.
+func (s *KeyValueStore) getZSetLocked(key string) (*ZSet, bool, error) {
+	value, exists := s.lookupLocked(key)
+	if !exists {
+		return nil, false, nil
+	}
+	zset, ok := value.(*ZSet)
+	if !ok {
+		return nil, false, ErrWrongType
+	}
+	return zset, true, nil
+}
+
+// getZSetForWriteLocked is getZSetLocked for writers, dropping the key first
+// if it has expired; callers must hold the write lock.
+func (s *KeyValueStore) getZSetForWriteLocked(key string) (*ZSet, bool, error) {
+	value, exists := s.lookupForWriteLocked(key)
+	if !exists {
+		return nil, false, nil
+	}
+	zset, ok := value.(*ZSet)
+	if !ok {
+		return nil, false, ErrWrongType
+	}
+	return zset, true, nil
+}
+
+// ZAddOptions are the NX, XX, GT and LT flags of ZADD.
+type ZAddOptions struct {
+	NX, XX, GT, LT bool
+}
+
+// ZAdd adds members or updates their scores as the options allow, creating
+// the set if needed unless XX is given. It returns how many members were
+// added and how many existing ones had their score changed.
+func (s *KeyValueStore) ZAdd(key string, members []ZMember, opts ZAddOptions) (int, int, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	zset, exists, err := s.getZSetForWriteLocked(key)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !exists {
+		if opts.XX {
+			return 0, 0, nil
+		}
+		zset = newZSet()
+		s.storeLocked(key, zset)
+	}
+
+	added, updated := 0, 0
+	for _, m := range members {
+		old, present := zset.Score(m.Member)
+		switch {
+		case present && (opts.NX || (opts.GT && m.Score <= old) || (opts.LT && m.Score >= old)):
+			continue
+		case !present && opts.XX:
+			continue
+		}
+		if zset.set(m.Member, m.Score) {
+			s.growLocked(key, int64(len(m.Member)+zsetEntrySize))
+			added++
+		} else if m.Score != old {
+			updated++
+		}
+	}
+	return added, updated, nil
+}
+
+// ZScore returns the score of member in the sorted set at key.
+func (s *KeyValueStore) ZScore(key, member string) (float64, bool, error) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	zset, exists, err := s.getZSetLocked(key)
+	if err != nil || !exists {
+		return 0, false, err
+	}
+	score, ok := zset.Score(member)
+	return score, ok, nil
+}
+
+// ZCard returns the number of members in the sorted set at key, 0 when it
+// does not exist.
+func (s *KeyValueStore) ZCard(key string) (int, error) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	zset, exists, err := s.getZSetLocked(key)
+	if err != nil || !exists {
+		return 0, err
+	}
+	return zset.Len(), nil
+}
+
+// ZRem removes members from the sorted set at key and returns how many were
+// removed, deleting the key once it is empty.
+func (s *KeyValueStore) ZRem(key string, members []string) (int, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	zset, exists, err := s.getZSetForWriteLocked(key)
+	if err != nil || !exists {
+		return 0, err
+	}
+	removed := 0
+	for _, member := range members {
+		if zset.remove(member) {
+			s.growLocked(key, -int64(len(member)+zsetEntrySize))
+			removed++
+		}
+	}
+	if zset.Len() == 0 {
+		s.deleteLocked(key)
+	}
+	return removed, nil
+}
+
+// ZRangeSpec selects sorted set members as ZRANGE does: the ranks Start to
+// Stop, which may count from the end, or with ByScore the members scored
+// between Lower and Upper, skipping Offset of them and returning at most
+// Count; a negative Count returns the rest. With Rev ranks count from the
+// highest score down and members come highest first.
+type ZRangeSpec struct {
+	ByScore, Rev  bool
+	Start, Stop   int
+	Lower, Upper  ScoreBound
+	Offset, Count int
+}
+
+// rangeOf returns a copy of the members spec selects, in the order it
+// selects them.
+func (z *ZSet) rangeOf(spec ZRangeSpec) []ZMember {
+	if spec.ByScore {
+		lo, hi := z.scoreRange(spec.Lower, spec.Upper)
+		return copyZMembers(z.Members()[lo:hi], spec.Rev, spec.Offset, spec.Count)
+	}
+	n := z.Len()
+	start, stop, ok := listRange(spec.Start, spec.Stop, n)
+	if !ok {
+		return nil
+	}
+	if spec.Rev {
+		start, stop = n-1-stop, n-1-start
+	}
+	return copyZMembers(z.Members()[start:stop+1], spec.Rev, 0, -1)
+}
+
+// ZRange returns a copy of the members of the sorted set at key that spec
+// selects.
+func (s *KeyValueStore) ZRange(key string, spec ZRangeSpec) ([]ZMember, error) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	zset, exists, err := s.getZSetLocked(key)
+	if err != nil || !exists {
+		return nil, err
+	}
+	return zset.rangeOf(spec), nil
+}
+
+// ZRangeStore stores the members of the sorted set at src that spec selects
+// as a new sorted set at dest, under one lock so dest may be src. It
+// returns how many members were stored and whether dest existed before.
+func (s *KeyValueStore) ZRangeStore(dest, src string, spec ZRangeSpec) (int, bool, error) {
+	defer s.lockKeys(dest, src)()
+
+	zset, exists, err := s.getZSetLocked(src)
+	if err != nil {
+		return 0, false, err
+	}
+	var members []ZMember
+	if exists {
+		members = zset.rangeOf(spec)
+	}
+	result := newZSet()
+	for _, m := range members {
+		result.scores[m.Member] = m.Score
+	}
+	if spec.Rev {
+		slices.Reverse(members)
+	}
+	result.sorted = members
+	existed := s.storeDestinationLocked(dest, result, len(members) == 0)
+	return len(members), existed, nil
+}
+
+// copyZMembers copies count members of window starting offset in, reading
+// it from the end when rev is set; a negative count copies the rest.
+func copyZMembers(window []ZMember, rev bool, offset, count int) []ZMember {
+	if offset < 0 || offset >= len(window) {
+		return nil
+	}
+	n := len(window) - offset
+	if count >= 0 {
+		n = min(n, count)
+	}
+	out := make([]ZMember, n)
+	for i := range out {
+		if rev {
+			out[i] = window[len(window)-1-offset-i]
+		} else {
+			out[i] = window[offset+i]
+		}
+	}
+	return out
+}
@@ -2,8 +2,8 @@
 set -e
 
 (
-  cd "$(dirname "$0")"
-  go build -o /tmp/rego app/*.go
+  cd "$(dirname "$0")/app"
+  go build -o /tmp/rego .
 )
 
 exec /tmp/rego "$@"